@@ -13,11 +13,11 @@ import (
 	"time"
 
 	"github.com/mrvdot/appengine/aeutils"
-	"github.com/qedus/nds"
 
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
 )
 
 var (
@@ -33,22 +33,38 @@ func MockAccount(acct *Account) {
 // AuthenticateRequest takes an http.Request and validates it against existing accounts and sessions
 // Checks first for an account slug, then falls back on acct session key if slug is not present
 // Returns an account (if valid) or error if unable to find acct matching account
+// If the request has already been authenticated (ie. by MethodOverrideHandler), that account is returned
 func AuthenticateRequest(req *http.Request, rw http.ResponseWriter) (acct *Account, err error) {
+	defer func() {
+		if err == nil {
+			setAccountLocale(rw, acct)
+		}
+	}()
 	if mockAccount != nil {
 		return mockAccount, nil
 	}
 	ctx := appengine.NewContext(req)
+	if acct, err = GetAccount(ctx); err == nil {
+		return acct, nil
+	}
 
-	if slug := req.Header.Get(Headers["account"]); slug != "" {
-		apiKey := req.Header.Get(Headers["key"])
+	if err = LoadEncryptionKey(ctx); err != nil {
+		return nil, err
+	}
+	if err = LoadPublicIDSecret(ctx); err != nil {
+		return nil, err
+	}
+
+	if slug := req.Header.Get(header(ctx, "account")); slug != "" {
+		apiKey := req.Header.Get(header(ctx, "key"))
 		acct, err = authenticateAccount(ctx, slug, apiKey)
 		if err == nil {
 			session, _ := GetSession(ctx)
 			sendSession(req, rw, session)
 		}
 		return
-	} else if username := req.Header.Get(Headers["slug"]); username != "" {
-		password := req.Header.Get(Headers["password"])
+	} else if username := req.Header.Get(header(ctx, "username")); username != "" {
+		password := req.Header.Get(header(ctx, "password"))
 		acct, err = authenticateAccountByUser(ctx, username, password)
 		if err == nil {
 			session, _ := GetSession(ctx)
@@ -56,7 +72,7 @@ func AuthenticateRequest(req *http.Request, rw http.ResponseWriter) (acct *Accou
 		}
 		return
 	} else {
-		sessionKey := sessionKeyFromRequest(req)
+		sessionKey := sessionKeyFromRequest(ctx, req)
 		if sessionKey == "" {
 			return nil, Unauthenticated
 		}
@@ -71,25 +87,28 @@ func AuthenticateRequest(req *http.Request, rw http.ResponseWriter) (acct *Accou
 // authenticateAccount takes acct accountId and key, authenticates it,
 // returning acct session if valid, or error if invalid
 // Also stores valid within authenticatedAccounts for later retrieval via authenticateSessions
-func authenticateAccount(ctx appengine.Context, accountSlug, accountKey string) (*Account, error) {
+func authenticateAccount(ctx context.Context, accountSlug, accountKey string) (*Account, error) {
 	acct, err := getAccountFromSlug(ctx, accountSlug, accountKey)
 	if err != nil {
+		publishAuthEvent(ctx, EventLoginFailed, nil, &AuthEvent{Slug: accountSlug})
 		return nil, err
 	}
 
 	_, err = createSession(ctx, acct, nil)
 	if err != nil {
 		// If we fail to create session, log it, but don't completely bail on authenticating account
-		ctx.Warningf("Error creating session for account: %v", err.Error())
+		warningf(ctx, "Error creating session for account: %v", err.Error())
 	}
+	publishAuthEvent(ctx, EventLogin, acct.GetKey(ctx), &AuthEvent{Slug: acct.Slug})
 	return acct, nil
 }
 
 // authenticateAccountByUser looks for a user account matching username and password
 // and if finds it, logs in the related account and returns it
-func authenticateAccountByUser(ctx appengine.Context, username, password string) (*Account, error) {
+func authenticateAccountByUser(ctx context.Context, username, password string) (*Account, error) {
 	user, err := AuthenticateUser(ctx, username, password)
 	if err != nil {
+		publishAuthEvent(ctx, EventLoginFailed, nil, &AuthEvent{Username: username})
 		return nil, err
 	}
 
@@ -97,38 +116,47 @@ func authenticateAccountByUser(ctx appengine.Context, username, password string)
 	if acct == nil {
 		return nil, errors.New("Orphaned user object has no account")
 	}
+	if !acct.Deactivated.IsZero() {
+		publishAuthEvent(ctx, EventLoginFailed, acct.GetKey(ctx), &AuthEvent{Slug: acct.Slug, Username: username})
+		return nil, AccountDeactivated
+	}
 
 	_, err = createSession(ctx, acct, user)
 	if err != nil {
 		// If we fail to create session, log it, but don't completely bail on authenticating account
-		ctx.Warningf("Error creating session for account: %v", err.Error())
+		warningf(ctx, "Error creating session for account: %v", err.Error())
 	}
+	publishAuthEvent(ctx, EventLogin, acct.GetKey(ctx), &AuthEvent{Slug: acct.Slug, Username: user.Username, User: user.GetKey(ctx)})
 	return acct, nil
 }
 
 // authenticateSession takes account session key and validates it
-func authenticateSession(ctx appengine.Context, sessionKey string) (acct *Account, session *Session, err error) {
+func authenticateSession(ctx context.Context, sessionKey string) (acct *Account, session *Session, err error) {
 	session, err = getSession(ctx, sessionKey)
 	if err != nil {
 		return nil, nil, Unauthenticated
 	}
 	acct, err = getAccountFromSession(ctx, session)
 	if err != nil {
+		return nil, nil, err
 	}
 	now := time.Now()
-	if now.After(session.LastUsed.Add(session.TTL)) {
+	if now.After(session.Expires()) {
 		return nil, nil, SessionExpired
 	}
-	// We don't care if this is nil, just means we're not using users here
-	user, _ := getUserFromSession(ctx, session)
+	// user is nil for sessions created with the API key
+	user, err := getUserFromSession(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
 	session.LastUsed = now
 	storeAuthenticatedRequest(ctx, acct, session, user)
 	return acct, session, nil
 }
 
 // Get Session key from request, checking Headers first, then Cookies
-func sessionKeyFromRequest(req *http.Request) (sessionKey string) {
-	headerName := Headers["session"]
+func sessionKeyFromRequest(ctx context.Context, req *http.Request) (sessionKey string) {
+	headerName := header(ctx, "session")
 	sessionKey = req.Header.Get(headerName)
 	if sessionKey == "" {
 		// fall back on cookie if we can
@@ -141,9 +169,27 @@ func sessionKeyFromRequest(req *http.Request) (sessionKey string) {
 	return
 }
 
+func init() {
+	// Record who made changes to tracked kinds, see aeutils.TrackHistory
+	aeutils.HistoryActor = historyActor
+	// Accounts are loaded for every request authenticated by session (see getAccountFromSession)
+	aeutils.CacheKind(&Account{}, 0)
+}
+
+// historyActor returns the username of the authenticated user for ctx's request, or the account slug if authenticated by API key
+func historyActor(ctx context.Context) string {
+	if user, _ := GetUser(ctx); user != nil {
+		return user.Username
+	}
+	if acct, _ := GetAccount(ctx); acct != nil {
+		return acct.Slug
+	}
+	return ""
+}
+
 // GetAccount returns the currently authenticated account, or an error if no account
 // has been authenticated for this request
-func GetAccount(ctx appengine.Context) (*Account, error) {
+func GetAccount(ctx context.Context) (*Account, error) {
 	if mockAccount != nil {
 		return mockAccount, nil
 	}
@@ -154,7 +200,7 @@ func GetAccount(ctx appengine.Context) (*Account, error) {
 	return nil, Unauthenticated
 }
 
-func GetUser(ctx appengine.Context) (*User, error) {
+func GetUser(ctx context.Context) (*User, error) {
 	reqId := appengine.RequestID(ctx)
 	if user, ok := authenticatedUsers[reqId]; ok {
 		return user, nil
@@ -164,7 +210,7 @@ func GetUser(ctx appengine.Context) (*User, error) {
 
 // GetAccountKey returns the datastore key for the current account, or an error if no account
 // has been authenticated for this request
-func GetAccountKey(ctx appengine.Context) (*datastore.Key, error) {
+func GetAccountKey(ctx context.Context) (*datastore.Key, error) {
 	acct, err := GetAccount(ctx)
 	if err != nil {
 		return nil, err
@@ -172,8 +218,8 @@ func GetAccountKey(ctx appengine.Context) (*datastore.Key, error) {
 	return acct.GetKey(ctx), nil
 }
 
-// GetSession takes an appengine.Context and returns the appropriate session
-func GetSession(ctx appengine.Context) (session *Session, err error) {
+// GetSession takes an context.Context and returns the appropriate session
+func GetSession(ctx context.Context) (session *Session, err error) {
 	reqId := appengine.RequestID(ctx)
 	session, ok := authenticatedSessions[reqId]
 	if ok {
@@ -184,21 +230,27 @@ func GetSession(ctx appengine.Context) (session *Session, err error) {
 
 // GetContext returns acct namespaced context for the currently authenticated account
 // Useful for multi-tenant applications
-func GetContext(req *http.Request) (appengine.Context, error) {
+func GetContext(req *http.Request) (context.Context, error) {
 	ctx := appengine.NewContext(req)
 	//acctKey, err := GetAccountKey(ctx)
 	acct, err := GetAccount(ctx)
 	if err != nil {
 		if err != Unauthenticated {
-			ctx.Errorf("[accounts/GetContext] %v", err.Error())
+			errorf(ctx, "[accounts/GetContext] %v", err.Error())
 		}
 		return nil, err
 	}
-	return appengine.Namespace(ctx, acct.Slug)
+	return NamespaceFor(ctx, acct.Slug)
 }
 
-func getSession(ctx appengine.Context, key string) (*Session, error) {
-	if session, ok := sessions[key]; ok {
+// NamespaceFor returns ctx in the namespace of the account with slug, which is where GetContext puts the requests it
+// authenticates, for work done outside of those requests (ie. in tasks). An empty slug returns the default namespace
+func NamespaceFor(ctx context.Context, slug string) (context.Context, error) {
+	return appengine.Namespace(ctx, slug)
+}
+
+func getSession(ctx context.Context, key string) (*Session, error) {
+	if session, ok := memorySession(key); ok {
 		return session, nil
 	}
 	session := &Session{}
@@ -209,23 +261,25 @@ func getSession(ctx appengine.Context, key string) (*Session, error) {
 	return session, nil
 }
 
-func storeSession(ctx appengine.Context, session *Session, acct *Account, user *User) {
-	key := session.Key
-	sessions[key] = session
-	sessionToAccount[session] = acct
+func storeSession(ctx context.Context, session *Session, acct *Account, user *User) {
+	sessionsMu.Lock()
+	sessions[session.Key] = session
 	sessionToUser[session] = user
+	sessionsMu.Unlock()
+	// Expires along with the session, so sessions held by other instances don't linger in memcache until evicted
 	i := &memcache.Item{
-		Key:    "session-" + session.Key,
-		Object: session,
+		Key:        "session-" + session.Key,
+		Object:     session,
+		Expiration: session.Expires().Sub(time.Now()),
 	}
 	err := memcache.Gob.Set(ctx, i)
 	if err != nil {
-		ctx.Errorf(err.Error())
+		errorf(ctx, "%v", err.Error())
 	}
 }
 
 func sendSession(req *http.Request, rw http.ResponseWriter, session *Session) {
-	sessionHeader := Headers["session"]
+	sessionHeader := header(appengine.NewContext(req), "session")
 	sessionKey := session.Key
 
 	var domain string
@@ -254,7 +308,7 @@ func SendSession(req *http.Request, rw http.ResponseWriter, session *Session) {
 	sendSession(req, rw, session)
 }
 
-func createSession(ctx appengine.Context, acct *Account, user *User) (*Session, error) {
+func createSession(ctx context.Context, acct *Account, user *User) (*Session, error) {
 	now := time.Now()
 	h := md5.New()
 	io.WriteString(h, fmt.Sprintf("%v-%d", acct.Slug, now.UnixNano()))
@@ -265,7 +319,7 @@ func createSession(ctx appengine.Context, acct *Account, user *User) (*Session,
 		Account:     acctKey,
 		Initialized: now,
 		LastUsed:    now,
-		TTL:         SessionTTL,
+		TTL:         sessionTTL(ctx),
 	}
 	if user != nil {
 		session.User = user.GetKey(ctx)
@@ -275,15 +329,45 @@ func createSession(ctx appengine.Context, acct *Account, user *User) (*Session,
 	return session, nil
 }
 
-func CreateSession(ctx appengine.Context, acct *Account, user *User) (*Session, error) {
+func CreateSession(ctx context.Context, acct *Account, user *User) (*Session, error) {
 	return createSession(ctx, acct, user)
 }
 
-func storeAuthenticatedRequest(ctx appengine.Context, acct *Account, session *Session, user *User) {
+// RefreshSession extends the session ctx's request was authenticated with to SessionTTL (or ConfigSessionTTL) from now, and stores it so
+// other instances see the new expiry. If rotate is set, the session is replaced by a new one for the same account and
+// user instead, and the old key stops working, for clients that rotate their session keys (see RotateSessionOnRefresh)
+// Either way, the session returned should be sent back to the client with SendSession
+func RefreshSession(ctx context.Context, rotate bool) (*Session, error) {
+	session, err := GetSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acct, err := GetAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// We don't care if this is nil, just means we're not using users here
+	user, _ := GetUser(ctx)
+	if rotate {
+		fresh, err := createSession(ctx, acct, user)
+		if err != nil {
+			return nil, err
+		}
+		clearSession(ctx, session.Key)
+		return fresh, nil
+	}
+	session.LastUsed = time.Now()
+	session.TTL = sessionTTL(ctx)
+	storeSession(ctx, session, acct, user)
+	return session, nil
+}
+
+func storeAuthenticatedRequest(ctx context.Context, acct *Account, session *Session, user *User) {
 	reqId := appengine.RequestID(ctx)
 	authenticatedAccounts[reqId] = acct
 	authenticatedSessions[reqId] = session
 	authenticatedUsers[reqId] = user
+	noteMetricsAccount(ctx, acct)
 }
 
 // ClearAuthenticatedRequest removes a request from the internal authentication mappings to both account and session
@@ -298,76 +382,87 @@ func ClearAuthenticatedRequest(req *http.Request) {
 
 // Clears the session, optionally specified by a key, otherwise pulled from the current request
 // Returns a bool for whether or not that session existed
+// Publishes EventLogout for the session's account, if it hadn't already expired
 func ClearSession(req *http.Request, sessionKey string) bool {
 	ctx := appengine.NewContext(req)
 	if sessionKey == "" {
-		sessionKey = sessionKeyFromRequest(req)
+		sessionKey = sessionKeyFromRequest(ctx, req)
 		if sessionKey == "" {
 			return false
 		}
 	}
+	session, err := getSession(ctx, sessionKey)
+	existed := clearSession(ctx, sessionKey)
+	if err == nil && time.Now().Before(session.Expires()) {
+		publishAuthEvent(ctx, EventLogout, session.Account, &AuthEvent{Slug: session.Account.StringID(), User: session.User})
+	}
+	return existed
+}
+
+// func clearSession removes the session with sessionKey from memcache and memory, returning whether it was in memory
+func clearSession(ctx context.Context, sessionKey string) bool {
 	memcache.Delete(ctx, "session-"+sessionKey)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
 	if session, ok := sessions[sessionKey]; ok {
 		delete(sessions, sessionKey)
-
-		if _, ok = sessionToAccount[session]; ok {
-			delete(sessionToAccount, session)
-		}
-
+		delete(sessionToUser, session)
 		return true
 	}
 	return false
 }
 
-func getAccountFromSession(ctx appengine.Context, session *Session) (acct *Account, err error) {
-	if acct, ok := sessionToAccount[session]; ok {
-		return acct, nil
-	}
-	acctKey := session.Account
+// func memorySession returns the session with key, if this instance holds it in memory
+func memorySession(key string) (*Session, bool) {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	session, ok := sessions[key]
+	return session, ok
+}
+
+// func getAccountFromSession loads the account session is for. It's always loaded again (from memcache, as Account is
+// a cached kind) rather than kept with the session, so an account deactivated on any instance stops authenticating
+// on all of them
+func getAccountFromSession(ctx context.Context, session *Session) (acct *Account, err error) {
 	acct = &Account{}
-	if aeutils.UseNDS {
-		err = nds.Get(ctx, acctKey, acct)
-	} else {
-		err = datastore.Get(ctx, acctKey, acct)
-	}
-	if err != nil {
+	if err = aeutils.GetByKey(ctx, session.Account, acct); err != nil {
 		return nil, NoSuchSession
 	}
-	acct.Load(ctx)
-	return
+	if !acct.Deactivated.IsZero() {
+		return nil, AccountDeactivated
+	}
+	return acct, nil
 }
 
-func getAccountFromSlug(ctx appengine.Context, slug string, apiKey string) (*Account, error) {
-	iter := datastore.NewQuery("Account").
-		Filter("Slug = ", slug).
-		Limit(1).
-		Run(ctx)
-
+func getAccountFromSlug(ctx context.Context, slug string, apiKey string) (*Account, error) {
 	acct := &Account{}
-	_, err := iter.Next(acct)
+	err := aeutils.GetBySlug(ctx, slug, acct)
 	if err != nil {
 		return nil, NoSuchAccount
 	}
 	if acct.ApiKey != apiKey {
 		return nil, InvalidApiKey
 	}
-	acct.Load(ctx)
+	if !acct.Deactivated.IsZero() {
+		return nil, AccountDeactivated
+	}
 	return acct, nil
 }
 
-func getUserFromSession(ctx appengine.Context, session *Session) (user *User, err error) {
-	if user, ok := sessionToUser[session]; ok {
+func getUserFromSession(ctx context.Context, session *Session) (user *User, err error) {
+	sessionsMu.RLock()
+	user = sessionToUser[session]
+	sessionsMu.RUnlock()
+	if user != nil || session.User == nil {
 		return user, nil
 	}
-	userKey := session.User
 	user = &User{}
-	if aeutils.UseNDS {
-		err = nds.Get(ctx, userKey, user)
-	} else {
-		err = datastore.Get(ctx, userKey, user)
-	}
-	if err != nil {
+	err = aeutils.GetByKey(ctx, session.User, user)
+	if err == datastore.ErrNoSuchEntity {
 		return nil, NoSuchSession
+	} else if err != nil {
+		errorf(ctx, "[accounts/getUserFromSession] %v", err.Error())
+		return nil, err
 	}
 	return
 }
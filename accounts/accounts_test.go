@@ -3,6 +3,8 @@ package accounts
 import (
 	"fmt"
 	. "gopkg.in/check.v1"
+
+	"google.golang.org/appengine/datastore"
 )
 
 func (s *MySuite) TestGetAccountFromSlug(c *C) {
@@ -36,3 +38,35 @@ func (s *MySuite) TestAuthentication(c *C) {
 	c.Assert(session, DeepEquals, session2)
 	c.Assert(account, DeepEquals, account2)
 }
+
+func (s *MySuite) TestRefreshSession(c *C) {
+	_, err := authenticateAccount(ctx, validAccount.Slug, validAccount.ApiKey)
+	c.Assert(err, IsNil)
+	session, err := GetSession(ctx)
+	c.Assert(err, IsNil)
+	lastUsed := session.LastUsed
+
+	refreshed, err := RefreshSession(ctx, false)
+	c.Assert(err, IsNil)
+	c.Assert(refreshed.Key, Equals, session.Key)
+	c.Assert(refreshed.LastUsed.After(lastUsed), Equals, true)
+	c.Assert(refreshed.Expires(), Equals, refreshed.LastUsed.Add(SessionTTL))
+
+	rotated, err := RefreshSession(ctx, true)
+	c.Assert(err, IsNil)
+	c.Assert(rotated.Key, Not(Equals), session.Key)
+	current, err := GetSession(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(current.Key, Equals, rotated.Key)
+	_, _, err = authenticateSession(ctx, session.Key)
+	c.Assert(err, Equals, Unauthenticated)
+}
+
+func (s *MySuite) TestDeletedUserSession(c *C) {
+	session, err := createSession(ctx, validAccount, nil)
+	c.Assert(err, IsNil)
+	session.User = datastore.NewKey(ctx, "User", "", 987654321, nil)
+	storeSession(ctx, session, validAccount, nil)
+	_, _, err = authenticateSession(ctx, session.Key)
+	c.Assert(err, Equals, NoSuchSession)
+}
@@ -0,0 +1,303 @@
+package accounts
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+var (
+	// Maintenance jobs admins can run through the AdminRunJob route, by name
+	adminJobs = map[string]AdminJob{
+		"cleanup-sessions": func(ctx context.Context) (interface{}, error) {
+			removed, err := CleanupSessions(ctx)
+			return map[string]interface{}{"sessions": removed}, err
+		},
+	}
+	adminJobsMu sync.RWMutex
+)
+
+// AdminJob is a maintenance job admins can run through the admin routes, returning a result to respond with
+type AdminJob func(ctx context.Context) (interface{}, error)
+
+// AdminSession describes a session held in memory, as listed by the admin routes. The session key is left out,
+// as it would let whoever sees it act as the account
+type AdminSession struct {
+	Account     string    `json:"account"` // Account slug
+	User        int64     `json:"user,omitempty"`
+	Initialized time.Time `json:"initialized"`
+	LastUsed    time.Time `json:"lastUsed"`
+	Expires     time.Time `json:"expires"`
+}
+
+// func RegisterAdminJob adds a maintenance job, run by admins with a POST to /admin/jobs/<name>
+// A job registered with the same name as an existing one (such as the built in "cleanup-sessions") replaces it
+func RegisterAdminJob(name string, job AdminJob) {
+	adminJobsMu.Lock()
+	defer adminJobsMu.Unlock()
+	adminJobs[name] = job
+}
+
+// func DeactivateAccount marks acct deactivated and inactive, so it can no longer authenticate, and clears the sessions
+// held for it by this instance. Every instance loads the account again for each request authenticated by session,
+// so its sessions held by other instances are rejected from then on
+func DeactivateAccount(ctx context.Context, acct *Account) error {
+	acct.Active = false
+	acct.Deactivated = time.Now()
+	if _, err := aeutils.Save(ctx, acct); err != nil {
+		errorf(ctx, "[accounts/DeactivateAccount] %v", err.Error())
+		return err
+	}
+	for _, key := range accountSessionKeys(acct.Slug) {
+		clearSession(ctx, key)
+	}
+	return nil
+}
+
+// func ReactivateAccount undoes DeactivateAccount, so acct can authenticate again
+func ReactivateAccount(ctx context.Context, acct *Account) error {
+	acct.Active = true
+	acct.Deactivated = time.Time{}
+	_, err := aeutils.Save(ctx, acct)
+	if err != nil {
+		errorf(ctx, "[accounts/ReactivateAccount] %v", err.Error())
+	}
+	return err
+}
+
+// func adminFunc wraps an admin route's handler with AdminOnlyHandler
+func adminFunc(handler http.HandlerFunc) http.HandlerFunc {
+	return AdminOnlyHandler(handler).ServeHTTP
+}
+
+// func adminListAccounts lists accounts by slug, taking "limit" and "offset" parameters, and "q" to only list those whose
+// slugs start with it
+func adminListAccounts(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	limit, offset := pageParams(req.URL.Query())
+	query := aeutils.Query(&Account{})
+	if q := req.FormValue("q"); q != "" {
+		query = query.Filter("Slug >=", q).Filter("Slug <", q+"\ufffd")
+	}
+	accts := []*Account{}
+	_, err := query.Order("Slug").Limit(limit).Offset(offset).GetAll(ctx, &accts)
+	if err != nil {
+		errorf(ctx, "[accounts/adminListAccounts] %v", err.Error())
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: accts,
+		Data: map[string]interface{}{
+			"limit":  limit,
+			"offset": offset,
+		},
+	})
+}
+
+// func adminGetAccount responds with the account with the slug at the end of the path, along with its users
+// and the sessions this instance holds for it
+func adminGetAccount(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	acct, err := adminAccount(ctx, pathParam(req))
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	users := []*User{}
+	_, err = aeutils.Query(&User{}).Filter("AccountKey =", acct.GetKey(ctx)).Limit(ResourceLimit).GetAll(ctx, &users)
+	if err != nil {
+		errorf(ctx, "[accounts/adminGetAccount] %v", err.Error())
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: acct,
+		Data: map[string]interface{}{
+			"users":    users,
+			"sessions": memorySessions(acct.Slug),
+		},
+	})
+}
+
+// func adminUpdateAccount deactivates (or reactivates) the account with the slug at the end of the path,
+// from a JSON body of {"active": false} (or true)
+func adminUpdateAccount(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	acct, err := adminAccount(ctx, pathParam(req))
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	update := &struct {
+		Active *bool `json:"active"`
+	}{}
+	limitBody(rw, req)
+	err = json.NewDecoder(req.Body).Decode(update)
+	req.Body.Close()
+	if err != nil {
+		RespondTo(rw, req, bodyError(err))
+		return
+	}
+	if update.Active == nil {
+		apiErr := NewApiError(http.StatusBadRequest, ErrorCodeValidation, "active must be provided")
+		apiErr.Field = "active"
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	if *update.Active {
+		err = ReactivateAccount(ctx, acct)
+	} else {
+		err = DeactivateAccount(ctx, acct)
+	}
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: acct,
+	})
+}
+
+// func adminListUsers lists users by username, taking "limit" and "offset" parameters, "account" to only list the users
+// of the account with that slug, and "q" to only list those whose usernames start with it
+// Combining "account" and "q" needs a composite index on AccountKey and Username
+func adminListUsers(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	limit, offset := pageParams(req.URL.Query())
+	query := aeutils.Query(&User{})
+	if slug := req.FormValue("account"); slug != "" {
+		query = query.Filter("AccountKey =", (&Account{Slug: slug}).GetKey(ctx))
+	}
+	if q := req.FormValue("q"); q != "" {
+		query = query.Filter("Username >=", q).Filter("Username <", q+"\ufffd").Order("Username")
+	}
+	users := []*User{}
+	_, err := query.Limit(limit).Offset(offset).GetAll(ctx, &users)
+	if err != nil {
+		errorf(ctx, "[accounts/adminListUsers] %v", err.Error())
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: users,
+		Data: map[string]interface{}{
+			"limit":  limit,
+			"offset": offset,
+		},
+	})
+}
+
+// func adminListSessions lists the sessions held in memory by the instance handling the request, most recently used
+// first, taking "account" to only list those of the account with that slug
+func adminListSessions(rw http.ResponseWriter, req *http.Request) {
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: memorySessions(req.FormValue("account")),
+	})
+}
+
+// func adminListJobs lists the names of the maintenance jobs admins can run
+func adminListJobs(rw http.ResponseWriter, req *http.Request) {
+	adminJobsMu.RLock()
+	names := make([]string, 0, len(adminJobs))
+	for name := range adminJobs {
+		names = append(names, name)
+	}
+	adminJobsMu.RUnlock()
+	sort.Strings(names)
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: names,
+	})
+}
+
+// func adminRunJob runs the maintenance job named at the end of the path, and responds with its result
+func adminRunJob(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	name := pathParam(req)
+	adminJobsMu.RLock()
+	job, ok := adminJobs[name]
+	adminJobsMu.RUnlock()
+	if !ok {
+		RespondTo(rw, req, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "No job is registered as "+name))
+		return
+	}
+	result, err := job(ctx)
+	if err != nil {
+		errorf(ctx, "[accounts/adminRunJob] %v: %v", name, err.Error())
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error running " + name + ": " + apiErr.Message
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: result,
+	})
+}
+
+// func adminAccount loads the account with slug, whatever its API key
+func adminAccount(ctx context.Context, slug string) (*Account, error) {
+	acct := &Account{Slug: slug}
+	if err := aeutils.GetByKey(ctx, acct.GetKey(ctx), acct); err != nil {
+		return nil, err
+	}
+	return acct, nil
+}
+
+// func memorySessions returns the sessions this instance holds in memory, for the account with slug if it's not empty
+func memorySessions(slug string) []*AdminSession {
+	listed := []*AdminSession{}
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	for _, session := range sessions {
+		if session.Account == nil || (slug != "" && session.Account.StringID() != slug) {
+			continue
+		}
+		info := &AdminSession{
+			Account:     session.Account.StringID(),
+			Initialized: session.Initialized,
+			LastUsed:    session.LastUsed,
+			Expires:     session.Expires(),
+		}
+		if session.User != nil {
+			info.User = session.User.IntID()
+		}
+		listed = append(listed, info)
+	}
+	sort.Sort(recentSessions(listed))
+	return listed
+}
+
+// func accountSessionKeys returns the keys of the sessions this instance holds in memory for the account with slug
+func accountSessionKeys(slug string) []string {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	var keys []string
+	for key, session := range sessions {
+		if session.Account != nil && session.Account.StringID() == slug {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// recentSessions sorts sessions by when they were last used, most recent first
+type recentSessions []*AdminSession
+
+func (s recentSessions) Len() int           { return len(s) }
+func (s recentSessions) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s recentSessions) Less(i, j int) bool { return s[i].LastUsed.After(s[j].LastUsed) }
@@ -0,0 +1,69 @@
+package accounts
+
+import (
+	"errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"golang.org/x/net/context"
+)
+
+func (s *MySuite) TestDeactivateAccount(c *C) {
+	acct := &Account{
+		Name:   "Deactivated Account",
+		Active: true,
+	}
+	_, err := aeutils.Save(ctx, acct)
+	c.Assert(err, IsNil)
+	session, err := createSession(ctx, acct, nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(DeactivateAccount(ctx, acct), IsNil)
+	c.Assert(acct.Active, Equals, false)
+	c.Assert(acct.Deactivated.IsZero(), Equals, false)
+	_, ok := memorySession(session.Key)
+	c.Assert(ok, Equals, false)
+	_, err = authenticateAccount(ctx, acct.Slug, acct.ApiKey)
+	c.Assert(err, Equals, AccountDeactivated)
+	// Sessions held by other instances are rejected as well
+	storeSession(ctx, session, &Account{Slug: acct.Slug, Active: true}, nil)
+	_, _, err = authenticateSession(ctx, session.Key)
+	c.Assert(err, Equals, AccountDeactivated)
+
+	c.Assert(ReactivateAccount(ctx, acct), IsNil)
+	_, err = authenticateAccount(ctx, acct.Slug, acct.ApiKey)
+	c.Assert(err, IsNil)
+}
+
+func (s *MySuite) TestMemorySessions(c *C) {
+	session, err := createSession(ctx, validAccount, nil)
+	c.Assert(err, IsNil)
+
+	listed := memorySessions(validAccount.Slug)
+	c.Assert(len(listed) >= 1, Equals, true)
+	c.Assert(listed[0].Account, Equals, validAccount.Slug)
+	c.Assert(listed[0].LastUsed.Equal(session.LastUsed), Equals, true)
+	c.Assert(memorySessions("no-such-account"), HasLen, 0)
+}
+
+func (s *MySuite) TestRegisterAdminJob(c *C) {
+	failed := errors.New("failed")
+	RegisterAdminJob("test-job", func(ctx context.Context) (interface{}, error) {
+		return nil, failed
+	})
+	defer func() {
+		adminJobsMu.Lock()
+		delete(adminJobs, "test-job")
+		adminJobsMu.Unlock()
+	}()
+
+	adminJobsMu.RLock()
+	job, ok := adminJobs["test-job"]
+	_, builtin := adminJobs["cleanup-sessions"]
+	adminJobsMu.RUnlock()
+	c.Assert(ok, Equals, true)
+	c.Assert(builtin, Equals, true)
+	_, err := job(ctx)
+	c.Assert(err, Equals, failed)
+}
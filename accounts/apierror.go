@@ -0,0 +1,129 @@
+package accounts
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+)
+
+// Machine readable codes for ApiError.ErrorCode, so clients can branch on them rather than on Message
+const (
+	ErrorCodeUnauthenticated    = "AUTH_REQUIRED"
+	ErrorCodeInvalidKey         = "AUTH_INVALID_KEY"
+	ErrorCodeInvalidPassword    = "AUTH_INVALID_PASSWORD"
+	ErrorCodeInvalidSession     = "AUTH_INVALID_SESSION"
+	ErrorCodeSessionExpired     = "AUTH_SESSION_EXPIRED"
+	ErrorCodeNoSuchAccount      = "ACCOUNT_NOT_FOUND"
+	ErrorCodeAccountDeactivated = "ACCOUNT_DEACTIVATED"
+	ErrorCodeInvalidRequest     = "INVALID_REQUEST"
+	ErrorCodeValidation         = "VALIDATION_FAILED"
+	ErrorCodeNotFound           = "NOT_FOUND"
+	ErrorCodeConflict           = "CONFLICT"
+	ErrorCodePreconditionFailed = "PRECONDITION_FAILED"
+	ErrorCodeBodyTooLarge       = "BODY_TOO_LARGE"
+	ErrorCodeInternal           = "INTERNAL_ERROR"
+	ErrorCodeRateLimited        = "RATE_LIMITED"
+	ErrorCodeAdminRequired      = "ADMIN_REQUIRED"
+	ErrorCodeForbidden          = "FORBIDDEN"
+	ErrorCodeInvalidWebhook     = "WEBHOOK_INVALID_SIGNATURE"
+	ErrorCodeWebhookExpired     = "WEBHOOK_EXPIRED"
+)
+
+var (
+	// Error codes (and response codes) for the errors accounts returns when authenticating
+	authErrorCodes = map[error]struct {
+		code      int
+		errorCode string
+	}{
+		Unauthenticated:    {http.StatusUnauthorized, ErrorCodeUnauthenticated},
+		InvalidApiKey:      {http.StatusForbidden, ErrorCodeInvalidKey},
+		InvalidPassword:    {http.StatusForbidden, ErrorCodeInvalidPassword},
+		NoSuchSession:      {http.StatusForbidden, ErrorCodeInvalidSession},
+		SessionExpired:     {http.StatusForbidden, ErrorCodeSessionExpired},
+		NoSuchAccount:      {http.StatusForbidden, ErrorCodeNoSuchAccount},
+		AccountDeactivated: {http.StatusForbidden, ErrorCodeAccountDeactivated},
+		// Incoming webhooks (see WebhookReceiver)
+		InvalidWebhookSignature: {http.StatusUnauthorized, ErrorCodeInvalidWebhook},
+		WebhookExpired:          {http.StatusUnauthorized, ErrorCodeWebhookExpired},
+	}
+)
+
+// FieldError describes what's wrong with a single field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ApiError is the utils.ApiResponse accounts handlers respond with on failure, with a machine readable ErrorCode,
+// and the Field (or for validation errors, Details of each field) the error relates to, if any
+type ApiError struct {
+	utils.ApiResponse
+	ErrorCode string       `json:"errorCode"`
+	Field     string       `json:"field,omitempty"`
+	Details   []FieldError `json:"details,omitempty"`
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+// func NewApiError returns an ApiError with the given response code, error code and message
+func NewApiError(code int, errorCode, message string) *ApiError {
+	return &ApiError{
+		ApiResponse: utils.ApiResponse{
+			Code:    code,
+			Message: message,
+		},
+		ErrorCode: errorCode,
+	}
+}
+
+// func ErrorResponse returns an ApiError for err. Authentication errors (Unauthenticated, InvalidApiKey, etc.) have
+// their own codes, a *aeutils.ValidationError has Details for each invalid field, and other aeutils errors
+// are mapped by aeutils.StatusCode. An *ApiError is returned as is
+func ErrorResponse(err error) *ApiError {
+	if apiErr, ok := err.(*ApiError); ok {
+		return apiErr
+	}
+	if codes, ok := authErrorCodes[err]; ok {
+		return NewApiError(codes.code, codes.errorCode, err.Error())
+	}
+	code := aeutils.StatusCode(err)
+	apiErr := NewApiError(code, ErrorCodeInternal, err.Error())
+	switch code {
+	case http.StatusBadRequest:
+		apiErr.ErrorCode = ErrorCodeInvalidRequest
+	case http.StatusNotFound:
+		apiErr.ErrorCode = ErrorCodeNotFound
+	case http.StatusConflict:
+		apiErr.ErrorCode = ErrorCodeConflict
+	}
+	if verr := validationError(err); verr != nil {
+		apiErr.ErrorCode = ErrorCodeValidation
+		fields := make([]string, 0, len(verr.Fields))
+		for field := range verr.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			apiErr.Details = append(apiErr.Details, FieldError{Field: field, Message: verr.Fields[field]})
+		}
+		if len(fields) == 1 {
+			apiErr.Field = fields[0]
+		}
+	}
+	return apiErr
+}
+
+// func validationError returns the *aeutils.ValidationError err is (or wraps, for a *aeutils.SaveError), if any
+func validationError(err error) *aeutils.ValidationError {
+	switch e := err.(type) {
+	case *aeutils.ValidationError:
+		return e
+	case *aeutils.SaveError:
+		return validationError(e.Err)
+	}
+	return nil
+}
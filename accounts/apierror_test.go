@@ -0,0 +1,38 @@
+package accounts
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+)
+
+func (s *MySuite) TestErrorResponse(c *C) {
+	apiErr := ErrorResponse(InvalidApiKey)
+	c.Assert(apiErr.Code, Equals, http.StatusForbidden)
+	c.Assert(apiErr.ErrorCode, Equals, ErrorCodeInvalidKey)
+	c.Assert(apiErr.Message, Equals, InvalidApiKey.Error())
+
+	c.Assert(ErrorResponse(Unauthenticated).Code, Equals, http.StatusUnauthorized)
+	c.Assert(ErrorResponse(errors.New("Something broke")).ErrorCode, Equals, ErrorCodeInternal)
+	c.Assert(ErrorResponse(apiErr), Equals, apiErr)
+
+	verr := &aeutils.ValidationError{Kind: "User"}
+	verr.Add("Email", "must be a valid email address")
+	apiErr = ErrorResponse(verr)
+	c.Assert(apiErr.Code, Equals, 422)
+	c.Assert(apiErr.ErrorCode, Equals, ErrorCodeValidation)
+	c.Assert(apiErr.Field, Equals, "Email")
+	c.Assert(apiErr.Details, DeepEquals, []FieldError{{Field: "Email", Message: "must be a valid email address"}})
+
+	// ApiResponse fields are flattened into the same object as the error fields
+	encoded, err := json.Marshal(apiErr)
+	c.Assert(err, IsNil)
+	var fields map[string]interface{}
+	c.Assert(json.Unmarshal(encoded, &fields), IsNil)
+	c.Assert(fields["code"], Equals, float64(422))
+	c.Assert(fields["errorCode"], Equals, ErrorCodeValidation)
+	c.Assert(fields["field"], Equals, "Email")
+}
@@ -0,0 +1,179 @@
+package accounts
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/image"
+)
+
+var (
+	// AttachmentBucket is an optional Google Cloud Storage bucket to store uploaded attachments in
+	// If empty, attachments are stored in the blobstore
+	AttachmentBucket = ""
+	// AttachmentMaxBytes limits the size of each uploaded attachment
+	AttachmentMaxBytes int64 = 32 << 20
+)
+
+// Attachment records a file uploaded through the attachment routes (or SaveUploads), in the namespace of the account it was uploaded for
+type Attachment struct {
+	Key         *datastore.Key    `json:"-" datastore:"-"`
+	ID          int64             `json:"id"`
+	Created     time.Time         `json:"created" aetime:"created"`
+	Field       string            `json:"field"` // Form field the file was uploaded as
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"contentType"`
+	Size        int64             `json:"size"`
+	URL         string            `json:"url" datastore:",noindex"` // Images service URL for images, otherwise the attachment download route
+	BlobKey     appengine.BlobKey `json:"-"`
+	ObjectName  string            `json:"-"` // Cloud Storage object, if stored in AttachmentBucket
+	User        *datastore.Key    `json:"-"` // User that uploaded it, if any
+}
+
+// func AttachmentUploadURL returns a one-time URL the client should POST multipart form files to. Each file is streamed to
+// AttachmentBucket (or the blobstore) by App Engine, which then calls successPath with the upload (see SaveUploads)
+func AttachmentUploadURL(ctx context.Context, successPath string) (*url.URL, error) {
+	return blobstore.UploadURL(ctx, successPath, &blobstore.UploadURLOptions{
+		MaxUploadBytesPerBlob: AttachmentMaxBytes,
+		StorageBucket:         AttachmentBucket,
+	})
+}
+
+// func SaveUploads records an Attachment for each file in req, a blobstore upload callback (see AttachmentUploadURL),
+// in the namespace of the authenticated account, and returns them with their serving URLs. Images are served by the
+// images service, anything else through the attachment download route. If any can't be recorded, none of the uploaded
+// files are kept
+func SaveUploads(req *http.Request) ([]*Attachment, error) {
+	ctx, err := GetContext(req)
+	if err != nil {
+		return nil, err
+	}
+	blobs, _, err := blobstore.ParseUpload(req)
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+	}
+	var userKey *datastore.Key
+	if user, _ := GetUser(ctx); user != nil {
+		userKey = user.Key
+	}
+	var blobKeys []appengine.BlobKey
+	var attachments []*Attachment
+	for field, infos := range blobs {
+		for _, info := range infos {
+			blobKeys = append(blobKeys, info.BlobKey)
+			attachments = append(attachments, &Attachment{
+				Field:       field,
+				Filename:    info.Filename,
+				ContentType: info.ContentType,
+				Size:        info.Size,
+				BlobKey:     info.BlobKey,
+				ObjectName:  info.ObjectName,
+				User:        userKey,
+			})
+		}
+	}
+	for _, att := range attachments {
+		if err = att.save(ctx); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		errorf(ctx, "[accounts/SaveUploads] %v", err.Error())
+		for _, att := range attachments {
+			if att.Key != nil {
+				aeutils.HardDelete(ctx, att)
+			}
+		}
+		if delErr := blobstore.DeleteMulti(ctx, blobKeys); delErr != nil {
+			warningf(ctx, "[accounts/SaveUploads] Error removing uploaded files: %v", delErr.Error())
+		}
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// func save stores att, then sets its URL now its key is known
+func (att *Attachment) save(ctx context.Context) error {
+	if strings.HasPrefix(att.ContentType, "image/") {
+		servingURL, err := image.ServingURL(ctx, att.BlobKey, &image.ServingURLOptions{Secure: true})
+		if err == nil {
+			att.URL = servingURL.String()
+		} else {
+			// Not every image format is supported by the images service, those are downloaded like anything else
+			warningf(ctx, "[accounts/SaveUploads] %v", err.Error())
+		}
+	}
+	key, err := aeutils.Save(ctx, att)
+	if err != nil || att.URL != "" {
+		return err
+	}
+	att.URL = fmt.Sprintf("/%v/attachments/file?id=%v", SubrouterPath, url.QueryEscape(aeutils.EncodeKey(key)))
+	_, err = aeutils.Save(ctx, att)
+	return err
+}
+
+// func attachmentUploadURL responds with a one-time URL the client should POST its files to
+func attachmentUploadURL(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	// Blobstore posts back to the attachments route alongside this one, wherever the routes are mounted
+	uploadURL, err := AttachmentUploadURL(ctx, strings.TrimSuffix(req.URL.Path, "/upload"))
+	if err != nil {
+		errorf(ctx, "[accounts/attachmentUploadURL] %v", err.Error())
+		RespondTo(rw, req, NewApiError(http.StatusInternalServerError, ErrorCodeInternal, err.Error()))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code: 200,
+		Data: map[string]interface{}{
+			"uploadUrl": uploadURL.String(),
+		},
+	})
+}
+
+// func uploadAttachments receives the blobstore upload callback, and responds with an Attachment for each file
+func uploadAttachments(rw http.ResponseWriter, req *http.Request) {
+	attachments, err := SaveUploads(req)
+	if err != nil {
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error saving attachments: " + apiErr.Message
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: attachments,
+	})
+}
+
+// func serveAttachment sends the file of the attachment with the encoded key passed as the "id" parameter
+func serveAttachment(rw http.ResponseWriter, req *http.Request) {
+	ctx, err := GetContext(req)
+	if err != nil {
+		respondAuthError(rw, req, err)
+		return
+	}
+	att := &Attachment{}
+	key, err := aeutils.DecodeKey(ctx, req.FormValue("id"), att)
+	if err == nil {
+		err = aeutils.GetByKey(ctx, key, att)
+	}
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	if att.Filename != "" {
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename}))
+	}
+	blobstore.Send(rw, att.BlobKey)
+}
@@ -0,0 +1,25 @@
+package accounts
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+)
+
+func (s *MySuite) TestAttachmentSave(c *C) {
+	att := &Attachment{
+		Field:       "file",
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Size:        1024,
+		BlobKey:     "test-blob-key",
+	}
+	c.Assert(att.save(ctx), IsNil)
+	c.Assert(att.Key, NotNil)
+	c.Assert(att.URL, Equals, "/"+SubrouterPath+"/attachments/file?id="+aeutils.EncodeKey(att.Key))
+
+	loaded := &Attachment{}
+	c.Assert(aeutils.GetByKey(ctx, att.Key, loaded), IsNil)
+	c.Assert(loaded.URL, Equals, att.URL)
+	c.Assert(loaded.BlobKey, Equals, att.BlobKey)
+}
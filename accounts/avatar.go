@@ -0,0 +1,121 @@
+package accounts
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/image"
+)
+
+var (
+	// AvatarSize is the size (in pixels) avatars are served at, both from Gravatar and the images service
+	AvatarSize = 200
+	// GravatarDefault is the default image Gravatar should use when no avatar exists for an email
+	// See https://en.gravatar.com/site/implement/images/ for valid options
+	GravatarDefault = "identicon"
+	// AvatarMaxBytes limits the size of an uploaded avatar
+	AvatarMaxBytes int64 = 5 << 20
+	// AvatarBucket is an optional Google Cloud Storage bucket to store uploaded avatars in
+	// If empty, avatars are stored in the blobstore
+	AvatarBucket = ""
+)
+
+// GravatarURL returns the Gravatar image URL for an email address at the specified size
+func GravatarURL(email string, size int) string {
+	h := md5.New()
+	io.WriteString(h, strings.ToLower(strings.TrimSpace(email)))
+	return fmt.Sprintf("https://www.gravatar.com/avatar/%x?s=%d&d=%v", h.Sum(nil), size, url.QueryEscape(GravatarDefault))
+}
+
+// setAvatar stores the uploaded blob as the user's avatar, replacing any previous upload
+func (u *User) setAvatar(ctx context.Context, blobKey appengine.BlobKey) error {
+	servingURL, err := image.ServingURL(ctx, blobKey, &image.ServingURLOptions{
+		Secure: true,
+		Size:   AvatarSize,
+		Crop:   true,
+	})
+	if err != nil {
+		return err
+	}
+	if u.AvatarBlobKey != "" && u.AvatarBlobKey != blobKey {
+		image.DeleteServingURL(ctx, u.AvatarBlobKey)
+		if err := blobstore.Delete(ctx, u.AvatarBlobKey); err != nil {
+			warningf(ctx, "[accounts/setAvatar] Error removing previous avatar: %v", err.Error())
+		}
+	}
+	u.AvatarBlobKey = blobKey
+	u.AvatarURL = servingURL.String()
+	return nil
+}
+
+// func avatarUploadURL returns a one-time URL the client should POST the avatar image to
+func avatarUploadURL(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	response := &utils.ApiResponse{}
+	if user, _ := GetUser(ctx); user == nil {
+		RespondTo(rw, req, NewApiError(http.StatusForbidden, ErrorCodeUnauthenticated, "Avatars can only be uploaded for an authenticated user"))
+		return
+	}
+	// Blobstore posts back to the avatar route alongside this one, wherever the routes are mounted
+	uploadURL, err := blobstore.UploadURL(ctx, strings.TrimSuffix(req.URL.Path, "/upload"), &blobstore.UploadURLOptions{
+		MaxUploadBytesPerBlob: AvatarMaxBytes,
+		StorageBucket:         AvatarBucket,
+	})
+	if err != nil {
+		errorf(ctx, "[accounts/avatarUploadURL] %v", err.Error())
+		RespondTo(rw, req, NewApiError(http.StatusInternalServerError, ErrorCodeInternal, err.Error()))
+		return
+	}
+	response.Code = 200
+	response.Data = map[string]interface{}{
+		"uploadUrl": uploadURL.String(),
+	}
+	RespondTo(rw, req, response)
+}
+
+// func uploadAvatar receives the blobstore upload callback, and stores the "avatar" file on the current user
+func uploadAvatar(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	response := &utils.ApiResponse{}
+	blobs, _, err := blobstore.ParseUpload(req)
+	if err != nil {
+		RespondTo(rw, req, NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+	files := blobs["avatar"]
+	if len(files) == 0 {
+		apiErr := NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, "No avatar file was uploaded")
+		apiErr.Field = "avatar"
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	user, _ := GetUser(ctx)
+	if user == nil {
+		blobstore.Delete(ctx, files[0].BlobKey)
+		RespondTo(rw, req, NewApiError(http.StatusForbidden, ErrorCodeUnauthenticated, "Avatars can only be uploaded for an authenticated user"))
+		return
+	}
+	if err = user.setAvatar(ctx, files[0].BlobKey); err == nil {
+		_, err = aeutils.Save(ctx, user)
+	}
+	if err != nil {
+		errorf(ctx, "[accounts/uploadAvatar] %v", err.Error())
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error saving avatar: " + apiErr.Message
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	response.Code = 200
+	response.Result = user
+	RespondTo(rw, req, response)
+}
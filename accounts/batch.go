@@ -0,0 +1,87 @@
+package accounts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mrvdot/golang-utils"
+)
+
+var (
+	// BatchMaxRequests limits how many sub-requests a single batch may contain
+	BatchMaxRequests = 50
+)
+
+// BatchRequest is a single sub-request of a batch, against a resource added with RegisterResource
+type BatchRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"` // Path the resource was registered at, then the ID for a single entity, ie. "/items/<id>"
+	Body   json.RawMessage `json:"body,omitempty"`
+	// Headers of the sub-request, ie. If-Match or If-None-Match to make it conditional
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// func batch runs each of the BatchRequests in the JSON array posted, in order, for the authenticated account,
+// and responds with the response to each (a utils.ApiResponse or ApiError) as its Result, in the same order
+// A failed sub-request doesn't stop the rest, and writes made by the others aren't undone, so clients should check
+// the code of each response. Routed at /batch, so clients can sync many small changes in one round-trip
+func batch(rw http.ResponseWriter, req *http.Request) {
+	ctx, err := GetContext(req)
+	if err != nil {
+		respondAuthError(rw, req, err)
+		return
+	}
+	var requests []BatchRequest
+	limitBody(rw, req)
+	err = json.NewDecoder(req.Body).Decode(&requests)
+	req.Body.Close()
+	if err != nil {
+		RespondTo(rw, req, bodyError(err))
+		return
+	}
+	if len(requests) > BatchMaxRequests {
+		RespondTo(rw, req, NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest,
+			fmt.Sprintf("A batch may contain at most %d requests", BatchMaxRequests)))
+		return
+	}
+	results := make([]interface{}, len(requests))
+	for i, sub := range requests {
+		subURL, err := url.Parse(sub.Path)
+		if err != nil {
+			results[i] = NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			continue
+		}
+		rs, id, ok := lookupResource(subURL.Path)
+		if !ok {
+			results[i] = NewApiError(http.StatusNotFound, ErrorCodeNotFound, "No resource is registered at "+subURL.Path)
+			continue
+		}
+		header := http.Header{}
+		for name, value := range sub.Headers {
+			header.Set(name, value)
+		}
+		results[i], _ = rs.do(ctx, strings.ToUpper(sub.Method), id, subURL.Query(), header, sub.Body)
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: results,
+	})
+}
+
+// func lookupResource returns the resource registered for path, and the ID of the entity path is for, if any
+func lookupResource(path string) (rs *resource, id string, ok bool) {
+	path = "/" + strings.Trim(path, "/")
+	resourcesMu.RLock()
+	defer resourcesMu.RUnlock()
+	if rs, ok = resources[path]; ok {
+		return rs, "", true
+	}
+	if slash := strings.LastIndex(path, "/"); slash > 0 {
+		rs, ok = resources[path[:slash]]
+		return rs, path[slash+1:], ok
+	}
+	return nil, "", false
+}
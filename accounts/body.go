@@ -0,0 +1,30 @@
+package accounts
+
+import (
+	"fmt"
+	"net/http"
+)
+
+var (
+	// MaxBodyBytes limits the size of the JSON bodies the accounts handlers and resources (see RegisterResource) decode,
+	// so huge payloads are rejected with a 413 rather than read into instance memory. 0 for no limit
+	MaxBodyBytes int64 = 1 << 20
+)
+
+// func limitBody caps how much of req's body can be read at MaxBodyBytes. Reading past it fails with an error bodyError maps to a 413
+func limitBody(rw http.ResponseWriter, req *http.Request) {
+	if MaxBodyBytes > 0 && req.Body != nil {
+		req.Body = http.MaxBytesReader(rw, req.Body, MaxBodyBytes)
+	}
+}
+
+// func bodyError returns the ApiError for an error reading or decoding a request body: 413 if it was larger than MaxBodyBytes,
+// otherwise 400
+func bodyError(err error) *ApiError {
+	// http.MaxBytesReader's error has no type of it's own in older Go versions, only this message
+	if err.Error() == "http: request body too large" {
+		return NewApiError(http.StatusRequestEntityTooLarge, ErrorCodeBodyTooLarge,
+			fmt.Sprintf("Request body must be at most %d bytes", MaxBodyBytes))
+	}
+	return NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+}
@@ -0,0 +1,24 @@
+package accounts
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestLimitBody(c *C) {
+	defer func(max int64) { MaxBodyBytes = max }(MaxBodyBytes)
+	MaxBodyBytes = 8
+
+	req, err := http.NewRequest("POST", "/batch", strings.NewReader(`["too", "large"]`))
+	c.Assert(err, IsNil)
+	limitBody(httptest.NewRecorder(), req)
+	_, err = ioutil.ReadAll(req.Body)
+	c.Assert(err, NotNil)
+	c.Assert(bodyError(err).Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(bodyError(err).ErrorCode, Equals, ErrorCodeBodyTooLarge)
+	c.Assert(bodyError(errors.New("unexpected EOF")).Code, Equals, http.StatusBadRequest)
+}
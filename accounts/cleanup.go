@@ -0,0 +1,181 @@
+package accounts
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/user"
+)
+
+var (
+	// CleanupBatchSize is how many expired sessions CleanupSessions removes from memcache with each call, and how many
+	// expired entities CleanupExpired deletes with each call
+	CleanupBatchSize = 100
+
+	// Kinds registered with ExpireKind, with the time field each expires at
+	expiringKinds   = map[string]expiringKind{}
+	expiringKindsMu sync.RWMutex
+)
+
+type expiringKind struct {
+	obj   interface{}
+	field string
+}
+
+// func ExpireKind registers the kind of obj (a pointer to a struct) for CleanupExpired, which deletes its entities once
+// the time in field has passed. Use it for anything persisted that goes stale, ie. password reset or invite tokens
+//
+// 	func init() {
+// 		accounts.ExpireKind(&ResetToken{}, "Expires")
+// 	}
+func ExpireKind(obj interface{}, field string) {
+	expiringKindsMu.Lock()
+	defer expiringKindsMu.Unlock()
+	expiringKinds[aeutils.KindOf(obj)] = expiringKind{obj: obj, field: field}
+}
+
+// func CleanupExpired deletes the entities of each kind registered with ExpireKind whose expiry has passed,
+// CleanupBatchSize at a time, returning how many were deleted of each kind. Entities are deleted with
+// aeutils.HardDeleteMulti, so delete hooks run and cached copies are removed
+// Entities are only deleted from ctx's namespace, so apps with per-account entities call it for each account's
+func CleanupExpired(ctx context.Context) (map[string]int, error) {
+	expiringKindsMu.RLock()
+	kinds := make(map[string]expiringKind, len(expiringKinds))
+	for name, kind := range expiringKinds {
+		kinds[name] = kind
+	}
+	expiringKindsMu.RUnlock()
+	now := time.Now()
+	deleted := map[string]int{}
+	for name, kind := range kinds {
+		var batch []interface{}
+		flush := func() error {
+			if err := aeutils.HardDeleteMulti(ctx, batch); err != nil {
+				return err
+			}
+			deleted[name] += len(batch)
+			batch = nil
+			return nil
+		}
+		q := datastore.NewQuery(name).Filter(kind.field+" <", now)
+		_, err := aeutils.Iterate(ctx, q, kind.obj, func(obj interface{}, key *datastore.Key) error {
+			if batch = append(batch, obj); len(batch) == CleanupBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil && len(batch) > 0 {
+			err = flush()
+		}
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// func CleanupSessions removes sessions that have expired (see Session.Expires) from memory and memcache, returning how many
+// were removed. Sessions are only held in memory by the instances that created or used them, so this only clears those of
+// the instance it's called on, which should be done regularly (ie. by the /_cron/cleanup route) so they don't grow unbounded
+// Sessions held by other instances expire from memcache along with the session (see storeSession)
+func CleanupSessions(ctx context.Context) (int, error) {
+	now := time.Now()
+	var expired []string
+	sessionsMu.RLock()
+	for key, session := range sessions {
+		if now.After(session.Expires()) {
+			expired = append(expired, key)
+		}
+	}
+	sessionsMu.RUnlock()
+	for start := 0; start < len(expired); start += CleanupBatchSize {
+		end := start + CleanupBatchSize
+		if end > len(expired) {
+			end = len(expired)
+		}
+		cacheKeys := make([]string, 0, end-start)
+		sessionsMu.Lock()
+		for _, key := range expired[start:end] {
+			if session, ok := sessions[key]; ok {
+				delete(sessions, key)
+				delete(sessionToUser, session)
+			}
+			cacheKeys = append(cacheKeys, "session-"+key)
+		}
+		sessionsMu.Unlock()
+		if err := memcache.DeleteMulti(ctx, cacheKeys); err != nil && !onlyCacheMisses(err) {
+			return start, err
+		}
+	}
+	return len(expired), nil
+}
+
+// func onlyCacheMisses returns whether err is an appengine.MultiError of nothing but cache misses, ie. items already evicted
+func onlyCacheMisses(err error) bool {
+	multi, ok := err.(appengine.MultiError)
+	if !ok {
+		return false
+	}
+	for _, e := range multi {
+		if e != nil && e != memcache.ErrCacheMiss {
+			return false
+		}
+	}
+	return true
+}
+
+// func cleanup removes expired sessions (see CleanupSessions) and entities (see CleanupExpired), and responds with how
+// many were removed. Routed at
+// /_cron/cleanup, to be called by App Engine cron:
+//
+// 	cron:
+// 	- description: remove expired sessions
+// 	  url: /accounts/_cron/cleanup
+// 	  schedule: every 1 hours
+func cleanup(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	removed, err := CleanupSessions(ctx)
+	if err != nil {
+		errorf(ctx, "[accounts/cleanup] %v", err.Error())
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error removing expired sessions: " + apiErr.Message
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	expired, err := CleanupExpired(ctx)
+	if err != nil {
+		errorf(ctx, "[accounts/cleanup] %v", err.Error())
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error removing expired entities: " + apiErr.Message
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code: 200,
+		Data: map[string]interface{}{
+			"sessions": removed,
+			"expired":  expired,
+		},
+	})
+}
+
+// func CronOnly only passes requests sent by App Engine cron (which strips the X-Appengine-Cron header from any others)
+// or by admins of the app on to handler, responding 403 to anyone else
+func CronOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Appengine-Cron") != "true" && !user.IsAdmin(appengine.NewContext(req)) {
+			apiErr := NewApiError(http.StatusForbidden, ErrorCodeAdminRequired, "Only App Engine cron or admins can run this")
+			respond(rw, req, apiErr.Code, apiErr)
+			return
+		}
+		handler(rw, req)
+	}
+}
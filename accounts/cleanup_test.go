@@ -0,0 +1,58 @@
+package accounts
+
+import (
+	"time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func (s *MySuite) TestCleanupSessions(c *C) {
+	session, err := createSession(ctx, validAccount, nil)
+	c.Assert(err, IsNil)
+	expired, err := createSession(ctx, validAccount, nil)
+	c.Assert(err, IsNil)
+	expired.LastUsed = time.Now().Add(-2 * expired.TTL)
+
+	removed, err := CleanupSessions(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(removed >= 1, Equals, true)
+	_, ok := memorySession(expired.Key)
+	c.Assert(ok, Equals, false)
+	_, ok = memorySession(session.Key)
+	c.Assert(ok, Equals, true)
+}
+
+type expiringToken struct {
+	ID      int64
+	Expires time.Time
+}
+
+func (s *MySuite) TestCleanupExpired(c *C) {
+	ExpireKind(&expiringToken{}, "Expires")
+	defer func() {
+		expiringKindsMu.Lock()
+		delete(expiringKinds, aeutils.KindOf(&expiringToken{}))
+		expiringKindsMu.Unlock()
+	}()
+	stale := &expiringToken{Expires: time.Now().Add(-time.Hour)}
+	fresh := &expiringToken{Expires: time.Now().Add(time.Hour)}
+	staleKey, err := aeutils.Save(ctx, stale)
+	c.Assert(err, IsNil)
+	freshKey, err := aeutils.Save(ctx, fresh)
+	c.Assert(err, IsNil)
+	// Make sure eventual consistency is ready for the query
+	_ = datastore.Get(ctx, staleKey, &expiringToken{})
+
+	deleted, err := CleanupExpired(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(deleted[aeutils.KindOf(stale)], Equals, 1)
+	exists, err := aeutils.ExistsKey(ctx, staleKey)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+	exists, err = aeutils.ExistsKey(ctx, freshKey)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+}
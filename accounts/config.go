@@ -0,0 +1,88 @@
+package accounts
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/config"
+
+	"golang.org/x/net/context"
+)
+
+// Names of the config values (see the config package) that override the package defaults, so they can be changed
+// without a deploy
+const (
+	// ConfigSessionTTL overrides SessionTTL, as a duration such as "12h"
+	ConfigSessionTTL = "accounts.sessionTTL"
+	// ConfigHeaderPrefix is followed by a name in Headers to override that header, ie. "accounts.header.session"
+	ConfigHeaderPrefix = "accounts.header."
+	// ConfigEncryptionKey is the secret loaded as the encryption key, if none has been set with SetEncryptionKey
+	ConfigEncryptionKey = "accounts.encryptionKey"
+	// ConfigPublicIDSecret is the secret loaded for aeutils.SetPublicIDSecret, if no public ID encoder has been set.
+	// Until there is one, users are identified by their numeric IDs and resources by their encoded keys, which let
+	// clients count and enumerate them
+	ConfigPublicIDSecret = "accounts.publicIDSecret"
+)
+
+// Warns that no public ID secret is set, once per instance
+var noPublicIDSecret sync.Once
+
+// func sessionTTL returns how long new and refreshed sessions remain valid since they were last used
+func sessionTTL(ctx context.Context) time.Duration {
+	return config.Duration(ctx, ConfigSessionTTL, SessionTTL)
+}
+
+// func header returns the name of the request header for name, one of the keys of Headers
+func header(ctx context.Context, name string) string {
+	return config.String(ctx, ConfigHeaderPrefix+name, Headers[name])
+}
+
+// func headers returns Headers, with any names overridden by config
+func headers(ctx context.Context) map[string]string {
+	names := make(map[string]string, len(Headers))
+	for name := range Headers {
+		names[name] = header(ctx, name)
+	}
+	return names
+}
+
+// func LoadEncryptionKey sets the encryption key from the ConfigEncryptionKey secret, unless a key has already been set
+// AuthenticateRequest calls it, so users can be loaded once a request is authenticated. Call it before loading or
+// saving users elsewhere, ie. in tasks
+func LoadEncryptionKey(ctx context.Context) error {
+	if hasEncryptionKey() {
+		return nil
+	}
+	key, err := config.Secret(ctx, ConfigEncryptionKey)
+	if err == config.ErrNotSet {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = SetEncryptionKey(key); err != nil {
+		errorf(ctx, "[accounts/LoadEncryptionKey] %v", err.Error())
+	}
+	return err
+}
+
+// func LoadPublicIDSecret sets the secret user and resource IDs are encoded with (see aeutils.PublicID) from the
+// ConfigPublicIDSecret secret, unless an encoder has already been set. AuthenticateRequest calls it
+func LoadPublicIDSecret(ctx context.Context) error {
+	if aeutils.HasPublicIDs() {
+		return nil
+	}
+	secret, err := config.Secret(ctx, ConfigPublicIDSecret)
+	if err == config.ErrNotSet {
+		noPublicIDSecret.Do(func() {
+			warningf(ctx, "[accounts/LoadPublicIDSecret] No %v secret is set, so IDs will be sent as they're stored", ConfigPublicIDSecret)
+		})
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = aeutils.SetPublicIDSecret(secret); err != nil {
+		errorf(ctx, "[accounts/LoadPublicIDSecret] %v", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+package accounts
+
+import (
+	"net/http"
+	"time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/config"
+)
+
+func (s *MySuite) TestConfigOverrides(c *C) {
+	c.Assert(sessionTTL(ctx), Equals, SessionTTL)
+	c.Assert(header(ctx, "session"), Equals, Headers["session"])
+
+	c.Assert(config.Set(ctx, ConfigSessionTTL, "12h"), IsNil)
+	c.Assert(config.Set(ctx, ConfigHeaderPrefix+"session", "X-token"), IsNil)
+	defer config.Unset(ctx, ConfigSessionTTL)
+	defer config.Unset(ctx, ConfigHeaderPrefix+"session")
+
+	session, err := createSession(ctx, validAccount, nil)
+	c.Assert(err, IsNil)
+	c.Assert(session.TTL, Equals, 12*time.Hour)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("X-token", session.Key)
+	c.Assert(sessionKeyFromRequest(ctx, req), Equals, session.Key)
+	c.Assert(hasCredentials(ctx, req), Equals, true)
+}
@@ -0,0 +1,46 @@
+package accounts
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// CorsAllowOrigin is the origin preflight requests to the accounts routes are allowed from, "*" for any
+	CorsAllowOrigin = "*"
+	// CorsAllowHeaders are headers preflight requests may ask for, in addition to the ones in Headers,
+	// RequestIDHeader and the standard Accept and Content-Type. Preflight requests aren't authenticated or tied to
+	// an app context, so headers renamed through config (see ConfigHeaderPrefix) must be added here as well
+	CorsAllowHeaders = []string{}
+	// CorsMaxAge is how long browsers may cache a preflight response
+	CorsMaxAge = 10 * time.Minute
+)
+
+// func corsAllowedHeaders returns the headers clients of the accounts routes may send, in order
+func corsAllowedHeaders() string {
+	headers := []string{"Accept", "Content-Type", "If-Match", "If-None-Match", MethodOverrideHeader, RequestIDHeader}
+	for _, header := range Headers {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	return strings.Join(append(headers, CorsAllowHeaders...), ", ")
+}
+
+// func preflightHandler answers CORS preflight (OPTIONS) requests for a route accepting method, so browsers
+// allow the request itself (including the X-account, X-session, etc. headers) before it's authenticated
+func preflightHandler(method string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := rw.Header()
+		header.Set("Access-Control-Allow-Origin", CorsAllowOrigin)
+		header.Set("Access-Control-Allow-Methods", method+", OPTIONS")
+		header.Set("Access-Control-Allow-Headers", corsAllowedHeaders())
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(CorsMaxAge/time.Second)))
+		if CorsAllowOrigin != "*" {
+			header.Add("Vary", "Origin")
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
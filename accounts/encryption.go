@@ -1,75 +1,120 @@
 package accounts
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"errors"
-	"io"
-)
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mrvdot/appengine/aeutils"
 
-var (
-	encryptionKey []byte
+	"google.golang.org/appengine/datastore"
 )
 
 // Sets the encryption key to use. Must be a valid size AES encryption key (16, 24, or 32 bytes)
-// Does not currently pad to accomadate
+// The key is shared with aeutils (see aeutils.SetEncryptionKey), which does the encryption
 func SetEncryptionKey(key []byte) error {
-	_, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-	encryptionKey = key
-	return nil
+	return aeutils.SetEncryptionKey(key)
 }
 
 func SetEncryptionKeyString(key string) error {
 	return SetEncryptionKey([]byte(key))
 }
 
+// func hasEncryptionKey returns whether an encryption key has been set
+func hasEncryptionKey() bool {
+	return aeutils.HasEncryptionKey()
+}
+
 // encrypts data based on specified key
 func encrypt(plaintext []byte) (ciphertext []byte, err error) {
-	if encryptionKey == nil || len(encryptionKey) == 0 {
+	if !hasEncryptionKey() {
 		panic("Cannot store user information until encryption has been set")
 	}
-
-	ciphertext = make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, err
-	}
-
-	block, err := aes.NewCipher(encryptionKey)
-	if err != nil {
-		return nil, err
-	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
-	return
+	return aeutils.Encrypt(plaintext)
 }
 
 // descyrpts data based on specified key
 func decrypt(ciphertext []byte) (plaintext []byte, err error) {
-	if encryptionKey == nil || len(encryptionKey) == 0 {
+	if !hasEncryptionKey() {
 		panic("Cannot decrypt user information until encryption has been set")
 	}
+	return aeutils.Decrypt(ciphertext)
+}
 
-	block, err := aes.NewCipher(encryptionKey)
+// LoadEncrypted loads props into dst, a pointer to a struct, decrypting any fields tagged `encrypted:"true"`
+// Use it (along with SaveEncrypted) to implement datastore.PropertyLoadSaver:
+//
+// 	func (s *Secret) Load(props []datastore.Property) error {
+// 		return accounts.LoadEncrypted(s, props)
+// 	}
+//
+// 	func (s *Secret) Save() ([]datastore.Property, error) {
+// 		return accounts.SaveEncrypted(s)
+// 	}
+//
+// Encrypted fields must be of type []byte, and hold the plaintext while in memory
+func LoadEncrypted(dst interface{}, props []datastore.Property) error {
+	fields, err := encryptedFields(reflect.TypeOf(dst))
+	if err != nil {
+		return err
+	}
+	loaded := make([]datastore.Property, len(props))
+	for i, p := range props {
+		if ciphertext, ok := p.Value.([]byte); ok && fields[p.Name] && len(ciphertext) > 0 {
+			if p.Value, err = decrypt(ciphertext); err != nil {
+				return err
+			}
+		}
+		loaded[i] = p
+	}
+	return datastore.LoadStruct(dst, loaded)
+}
 
+// SaveEncrypted returns the properties of src, a pointer to a struct, encrypting any fields tagged `encrypted:"true"`
+// See LoadEncrypted
+func SaveEncrypted(src interface{}) ([]datastore.Property, error) {
+	fields, err := encryptedFields(reflect.TypeOf(src))
 	if err != nil {
 		return nil, err
 	}
-
-	if len(ciphertext) < aes.BlockSize {
-		return nil, errors.New("ciphertext too short")
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		return nil, err
 	}
+	for i, p := range props {
+		if plaintext, ok := p.Value.([]byte); ok && fields[p.Name] && len(plaintext) > 0 {
+			if props[i].Value, err = encrypt(plaintext); err != nil {
+				return nil, err
+			}
+			props[i].NoIndex = true
+		}
+	}
+	return props, nil
+}
 
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
-
-	stream := cipher.NewCFBDecrypter(block, iv)
-
-	plaintext = make([]byte, len(ciphertext))
-	stream.XORKeyStream(plaintext, ciphertext)
-	return
+// encryptedFields returns the datastore property names of all fields of t tagged `encrypted:"true"`
+func encryptedFields(t reflect.Type) (map[string]bool, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, errors.New(fmt.Sprintf("Must pass a pointer to a struct: passed %v", t))
+	}
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("encrypted") != "true" {
+			continue
+		}
+		if field.Type != reflect.TypeOf([]byte(nil)) {
+			return nil, errors.New(fmt.Sprintf("Encrypted field %v.%v must be []byte, is %v", t, field.Name, field.Type))
+		}
+		name := strings.Split(field.Tag.Get("datastore"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = true
+	}
+	return fields, nil
 }
@@ -2,20 +2,56 @@ package accounts
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
 	. "gopkg.in/check.v1"
 )
 
+type secretObject struct {
+	Name   string
+	Secret []byte `encrypted:"true"`
+}
+
 func (s *MySuite) TestEncryption(c *C) {
 	key := []byte("my test key 1234")
 	plaintext := []byte("my secret message")
 	SetEncryptionKey(key)
 	ciphertext, err := encrypt(plaintext)
 	c.Assert(err, IsNil)
-	// make sure it's the correct format
-	c.Assert(ciphertext, HasLen, len(plaintext)+aes.BlockSize)
+	// make sure it's the correct format: version header and nonce, then ciphertext and tag
+	c.Assert(ciphertext, HasLen, 4+12+len(plaintext)+16)
 	// assert it returned correctly
 	plaintext2, err := decrypt(ciphertext)
 	c.Assert(err, IsNil)
 	// Have to use deep equals because of byte types
 	c.Assert(plaintext, DeepEquals, plaintext2)
+	// Altered ciphertext is rejected
+	ciphertext[len(ciphertext)-1] ^= 1
+	_, err = decrypt(ciphertext)
+	c.Assert(err, NotNil)
+
+	// Values encrypted with AES-CFB before the version header was added can still be decrypted
+	block, err := aes.NewCipher(key)
+	c.Assert(err, IsNil)
+	legacy := make([]byte, aes.BlockSize+len(plaintext))
+	cipher.NewCFBEncrypter(block, legacy[:aes.BlockSize]).XORKeyStream(legacy[aes.BlockSize:], plaintext)
+	plaintext3, err := decrypt(legacy)
+	c.Assert(err, IsNil)
+	c.Assert(plaintext3, DeepEquals, plaintext)
+}
+
+func (s *MySuite) TestEncryptedLoadSave(c *C) {
+	SetEncryptionKey([]byte("my test key 1234"))
+	obj := &secretObject{Name: "Plain", Secret: []byte("my secret message")}
+	props, err := SaveEncrypted(obj)
+	c.Assert(err, IsNil)
+	c.Assert(props, HasLen, 2)
+	for _, p := range props {
+		if p.Name == "Secret" {
+			c.Assert(p.Value, Not(DeepEquals), obj.Secret)
+		}
+	}
+
+	loaded := &secretObject{}
+	c.Assert(LoadEncrypted(loaded, props), IsNil)
+	c.Assert(loaded, DeepEquals, obj)
 }
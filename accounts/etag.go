@@ -0,0 +1,67 @@
+package accounts
+
+import (
+	"net/http"
+	"strings"
+)
+
+// func RespondWithETag is like RespondTo, but sends etag (ie. from aeutils.ETag) in the ETag header, and if the request's
+// If-None-Match includes it, responds 304 Not Modified without a body instead, so clients can revalidate cached copies cheaply
+func RespondWithETag(rw http.ResponseWriter, req *http.Request, resp interface{}, etag string) {
+	if etag != "" {
+		rw.Header().Set("ETag", etag)
+		if notModified(req.Method, req.Header, etag) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	RespondTo(rw, req, resp)
+}
+
+// func CheckPrecondition returns an ApiError (412 Precondition Failed) if req has an If-Match header that doesn't include etag,
+// so a write based on a stale copy is rejected rather than overwriting someone else's change. Returns nil otherwise
+func CheckPrecondition(req *http.Request, etag string) *ApiError {
+	return checkIfMatch(req.Header, etag)
+}
+
+func checkIfMatch(header http.Header, etag string) *ApiError {
+	ifMatch := header.Get("If-Match")
+	if ifMatch == "" || etagMatches(ifMatch, etag, false) {
+		return nil
+	}
+	return preconditionFailed()
+}
+
+func preconditionFailed() *ApiError {
+	return NewApiError(http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "The resource has changed since it was fetched")
+}
+
+// func notModified returns whether a GET or HEAD request's If-None-Match header includes etag
+func notModified(method string, header http.Header, etag string) bool {
+	if method != "GET" && method != "HEAD" {
+		return false
+	}
+	ifNoneMatch := header.Get("If-None-Match")
+	return ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true)
+}
+
+// func etagMatches returns whether the list of entity tags in an If-Match or If-None-Match header includes etag (or is "*")
+// Weak tags (W/"...") only match for If-None-Match, as If-Match requires a strong comparison
+func etagMatches(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return etag != ""
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
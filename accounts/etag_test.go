@@ -0,0 +1,39 @@
+package accounts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/golang-utils"
+)
+
+func (s *MySuite) TestETagMatches(c *C) {
+	c.Assert(etagMatches(`"abc"`, `"abc"`, false), Equals, true)
+	c.Assert(etagMatches(`"xyz", "abc"`, `"abc"`, false), Equals, true)
+	c.Assert(etagMatches(`W/"abc"`, `"abc"`, false), Equals, false)
+	c.Assert(etagMatches(`W/"abc"`, `"abc"`, true), Equals, true)
+	c.Assert(etagMatches(`*`, `"abc"`, false), Equals, true)
+	c.Assert(etagMatches(`"xyz"`, `"abc"`, true), Equals, false)
+
+	header := http.Header{}
+	c.Assert(checkIfMatch(header, `"abc"`), IsNil)
+	header.Set("If-Match", `"xyz"`)
+	c.Assert(checkIfMatch(header, `"abc"`).Code, Equals, http.StatusPreconditionFailed)
+}
+
+func (s *MySuite) TestRespondWithETag(c *C) {
+	req, err := http.NewRequest("GET", "/item", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("If-None-Match", `"abc"`)
+	rw := httptest.NewRecorder()
+	RespondWithETag(rw, req, &utils.ApiResponse{Code: 200}, `"abc"`)
+	c.Assert(rw.Code, Equals, http.StatusNotModified)
+	c.Assert(rw.Body.Len(), Equals, 0)
+	c.Assert(rw.Header().Get("ETag"), Equals, `"abc"`)
+
+	rw = httptest.NewRecorder()
+	RespondWithETag(rw, req, &utils.ApiResponse{Code: 200}, `"def"`)
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	c.Assert(rw.Header().Get("ETag"), Equals, `"def"`)
+}
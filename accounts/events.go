@@ -0,0 +1,38 @@
+package accounts
+
+import (
+	"encoding/gob"
+
+	"github.com/mrvdot/appengine/events"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Names of the events published (see the events package) as requests authenticate and sessions end
+const (
+	EventLogin       = "Account.login"       // An account authenticated with its API key, or a user with their password
+	EventLoginFailed = "Account.loginFailed" // Credentials were rejected
+	EventLogout      = "Account.logout"      // A session was cleared, before it expired
+)
+
+// AuthEvent is the Data of the authentication events. The event's Key is the account's, once it's known
+// Credentials and sessions are left out, as events may be dispatched through the task queue
+type AuthEvent struct {
+	Slug     string         // Account slug, as sent with the request for EventLoginFailed
+	Username string         // User that logged in (or tried to), if any
+	User     *datastore.Key // Key of that user, once authenticated
+}
+
+func init() {
+	// So events can be dispatched to asynchronous subscribers
+	gob.Register(&AuthEvent{})
+}
+
+// func publishAuthEvent publishes an authentication event, only logging if a subscriber fails,
+// as authentication shouldn't depend on what subscribers do with it
+func publishAuthEvent(ctx context.Context, name string, key *datastore.Key, data *AuthEvent) {
+	if err := events.Publish(ctx, &events.Event{Name: name, Key: key, Data: data}); err != nil {
+		warningf(ctx, "[accounts/%v] %v", name, err.Error())
+	}
+}
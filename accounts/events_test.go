@@ -0,0 +1,32 @@
+package accounts
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/events"
+
+	"golang.org/x/net/context"
+)
+
+func (s *MySuite) TestAuthEvents(c *C) {
+	var published []*events.Event
+	record := func(ctx context.Context, e *events.Event) error {
+		published = append(published, e)
+		return nil
+	}
+	events.Subscribe(EventLogin, record)
+	events.Subscribe(EventLoginFailed, record)
+
+	_, err := authenticateAccount(ctx, validAccount.Slug, fmt.Sprintf("%v-other", validAccount.ApiKey))
+	c.Assert(err, Equals, InvalidApiKey)
+	_, err = authenticateAccount(ctx, validAccount.Slug, validAccount.ApiKey)
+	c.Assert(err, IsNil)
+
+	c.Assert(published, HasLen, 2)
+	c.Assert(published[0].Name, Equals, EventLoginFailed)
+	c.Assert(published[0].Key, IsNil)
+	c.Assert(published[0].Data.(*AuthEvent).Slug, Equals, validAccount.Slug)
+	c.Assert(published[1].Name, Equals, EventLogin)
+	c.Assert(published[1].Key.StringID(), Equals, validAccount.Slug)
+}
@@ -1,52 +1,106 @@
 package accounts
 
-import "net/http"
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
 
 type AuthFunc func(http.ResponseWriter, *http.Request, *Account)
 
 // AuthenticatedFunc wraps a function to ensure the request is authenticated
 // before passing through to the wrapped function.
-// Wrapped function can be either http.HandlerFunc or AuthFunc (receives http.ResponseWriter, *http.Request, *Account)
-// BUG - Type switch is panicking way too often right now, need to inspect
+// Wrapped function can be either http.HandlerFunc or AuthFunc (receives http.ResponseWriter, *http.Request, *Account),
+// or a plain func with either signature. Anything else panics when it's wrapped, rather than on every request
+// Entities fetched during the request are cached in memory until it's finished (see aeutils.StartRequestCache)
 func AuthenticatedFunc(fn interface{}) http.HandlerFunc {
+	var handle AuthFunc
+	switch fn := fn.(type) {
+	case AuthFunc:
+		handle = fn
+	case func(http.ResponseWriter, *http.Request, *Account):
+		handle = fn
+	case http.HandlerFunc:
+		handle = func(rw http.ResponseWriter, req *http.Request, _ *Account) { fn(rw, req) }
+	case func(http.ResponseWriter, *http.Request):
+		handle = func(rw http.ResponseWriter, req *http.Request, _ *Account) { fn(rw, req) }
+	default:
+		panic("Unsupported func passed to AuthenticatedFunc, must be AuthFunc or http.HandlerFunc")
+	}
 	return func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		aeutils.StartRequestCache(ctx)
+		defer aeutils.ClearRequestCache(ctx)
 		acct, err := AuthenticateRequest(req, rw)
 		if err != nil {
-			if err == Unauthenticated {
-				rw.WriteHeader(http.StatusUnauthorized)
-			} else {
-				rw.WriteHeader(http.StatusInternalServerError)
-				rw.Write([]byte(err.Error()))
-			}
+			respondAuthError(rw, req, err)
 			return
 		}
-		switch fn := fn.(type) {
-		case AuthFunc:
-			fn(rw, req, acct)
-		case http.HandlerFunc:
-			fn(rw, req)
-		default:
-			panic("Unsupported func passed to AuthenticatedFunc, must be AuthFunc or http.HandlerFunc")
-		}
-		ClearAuthenticatedRequest(req)
+		defer ClearAuthenticatedRequest(req)
+		handle(rw, req, acct)
 	}
 }
 
 // AuthenicatedHandler wraps a handler and ensures everything that passes through it
 // is authenticated. Useful when an entire module/subrouter should be gated by authentication
+// As with AuthenticatedFunc, entities fetched during the request are cached in memory until it's finished
 func AuthenticatedHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		aeutils.StartRequestCache(ctx)
+		defer aeutils.ClearRequestCache(ctx)
 		_, err := AuthenticateRequest(req, rw)
 		if err != nil {
-			if err == Unauthenticated {
-				rw.WriteHeader(http.StatusUnauthorized)
-			} else {
-				rw.WriteHeader(http.StatusInternalServerError)
-				rw.Write([]byte(err.Error()))
+			respondAuthError(rw, req, err)
+			return
+		}
+		defer ClearAuthenticatedRequest(req)
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// AdminOnlyHandler wraps a handler so only admins of the app (signed in with their Google account, see user.IsAdmin)
+// can reach it, for admin pages and endpoints like migrations. Anyone else gets a 403, with a loginUrl in its Data if
+// they're not signed in at all. Wrap it in AuthenticatedHandler to also require account authentication
+func AdminOnlyHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		if !user.IsAdmin(ctx) {
+			apiErr := NewApiError(http.StatusForbidden, ErrorCodeAdminRequired, "Admin access required")
+			if user.Current(ctx) == nil {
+				if loginUrl, err := user.LoginURL(ctx, req.URL.String()); err == nil {
+					apiErr.Data = map[string]interface{}{"loginUrl": loginUrl}
+				}
 			}
+			respond(rw, req, apiErr.Code, apiErr)
 			return
 		}
 		handler.ServeHTTP(rw, req)
-		ClearAuthenticatedRequest(req)
 	})
 }
+
+// RecoveryHandler wraps a handler so a panic while handling a request is logged (with its stack) as critical,
+// and answered with a 500 ApiError, rather than a blank response. InitRouter and InitServeMux apply it to the accounts routes
+func RecoveryHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				ctx := appengine.NewContext(req)
+				criticalf(ctx, "[accounts/RecoveryHandler] panic handling %v %v: %v\n%s", req.Method, req.URL.Path, r, debug.Stack())
+				respond(rw, req, http.StatusInternalServerError, NewApiError(http.StatusInternalServerError, ErrorCodeInternal, "Internal server error"))
+			}
+		}()
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// respondAuthError responds to a request that failed authentication with an ApiError for err, using its code as the status
+// (401 if it wasn't authenticated at all, 403 if the credentials it passed were rejected, or 500 for any other error)
+func respondAuthError(rw http.ResponseWriter, req *http.Request, err error) {
+	apiErr := ErrorResponse(err)
+	respond(rw, req, apiErr.Code, apiErr)
+}
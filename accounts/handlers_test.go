@@ -0,0 +1,14 @@
+package accounts
+
+import (
+	"net/http"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestAuthenticatedFuncTypes(c *C) {
+	c.Assert(AuthenticatedFunc(func(rw http.ResponseWriter, req *http.Request, acct *Account) {}), NotNil)
+	c.Assert(AuthenticatedFunc(AuthFunc(func(rw http.ResponseWriter, req *http.Request, acct *Account) {})), NotNil)
+	c.Assert(AuthenticatedFunc(func(rw http.ResponseWriter, req *http.Request) {}), NotNil)
+	c.Assert(AuthenticatedFunc(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})), NotNil)
+	c.Assert(func() { AuthenticatedFunc("not a func") }, PanicMatches, "Unsupported func.*")
+}
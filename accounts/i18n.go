@@ -0,0 +1,210 @@
+package accounts
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// DefaultLocale is the language of the messages as written, used when neither the account nor the request
+	// asks for one there are translations for
+	DefaultLocale = "en"
+
+	// Translations of the messages accounts responds with, by locale (lowercase, ie. "es" or "pt-br"), then the
+	// message as written. Add to (or replace) them with RegisterMessages
+	messages = map[string]map[string]string{
+		"es": {
+			"No account has been authenticated for this request": "No se ha autenticado ninguna cuenta para esta solicitud",
+			"No account matches that session":                    "Ninguna cuenta coincide con esa sesión",
+			"No account matches that slug":                       "Ninguna cuenta coincide con ese identificador",
+			"API Key does not match account":                     "La clave de API no corresponde a la cuenta",
+			"This account has been deactivated":                  "Esta cuenta ha sido desactivada",
+			"Session has expired, please reauthenticate":         "La sesión ha caducado, vuelva a autenticarse",
+			"That password is not valid for this user":           "La contraseña no es válida para este usuario",
+			"Admin access required":                              "Se requiere acceso de administrador",
+			"Only account admins can manage users":               "Solo los administradores de la cuenta pueden gestionar usuarios",
+			"Only account admins can change a user's role":       "Solo los administradores de la cuenta pueden cambiar el rol de un usuario",
+			"Rate limit exceeded":                                "Se ha superado el límite de solicitudes",
+			"The resource has changed since it was fetched":      "El recurso ha cambiado desde que se obtuvo",
+			"Account name must be provided":                      "Debe indicar el nombre de la cuenta",
+			"A username or email must be provided":               "Debe indicar un nombre de usuario o correo electrónico",
+			"Request is invalid":                                 "La solicitud no es válida",
+			"is required":                                        "es obligatorio",
+			"must be a valid email address":                      "debe ser una dirección de correo electrónico válida",
+		},
+		"fr": {
+			"No account has been authenticated for this request": "Aucun compte n'a été authentifié pour cette requête",
+			"No account matches that session":                    "Aucun compte ne correspond à cette session",
+			"No account matches that slug":                       "Aucun compte ne correspond à cet identifiant",
+			"API Key does not match account":                     "La clé d'API ne correspond pas au compte",
+			"This account has been deactivated":                  "Ce compte a été désactivé",
+			"Session has expired, please reauthenticate":         "La session a expiré, veuillez vous authentifier à nouveau",
+			"That password is not valid for this user":           "Ce mot de passe n'est pas valide pour cet utilisateur",
+			"Admin access required":                              "Accès administrateur requis",
+			"Only account admins can manage users":               "Seuls les administrateurs du compte peuvent gérer les utilisateurs",
+			"Only account admins can change a user's role":       "Seuls les administrateurs du compte peuvent modifier le rôle d'un utilisateur",
+			"Rate limit exceeded":                                "Limite de requêtes dépassée",
+			"The resource has changed since it was fetched":      "La ressource a été modifiée depuis qu'elle a été récupérée",
+			"Account name must be provided":                      "Le nom du compte doit être fourni",
+			"A username or email must be provided":               "Un nom d'utilisateur ou une adresse e-mail doit être fourni",
+			"Request is invalid":                                 "La requête n'est pas valide",
+			"is required":                                        "est obligatoire",
+			"must be a valid email address":                      "doit être une adresse e-mail valide",
+		},
+		"de": {
+			"No account has been authenticated for this request": "Für diese Anfrage wurde kein Konto authentifiziert",
+			"No account matches that session":                    "Kein Konto passt zu dieser Sitzung",
+			"No account matches that slug":                       "Kein Konto passt zu dieser Kennung",
+			"API Key does not match account":                     "Der API-Schlüssel passt nicht zum Konto",
+			"This account has been deactivated":                  "Dieses Konto wurde deaktiviert",
+			"Session has expired, please reauthenticate":         "Die Sitzung ist abgelaufen, bitte erneut authentifizieren",
+			"That password is not valid for this user":           "Das Passwort ist für diesen Benutzer nicht gültig",
+			"Admin access required":                              "Administratorzugriff erforderlich",
+			"Only account admins can manage users":               "Nur Kontoadministratoren können Benutzer verwalten",
+			"Only account admins can change a user's role":       "Nur Kontoadministratoren können die Rolle eines Benutzers ändern",
+			"Rate limit exceeded":                                "Anfragelimit überschritten",
+			"The resource has changed since it was fetched":      "Die Ressource wurde seit dem Abruf geändert",
+			"Account name must be provided":                      "Der Kontoname muss angegeben werden",
+			"A username or email must be provided":               "Ein Benutzername oder eine E-Mail-Adresse muss angegeben werden",
+			"Request is invalid":                                 "Die Anfrage ist ungültig",
+			"is required":                                        "ist erforderlich",
+			"must be a valid email address":                      "muss eine gültige E-Mail-Adresse sein",
+		},
+	}
+	messagesMu sync.RWMutex
+)
+
+// func RegisterMessages adds translations for locale (ie. "pt-BR"), keyed by the message as accounts (or the app) writes it,
+// replacing any already registered. Messages with no translation are sent as written
+//
+// 	accounts.RegisterMessages("pt-BR", map[string]string{
+// 		"Rate limit exceeded": "Limite de solicitações excedido",
+// 	})
+func RegisterMessages(locale string, translations map[string]string) {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	locale = strings.ToLower(locale)
+	if messages[locale] == nil {
+		messages[locale] = map[string]string{}
+	}
+	for message, translation := range translations {
+		messages[locale][message] = translation
+	}
+}
+
+// func Localize returns the translation of message for locale, falling back on its language (ie. "fr" for "fr-CA"),
+// then message itself
+func Localize(locale, message string) string {
+	messagesMu.RLock()
+	defer messagesMu.RUnlock()
+	locale = strings.ToLower(locale)
+	for {
+		if translation, ok := messages[locale][message]; ok {
+			return translation
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			return message
+		}
+		locale = locale[:i]
+	}
+}
+
+// func NegotiateLanguage returns the locale RespondTo should use for an Accept-Language header, preferring those with
+// the highest quality value that there are translations for. Falls back to DefaultLocale if there are none
+func NegotiateLanguage(acceptLanguage string) string {
+	messagesMu.RLock()
+	defer messagesMu.RUnlock()
+	best, bestQ := DefaultLocale, 0.0
+	def := strings.ToLower(DefaultLocale)
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(part, ";")
+		locale := strings.ToLower(strings.TrimSpace(params[0]))
+		// Variants of DefaultLocale (ie. "en-US") need no translations
+		if !hasMessages(locale) && locale != def && !strings.HasPrefix(locale, def+"-") {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if parsed, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = locale, q
+		}
+	}
+	return best
+}
+
+// func hasMessages returns whether there are translations for locale, or its language. messagesMu must be held
+func hasMessages(locale string) bool {
+	for {
+		if _, ok := messages[locale]; ok {
+			return true
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			return false
+		}
+		locale = locale[:i]
+	}
+}
+
+// func setAccountLocale makes responses to the request authenticated as acct use its Locale (see respond)
+func setAccountLocale(rw http.ResponseWriter, acct *Account) {
+	if rw != nil && acct != nil && acct.Locale != "" {
+		rw.Header().Set("Content-Language", acct.Locale)
+	}
+}
+
+// func requestLocale returns the locale responses to req are translated for: the authenticated account's Locale, if it
+// has one, or else negotiated from the Accept-Language header
+func requestLocale(ctx context.Context, req *http.Request) string {
+	if acct, err := GetAccount(ctx); err == nil && acct.Locale != "" {
+		return acct.Locale
+	}
+	return NegotiateLanguage(req.Header.Get("Accept-Language"))
+}
+
+// func localize returns a copy of resp (a *utils.ApiResponse or *ApiError) with its messages translated for the
+// locale set by the Content-Language header already on rw (ie. by setAccountLocale), or negotiated from req's
+// Accept-Language header. Other responses are returned as they are
+func localize(rw http.ResponseWriter, req *http.Request, resp interface{}) interface{} {
+	locale := rw.Header().Get("Content-Language")
+	if locale == "" {
+		locale = NegotiateLanguage(req.Header.Get("Accept-Language"))
+		rw.Header().Add("Vary", "Accept-Language")
+		rw.Header().Set("Content-Language", locale)
+	}
+	switch r := resp.(type) {
+	case *utils.ApiResponse:
+		localized := *r
+		localized.Message = Localize(locale, r.Message)
+		return &localized
+	case *ApiError:
+		localized := *r
+		localized.Message = Localize(locale, r.Message)
+		if len(r.Details) > 0 {
+			localized.Details = make([]FieldError, len(r.Details))
+			for i, detail := range r.Details {
+				localized.Details[i] = FieldError{Field: detail.Field, Message: Localize(locale, detail.Message)}
+			}
+			// Validation messages combine every field's, so can't be translated as a whole. Summarize them instead
+			summary := Localize(locale, "Request is invalid")
+			if r.ErrorCode == ErrorCodeValidation && localized.Message == r.Message && summary != "Request is invalid" {
+				localized.Message = summary
+			}
+		}
+		return &localized
+	}
+	return resp
+}
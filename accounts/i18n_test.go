@@ -0,0 +1,47 @@
+package accounts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+)
+
+func (s *MySuite) TestLocalize(c *C) {
+	c.Assert(NegotiateLanguage(""), Equals, DefaultLocale)
+	c.Assert(NegotiateLanguage("fr-CA, en;q=0.8"), Equals, "fr-ca")
+	c.Assert(NegotiateLanguage("en-US, fr;q=0.5"), Equals, "en-us")
+	c.Assert(NegotiateLanguage("ja, de;q=0.7"), Equals, "de")
+
+	c.Assert(Localize("fr-CA", InvalidApiKey.Error()), Equals, "La clé d'API ne correspond pas au compte")
+	c.Assert(Localize("ja", InvalidApiKey.Error()), Equals, InvalidApiKey.Error())
+	RegisterMessages("ja", map[string]string{"Rate limit exceeded": "リクエスト数の上限を超えました"})
+	c.Assert(Localize("ja", "Rate limit exceeded"), Equals, "リクエスト数の上限を超えました")
+}
+
+func (s *MySuite) TestRespondLocalized(c *C) {
+	req, err := http.NewRequest("GET", "/accounts/me", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Language", "es")
+	rw := httptest.NewRecorder()
+	verr := &aeutils.ValidationError{Kind: "User"}
+	verr.Add("Email", "must be a valid email address")
+	RespondTo(rw, req, ErrorResponse(verr))
+	c.Assert(rw.Header().Get("Content-Language"), Equals, "es")
+	decoded := &ApiError{}
+	c.Assert(json.Unmarshal(rw.Body.Bytes(), decoded), IsNil)
+	c.Assert(decoded.Message, Equals, "La solicitud no es válida")
+	c.Assert(decoded.Details[0].Message, Equals, "debe ser una dirección de correo electrónico válida")
+
+	// The authenticated account's locale wins over Accept-Language
+	rw = httptest.NewRecorder()
+	setAccountLocale(rw, &Account{Locale: "de"})
+	apiErr := ErrorResponse(SessionExpired)
+	RespondTo(rw, req, apiErr)
+	decoded = &ApiError{}
+	c.Assert(json.Unmarshal(rw.Body.Bytes(), decoded), IsNil)
+	c.Assert(decoded.Message, Equals, "Die Sitzung ist abgelaufen, bitte erneut authentifizieren")
+	c.Assert(apiErr.Message, Equals, SessionExpired.Error())
+}
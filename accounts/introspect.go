@@ -0,0 +1,85 @@
+package accounts
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mrvdot/golang-utils"
+)
+
+const (
+	// Prefix of the names given to the routes added with RegisterResource, which always require authentication
+	resourceRoutePrefix = "Resource "
+)
+
+var (
+	// listRoutes returns the routes RoutesHandler describes. Routers walk their own routes (see MuxRoutes),
+	// otherwise the accounts routes table and registered resources are described as InitServeMux mounts them
+	listRoutes = func() ([]RouteInfo, error) {
+		return routeTable(), nil
+	}
+)
+
+func init() {
+	// Added here rather than in the routes table, as RoutesHandler reads the table
+	routes = append(routes, route{"Routes", "GET", "/routes", AdminOnlyHandler(http.HandlerFunc(RoutesHandler)).ServeHTTP})
+}
+
+// RouteInfo describes a registered route, as listed by RoutesHandler
+type RouteInfo struct {
+	Name    string   `json:"name,omitempty"`
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"` // Empty if the route matches any method
+	Auth    bool     `json:"auth"`              // Requires the authentication headers (see Headers)
+	Summary string   `json:"summary,omitempty"`
+}
+
+// func RoutesHandler responds with a RouteInfo for each registered route, as its Result, for debugging deployments and
+// generating clients. It's routed at /routes for admins of the app only (see AdminOnlyHandler), and should be wrapped
+// with AdminOnlyHandler wherever else it's mounted
+func RoutesHandler(rw http.ResponseWriter, req *http.Request) {
+	infos, err := listRoutes()
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: infos,
+	})
+}
+
+// func newRouteInfo describes the route named name, using its routeDoc if it's one of the accounts routes
+func newRouteInfo(name, path string, methods []string) RouteInfo {
+	doc := routeDocs[name]
+	return RouteInfo{
+		Name:    name,
+		Path:    path,
+		Methods: methods,
+		Auth:    doc.auth || strings.HasPrefix(name, resourceRoutePrefix),
+		Summary: doc.summary,
+	}
+}
+
+// func routeTable describes the accounts routes under SubrouterPath, then each resource added with
+// RegisterResource or RegisterServeMuxResource, by path
+func routeTable() []RouteInfo {
+	var infos []RouteInfo
+	for _, rt := range routes {
+		infos = append(infos, newRouteInfo(rt.name, "/"+SubrouterPath+rt.path, []string{rt.method}))
+	}
+	resourcesMu.RLock()
+	paths := make([]string, 0, len(resources))
+	for path := range resources {
+		paths = append(paths, path)
+	}
+	resourcesMu.RUnlock()
+	sort.Strings(paths)
+	for _, path := range paths {
+		infos = append(infos,
+			newRouteInfo(resourceRoutePrefix+path, path, []string{"GET", "POST"}),
+			newRouteInfo(resourceRoutePrefix+path+"/{id}", path+"/{id}", []string{"GET", "PUT", "PATCH", "DELETE"}))
+	}
+	return infos
+}
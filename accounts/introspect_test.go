@@ -0,0 +1,16 @@
+package accounts
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRouteTable(c *C) {
+	infos := routeTable()
+	c.Assert(len(infos) >= len(routes), Equals, true)
+	for i, rt := range routes {
+		c.Assert(infos[i].Name, Equals, rt.name)
+		c.Assert(infos[i].Path, Equals, "/"+SubrouterPath+rt.path)
+		c.Assert(infos[i].Methods, DeepEquals, []string{rt.method})
+		c.Assert(infos[i].Auth, Equals, routeDocs[rt.name].auth)
+	}
+}
@@ -0,0 +1,35 @@
+package accounts
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+
+	"github.com/mrvdot/appengine/logging"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	logging.RegisterTags(logTags)
+}
+
+// func logTags tags log entries (see the logging package) with the account, user and session ctx's request is
+// authenticated with, and its RequestID. Sessions are identified by a hash of their key, which would otherwise let
+// anyone reading the logs use them
+func logTags(ctx context.Context) []logging.Tag {
+	var tags []logging.Tag
+	if acct, err := GetAccount(ctx); err == nil {
+		tags = append(tags, logging.Tag{Name: "account", Value: acct.Slug})
+	}
+	if user, err := GetUser(ctx); err == nil && user != nil {
+		tags = append(tags, logging.Tag{Name: "user", Value: strconv.FormatInt(user.ID, 10)})
+	}
+	if session, err := GetSession(ctx); err == nil && session != nil {
+		tags = append(tags, logging.Tag{Name: "session", Value: fmt.Sprintf("%x", sha1.Sum([]byte(session.Key)))[:8]})
+	}
+	if id := RequestID(ctx); id != "" {
+		tags = append(tags, logging.Tag{Name: "request", Value: id})
+	}
+	return tags
+}
@@ -0,0 +1,21 @@
+package accounts
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/logging"
+)
+
+func (s *MySuite) TestLogTags(c *C) {
+	_, err := authenticateAccount(ctx, validAccount.Slug, validAccount.ApiKey)
+	c.Assert(err, IsNil)
+	session, err := GetSession(ctx)
+	c.Assert(err, IsNil)
+
+	tags := logTags(ctx)
+	c.Assert(len(tags) >= 2, Equals, true)
+	c.Assert(tags[0], Equals, logging.Tag{Name: "account", Value: validAccount.Slug})
+	c.Assert(tags[1].Name, Equals, "session")
+	c.Assert(tags[1].Value, HasLen, 8)
+	c.Assert(tags[1].Value, Not(Equals), session.Key[:8])
+}
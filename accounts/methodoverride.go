@@ -0,0 +1,60 @@
+package accounts
+
+import (
+	"net/http"
+	"strings"
+)
+
+var (
+	// MethodOverrideHeader is the header MethodOverrideHandler takes the method a POST request should be routed as from
+	MethodOverrideHeader = "X-HTTP-Method-Override"
+	// MethodOverrideMethods are the methods a POST request may be overridden to
+	MethodOverrideMethods = []string{"PUT", "PATCH", "DELETE"}
+)
+
+// func MethodOverrideHandler wraps a router so a POST request sending MethodOverrideHeader is routed as the method it names
+// (one of MethodOverrideMethods), for clients and proxies that can only send GET and POST. Only authenticated requests are
+// overridden, so a cross-site form can't reach a DELETE route, and those that fail to authenticate are answered with the
+// same error as AuthenticatedHandler. Routes behind it reuse the authentication rather than checking the credentials again
+//
+// InitRouter's router and InitServeMux's routes are already wrapped. Apps mounting RegisterResource routes on their own router should wrap that router:
+//
+// 	http.Handle("/", accounts.MethodOverrideHandler(r))
+func MethodOverrideHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		method, apiErr := overrideMethod(req)
+		if apiErr != nil {
+			respond(rw, req, apiErr.Code, apiErr)
+			return
+		}
+		if method == "" {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		if _, err := AuthenticateRequest(req, rw); err != nil {
+			respondAuthError(rw, req, err)
+			return
+		}
+		defer ClearAuthenticatedRequest(req)
+		req.Method = method
+		req.Header.Del(MethodOverrideHeader)
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// func overrideMethod returns the method req should be routed as, or an empty string if it isn't overridden
+// Returns an ApiError (400 Bad Request) if it names a method that isn't one of MethodOverrideMethods
+func overrideMethod(req *http.Request) (string, *ApiError) {
+	method := strings.ToUpper(strings.TrimSpace(req.Header.Get(MethodOverrideHeader)))
+	if req.Method != "POST" || method == "" {
+		return "", nil
+	}
+	for _, allowed := range MethodOverrideMethods {
+		if method == allowed {
+			return method, nil
+		}
+	}
+	apiErr := NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, "Can't override POST to "+method)
+	apiErr.Field = MethodOverrideHeader
+	return "", apiErr
+}
@@ -0,0 +1,32 @@
+package accounts
+
+import (
+	"net/http"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestOverrideMethod(c *C) {
+	req, err := http.NewRequest("POST", "/items/abc", nil)
+	c.Assert(err, IsNil)
+	method, apiErr := overrideMethod(req)
+	c.Assert(apiErr, IsNil)
+	c.Assert(method, Equals, "")
+
+	req.Header.Set(MethodOverrideHeader, "delete")
+	method, apiErr = overrideMethod(req)
+	c.Assert(apiErr, IsNil)
+	c.Assert(method, Equals, "DELETE")
+
+	req.Header.Set(MethodOverrideHeader, "GET")
+	_, apiErr = overrideMethod(req)
+	c.Assert(apiErr, NotNil)
+	c.Assert(apiErr.Code, Equals, http.StatusBadRequest)
+	c.Assert(apiErr.Field, Equals, MethodOverrideHeader)
+
+	// Only POST requests are overridden
+	req.Method = "GET"
+	req.Header.Set(MethodOverrideHeader, "DELETE")
+	method, apiErr = overrideMethod(req)
+	c.Assert(apiErr, IsNil)
+	c.Assert(method, Equals, "")
+}
@@ -0,0 +1,372 @@
+package accounts
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var (
+	// MetricsEnabled wraps each of the accounts routes with MetricsHandler, when set before InitRouter, InitServeMux, etc.
+	MetricsEnabled = false
+	// MetricsWindow is how long each window of aggregated metrics covers
+	MetricsWindow = time.Hour
+	// MetricsRetention is how far back FlushMetrics looks for windows still in memcache. Cron should run it more often than this
+	MetricsRetention = 24 * time.Hour
+	// MetricsLatencyBuckets are the upper bounds of the latency histogram buckets. Slower requests go in a final overflow bucket
+	MetricsLatencyBuckets = []time.Duration{
+		10 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		250 * time.Millisecond,
+		500 * time.Millisecond,
+		time.Second,
+		2500 * time.Millisecond,
+		5 * time.Second,
+		10 * time.Second,
+	}
+
+	// Accounts authenticated during requests being measured by MetricsHandler, by App Engine request ID
+	metricsAccounts   = map[string]string{}
+	metricsAccountsMu sync.Mutex
+	// Series this instance has already added to the current window's series list
+	knownSeries   = map[string]bool{}
+	knownWindow   time.Time
+	knownSeriesMu sync.Mutex
+)
+
+// RouteMetrics are the metrics for one route and account within a window, as stored by FlushMetrics
+type RouteMetrics struct {
+	Key            *datastore.Key `json:"-" datastore:"-"`
+	Window         time.Time      `json:"window"`
+	Route          string         `json:"route"`
+	Account        string         `json:"account"` // Slug of the account, empty for unauthenticated requests
+	Requests       int64          `json:"requests"`
+	ClientErrors   int64          `json:"clientErrors"` // 4xx responses
+	Errors         int64          `json:"errors"`       // 5xx responses
+	TotalLatency   time.Duration  `json:"totalLatency"`
+	LatencyBuckets []int64        `json:"latencyBuckets" datastore:",noindex"` // Requests in each of MetricsLatencyBuckets, then the overflow
+}
+
+// func ErrorRate returns the fraction of requests that failed with a 5xx response
+func (m *RouteMetrics) ErrorRate() float64 {
+	if m.Requests == 0 {
+		return 0
+	}
+	return float64(m.Errors) / float64(m.Requests)
+}
+
+// func MeanLatency returns the average time taken to respond
+func (m *RouteMetrics) MeanLatency() time.Duration {
+	if m.Requests == 0 {
+		return 0
+	}
+	return m.TotalLatency / time.Duration(m.Requests)
+}
+
+// metricsSeries identifies the counters for a route and account within a window
+type metricsSeries struct {
+	Route   string
+	Account string
+}
+
+func (s metricsSeries) key(window time.Time) string {
+	return fmt.Sprintf("accounts-metrics-%d-%x", window.Unix(), sha1.Sum([]byte(s.Route+"\x00"+s.Account)))
+}
+
+// counterKeys returns the memcache keys of the requests, client errors, errors and latency counters, then each latency bucket
+func (s metricsSeries) counterKeys(window time.Time) []string {
+	prefix := s.key(window)
+	keys := []string{prefix + "-requests", prefix + "-clientErrors", prefix + "-errors", prefix + "-latency"}
+	for i := 0; i <= len(MetricsLatencyBuckets); i++ {
+		keys = append(keys, prefix+"-bucket-"+strconv.Itoa(i))
+	}
+	return keys
+}
+
+func seriesListKey(window time.Time) string {
+	return fmt.Sprintf("accounts-metrics-%d-series", window.Unix())
+}
+
+// statusRecorder keeps the status code a handler responds with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// func MetricsHandler wraps a handler to count requests, errors and latency for route (a name for it, ie. "CreateAccount"),
+// broken down by the account each request authenticated as, if any. Counters are aggregated in memcache per MetricsWindow,
+// and stored in the datastore as RouteMetrics by FlushMetrics, which should be run by cron (see FlushMetricsHandler)
+// As with anything in memcache, counters may be evicted before they're flushed, so the figures are approximate
+func MetricsHandler(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		reqId := appengine.RequestID(ctx)
+		metricsAccountsMu.Lock()
+		metricsAccounts[reqId] = ""
+		metricsAccountsMu.Unlock()
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req)
+		metricsAccountsMu.Lock()
+		account := metricsAccounts[reqId]
+		delete(metricsAccounts, reqId)
+		metricsAccountsMu.Unlock()
+		recordMetrics(ctx, metricsSeries{Route: route, Account: account}, recorder.status, time.Since(start))
+	})
+}
+
+// func noteMetricsAccount records the account ctx's request authenticated as, if it's being measured by MetricsHandler
+func noteMetricsAccount(ctx context.Context, acct *Account) {
+	if acct == nil {
+		return
+	}
+	reqId := appengine.RequestID(ctx)
+	metricsAccountsMu.Lock()
+	defer metricsAccountsMu.Unlock()
+	if _, ok := metricsAccounts[reqId]; ok {
+		metricsAccounts[reqId] = acct.Slug
+	}
+}
+
+// func recordMetrics increments the counters of series in the current window for a request
+func recordMetrics(ctx context.Context, series metricsSeries, status int, latency time.Duration) {
+	window := time.Now().Truncate(MetricsWindow)
+	keys := series.counterKeys(window)
+	bucket := len(MetricsLatencyBuckets)
+	for i, limit := range MetricsLatencyBuckets {
+		if latency <= limit {
+			bucket = i
+			break
+		}
+	}
+	increments := map[string]int64{
+		keys[0]:        1,
+		keys[3]:        int64(latency / time.Millisecond),
+		keys[4+bucket]: 1,
+	}
+	if status >= 500 {
+		increments[keys[2]] = 1
+	} else if status >= 400 {
+		increments[keys[1]] = 1
+	}
+	for key, delta := range increments {
+		if _, err := memcache.Increment(ctx, key, delta, 0); err != nil {
+			warningf(ctx, "[accounts/MetricsHandler] %v", err.Error())
+			return
+		}
+	}
+	if err := addSeries(ctx, window, series); err != nil {
+		warningf(ctx, "[accounts/MetricsHandler] %v", err.Error())
+	}
+}
+
+// func addSeries adds series to the list of those with counters in window, so FlushMetrics can find them
+func addSeries(ctx context.Context, window time.Time, series metricsSeries) error {
+	seriesKey := series.key(window)
+	knownSeriesMu.Lock()
+	if !knownWindow.Equal(window) {
+		knownSeries, knownWindow = map[string]bool{}, window
+	}
+	known := knownSeries[seriesKey]
+	knownSeriesMu.Unlock()
+	if known {
+		return nil
+	}
+	listKey := seriesListKey(window)
+	// Retry a few times if another instance changes the list at the same time
+	for attempt := 0; attempt < 5; attempt++ {
+		var list []metricsSeries
+		item, err := memcache.Gob.Get(ctx, listKey, &list)
+		if err == memcache.ErrCacheMiss {
+			err = memcache.Gob.Add(ctx, &memcache.Item{Key: listKey, Object: []metricsSeries{series}})
+		} else if err == nil {
+			if !containsSeries(list, series) {
+				item.Object = append(list, series)
+				err = memcache.Gob.CompareAndSwap(ctx, item)
+			}
+		}
+		if err == memcache.ErrNotStored || err == memcache.ErrCASConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		knownSeriesMu.Lock()
+		if knownWindow.Equal(window) {
+			knownSeries[seriesKey] = true
+		}
+		knownSeriesMu.Unlock()
+		return nil
+	}
+	return memcache.ErrCASConflict
+}
+
+func containsSeries(list []metricsSeries, series metricsSeries) bool {
+	for _, existing := range list {
+		if existing == series {
+			return true
+		}
+	}
+	return false
+}
+
+// func FlushMetrics adds the counters aggregated in memcache by MetricsHandler (for windows within MetricsRetention)
+// to the RouteMetrics stored in the datastore, then subtracts what was stored from the counters, so
+// requests counted while it runs aren't lost and it's safe to run as often as needed
+func FlushMetrics(ctx context.Context) error {
+	current := time.Now().Truncate(MetricsWindow)
+	for window := current; !window.Before(current.Add(-MetricsRetention)); window = window.Add(-MetricsWindow) {
+		if err := flushWindow(ctx, window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flushWindow(ctx context.Context, window time.Time) error {
+	var list []metricsSeries
+	if _, err := memcache.Gob.Get(ctx, seriesListKey(window), &list); err == memcache.ErrCacheMiss {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var flushed []*RouteMetrics
+	var flushedKeys []*datastore.Key
+	counters := map[string]uint64{}
+	for _, series := range list {
+		keys := series.counterKeys(window)
+		items, err := memcache.GetMulti(ctx, keys)
+		if err != nil {
+			return err
+		}
+		values := make([]int64, len(keys))
+		for i, key := range keys {
+			if item, ok := items[key]; ok {
+				n, _ := strconv.ParseUint(string(item.Value), 10, 64)
+				values[i] = int64(n)
+				counters[key] = n
+			}
+		}
+		if values[0] == 0 {
+			continue
+		}
+		flushed = append(flushed, &RouteMetrics{
+			Window:         window,
+			Route:          series.Route,
+			Account:        series.Account,
+			Requests:       values[0],
+			ClientErrors:   values[1],
+			Errors:         values[2],
+			TotalLatency:   time.Duration(values[3]) * time.Millisecond,
+			LatencyBuckets: values[4:],
+		})
+		flushedKeys = append(flushedKeys, datastore.NewKey(ctx, "RouteMetrics", series.key(window), 0, nil))
+	}
+	if len(flushed) == 0 {
+		return nil
+	}
+	stored := make([]*RouteMetrics, len(flushed))
+	err := aeutils.GetMulti(ctx, flushedKeys, stored)
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, err := range me {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	objs := make([]interface{}, len(flushed))
+	for i, m := range flushed {
+		m.Key = flushedKeys[i]
+		if s := stored[i]; s != nil && s.Route != "" {
+			m.Requests += s.Requests
+			m.ClientErrors += s.ClientErrors
+			m.Errors += s.Errors
+			m.TotalLatency += s.TotalLatency
+			for j := range m.LatencyBuckets {
+				if j < len(s.LatencyBuckets) {
+					m.LatencyBuckets[j] += s.LatencyBuckets[j]
+				}
+			}
+		}
+		objs[i] = m
+	}
+	if _, err = aeutils.SaveMulti(ctx, objs); err != nil {
+		return err
+	}
+	for key, n := range counters {
+		if _, err := memcache.Increment(ctx, key, -int64(n), 0); err != nil && err != memcache.ErrCacheMiss {
+			warningf(ctx, "[accounts/FlushMetrics] %v", err.Error())
+		}
+	}
+	return nil
+}
+
+// func GetMetrics returns the stored RouteMetrics for windows since the given time, for a single account if account
+// (a slug) isn't empty. Filtering by account needs a composite index on Account and Window
+func GetMetrics(ctx context.Context, since time.Time, account string) ([]*RouteMetrics, error) {
+	q := aeutils.Query(&RouteMetrics{}).Filter("Window >=", since)
+	if account != "" {
+		q = q.Filter("Account =", account)
+	}
+	var metrics []*RouteMetrics
+	_, err := q.Order("Window").GetAll(ctx, &metrics)
+	return metrics, err
+}
+
+// func MetricsReportHandler responds with the RouteMetrics (see GetMetrics) since the "since" parameter (RFC 3339,
+// defaulting to the last day), for the "account" parameter if set. It isn't mounted with the accounts routes,
+// so should be added to the app's own routes with whatever access control operators need
+func MetricsReportHandler(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	since := time.Now().Add(-24 * time.Hour)
+	if s := req.FormValue("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			apiErr := NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			apiErr.Field = "since"
+			RespondTo(rw, req, apiErr)
+			return
+		}
+	}
+	metrics, err := GetMetrics(ctx, since, req.FormValue("account"))
+	if err != nil {
+		errorf(ctx, "[accounts/MetricsReportHandler] %v", err.Error())
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: metrics,
+	})
+}
+
+// func FlushMetricsHandler runs FlushMetrics, for a cron job
+//
+// 	- description: flush accounts metrics
+// 	  url: /tasks/flush-metrics
+// 	  schedule: every 15 minutes
+func FlushMetricsHandler(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	if err := FlushMetrics(ctx); err != nil {
+		errorf(ctx, "[accounts/FlushMetrics] %v", err.Error())
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,30 @@
+package accounts
+
+import (
+	"time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func (s *MySuite) TestMetrics(c *C) {
+	series := metricsSeries{Route: "TestRoute", Account: validAccount.Slug}
+	recordMetrics(ctx, series, 500, 20*time.Millisecond)
+	recordMetrics(ctx, series, 404, 20*time.Millisecond)
+	recordMetrics(ctx, series, 200, time.Minute)
+	c.Assert(FlushMetrics(ctx), IsNil)
+	// Flushing again doesn't count anything twice
+	c.Assert(FlushMetrics(ctx), IsNil)
+
+	window := time.Now().Truncate(MetricsWindow)
+	metrics := &RouteMetrics{}
+	c.Assert(aeutils.GetByKey(ctx, datastore.NewKey(ctx, "RouteMetrics", series.key(window), 0, nil), metrics), IsNil)
+	c.Assert(metrics.Account, Equals, validAccount.Slug)
+	c.Assert(metrics.Requests, Equals, int64(3))
+	c.Assert(metrics.Errors, Equals, int64(1))
+	c.Assert(metrics.ClientErrors, Equals, int64(1))
+	c.Assert(metrics.LatencyBuckets[1], Equals, int64(2))
+	c.Assert(metrics.LatencyBuckets[len(MetricsLatencyBuckets)], Equals, int64(1))
+}
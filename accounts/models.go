@@ -3,28 +3,30 @@ package accounts
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"sync"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
-
 	"github.com/mrvdot/appengine/aeutils"
-	"github.com/qedus/nds"
 
-	"appengine"
-	"appengine/datastore"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 )
 
 var (
 	authenticatedAccounts = map[string]*Account{}
 	authenticatedSessions = map[string]*Session{}
 	authenticatedUsers    = map[string]*User{}
-	sessionToAccount      = map[*Session]*Account{}
-	sessionToUser         = map[*Session]*User{}
-	sessions              = map[string]*Session{}
+	// Sessions held in memory by this instance, with the user each is for. Guarded by sessionsMu
+	sessionToUser = map[*Session]*User{}
+	sessions      = map[string]*Session{}
+	sessionsMu    sync.RWMutex
 	// Unauthenticated is returned when a request was not successfully authenticated
 	Unauthenticated = errors.New("No account has been authenticated for this request")
 	// NoSuchSession is returned when the session key passed does not correspond to an active session
@@ -33,11 +35,14 @@ var (
 	NoSuchAccount = errors.New("No account matches that slug")
 	// InvalidApiKey is returned when the specified ApiKey does not match account
 	InvalidApiKey = errors.New("API Key does not match account")
+	// AccountDeactivated is returned when the account authenticating has been deactivated by an admin
+	AccountDeactivated = errors.New("This account has been deactivated")
 	// SessionExpired is returned when the specified session has not been used within Session.TTL
 	SessionExpired = errors.New("Session has expired, please reauthenticate")
 	// Invalid password means the password specified for a username doesn't match what we have stored
 	InvalidPassword = errors.New("That password is not valid for this user")
 	// Headers is a string map to header names used for checking account info in request headers
+	// Each can be overridden with a config value (see ConfigHeaderPrefix)
 	Headers = map[string]string{
 		"account":  "X-account",  // Account slug
 		"key":      "X-key",      // Account key
@@ -46,18 +51,42 @@ var (
 		"password": "X-password", // Password (for auth by user)
 	}
 	// SessionTTL is a time.Duration for how long a session should remain valid since LastUsed
+	// It can be overridden with a config value (see ConfigSessionTTL)
 	SessionTTL = time.Duration(3 * time.Hour)
+	// RotateSessionOnRefresh gives a session a new key each time it's refreshed through the RefreshSession route,
+	// so the old key stops working
+	RotateSessionOnRefresh = false
+)
+
+// Roles a User can have within its account
+const (
+	RoleAdmin  = "admin"  // Can manage the account's users
+	RoleMember = "member" // Can only update their own user
+)
+
+// Compile time checks that models implement the aeutils hooks and datastore interfaces they rely on
+var (
+	_ aeutils.BeforeSaver         = &User{}
+	_ datastore.PropertyLoadSaver = &User{}
+	_ aeutils.KeyGetter           = &User{}
+	_ aeutils.KeyGetter           = &Account{}
+	_ aeutils.AfterLoader         = &Account{}
 )
 
 //type Account holds the basic information for an attached account
 type Account struct {
 	Key     *datastore.Key `json:"-" datastore:"-"` //Locally cached key
 	ID      string         `json:"id"`
-	Created time.Time      `json:"created"` //When account was first created
-	Name    string         `json:"name"`    //Name of account
-	Slug    string         `json:"slug"`    //Unique slug
-	ApiKey  string         `json:"apikey"`  //Generated API Key for this account // TODO - encrypt this
-	Active  bool           `json:"active"`  //True if this account is active
+	Created time.Time      `json:"created" aetime:"created"` //When account was first created
+	Name    string         `json:"name"`                     //Name of account
+	Slug    string         `json:"slug" aekey:"name"`        //Unique slug, also used as the key name
+	ApiKey  string         `json:"apikey"`                   //Generated API Key for this account // TODO - encrypt this
+	Active  bool           `json:"active"`                   //True if this account is active
+	// When an admin deactivated the account (see DeactivateAccount), after which it can't authenticate
+	Deactivated time.Time `json:"deactivated"`
+	// Language responses to the account are translated to (see RegisterMessages), ie. "fr". If empty, it's negotiated
+	// from each request's Accept-Language header
+	Locale string `json:"locale,omitempty"`
 }
 
 type Session struct {
@@ -69,34 +98,34 @@ type Session struct {
 	TTL         time.Duration  `json:"ttl"`         //How long should this session be valid after LastUsed
 }
 
+// Expires returns when the session stops being valid, if it isn't used again before then
+func (s *Session) Expires() time.Time {
+	return s.LastUsed.Add(s.TTL)
+}
+
 type User struct {
-	Key               *datastore.Key `json:"-" datastore:"-"`
-	ID                int64          `json:"id"`
-	Created           time.Time      `json:"created"`
-	LastLogin         time.Time      `json:"lastLogin"`
-	Username          string         `json:"username"`
-	Email             string         `json:"email"`
-	Password          string         `json:"password" datastore:"-"`
-	EncryptedPassword []byte         `json:"-"`
-	FirstName         string         `json:"firstName"`
-	LastName          string         `json:"lastName"`
-	AccountKey        *datastore.Key `json:"-"`
+	Key               *datastore.Key    `json:"-" datastore:"-"`
+	ID                int64             `json:"id"`
+	Created           time.Time         `json:"created" aetime:"created"`
+	LastLogin         time.Time         `json:"lastLogin"`
+	Username          string            `json:"username" aeunique:"scope=AccountKey"`
+	Email             string            `json:"email"`
+	Password          string            `json:"password" datastore:"-"`
+	EncryptedPassword []byte            `json:"-" encrypted:"true"` //Plaintext while in memory, encrypted when stored
+	FirstName         string            `json:"firstName"`
+	LastName          string            `json:"lastName"`
+	AvatarURL         string            `json:"avatarUrl"` //Gravatar for Email unless an avatar has been uploaded
+	AvatarBlobKey     appengine.BlobKey `json:"-"`
+	Role              string            `json:"role"` //RoleAdmin or RoleMember (the default) within its account
+	AccountKey        *datastore.Key    `json:"-"`
 	account           *Account
 }
 
-// TODO - validate uniqueness for username
-// TODO - Move to PropertyLoadSaver for encryption/decryption
-// TODO - Utilize MarshalJSON to remove password
-func (u *User) BeforeSave(ctx appengine.Context) {
+func (u *User) BeforeSave(ctx context.Context) error {
 	if u.Password != "" {
-		pw := u.Password
+		// Encrypted when saved, see User.Save
+		u.EncryptedPassword = []byte(u.Password)
 		u.Password = ""
-		encrypted, err := encrypt([]byte(pw))
-		if err != nil {
-			ctx.Errorf("Error encoding password: %v", err.Error())
-			return
-		}
-		u.EncryptedPassword = encrypted
 	}
 	if u.Username == "" {
 		if u.Email != "" {
@@ -109,12 +138,53 @@ func (u *User) BeforeSave(ctx appengine.Context) {
 	if acct, _ := GetAccount(ctx); acct != nil {
 		u.AccountKey = acct.Key
 	}
-	if u.Created.IsZero() {
-		u.Created = time.Now()
+	if u.AvatarBlobKey == "" && u.Email != "" {
+		u.AvatarURL = GravatarURL(u.Email, AvatarSize)
 	}
+	if u.Role == "" {
+		u.Role = RoleMember
+	}
+	return nil
 }
 
-func (u *User) GetKey(ctx appengine.Context) (key *datastore.Key) {
+// MarshalJSON implements json.Marshaler, leaving out the password so it's never sent back to clients, and sending
+// the ID as its public ID (see aeutils.PublicID) so clients can't enumerate users. Until a public ID secret is set
+// (see LoadPublicIDSecret), the numeric ID is sent instead
+func (u *User) MarshalJSON() ([]byte, error) {
+	type user User
+	var id interface{}
+	if u.ID != 0 {
+		public, err := aeutils.EncodePublicID("User", u.ID)
+		if err == aeutils.ErrNoPublicIDs {
+			id = u.ID
+		} else if err != nil {
+			return nil, err
+		} else {
+			id = public
+		}
+	}
+	return json.Marshal(struct {
+		*user
+		ID       interface{} `json:"id,omitempty"`
+		Password string      `json:"password,omitempty"`
+	}{user: (*user)(u), ID: id})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, ignoring any "id" sent, as users are identified by the request path
+func (u *User) UnmarshalJSON(data []byte) error {
+	type user User
+	return json.Unmarshal(data, &struct {
+		*user
+		ID json.RawMessage `json:"id"`
+	}{user: (*user)(u)})
+}
+
+// IsAdmin returns whether u can manage the users of its account
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+func (u *User) GetKey(ctx context.Context) (key *datastore.Key) {
 	if u.Key != nil {
 		key = u.Key
 	} else if u.ID == 0 {
@@ -126,37 +196,34 @@ func (u *User) GetKey(ctx appengine.Context) (key *datastore.Key) {
 	return
 }
 
+// Load implements datastore.PropertyLoadSaver, decrypting the stored password
+func (u *User) Load(props []datastore.Property) error {
+	return LoadEncrypted(u, props)
+}
+
+// Save implements datastore.PropertyLoadSaver, encrypting the password
+func (u *User) Save() ([]datastore.Property, error) {
+	return SaveEncrypted(u)
+}
+
 func (u *User) validatePassword(password string) bool {
-	decrypted, err := decrypt(u.EncryptedPassword)
-	if err != nil {
-		return false
-	}
-	return bytes.Equal([]byte(password), decrypted)
+	return len(u.EncryptedPassword) > 0 && bytes.Equal([]byte(password), u.EncryptedPassword)
 }
 
-func (u *User) Account(ctx appengine.Context) *Account {
-	if u.AccountKey == nil {
+func (u *User) Account(ctx context.Context) *Account {
+	acct, err := aeutils.LoadRelated(ctx, u, "Account")
+	if err != nil {
+		errorf(ctx, "Error retrieving account for user: %v", err.Error())
 		return nil
 	}
-	if u.account == nil {
-		acct := &Account{}
-		var err error
-		if aeutils.UseNDS {
-			err = nds.Get(ctx, u.AccountKey, acct)
-		} else {
-			err = datastore.Get(ctx, u.AccountKey, acct)
-		}
-		if err != nil {
-			ctx.Errorf("Error retrieving account for user: %v", err.Error())
-			return nil
-		}
-		u.account = acct
+	if acct == nil {
+		return nil
 	}
-	return u.account
+	return acct.(*Account)
 }
 
 // Validate a username and password, returning the appropriate user object is one is found
-func AuthenticateUser(ctx appengine.Context, username, password string) (*User, error) {
+func AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
 	u := &User{
 		Username: username,
 		Password: password,
@@ -169,22 +236,20 @@ func AuthenticateUser(ctx appengine.Context, username, password string) (*User,
 }
 
 // Authenticate a user based on the current values for username and password
-func (u *User) Authenticate(ctx appengine.Context) error {
-	query := datastore.NewQuery("User").
-		Filter("Username =", u.Username).
-		Limit(1)
+func (u *User) Authenticate(ctx context.Context) error {
+	query := aeutils.Query(&User{}).
+		Filter("Username =", u.Username)
 
 	// We only check account if it's already set, so don't worry about an error
 	acct, _ := GetAccount(ctx)
 	if acct != nil {
-		query.Filter("Account =", acct.Key)
+		query = query.Filter("AccountKey =", acct.Key)
 	}
-	iter := query.Run(ctx)
 
-	_, err := iter.Next(u)
+	_, err := query.First(ctx, u)
 	if err != nil {
-		if err != datastore.Done {
-			ctx.Errorf("Error loading user: %v", err.Error())
+		if err != datastore.ErrNoSuchEntity {
+			errorf(ctx, "Error loading user: %v", err.Error())
 		}
 		// If it's just a mismatch, keep going, likely just changed structure
 		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
@@ -202,7 +267,7 @@ func (u *User) Authenticate(ctx appengine.Context) error {
 
 // func GetKey returns the datastore key for an account
 // [TODO] - Want to migrate this to use ID's for key, not slug
-func (acct *Account) GetKey(ctx appengine.Context) (key *datastore.Key) {
+func (acct *Account) GetKey(ctx context.Context) (key *datastore.Key) {
 	if acct.Key != nil {
 		key = acct.Key
 	} else {
@@ -213,8 +278,8 @@ func (acct *Account) GetKey(ctx appengine.Context) (key *datastore.Key) {
 }
 
 // func BeforeSave is called as part of aeutils.Save prior to storing in the datastore
-// serves to set a default account name and slug, as well as ApiKey and Created timestamp
-func (acct *Account) BeforeSave(ctx appengine.Context) {
+// serves to set a default account name and slug, as well as ApiKey (Created is set by aeutils)
+func (acct *Account) BeforeSave(ctx context.Context) {
 	if acct.ID == "" {
 		acct.ID = uuid.New()
 	}
@@ -223,29 +288,32 @@ func (acct *Account) BeforeSave(ctx appengine.Context) {
 	}
 	if acct.Slug == "" {
 		acct.Slug = aeutils.GenerateUniqueSlug(ctx, "Account", acct.Name)
-		acct.Created = time.Now()
 		h := md5.New()
 		io.WriteString(h, uuid.New())
 		apiKeyBytes := h.Sum(nil)
 		acct.ApiKey = fmt.Sprintf("%x", apiKeyBytes)
 	}
-	if acct.Key == nil {
-		acct.GetKey(ctx)
-	}
 }
 
-// func Load initializes an account with any necessary calculated values
-func (acct *Account) Load(ctx appengine.Context) {
+// func AfterLoad is called by aeutils after an account is fetched from the datastore
+// and initializes it with any necessary calculated values
+func (acct *Account) AfterLoad(ctx context.Context) {
 	acct.GetKey(ctx)
 }
 
-func (acct *Account) Session(ctx appengine.Context) *Session {
+// func Load initializes an account with any necessary calculated values
+// Deprecated: AfterLoad is now called automatically when fetching via aeutils
+func (acct *Account) Load(ctx context.Context) {
+	acct.AfterLoad(ctx)
+}
+
+func (acct *Account) Session(ctx context.Context) *Session {
 	if session, err := GetSession(ctx); err == nil {
 		return session
 	}
 	session, err := createSession(ctx, acct, nil)
 	if err != nil {
-		ctx.Errorf("Error creating session: %v", err.Error())
+		errorf(ctx, "Error creating session: %v", err.Error())
 		return nil
 	}
 	return session
@@ -0,0 +1,167 @@
+//go:build !nomux
+// +build !nomux
+
+package accounts
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mrvdot/golang-utils"
+)
+
+// Routing with gorilla/mux. Build with the nomux tag to leave this (and the dependency) out, and use InitServeMux instead
+var (
+	// Router instance for accounts, made public to allow for adding additional routes
+	Router *mux.Router
+	// Router instances for each version mounted with InitVersionedRouter, by version
+	VersionRouters = map[string]*mux.Router{}
+)
+
+func init() {
+	listRoutes = routerRoutes
+}
+
+// func InitRouter attaches two routes "new" and "authenticate" to a subpath
+// to the http handler
+// If an empty string is passed for the subpath, the default SubrouterPath is used
+func InitRouter(subpath string) {
+	Router = initRouter("", subpath)
+}
+
+// func InitVersionedRouter attaches the same routes as InitRouter under a version prefix, ie. /v1/accounts
+// It may be called once for each version, so several can be mounted at once while clients migrate between them
+// Handlers can check which version a request came through with APIVersion
+func InitVersionedRouter(version, subpath string) {
+	VersionRouters[version] = initRouter(version, subpath)
+}
+
+// func APIVersion returns the version prefix req was routed through (see InitVersionedRouter),
+// or an empty string if it came through InitRouter's unversioned routes
+func APIVersion(req *http.Request) string {
+	return mux.Vars(req)["version"]
+}
+
+// func AttachRoutes adds the accounts routes to an existing router under a subpath, for apps that already
+// have their own router (and middleware) rather than using InitRouter. Nothing is attached to the http handler,
+// and the routes aren't wrapped with utils.CorsHandler, RequestIDHandler, RecoveryHandler or MethodOverrideHandler, so that's left to the app
+// If an empty string is passed for the subpath, the default SubrouterPath is used
+func AttachRoutes(r *mux.Router, subpath string) {
+	addRoutes(r.PathPrefix(fmt.Sprintf("/%v", routerPath(subpath))).Subrouter())
+}
+
+// func initRouter creates a router with the accounts routes under subpath (and version if it's not empty),
+// and attaches it to the http handler
+func initRouter(version, subpath string) *mux.Router {
+	subpath = routerPath(subpath)
+	prefix := fmt.Sprintf("/%v", subpath)
+	if version != "" {
+		prefix = fmt.Sprintf("/{version:%v}%v", regexp.QuoteMeta(version), prefix)
+	}
+	router := mux.NewRouter()
+	addRoutes(router.PathPrefix(prefix).Subrouter())
+	if version != "" {
+		http.Handle(fmt.Sprintf("/%v/%v/", version, subpath), utils.CorsHandler(RequestIDHandler(RecoveryHandler(MethodOverrideHandler(router)))))
+	} else {
+		http.Handle(fmt.Sprintf("/%v/", subpath), utils.CorsHandler(RequestIDHandler(RecoveryHandler(MethodOverrideHandler(router)))))
+	}
+	return router
+}
+
+// func addRoutes adds the accounts routes to ar
+func addRoutes(ar *mux.Router) {
+	for _, rt := range routes {
+		ar.Handle(rt.path, rt.serve()).
+			Methods(rt.method).
+			Name(rt.name)
+	}
+	paths, methods := routeMethods()
+	for _, path := range paths {
+		ar.Handle(path, preflightHandler(strings.Join(methods[path], ", "))).
+			Methods("OPTIONS")
+	}
+}
+
+// func RegisterResource adds authenticated CRUD routes for model (a struct or pointer to struct) to r at path (ie. "/items"):
+//
+// * GET path lists entities, taking "limit" (up to ResourceLimit) and "offset" parameters
+// * POST path creates one from the JSON body
+// * GET path/{id} gets one, PUT replaces fields from the JSON body, PATCH applies a JSON merge patch
+//   (see aeutils.ApplyMergePatch) and DELETE deletes it (see aeutils.Delete)
+//
+// Entities are stored in the namespace of the authenticated account (see GetContext), and identified by the public ID
+// of their key (see aeutils.PublicID and LoadPublicIDSecret), or the encoded key if it's named (or no public ID secret
+// is set), which is returned in the Data of each response as "id" (or "ids" for lists)
+// As with AttachRoutes, the routes aren't wrapped with utils.CorsHandler, RequestIDHandler, RecoveryHandler or MethodOverrideHandler
+func RegisterResource(r *mux.Router, path string, model interface{}) {
+	path = resourcePath(path)
+	rs := newResource(path, model)
+	r.Handle(path, AuthenticatedHandler(http.HandlerFunc(rs.serveCollection))).
+		Methods("GET", "POST").
+		Name(resourceRoutePrefix + path)
+	r.Handle(path, preflightHandler("GET, POST")).
+		Methods("OPTIONS")
+	r.Handle(path+"/{id}", AuthenticatedHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rs.serveItem(rw, req, mux.Vars(req)["id"])
+	}))).
+		Methods("GET", "PUT", "PATCH", "DELETE").
+		Name(resourceRoutePrefix + path + "/{id}")
+	r.Handle(path+"/{id}", preflightHandler("GET, PUT, PATCH, DELETE")).
+		Methods("OPTIONS")
+}
+
+// func MuxRoutes walks r, describing each of its routes (including those of subrouters) for RoutesHandler,
+// for apps that mount the accounts routes on their own router. CORS preflight routes are left out
+func MuxRoutes(r *mux.Router) ([]RouteInfo, error) {
+	var infos []RouteInfo
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			// A path prefix for a subrouter, its routes are walked next
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		if len(methods) == 1 && methods[0] == "OPTIONS" {
+			return nil
+		}
+		infos = append(infos, newRouteInfo(route.GetName(), path, methods))
+		return nil
+	})
+	return infos, err
+}
+
+// func routerRoutes describes the routes of Router, then of each of VersionRouters by version, or if none have been
+// initialized, the routes as InitServeMux mounts them
+func routerRoutes() ([]RouteInfo, error) {
+	if Router == nil && len(VersionRouters) == 0 {
+		return routeTable(), nil
+	}
+	var infos []RouteInfo
+	if Router != nil {
+		routerInfos, err := MuxRoutes(Router)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, routerInfos...)
+	}
+	versions := make([]string, 0, len(VersionRouters))
+	for version := range VersionRouters {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	for _, version := range versions {
+		versionInfos, err := MuxRoutes(VersionRouters[version])
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, versionInfos...)
+	}
+	return infos, nil
+}
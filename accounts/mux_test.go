@@ -0,0 +1,58 @@
+//go:build !nomux
+// +build !nomux
+
+package accounts
+
+import (
+	"net/http"
+	. "gopkg.in/check.v1"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *MySuite) TestVersionedRouter(c *C) {
+	InitVersionedRouter("v1", "")
+	InitVersionedRouter("v2", "")
+
+	req, err := http.NewRequest("POST", "/v2/accounts/new", nil)
+	c.Assert(err, IsNil)
+	var match mux.RouteMatch
+	c.Assert(VersionRouters["v2"].Match(req, &match), Equals, true)
+	c.Assert(match.Route.GetName(), Equals, "CreateAccount")
+	c.Assert(match.Vars["version"], Equals, "v2")
+	c.Assert(VersionRouters["v1"].Match(req, &match), Equals, false)
+}
+
+func (s *MySuite) TestAttachRoutes(c *C) {
+	r := mux.NewRouter()
+	r.HandleFunc("/other", func(rw http.ResponseWriter, req *http.Request) {})
+	AttachRoutes(r, "")
+
+	req, err := http.NewRequest("POST", "/accounts/authenticate", nil)
+	c.Assert(err, IsNil)
+	var match mux.RouteMatch
+	c.Assert(r.Match(req, &match), Equals, true)
+	c.Assert(match.Route.GetName(), Equals, "Authenticate")
+}
+
+func (s *MySuite) TestMuxRoutes(c *C) {
+	r := mux.NewRouter()
+	AttachRoutes(r, "")
+	RegisterResource(r, "/routed-items", &Account{})
+
+	infos, err := MuxRoutes(r)
+	c.Assert(err, IsNil)
+	byName := map[string]RouteInfo{}
+	for _, info := range infos {
+		c.Assert(info.Methods, Not(DeepEquals), []string{"OPTIONS"})
+		byName[info.Name] = info
+	}
+	c.Assert(byName["Authenticate"].Path, Equals, "/accounts/authenticate")
+	c.Assert(byName["Authenticate"].Methods, DeepEquals, []string{"POST"})
+	c.Assert(byName["Authenticate"].Auth, Equals, true)
+	c.Assert(byName["CreateAccount"].Auth, Equals, false)
+	item := byName[resourceRoutePrefix+"/routed-items/{id}"]
+	c.Assert(item.Path, Equals, "/routed-items/{id}")
+	c.Assert(item.Methods, DeepEquals, []string{"GET", "PUT", "PATCH", "DELETE"})
+	c.Assert(item.Auth, Equals, true)
+}
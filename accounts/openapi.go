@@ -0,0 +1,393 @@
+package accounts
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// OpenAPITitle and OpenAPIVersion are the title and version given in the info of the OpenAPI document
+	OpenAPITitle   = "Accounts API"
+	OpenAPIVersion = "1.0.0"
+
+	// What each route expects and responds with, by route name, for the OpenAPI document
+	routeDocs = map[string]routeDoc{
+		"CreateAccount": {
+			summary: "Create a new account, from an account name or a JSON Account",
+			request: &Account{},
+			form:    []string{"account"},
+			result:  &Account{},
+		},
+		"Authenticate": {
+			summary: "Authenticate by account key, username and password or session, starting a session",
+			auth:    true,
+			data:    []string{"session"},
+		},
+		"RefreshSession": {
+			summary: "Extend the current session, rotating its key if the app is configured to, and send it with its new expiry",
+			auth:    true,
+			result:  &Session{},
+			data:    []string{"session", "expires"},
+		},
+		"ListUsers": {
+			summary: "List the users of the current account, taking optional limit and offset parameters",
+			auth:    true,
+			result:  []*User{},
+		},
+		"CreateUser": {
+			summary: "Add a user to the current account, for account admins",
+			auth:    true,
+			request: &User{},
+			result:  &User{},
+		},
+		"GetUser": {
+			summary: "Get a user of the current account",
+			auth:    true,
+			result:  &User{},
+		},
+		"UpdateUser": {
+			summary: "Update a user of the current account, for account admins or the user themselves",
+			auth:    true,
+			request: &User{},
+			result:  &User{},
+		},
+		"DeleteUser": {
+			summary: "Delete a user of the current account, for account admins",
+			auth:    true,
+			result:  &User{},
+		},
+		"AvatarUploadURL": {
+			summary: "Get a one-time URL to upload the current user's avatar to",
+			auth:    true,
+			data:    []string{"uploadUrl"},
+		},
+		"UploadAvatar": {
+			summary:   "Store the uploaded avatar file on the current user",
+			auth:      true,
+			form:      []string{"avatar"},
+			multipart: true,
+			result:    &User{},
+		},
+		"AttachmentUploadURL": {
+			summary: "Get a one-time URL to upload attachments to, as multipart form files",
+			auth:    true,
+			data:    []string{"uploadUrl"},
+		},
+		"UploadAttachments": {
+			summary:   "Record the files uploaded to an attachment upload URL",
+			auth:      true,
+			form:      []string{"file"},
+			multipart: true,
+			result:    []*Attachment{},
+		},
+		"GetAttachment": {
+			summary: "Download the file of an attachment",
+			auth:    true,
+			params:  []string{"id"},
+		},
+		"Batch": {
+			summary: "Run several requests against the resources added with RegisterResource, responding to each in Result",
+			auth:    true,
+			request: []BatchRequest{},
+		},
+		"Cleanup": {
+			summary: "Remove expired sessions, for App Engine cron",
+			data:    []string{"sessions"},
+		},
+		"AdminListAccounts": {
+			summary: "List accounts by slug, for admins of the app",
+			params:  []string{"q", "limit", "offset"},
+			result:  []*Account{},
+		},
+		"AdminGetAccount": {
+			summary: "Get an account by slug, with its users and the sessions held by this instance, for admins of the app",
+			result:  &Account{},
+		},
+		"AdminUpdateAccount": {
+			summary: "Deactivate (or reactivate) an account, for admins of the app",
+			request: &struct {
+				Active bool `json:"active"`
+			}{},
+			result: &Account{},
+		},
+		"AdminListUsers": {
+			summary: "List users by username, for admins of the app",
+			params:  []string{"account", "q", "limit", "offset"},
+			result:  []*User{},
+		},
+		"AdminListSessions": {
+			summary: "List the sessions held by this instance, for admins of the app",
+			params:  []string{"account"},
+			result:  []*AdminSession{},
+		},
+		"AdminListJobs": {
+			summary: "List the maintenance jobs that can be run, for admins of the app",
+			result:  []string{},
+		},
+		"AdminRunJob": {
+			summary: "Run a maintenance job, for admins of the app",
+		},
+		"Routes": {
+			summary: "List every registered route, for admins of the app",
+			result:  []RouteInfo{},
+		},
+		"OpenAPI": {
+			summary: "This OpenAPI document",
+		},
+	}
+
+	// Types with their own schema, rather than the schema of their fields
+	timeType = reflect.TypeOf(time.Time{})
+	keyType  = reflect.TypeOf(&datastore.Key{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+func init() {
+	// Added here rather than in the routes table, as OpenAPIHandler reads the table
+	routes = append(routes, route{"OpenAPI", "GET", "/openapi.json", OpenAPIHandler})
+}
+
+// routeDoc describes the request and response of a route, beyond what's in the routes table
+type routeDoc struct {
+	summary   string
+	auth      bool        // Requires the authentication headers (see Headers)
+	params    []string    // Query parameters, if any
+	request   interface{} // JSON request body, if any
+	form      []string    // Form fields, if the request can be sent as a form
+	multipart bool        // Form fields are files, sent as multipart/form-data
+	result    interface{} // Result of the response, if any
+	data      []string    // String fields of the response's Data, if any
+}
+
+// func OpenAPI returns an OpenAPI (3.0) document describing the accounts routes, as mounted at basePath (ie. "/accounts")
+// Request and response schemas are derived from the json tags of the structs they're encoded from
+func OpenAPI(basePath string) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorSchema := openAPISchema(schemas, reflect.TypeOf(ApiError{}))
+	securitySchemes := map[string]interface{}{}
+	for name, header := range Headers {
+		securitySchemes[name] = map[string]interface{}{
+			"type": "apiKey",
+			"in":   "header",
+			"name": header,
+		}
+	}
+	// Any one of these combinations of headers authenticates a request (see AuthenticateRequest)
+	security := []interface{}{
+		map[string]interface{}{"account": []string{}, "key": []string{}},
+		map[string]interface{}{"username": []string{}, "password": []string{}},
+		map[string]interface{}{"session": []string{}},
+	}
+
+	paths := map[string]interface{}{}
+	for _, rt := range routes {
+		doc := routeDocs[rt.name]
+		response := map[string]interface{}{
+			"code":    map[string]interface{}{"type": "integer"},
+			"message": map[string]interface{}{"type": "string"},
+		}
+		if doc.result != nil {
+			response["result"] = openAPISchema(schemas, reflect.TypeOf(doc.result))
+		}
+		if len(doc.data) > 0 {
+			response["data"] = openAPIObject(doc.data, "string")
+		}
+		operation := map[string]interface{}{
+			"operationId": rt.name,
+			"summary":     doc.summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Success",
+					"content": map[string]interface{}{
+						MediaTypeJSON: map[string]interface{}{
+							"schema": map[string]interface{}{"type": "object", "properties": response},
+						},
+					},
+				},
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						MediaTypeJSON: map[string]interface{}{"schema": errorSchema},
+					},
+				},
+			},
+		}
+		if doc.auth {
+			operation["security"] = security
+		}
+		var parameters []interface{}
+		for _, segment := range strings.Split(rt.path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				parameters = append(parameters, openAPIParameter(strings.Trim(segment, "{}"), "path"))
+			}
+		}
+		for _, param := range doc.params {
+			parameters = append(parameters, openAPIParameter(param, "query"))
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		content := map[string]interface{}{}
+		if doc.request != nil {
+			content[MediaTypeJSON] = map[string]interface{}{"schema": openAPISchema(schemas, reflect.TypeOf(doc.request))}
+		}
+		if doc.multipart {
+			content["multipart/form-data"] = map[string]interface{}{"schema": openAPIObject(doc.form, "binary")}
+		} else if len(doc.form) > 0 {
+			content["application/x-www-form-urlencoded"] = map[string]interface{}{"schema": openAPIObject(doc.form, "")}
+		}
+		if len(content) > 0 {
+			operation["requestBody"] = map[string]interface{}{"content": content}
+		}
+		path, ok := paths[rt.path].(map[string]interface{})
+		if !ok {
+			path = map[string]interface{}{}
+			paths[rt.path] = path
+		}
+		path[strings.ToLower(rt.method)] = operation
+	}
+	// Users are sent with their public ID rather than the numeric one (see User.MarshalJSON)
+	if user, ok := schemas["User"].(map[string]interface{}); ok {
+		user["properties"].(map[string]interface{})["id"] = map[string]interface{}{"type": "string"}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   OpenAPITitle,
+			"version": OpenAPIVersion,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": basePath},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":         schemas,
+			"securitySchemes": securitySchemes,
+		},
+	}
+}
+
+// func OpenAPIHandler responds with the OpenAPI document for the accounts routes, wherever they're mounted
+func OpenAPIHandler(rw http.ResponseWriter, req *http.Request) {
+	body, err := json.MarshalIndent(OpenAPI(strings.TrimSuffix(req.URL.Path, "/openapi.json")), "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", MediaTypeJSON)
+	rw.Write(body)
+}
+
+// func openAPIParameter returns a required string parameter, in the path or query
+func openAPIParameter(name, in string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     name,
+		"in":       in,
+		"required": true,
+		"schema":   map[string]interface{}{"type": "string"},
+	}
+}
+
+// func openAPIObject returns the schema of an object with a string property for each field, in the given format
+func openAPIObject(fields []string, format string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for _, field := range fields {
+		property := map[string]interface{}{"type": "string"}
+		if format != "" {
+			property["format"] = format
+		}
+		properties[field] = property
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// func openAPISchema returns the schema of t as encoded by encoding/json. Named structs are added to schemas
+// and referenced by name
+func openAPISchema(schemas map[string]interface{}, t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr && t != keyType {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == keyType:
+		return map[string]interface{}{"type": "string"}
+	case t == rawType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": openAPISchema(schemas, t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openAPISchema(schemas, t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return openAPIStruct(schemas, t)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Placeholder, so structs that refer to themselves don't recurse forever
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = openAPIStruct(schemas, t)
+		}
+		return ref
+	}
+	// Any value, ie. interface{}
+	return map[string]interface{}{}
+}
+
+// func openAPIStruct returns the schema of the exported fields of struct t, flattening embedded structs as encoding/json does
+func openAPIStruct(schemas map[string]interface{}, t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	openAPIFields(schemas, t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func openAPIFields(schemas map[string]interface{}, t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := tag
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name = tag[:comma]
+		}
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				openAPIFields(schemas, embedded, properties)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = openAPISchema(schemas, field.Type)
+	}
+}
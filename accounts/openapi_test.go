@@ -0,0 +1,29 @@
+package accounts
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestOpenAPI(c *C) {
+	doc := OpenAPI("/accounts")
+	_, err := json.Marshal(doc)
+	c.Assert(err, IsNil)
+
+	paths := doc["paths"].(map[string]interface{})
+	for _, rt := range routes {
+		c.Assert(paths[rt.path], NotNil)
+	}
+	authenticate := paths["/authenticate"].(map[string]interface{})["post"].(map[string]interface{})
+	c.Assert(authenticate["operationId"], Equals, "Authenticate")
+	c.Assert(authenticate["security"], NotNil)
+
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	account := schemas["Account"].(map[string]interface{})["properties"].(map[string]interface{})
+	c.Assert(account["slug"], DeepEquals, map[string]interface{}{"type": "string"})
+	c.Assert(account["created"], DeepEquals, map[string]interface{}{"type": "string", "format": "date-time"})
+	c.Assert(account["Key"], IsNil)
+	apiError := schemas["ApiError"].(map[string]interface{})["properties"].(map[string]interface{})
+	c.Assert(apiError["errorCode"], NotNil)
+	c.Assert(apiError["code"], NotNil)
+}
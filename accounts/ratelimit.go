@@ -0,0 +1,131 @@
+package accounts
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// RateLimitKeyFunc returns the client a request counts against for rate limiting. An empty string falls back to RateLimitByIP
+type RateLimitKeyFunc func(ctx context.Context, req *http.Request) string
+
+// RateLimiter limits each client to Limit requests per Window, using memcache counters shared by all instances
+// Windows are fixed (ie. a limit of 100 per minute allows 100 requests between 12:00 and 12:01), and as counters
+// may be evicted from memcache at any time the limit is approximate. If memcache fails, requests are let through
+type RateLimiter struct {
+	Limit  int64
+	Window time.Duration
+	// Key picks the client requests are counted against, RateLimitByIP if nil
+	Key RateLimitKeyFunc
+	// Name keeps separate counts for limiters with the same Limit, Window and Key, ie. for different routes
+	Name string
+}
+
+// func RateLimit returns a RateLimiter allowing limit requests per window from each IP address. Set its Key to
+// RateLimitByAccount or RateLimitByApiKey to limit by account or API key instead, then wrap handlers with Handler
+func RateLimit(limit int64, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Limit:  limit,
+		Window: window,
+		Key:    RateLimitByIP,
+	}
+}
+
+// func RateLimitByIP limits requests by the client's IP address
+func RateLimitByIP(ctx context.Context, req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + req.RemoteAddr
+}
+
+// func RateLimitByAccount limits requests by account. Inside AuthenticatedHandler that's the authenticated account,
+// otherwise the account slug header, so unauthenticated requests can be limited before they're checked
+func RateLimitByAccount(ctx context.Context, req *http.Request) string {
+	if acct, err := GetAccount(ctx); err == nil {
+		return "account:" + acct.Slug
+	}
+	if slug := req.Header.Get(header(ctx, "account")); slug != "" {
+		return "account:" + slug
+	}
+	return ""
+}
+
+// func RateLimitByApiKey limits requests by the API key header they were sent with
+func RateLimitByApiKey(ctx context.Context, req *http.Request) string {
+	if apiKey := req.Header.Get(header(ctx, "key")); apiKey != "" {
+		return fmt.Sprintf("key:%x", sha1.Sum([]byte(apiKey)))
+	}
+	return ""
+}
+
+// func Handler wraps handler so each client's requests beyond the limit are rejected with 429 Too Many Requests and a
+// Retry-After header until the window is over. It can go either side of AuthenticatedHandler: inside it, requests
+// are counted after authentication, so RateLimitByAccount uses the authenticated account; outside it, requests are
+// counted (and rejected) before any datastore lookups
+func (rl *RateLimiter) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		keyFunc := rl.Key
+		if keyFunc == nil {
+			keyFunc = RateLimitByIP
+		}
+		client := keyFunc(ctx, req)
+		if client == "" {
+			client = RateLimitByIP(ctx, req)
+		}
+		count, reset, err := rl.take(ctx, client)
+		if err != nil {
+			warningf(ctx, "[accounts/RateLimit] %v", err.Error())
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		remaining := rl.Limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		rw.Header().Set("X-RateLimit-Limit", strconv.FormatInt(rl.Limit, 10))
+		rw.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		if count > rl.Limit {
+			retryAfter := int64((reset.Sub(time.Now()) + time.Second - 1) / time.Second)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			rw.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			respond(rw, req, http.StatusTooManyRequests, NewApiError(http.StatusTooManyRequests, ErrorCodeRateLimited, "Rate limit exceeded"))
+			return
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// func take counts a request from client in the current window, returning the count so far and when the window ends
+func (rl *RateLimiter) take(ctx context.Context, client string) (int64, time.Time, error) {
+	window := time.Now().Truncate(rl.Window)
+	reset := window.Add(rl.Window)
+	key := fmt.Sprintf("accounts-ratelimit-%x-%d", sha1.Sum([]byte(fmt.Sprintf("%v\x00%d\x00%d\x00%v", rl.Name, rl.Limit, rl.Window, client))), window.Unix())
+	count, err := memcache.IncrementExisting(ctx, key, 1)
+	if err == memcache.ErrCacheMiss {
+		// Counters expire with their window, rather than lingering until they're evicted
+		err = memcache.Add(ctx, &memcache.Item{
+			Key:        key,
+			Value:      []byte("1"),
+			Expiration: reset.Sub(time.Now()) + time.Second,
+		})
+		if err == nil {
+			return 1, reset, nil
+		}
+		if err == memcache.ErrNotStored {
+			// Another request started the counter first
+			count, err = memcache.IncrementExisting(ctx, key, 1)
+		}
+	}
+	return int64(count), reset, err
+}
@@ -0,0 +1,33 @@
+package accounts
+
+import (
+	"net/http"
+	"time"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRateLimit(c *C) {
+	rl := RateLimit(2, time.Hour)
+	for i := int64(1); i <= 3; i++ {
+		count, reset, err := rl.take(ctx, "ip:10.0.0.1")
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, i)
+		c.Assert(reset.After(time.Now()), Equals, true)
+	}
+	// Other clients and limiters are counted separately
+	count, _, err := rl.take(ctx, "ip:10.0.0.2")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(1))
+	rl.Name = "other"
+	count, _, err = rl.take(ctx, "ip:10.0.0.1")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(1))
+
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	c.Assert(RateLimitByIP(ctx, req), Equals, "ip:10.0.0.1")
+	req.Header.Set(Headers["account"], "some-account")
+	c.Assert(RateLimitByAccount(ctx, req), Equals, "account:some-account")
+	c.Assert(RateLimitByApiKey(ctx, req), Equals, "")
+}
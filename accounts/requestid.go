@@ -0,0 +1,87 @@
+package accounts
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mrvdot/appengine/logging"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+var (
+	// RequestIDHeader is the header RequestIDHandler takes a client's request ID from, and responds with the ID used
+	RequestIDHeader = "X-Request-ID"
+	// Request IDs assigned by RequestIDHandler, by App Engine request ID
+	requestIDs   = map[string]string{}
+	requestIDsMu sync.Mutex
+	// Client request IDs are only propagated if they're reasonably short and safe to log
+	validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+)
+
+// func RequestIDHandler wraps a handler to give each request an ID, propagated from the RequestIDHeader header if
+// the client sent one, or generated otherwise. The ID is sent back in the same header, added to the Data of responses
+// sent with RespondTo, and prefixed to everything accounts logs while handling the request, so a failure a client
+// reports can be matched up with the server logs. InitRouter and InitServeMux apply it to the accounts routes
+func RequestIDHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New()
+		}
+		reqId := appengine.RequestID(ctx)
+		requestIDsMu.Lock()
+		requestIDs[reqId] = id
+		requestIDsMu.Unlock()
+		defer func() {
+			requestIDsMu.Lock()
+			delete(requestIDs, reqId)
+			requestIDsMu.Unlock()
+		}()
+		rw.Header().Set(RequestIDHeader, id)
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// func RequestID returns the ID RequestIDHandler gave ctx's request, or an empty string if it didn't pass through it
+func RequestID(ctx context.Context) string {
+	requestIDsMu.Lock()
+	defer requestIDsMu.Unlock()
+	return requestIDs[appengine.RequestID(ctx)]
+}
+
+// func withRequestID adds id to the Data of resp (a *utils.ApiResponse or *ApiError), if it's empty or a map
+func withRequestID(resp interface{}, id string) {
+	var response *utils.ApiResponse
+	switch r := resp.(type) {
+	case *utils.ApiResponse:
+		response = r
+	case *ApiError:
+		response = &r.ApiResponse
+	default:
+		return
+	}
+	switch data := response.Data.(type) {
+	case nil:
+		response.Data = map[string]interface{}{"requestId": id}
+	case map[string]interface{}:
+		data["requestId"] = id
+	}
+}
+
+func errorf(ctx context.Context, format string, args ...interface{}) {
+	logging.For(ctx).Errorf(format, args...)
+}
+
+func criticalf(ctx context.Context, format string, args ...interface{}) {
+	logging.For(ctx).Criticalf(format, args...)
+}
+
+func warningf(ctx context.Context, format string, args ...interface{}) {
+	logging.For(ctx).Warningf(format, args...)
+}
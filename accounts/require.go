@@ -0,0 +1,114 @@
+package accounts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Requirement checks something about a request before it reaches a handler (see Require),
+// returning a FieldError for each problem, or nothing if the request is fine
+type Requirement func(req *http.Request) []FieldError
+
+// func Require returns middleware that checks each request against reqs before passing it on to the handler, and
+// responds 400 with a VALIDATION_FAILED ApiError listing every problem found (in Details) if any fail, so malformed
+// requests are rejected up front rather than failing somewhere inside the handler
+//
+// 	http.Handle("/items", accounts.Require(accounts.HasHeaders("X-account"), accounts.JSONBody())(itemsHandler))
+func Require(reqs ...Requirement) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			var problems []FieldError
+			for _, requirement := range reqs {
+				problems = append(problems, requirement(req)...)
+			}
+			if len(problems) > 0 {
+				apiErr := NewApiError(http.StatusBadRequest, ErrorCodeValidation, "Request is invalid")
+				apiErr.Details = problems
+				if len(problems) == 1 {
+					apiErr.Field = problems[0].Field
+					apiErr.Message = problems[0].Field + " " + problems[0].Message
+				}
+				respond(rw, req, http.StatusBadRequest, apiErr)
+				return
+			}
+			handler.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// func HasHeaders requires each of the named headers be sent with a non-empty value
+func HasHeaders(names ...string) Requirement {
+	return func(req *http.Request) (problems []FieldError) {
+		for _, name := range names {
+			if req.Header.Get(name) == "" {
+				problems = append(problems, FieldError{Field: name, Message: "header is required"})
+			}
+		}
+		return
+	}
+}
+
+// func FormValues requires each of the named parameters (from the query string or a form body) be non-empty
+func FormValues(names ...string) Requirement {
+	return func(req *http.Request) (problems []FieldError) {
+		for _, name := range names {
+			if req.FormValue(name) == "" {
+				problems = append(problems, FieldError{Field: name, Message: "is required"})
+			}
+		}
+		return
+	}
+}
+
+// func ContentType requires the request body be one of mediaTypes (ignoring parameters such as charset)
+func ContentType(mediaTypes ...string) Requirement {
+	return func(req *http.Request) []FieldError {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err == nil {
+			for _, allowed := range mediaTypes {
+				if strings.EqualFold(mediaType, allowed) {
+					return nil
+				}
+			}
+		}
+		return []FieldError{{Field: "Content-Type", Message: "must be " + strings.Join(mediaTypes, " or ")}}
+	}
+}
+
+// func JSONBody requires a JSON request body (sent as application/json) that's well formed, and no larger than MaxBodyBytes
+// The body is read to check it, then restored so the handler can decode it as usual
+func JSONBody() Requirement {
+	contentType := ContentType(MediaTypeJSON)
+	return func(req *http.Request) []FieldError {
+		if problems := contentType(req); len(problems) > 0 {
+			return problems
+		}
+		if req.Body == nil {
+			return []FieldError{{Field: "body", Message: "is required"}}
+		}
+		var reader io.Reader = req.Body
+		if MaxBodyBytes > 0 {
+			reader = io.LimitReader(req.Body, MaxBodyBytes+1)
+		}
+		body, err := ioutil.ReadAll(reader)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		switch {
+		case err != nil:
+			return []FieldError{{Field: "body", Message: "could not be read: " + err.Error()}}
+		case MaxBodyBytes > 0 && int64(len(body)) > MaxBodyBytes:
+			return []FieldError{{Field: "body", Message: fmt.Sprintf("must be at most %d bytes", MaxBodyBytes)}}
+		case len(bytes.TrimSpace(body)) == 0:
+			return []FieldError{{Field: "body", Message: "is required"}}
+		case !json.Valid(body):
+			return []FieldError{{Field: "body", Message: "is not valid JSON"}}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,41 @@
+package accounts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRequire(c *C) {
+	reached := false
+	handler := Require(HasHeaders(Headers["account"]), JSONBody())(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reached = true
+		var body map[string]interface{}
+		c.Assert(json.NewDecoder(req.Body).Decode(&body), IsNil)
+	}))
+
+	req, err := http.NewRequest("POST", "/items", strings.NewReader("{not json"))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusBadRequest)
+	c.Assert(reached, Equals, false)
+	apiErr := &ApiError{}
+	c.Assert(json.Unmarshal(rw.Body.Bytes(), apiErr), IsNil)
+	c.Assert(apiErr.ErrorCode, Equals, ErrorCodeValidation)
+	c.Assert(apiErr.Details, HasLen, 2)
+
+	req, err = http.NewRequest("POST", "/items", strings.NewReader(`{"name": "Item"}`))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", MediaTypeJSON)
+	req.Header.Set(Headers["account"], "some-account")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	c.Assert(reached, Equals, true)
+
+	c.Assert(ContentType(MediaTypeXML)(req), HasLen, 1)
+	c.Assert(FormValues("missing")(req), HasLen, 1)
+}
@@ -0,0 +1,267 @@
+package accounts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// ResourceLimit is how many entities a resource lists per request, unless a smaller "limit" parameter is passed
+	ResourceLimit = 100
+
+	// Resources added with RegisterResource or RegisterServeMuxResource, by path, for BatchHandler
+	resources   = map[string]*resource{}
+	resourcesMu sync.RWMutex
+)
+
+// resource serves the CRUD handlers for a model registered with RegisterResource (or RegisterServeMuxResource)
+type resource struct {
+	kind reflect.Type
+}
+
+// func newResource returns the resource for model, a struct or pointer to a struct, registering it at path for BatchHandler
+func newResource(path string, model interface{}) *resource {
+	kind := reflect.TypeOf(model)
+	for kind != nil && kind.Kind() == reflect.Ptr {
+		kind = kind.Elem()
+	}
+	if kind == nil || kind.Kind() != reflect.Struct {
+		panic("Unsupported model passed to RegisterResource, must be a struct or pointer to struct")
+	}
+	rs := &resource{kind: kind}
+	resourcesMu.Lock()
+	resources[path] = rs
+	resourcesMu.Unlock()
+	return rs
+}
+
+// func model returns a pointer to a new, empty model
+func (rs *resource) model() interface{} {
+	return reflect.New(rs.kind).Interface()
+}
+
+// func serveCollection lists (GET) or creates (POST) entities
+func (rs *resource) serveCollection(rw http.ResponseWriter, req *http.Request) {
+	rs.serve(rw, req, "", "GET, POST")
+}
+
+// func serveItem gets (GET), replaces (PUT), patches (PATCH) or deletes (DELETE) the entity with id (see resourceID)
+func (rs *resource) serveItem(rw http.ResponseWriter, req *http.Request, id string) {
+	rs.serve(rw, req, id, "GET, PUT, PATCH, DELETE")
+}
+
+func (rs *resource) serve(rw http.ResponseWriter, req *http.Request, id, allow string) {
+	if !allowsMethod(allow, req.Method) {
+		rw.Header().Set("Allow", allow+", OPTIONS")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, err := GetContext(req)
+	if err != nil {
+		respondAuthError(rw, req, err)
+		return
+	}
+	limitBody(rw, req)
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		RespondTo(rw, req, bodyError(err))
+		return
+	}
+	req.ParseForm()
+	resp, etag := rs.do(ctx, req.Method, id, req.Form, req.Header, body)
+	if etag != "" {
+		rw.Header().Set("ETag", etag)
+	}
+	// Conditional requests are answered with HTTP statuses, as that's what clients and caches act on
+	switch responseCode(resp) {
+	case http.StatusNotModified:
+		rw.WriteHeader(http.StatusNotModified)
+	case http.StatusPreconditionFailed:
+		respond(rw, req, http.StatusPreconditionFailed, resp)
+	default:
+		RespondTo(rw, req, resp)
+	}
+}
+
+// func allowsMethod returns whether method is one of the comma separated allow list
+func allowsMethod(allow, method string) bool {
+	for _, m := range strings.Split(allow, ",") {
+		if strings.TrimSpace(m) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// func do handles a request for the resource, returning the response (a *utils.ApiResponse or *ApiError) and the ETag of
+// the entity it's for, if any. An empty id is a request for the collection, otherwise for the entity with that ID (see resourceID)
+// ctx should be namespaced for the authenticated account (see GetContext). Requests for an entity honour If-None-Match
+// (with a 304 response) and If-Match (with a 412 response) in header
+func (rs *resource) do(ctx context.Context, method, id string, params url.Values, header http.Header, body []byte) (interface{}, string) {
+	switch {
+	case id == "" && method == "GET":
+		return rs.list(ctx, params), ""
+	case id == "" && method == "POST":
+		obj := rs.model()
+		if err := json.Unmarshal(body, obj); err != nil {
+			return NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error()), ""
+		}
+		key, err := aeutils.Save(ctx, obj, aeutils.CreateOnly())
+		return resourceResponse(obj, key, err)
+	case id != "" && (method == "GET" || method == "PUT" || method == "PATCH" || method == "DELETE"):
+		return rs.item(ctx, method, id, header, body)
+	}
+	return NewApiError(http.StatusMethodNotAllowed, ErrorCodeInvalidRequest, http.StatusText(http.StatusMethodNotAllowed)), ""
+}
+
+func (rs *resource) list(ctx context.Context, params url.Values) interface{} {
+	limit, offset := pageParams(params)
+	dst := reflect.New(reflect.SliceOf(reflect.PtrTo(rs.kind)))
+	keys, err := aeutils.Query(rs.model()).
+		Limit(limit).
+		Offset(offset).
+		GetAll(ctx, dst.Interface())
+	if err != nil {
+		errorf(ctx, "[accounts/resource] %v", err.Error())
+		return ErrorResponse(err)
+	}
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		if ids[i], err = resourceID(key); err != nil {
+			errorf(ctx, "[accounts/resource] %v", err.Error())
+			return ErrorResponse(err)
+		}
+	}
+	return &utils.ApiResponse{
+		Code:   200,
+		Result: dst.Elem().Interface(),
+		Data: map[string]interface{}{
+			"ids":    ids,
+			"limit":  limit,
+			"offset": offset,
+		},
+	}
+}
+
+// func item handles the requests for a single entity, which is loaded first so a request can't reach another kind or namespace
+// For versioned models (see aeutils.Save), an If-Match that matches the loaded entity can't be undone by a save in between,
+// as Save then fails with a *aeutils.ConflictError, which is answered as a failed precondition too
+func (rs *resource) item(ctx context.Context, method, id string, header http.Header, body []byte) (interface{}, string) {
+	obj := rs.model()
+	key, err := resolveResourceID(ctx, id, obj)
+	if err == nil {
+		err = aeutils.GetByKey(ctx, key, obj)
+	}
+	if err != nil {
+		return ErrorResponse(err), ""
+	}
+	etag := aeutils.ETag(key, obj)
+	if method == "GET" && notModified(method, header, etag) {
+		return &utils.ApiResponse{Code: http.StatusNotModified}, etag
+	}
+	if method != "GET" {
+		if apiErr := checkIfMatch(header, etag); apiErr != nil {
+			return apiErr, etag
+		}
+	}
+	switch method {
+	case "PUT":
+		if err = json.Unmarshal(body, obj); err != nil {
+			return NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error()), etag
+		}
+		_, err = aeutils.Save(ctx, obj, aeutils.WithKey(key), aeutils.UpdateOnly())
+	case "PATCH":
+		_, err = aeutils.ApplyMergePatch(ctx, obj, body, aeutils.WithKey(key), aeutils.UpdateOnly())
+	case "DELETE":
+		err = aeutils.Delete(ctx, obj)
+	}
+	if _, ok := err.(*aeutils.ConflictError); ok && header.Get("If-Match") != "" {
+		return preconditionFailed(), etag
+	}
+	return resourceResponse(obj, key, err)
+}
+
+// func pageParams returns the "limit" (up to ResourceLimit, which is the default) and "offset" parameters of a list request
+func pageParams(params url.Values) (limit, offset int) {
+	limit = ResourceLimit
+	if l, err := strconv.Atoi(params.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+	if o, err := strconv.Atoi(params.Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+	return limit, offset
+}
+
+// func resourceResponse returns a response with obj, its ID (see resourceID) and its ETag, or for err if it's not nil
+func resourceResponse(obj interface{}, key *datastore.Key, err error) (interface{}, string) {
+	var id string
+	if err == nil {
+		id, err = resourceID(key)
+	}
+	if err != nil {
+		return ErrorResponse(err), ""
+	}
+	etag := aeutils.ETag(key, obj)
+	return &utils.ApiResponse{
+		Code:   200,
+		Result: obj,
+		Data: map[string]interface{}{
+			"id":   id,
+			"etag": etag,
+		},
+	}, etag
+}
+
+// func resourceID returns the ID a resource entity is identified by: the public ID of numeric keys (see aeutils.PublicID),
+// so clients can't enumerate them, or the encoded key of named ones, and of any until a public ID secret is set
+func resourceID(key *datastore.Key) (string, error) {
+	if key.IntID() == 0 || key.Parent() != nil {
+		return aeutils.EncodeKey(key), nil
+	}
+	id, err := aeutils.PublicID(key)
+	if err == aeutils.ErrNoPublicIDs {
+		return aeutils.EncodeKey(key), nil
+	}
+	return id, err
+}
+
+// func resolveResourceID returns the key of obj's kind that id, from resourceID, refers to
+func resolveResourceID(ctx context.Context, id string, obj interface{}) (*datastore.Key, error) {
+	// Public IDs are at most 11 characters, far shorter than any encoded key
+	if len(id) <= 11 {
+		if key, err := aeutils.ResolvePublicID(ctx, id, obj); err != aeutils.ErrNoPublicIDs {
+			return key, err
+		}
+	}
+	return aeutils.DecodeKey(ctx, id, obj)
+}
+
+// func responseCode returns the Code of a *utils.ApiResponse or *ApiError
+func responseCode(resp interface{}) int {
+	switch r := resp.(type) {
+	case *utils.ApiResponse:
+		return r.Code
+	case *ApiError:
+		return r.Code
+	}
+	return 0
+}
+
+// func resourcePath returns path with a leading slash and without a trailing one
+func resourcePath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
@@ -0,0 +1,63 @@
+package accounts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func (s *MySuite) TestResource(c *C) {
+	rs := newResource("/accounts-test", &Account{})
+	c.Assert(rs.kind, Equals, reflect.TypeOf(Account{}))
+	_, ok := rs.model().(*Account)
+	c.Assert(ok, Equals, true)
+	c.Assert(func() { newResource("/invalid", "not a struct") }, PanicMatches, "Unsupported model.*")
+	c.Assert(resourcePath("items/"), Equals, "/items")
+
+	req, err := http.NewRequest("PUT", "/items", nil)
+	c.Assert(err, IsNil)
+	rw := httptest.NewRecorder()
+	rs.serveCollection(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(rw.Header().Get("Allow"), Equals, "GET, POST, OPTIONS")
+}
+
+func (s *MySuite) TestLookupResource(c *C) {
+	rs := newResource("/batch-items", &Account{})
+	found, id, ok := lookupResource("/batch-items")
+	c.Assert(ok, Equals, true)
+	c.Assert(found, Equals, rs)
+	c.Assert(id, Equals, "")
+	found, id, ok = lookupResource("/batch-items/abc123/")
+	c.Assert(ok, Equals, true)
+	c.Assert(found, Equals, rs)
+	c.Assert(id, Equals, "abc123")
+	_, _, ok = lookupResource("/unregistered/abc123")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *MySuite) TestResourceID(c *C) {
+	key := datastore.NewKey(ctx, "Account", "", 42, nil)
+	id, err := resourceID(key)
+	c.Assert(err, IsNil)
+	c.Assert(id, Not(Equals), "42")
+	resolved, err := resolveResourceID(ctx, id, &Account{})
+	c.Assert(err, IsNil)
+	c.Assert(resolved.Equal(key), Equals, true)
+
+	// Named keys are encoded
+	named := datastore.NewKey(ctx, "Account", "acme", 0, nil)
+	id, err = resourceID(named)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, aeutils.EncodeKey(named))
+	resolved, err = resolveResourceID(ctx, id, &Account{})
+	c.Assert(err, IsNil)
+	c.Assert(resolved.Equal(named), Equals, true)
+	_, err = resolveResourceID(ctx, "not-valid!", &User{})
+	c.Assert(aeutils.StatusCode(err), Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,255 @@
+package accounts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Media types RespondTo can encode an ApiResponse as
+	MediaTypeJSON    = "application/json"
+	MediaTypeXML     = "application/xml"
+	MediaTypeMsgpack = "application/msgpack"
+)
+
+var (
+	// Accepted media types for each format, as clients use several for XML and MessagePack
+	mediaTypes = map[string]string{
+		"application/json":      MediaTypeJSON,
+		"text/json":             MediaTypeJSON,
+		"application/xml":       MediaTypeXML,
+		"text/xml":              MediaTypeXML,
+		"application/msgpack":   MediaTypeMsgpack,
+		"application/x-msgpack": MediaTypeMsgpack,
+	}
+)
+
+// func RespondTo writes resp (a *utils.ApiResponse or *ApiError) to rw in the format preferred by req's Accept header:
+// JSON (the default), XML or MessagePack. XML and MessagePack responses have the same structure and field names as the JSON one.
+// In XML, the root element is <response> and array elements are each an <item>
+// If the request has an ID (see RequestIDHandler), it's added to the response's Data as "requestId"
+// Messages are translated for the authenticated account's Locale, or the request's Accept-Language (see RegisterMessages)
+func RespondTo(rw http.ResponseWriter, req *http.Request, resp interface{}) {
+	respond(rw, req, http.StatusOK, resp)
+}
+
+// func respond writes resp to rw as RespondTo does, with the given HTTP status
+func respond(rw http.ResponseWriter, req *http.Request, status int, resp interface{}) {
+	resp = localize(rw, req, resp)
+	if id := rw.Header().Get(RequestIDHeader); id != "" {
+		withRequestID(resp, id)
+	}
+	mediaType := NegotiateMediaType(req.Header.Get("Accept"))
+	var body []byte
+	var err error
+	switch mediaType {
+	case MediaTypeXML:
+		body, err = encodeXML(resp)
+	case MediaTypeMsgpack:
+		body, err = encodeMsgpack(resp)
+	default:
+		body, err = json.Marshal(resp)
+		body = append(body, '\n')
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", mediaType)
+	rw.Header().Add("Vary", "Accept")
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// func NegotiateMediaType returns the media type RespondTo should use for an Accept header, preferring
+// those with the highest quality value. Falls back to JSON if none are supported
+func NegotiateMediaType(accept string) string {
+	best, bestQ := MediaTypeJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType, ok := mediaTypes[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if parsed, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
+
+// func genericValue returns v as decoded from its JSON encoding, so other formats use the same field names (and omit
+// the same fields) as JSON
+func genericValue(v interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+	var generic interface{}
+	err = dec.Decode(&generic)
+	return generic, err
+}
+
+// func sortedKeys returns the keys of m in order, so encodings are deterministic
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// func encodeXML encodes v as XML, with a <response> root element
+func encodeXML(v interface{}) ([]byte, error) {
+	generic, err := genericValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	if err = writeXMLElement(enc, "response", generic); err != nil {
+		return nil, err
+	}
+	if err = enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeXMLElement(enc *xml.Encoder, name string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: xmlName(name)}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			if err := writeXMLElement(enc, k, v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := writeXMLElement(enc, "item", item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// func xmlName replaces any characters that aren't valid in an XML element name with underscores
+func xmlName(name string) string {
+	valid := strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || r == '.' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, name)
+	if valid == "" || strings.ContainsRune("-.0123456789", rune(valid[0])) {
+		valid = "_" + valid
+	}
+	return valid
+}
+
+// func encodeMsgpack encodes v as MessagePack
+func encodeMsgpack(v interface{}) ([]byte, error) {
+	generic, err := genericValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeMsgpack(&buf, generic)
+	return buf.Bytes(), nil
+}
+
+// func writeMsgpack writes v, a value decoded from JSON with json.Decoder.UseNumber, to buf
+func writeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+		} else {
+			f, _ := v.Float64()
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			writeMsgpack(buf, item)
+		}
+	case map[string]interface{}:
+		writeMsgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			writeMsgpack(buf, k)
+			writeMsgpack(buf, v[k])
+		}
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// func writeMsgpackHeader writes the type and length of a string, array or map of n elements, using the fix
+// format (fix|n) for lengths under fixMax, then the 8 bit (if the type has one), 16 bit or 32 bit formats
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, f8, f16, f32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(f8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(f16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(f32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
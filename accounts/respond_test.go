@@ -0,0 +1,53 @@
+package accounts
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/golang-utils"
+)
+
+func (s *MySuite) TestRespondTo(c *C) {
+	c.Assert(NegotiateMediaType(""), Equals, MediaTypeJSON)
+	c.Assert(NegotiateMediaType("text/html, */*"), Equals, MediaTypeJSON)
+	c.Assert(NegotiateMediaType("application/json;q=0.5, text/xml"), Equals, MediaTypeXML)
+	c.Assert(NegotiateMediaType("application/x-msgpack, application/json;q=0.9"), Equals, MediaTypeMsgpack)
+
+	req, err := http.NewRequest("GET", "/accounts/new", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept", "application/xml")
+	rw := httptest.NewRecorder()
+	RespondTo(rw, req, &utils.ApiResponse{Code: 200, Data: map[string]interface{}{"tags": []string{"a", "b"}}})
+	c.Assert(rw.Header().Get("Content-Type"), Equals, MediaTypeXML)
+	c.Assert(strings.Contains(rw.Body.String(), "<code>200</code>"), Equals, true)
+	c.Assert(strings.Contains(rw.Body.String(), "<tags><item>a</item><item>b</item></tags>"), Equals, true)
+
+	req.Header.Set("Accept", "application/msgpack")
+	rw = httptest.NewRecorder()
+	RespondTo(rw, req, &utils.ApiResponse{Code: 200})
+	c.Assert(rw.Header().Get("Content-Type"), Equals, MediaTypeMsgpack)
+
+	// Responses to requests with an ID include it in Data
+	req.Header.Del("Accept")
+	rw = httptest.NewRecorder()
+	rw.Header().Set(RequestIDHeader, "client-123")
+	RespondTo(rw, req, ErrorResponse(Unauthenticated))
+	var decoded struct {
+		Data map[string]string
+	}
+	c.Assert(json.Unmarshal(rw.Body.Bytes(), &decoded), IsNil)
+	c.Assert(decoded.Data["requestId"], Equals, "client-123")
+
+	var buf bytes.Buffer
+	writeMsgpack(&buf, map[string]interface{}{"code": json.Number("200"), "ok": true, "tags": []interface{}{"a"}})
+	c.Assert(buf.Bytes(), DeepEquals, []byte{
+		0x83,
+		0xa4, 'c', 'o', 'd', 'e', 0xd3, 0, 0, 0, 0, 0, 0, 0, 200,
+		0xa2, 'o', 'k', 0xc3,
+		0xa4, 't', 'a', 'g', 's', 0x91, 0xa1, 'a',
+	})
+}
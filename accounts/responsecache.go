@@ -0,0 +1,192 @@
+package accounts
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var (
+	// Kinds whose saves and deletes invalidate cached responses, so hooks are only registered once per kind
+	responseCacheKinds   = map[string]bool{}
+	responseCacheKindsMu sync.Mutex
+	// Response headers that are cached along with the body
+	cachedHeaders = []string{"Content-Type", "Content-Language", "ETag", "Vary", "Last-Modified"}
+)
+
+// cachedResponse is a response stored by CacheHandler
+type cachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// responseRecorder keeps a copy of what a handler writes, as well as writing it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// func CacheHandler wraps a handler so its 200 responses to GET requests are cached in memcache for ttl, keyed by the path,
+// query, response format (see NegotiateMediaType), language (see NegotiateLanguage) and authenticated account, to shed
+// load from read-heavy endpoints
+// Saving or deleting an entity of any of kinds (structs, or pointers to structs) through aeutils invalidates every
+// response cached by handlers for that kind, as does InvalidateResponses
+//
+// Responses are only cached per account if the account has already been authenticated, so per-account endpoints should
+// have CacheHandler inside AuthenticatedHandler. Requests that send credentials without having been authenticated yet
+// skip the cache altogether, so a handler that authenticates them itself never has its response served to anyone else
+func CacheHandler(handler http.Handler, ttl time.Duration, kinds ...interface{}) http.Handler {
+	kindNames := make([]string, len(kinds))
+	for i, kind := range kinds {
+		kindNames[i] = aeutils.KindOf(kind)
+		invalidateOnWrite(kindNames[i])
+	}
+	sort.Strings(kindNames)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		if req.Method != "GET" || (hasCredentials(ctx, req) && authenticatedSlug(ctx) == "") {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		cacheKey, err := responseCacheKey(ctx, req, kindNames)
+		if err != nil {
+			warningf(ctx, "[accounts/CacheHandler] %v", err.Error())
+			handler.ServeHTTP(rw, req)
+			return
+		}
+		cached := &cachedResponse{}
+		if _, err = memcache.Gob.Get(ctx, cacheKey, cached); err == nil {
+			for name, values := range cached.Header {
+				rw.Header()[name] = values
+			}
+			rw.Header().Set("X-Cache", "HIT")
+			rw.WriteHeader(cached.Status)
+			rw.Write(cached.Body)
+			return
+		} else if err != memcache.ErrCacheMiss {
+			warningf(ctx, "[accounts/CacheHandler] %v", err.Error())
+		}
+		rw.Header().Set("X-Cache", "MISS")
+		recorder := &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req)
+		if recorder.status != http.StatusOK {
+			return
+		}
+		cached = &cachedResponse{
+			Status: recorder.status,
+			Header: http.Header{},
+			Body:   recorder.body.Bytes(),
+		}
+		for _, name := range cachedHeaders {
+			if values, ok := rw.Header()[name]; ok {
+				cached.Header[name] = values
+			}
+		}
+		err = memcache.Gob.Set(ctx, &memcache.Item{
+			Key:        cacheKey,
+			Object:     cached,
+			Expiration: ttl,
+		})
+		if err != nil {
+			warningf(ctx, "[accounts/CacheHandler] %v", err.Error())
+		}
+	})
+}
+
+// func InvalidateResponses drops every response cached by CacheHandler for any of kinds (structs, or pointers to structs),
+// for changes aeutils doesn't see, ie. entities written directly with the datastore package
+func InvalidateResponses(ctx context.Context, kinds ...interface{}) error {
+	for _, kind := range kinds {
+		if _, err := responseGeneration(ctx, aeutils.KindOf(kind), 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// func invalidateOnWrite registers hooks so saving or deleting an entity of kind invalidates cached responses for it
+func invalidateOnWrite(kind string) {
+	responseCacheKindsMu.Lock()
+	defer responseCacheKindsMu.Unlock()
+	if responseCacheKinds[kind] {
+		return
+	}
+	responseCacheKinds[kind] = true
+	invalidate := func(ctx context.Context, obj interface{}, key *datastore.Key) {
+		if _, err := responseGeneration(ctx, kind, 1); err != nil {
+			warningf(ctx, "[accounts/CacheHandler] %v", err.Error())
+		}
+	}
+	aeutils.OnAfterSave(kind, invalidate)
+	aeutils.OnAfterDelete(kind, invalidate)
+}
+
+// func responseGeneration increments the generation counter for responses depending on kind by delta and returns the new value
+// Every cache key includes the generations of its kinds, so bumping one makes all of their cached responses miss
+// Counters are kept outside any namespace, as a write in one account's namespace may change public responses
+func responseGeneration(ctx context.Context, kind string, delta int64) (uint64, error) {
+	ctx, err := appengine.Namespace(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	// A missing counter starts from the current time, so one evicted from memcache can't restart at an old generation
+	return memcache.Increment(ctx, "accounts-response-generation-"+kind, delta, uint64(time.Now().UnixNano()))
+}
+
+// func responseCacheKey returns the memcache key for the response to req, at the current generation of each of kinds
+func responseCacheKey(ctx context.Context, req *http.Request, kinds []string) (string, error) {
+	h := sha1.New()
+	fmt.Fprintf(h, "%v\x00%v\x00%v\x00%v\x00%v", req.URL.Path, req.URL.Query().Encode(), NegotiateMediaType(req.Header.Get("Accept")),
+		requestLocale(ctx, req), authenticatedSlug(ctx))
+	for _, kind := range kinds {
+		generation, err := responseGeneration(ctx, kind, 0)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "\x00%v=%d", kind, generation)
+	}
+	return fmt.Sprintf("accounts-response-%x", h.Sum(nil)), nil
+}
+
+// func authenticatedSlug returns the slug of the account ctx's request has authenticated as, if any
+func authenticatedSlug(ctx context.Context) string {
+	if acct, err := GetAccount(ctx); err == nil {
+		return acct.Slug
+	}
+	return ""
+}
+
+// func hasCredentials returns whether req sent any of the headers (or the session cookie) AuthenticateRequest checks
+func hasCredentials(ctx context.Context, req *http.Request) bool {
+	names := headers(ctx)
+	for _, name := range names {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	_, err := req.Cookie(names["session"])
+	return err == nil
+}
@@ -0,0 +1,46 @@
+package accounts
+
+import (
+	"net/http"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestResponseCacheKey(c *C) {
+	kinds := []string{"Account"}
+	req, err := http.NewRequest("GET", "/public/accounts?b=2&a=1", nil)
+	c.Assert(err, IsNil)
+	key, err := responseCacheKey(ctx, req, kinds)
+	c.Assert(err, IsNil)
+
+	// Query parameters are matched regardless of order
+	reordered, _ := http.NewRequest("GET", "/public/accounts?a=1&b=2", nil)
+	same, err := responseCacheKey(ctx, reordered, kinds)
+	c.Assert(err, IsNil)
+	c.Assert(same, Equals, key)
+
+	// Each format is cached separately
+	req.Header.Set("Accept", MediaTypeXML)
+	xmlKey, err := responseCacheKey(ctx, req, kinds)
+	c.Assert(err, IsNil)
+	c.Assert(xmlKey, Not(Equals), key)
+
+	// As is each language
+	req.Header.Set("Accept-Language", "es")
+	esKey, err := responseCacheKey(ctx, req, kinds)
+	c.Assert(err, IsNil)
+	c.Assert(esKey, Not(Equals), xmlKey)
+	req.Header.Set("Accept-Language", "en-US")
+	enKey, err := responseCacheKey(ctx, req, kinds)
+	c.Assert(err, IsNil)
+	c.Assert(enKey, Not(Equals), esKey)
+
+	// Invalidating the kind moves every key on
+	c.Assert(InvalidateResponses(ctx, &Account{}), IsNil)
+	invalidated, err := responseCacheKey(ctx, reordered, kinds)
+	c.Assert(err, IsNil)
+	c.Assert(invalidated, Not(Equals), key)
+
+	c.Assert(hasCredentials(ctx, reordered), Equals, false)
+	reordered.Header.Set(Headers["session"], "some-session")
+	c.Assert(hasCredentials(ctx, reordered), Equals, true)
+}
@@ -2,50 +2,94 @@ package accounts
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
-
-	"github.com/gorilla/mux"
+	"strings"
 
 	"github.com/mrvdot/appengine/aeutils"
 	"github.com/mrvdot/golang-utils"
 
-	"appengine"
+	"google.golang.org/appengine"
 )
 
 var (
-	// Router instance for accounts, made public to allow for adding additional routes
-	Router        *mux.Router
 	SubrouterPath = "accounts"
+
+	// The accounts routes, under SubrouterPath
+	routes = []route{
+		{"CreateAccount", "POST", "/new", newAccount},
+		{"Authenticate", "POST", "/authenticate", authenticate},
+		{"RefreshSession", "POST", "/session/refresh", AuthenticatedFunc(http.HandlerFunc(refreshSession))},
+		{"ListUsers", "GET", "/users", AuthenticatedFunc(http.HandlerFunc(listUsers))},
+		{"CreateUser", "POST", "/users", AuthenticatedFunc(http.HandlerFunc(createUser))},
+		{"GetUser", "GET", "/users/{id}", AuthenticatedFunc(http.HandlerFunc(getUser))},
+		{"UpdateUser", "PUT", "/users/{id}", AuthenticatedFunc(http.HandlerFunc(updateUser))},
+		{"DeleteUser", "DELETE", "/users/{id}", AuthenticatedFunc(http.HandlerFunc(deleteUser))},
+		{"AvatarUploadURL", "GET", "/avatar/upload", AuthenticatedFunc(http.HandlerFunc(avatarUploadURL))},
+		{"UploadAvatar", "POST", "/avatar", AuthenticatedFunc(http.HandlerFunc(uploadAvatar))},
+		{"AttachmentUploadURL", "GET", "/attachments/upload", AuthenticatedFunc(http.HandlerFunc(attachmentUploadURL))},
+		{"UploadAttachments", "POST", "/attachments", AuthenticatedFunc(http.HandlerFunc(uploadAttachments))},
+		{"GetAttachment", "GET", "/attachments/file", AuthenticatedFunc(http.HandlerFunc(serveAttachment))},
+		{"Batch", "POST", "/batch", AuthenticatedFunc(http.HandlerFunc(batch))},
+		{"Cleanup", "GET", "/_cron/cleanup", CronOnly(cleanup)},
+		{"AdminListAccounts", "GET", "/admin/accounts", adminFunc(adminListAccounts)},
+		{"AdminGetAccount", "GET", "/admin/accounts/{id}", adminFunc(adminGetAccount)},
+		{"AdminUpdateAccount", "PATCH", "/admin/accounts/{id}", adminFunc(adminUpdateAccount)},
+		{"AdminListUsers", "GET", "/admin/users", adminFunc(adminListUsers)},
+		{"AdminListSessions", "GET", "/admin/sessions", adminFunc(adminListSessions)},
+		{"AdminListJobs", "GET", "/admin/jobs", adminFunc(adminListJobs)},
+		{"AdminRunJob", "POST", "/admin/jobs/{id}", adminFunc(adminRunJob)},
+	}
 )
 
-// func InitRouter attaches two routes "new" and "authenticate" to a subpath
-// to the http handler
-// If an empty string is passed for the subpath, the default SubrouterPath is used
-func InitRouter(subpath string) {
+// route is a single accounts endpoint, for whichever router they're mounted with
+type route struct {
+	name    string
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// func serve returns the handler for rt, measured by MetricsHandler if MetricsEnabled is set
+func (rt route) serve() http.Handler {
+	if MetricsEnabled {
+		return MetricsHandler(rt.name, rt.handler)
+	}
+	return rt.handler
+}
+
+// func routeMethods returns the paths of the routes table in order, and the methods routed for each
+func routeMethods() (paths []string, methods map[string][]string) {
+	methods = map[string][]string{}
+	for _, rt := range routes {
+		if methods[rt.path] == nil {
+			paths = append(paths, rt.path)
+		}
+		methods[rt.path] = append(methods[rt.path], rt.method)
+	}
+	return paths, methods
+}
+
+// func pathParam returns the last segment of req's path, ie. the {id} of /users/{id}, however the route was mounted
+func pathParam(req *http.Request) string {
+	return req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+}
+
+// func routerPath returns the subpath to mount routes under, defaulting to (or updating) SubrouterPath
+func routerPath(subpath string) string {
 	if subpath == "" {
-		subpath = SubrouterPath
-	} else {
-		SubrouterPath = subpath
+		return SubrouterPath
 	}
-	Router = mux.NewRouter()
-	ar := Router.PathPrefix(fmt.Sprintf("/%v", SubrouterPath)).Subrouter()
-	ar.HandleFunc("/new", newAccount).
-		Methods("POST").
-		Name("CreateAccount")
-	ar.HandleFunc("/authenticate", authenticate).
-		Methods("POST").
-		Name("Authenticate")
-	http.Handle(fmt.Sprintf("/%v/", SubrouterPath), utils.CorsHandler(Router))
+	SubrouterPath = subpath
+	return subpath
 }
 
 // func newAccount creates a new request based on the "account" parameter passed in
 func newAccount(rw http.ResponseWriter, req *http.Request) {
 	ctx := appengine.NewContext(req)
-	out := json.NewEncoder(rw)
 	response := &utils.ApiResponse{}
 	acct := &Account{}
+	limitBody(rw, req)
 	name := req.FormValue("account")
 	if name != "" {
 		acct = &Account{
@@ -57,45 +101,69 @@ func newAccount(rw http.ResponseWriter, req *http.Request) {
 		defer req.Body.Close()
 		err := dec.Decode(acct)
 		if err != nil {
+			var apiErr *ApiError
 			if err == io.EOF {
-				response.Code = http.StatusBadRequest
-				response.Message = "Account name must be provided"
+				apiErr = NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, "Account name must be provided")
+				apiErr.Field = "account"
 			} else {
-				response.Code = http.StatusInternalServerError
-				response.Message = err.Error()
+				apiErr = bodyError(err)
 			}
-			out.Encode(response)
+			RespondTo(rw, req, apiErr)
 			return
 		}
 	}
 	_, err := aeutils.Save(ctx, acct)
 	if err != nil {
-		response.Code = http.StatusInternalServerError
-		response.Message = "Error saving new account: " + err.Error()
-		out.Encode(response)
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error saving new account: " + apiErr.Message
+		RespondTo(rw, req, apiErr)
 		return
 	}
 	response.Code = 200
 	response.Result = acct
-	out.Encode(response)
+	RespondTo(rw, req, response)
 }
 
 //func authenticate takes a request and authenticates it
 func authenticate(rw http.ResponseWriter, req *http.Request) {
 	ctx := appengine.NewContext(req)
-	out := json.NewEncoder(rw)
-	data := &utils.ApiResponse{}
 	_, err := AuthenticateRequest(req, rw)
-	session, err := GetSession(ctx)
+	var session *Session
+	if err == nil {
+		session, err = GetSession(ctx)
+	}
 	if err != nil {
-		ctx.Errorf(err.Error())
-		data.Code = 403
-		data.Message = err.Error()
-	} else {
-		data.Code = 200
-		data.Data = map[string]interface{}{
+		errorf(ctx, "%v", err.Error())
+		apiErr := ErrorResponse(err)
+		apiErr.Code = 403
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code: 200,
+		Data: map[string]interface{}{
 			"session": session.Key, // Probably not needed anymore, kept for backwards compatibility
-		}
+		},
+	})
+}
+
+// func refreshSession extends the current session (see RefreshSession), rotating its key if RotateSessionOnRefresh is set,
+// and sends it back with its new expiry
+func refreshSession(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	session, err := RefreshSession(ctx, RotateSessionOnRefresh)
+	if err != nil {
+		errorf(ctx, "[accounts/refreshSession] %v", err.Error())
+		respondAuthError(rw, req, err)
+		return
 	}
-	out.Encode(data)
+	sendSession(req, rw, session)
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: session,
+		Data: map[string]interface{}{
+			"session": session.Key,
+			"expires": session.Expires(),
+		},
+	})
 }
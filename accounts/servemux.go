@@ -0,0 +1,99 @@
+package accounts
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mrvdot/golang-utils"
+)
+
+// func InitServeMux attaches the same routes as InitRouter to sm (or http.DefaultServeMux if it's nil), using only the
+// standard library, for apps that don't otherwise need gorilla/mux (build with the nomux tag to drop the dependency)
+// If an empty string is passed for the subpath, the default SubrouterPath is used
+func InitServeMux(sm *http.ServeMux, subpath string) {
+	if sm == nil {
+		sm = http.DefaultServeMux
+	}
+	prefix := fmt.Sprintf("/%v", routerPath(subpath))
+	paths, methods := routeMethods()
+	handlers := map[string]map[string]http.Handler{}
+	for _, rt := range routes {
+		if handlers[rt.path] == nil {
+			handlers[rt.path] = map[string]http.Handler{}
+		}
+		handlers[rt.path][rt.method] = RequestIDHandler(RecoveryHandler(rt.serve()))
+	}
+	for _, path := range paths {
+		var h http.Handler = methodHandler(methods[path], handlers[path])
+		pattern := path
+		if brace := strings.Index(path, "{"); brace >= 0 {
+			// ServeMux has no path parameters, so /users/{id} is routed as everything under /users/
+			pattern = path[:brace]
+			h = pathParamHandler(prefix+pattern, h)
+		}
+		sm.Handle(prefix+pattern, utils.CorsHandler(MethodOverrideHandler(h)))
+	}
+}
+
+// func methodHandler passes requests on to the handler for their method, answering CORS preflight (OPTIONS) requests
+// itself and responding 405 Method Not Allowed to any methods without a handler
+func methodHandler(methods []string, handlers map[string]http.Handler) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if h, ok := handlers[strings.ToUpper(req.Method)]; ok {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		if strings.EqualFold(req.Method, "OPTIONS") {
+			preflightHandler(allow).ServeHTTP(rw, req)
+			return
+		}
+		rw.Header().Set("Allow", allow+", OPTIONS")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
+// func pathParamHandler only passes requests for a single path segment under prefix (ie. /users/123) on to h,
+// responding 404 Not Found to any others
+func pathParamHandler(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		param := strings.TrimPrefix(req.URL.Path, prefix)
+		if param == "" || strings.Contains(param, "/") {
+			http.NotFound(rw, req)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// func RegisterServeMuxResource adds the same authenticated CRUD routes as RegisterResource to sm
+// (or http.DefaultServeMux if it's nil), for apps using InitServeMux. Unlike RegisterResource, requests for a single
+// entity are wrapped with MethodOverrideHandler
+func RegisterServeMuxResource(sm *http.ServeMux, path string, model interface{}) {
+	if sm == nil {
+		sm = http.DefaultServeMux
+	}
+	path = resourcePath(path)
+	rs := newResource(path, model)
+	sm.Handle(path, resourceHandler("GET, POST", AuthenticatedHandler(http.HandlerFunc(rs.serveCollection))))
+	sm.Handle(path+"/", resourceHandler("GET, PUT, PATCH, DELETE", MethodOverrideHandler(AuthenticatedHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, path+"/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(rw, req)
+			return
+		}
+		rs.serveItem(rw, req, id)
+	})))))
+}
+
+// func resourceHandler answers CORS preflight requests for a resource accepting methods, passing anything else on to h
+func resourceHandler(methods string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "OPTIONS" {
+			preflightHandler(methods).ServeHTTP(rw, req)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
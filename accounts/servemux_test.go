@@ -0,0 +1,59 @@
+package accounts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestServeMux(c *C) {
+	sm := http.NewServeMux()
+	InitServeMux(sm, "")
+
+	req, err := http.NewRequest("GET", "/accounts/new", nil)
+	c.Assert(err, IsNil)
+	_, pattern := sm.Handler(req)
+	c.Assert(pattern, Equals, "/accounts/new")
+
+	rw := httptest.NewRecorder()
+	sm.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(rw.Header().Get("Allow"), Equals, "POST, OPTIONS")
+
+	// Routes with a path parameter are routed for a single segment under their prefix
+	req, err = http.NewRequest("POST", "/accounts/users/123", nil)
+	c.Assert(err, IsNil)
+	_, pattern = sm.Handler(req)
+	c.Assert(pattern, Equals, "/accounts/users/")
+	rw = httptest.NewRecorder()
+	sm.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(rw.Header().Get("Allow"), Equals, "GET, PUT, DELETE, OPTIONS")
+
+	req, err = http.NewRequest("GET", "/accounts/users/123/other", nil)
+	c.Assert(err, IsNil)
+	rw = httptest.NewRecorder()
+	sm.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusNotFound)
+}
+
+func (s *MySuite) TestPreflight(c *C) {
+	sm := http.NewServeMux()
+	InitServeMux(sm, "")
+
+	req, err := http.NewRequest("OPTIONS", "/accounts/new", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rw := httptest.NewRecorder()
+	sm.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusNoContent)
+	c.Assert(rw.Header().Get("Access-Control-Allow-Origin"), Equals, CorsAllowOrigin)
+	c.Assert(rw.Header().Get("Access-Control-Allow-Methods"), Equals, "POST, OPTIONS")
+	allowed := rw.Header().Get("Access-Control-Allow-Headers")
+	for _, header := range Headers {
+		c.Assert(strings.Contains(allowed, header), Equals, true)
+	}
+}
@@ -5,19 +5,23 @@ import (
 	. "gopkg.in/check.v1"
 
 	"github.com/mrvdot/appengine/aeutils"
-	"appengine/aetest"
-	"appengine/datastore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
 )
 
 // Setup test suite
 type MySuite struct{}
 
 var (
-	_            = Suite(&MySuite{})
-	elType       = "MyType"
-	elIdentifier = "MyIdentifier"
-	ctx          aetest.Context
-	validAccount = &Account{
+	_              = Suite(&MySuite{})
+	elType         = "MyType"
+	elIdentifier   = "MyIdentifier"
+	ctx            context.Context
+	done           func()
+	publicIDSecret = []byte("accounts test public ID secret")
+	validAccount   = &Account{
 		Name:   "Valid Account",
 		Active: true,
 	}
@@ -30,10 +34,11 @@ func Test(t *testing.T) {
 
 func (s *MySuite) SetUpSuite(c *C) {
 	var err error
-	ctx, err = aetest.NewContext(nil)
+	ctx, done, err = aetest.NewContext()
 	if err != nil {
 		c.Fatal("Failed to create appengine context")
 	}
+	c.Assert(aeutils.SetPublicIDSecret(publicIDSecret), IsNil)
 	// Create an initial account for testing
 	key, err := aeutils.Save(ctx, validAccount)
 	c.Assert(err, IsNil)
@@ -42,5 +47,5 @@ func (s *MySuite) SetUpSuite(c *C) {
 }
 
 func (s *MySuite) TearDownSuite(c *C) {
-	ctx.Close()
+	done()
 }
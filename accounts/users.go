@@ -0,0 +1,241 @@
+package accounts
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// func listUsers lists the users of the authenticated account, taking "limit" (up to ResourceLimit) and "offset" parameters
+func listUsers(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	acct, err := GetAccount(ctx)
+	if err != nil {
+		respondAuthError(rw, req, err)
+		return
+	}
+	limit, offset := pageParams(req.URL.Query())
+	users := []*User{}
+	_, err = aeutils.Query(&User{}).
+		Filter("AccountKey =", acct.GetKey(ctx)).
+		Limit(limit).
+		Offset(offset).
+		GetAll(ctx, &users)
+	if err != nil {
+		errorf(ctx, "[accounts/listUsers] %v", err.Error())
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: users,
+		Data: map[string]interface{}{
+			"limit":  limit,
+			"offset": offset,
+		},
+	})
+}
+
+// func createUser adds a user to the authenticated account from the JSON User posted. Only account admins
+// (or requests authenticated with the account's API key) can add users, or give them a role
+func createUser(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	acct, err := GetAccount(ctx)
+	if err != nil {
+		respondAuthError(rw, req, err)
+		return
+	}
+	if !canManageUsers(ctx) {
+		RespondTo(rw, req, manageUsersForbidden())
+		return
+	}
+	u := &User{}
+	limitBody(rw, req)
+	err = json.NewDecoder(req.Body).Decode(u)
+	req.Body.Close()
+	if err != nil {
+		RespondTo(rw, req, bodyError(err))
+		return
+	}
+	if u.Username == "" && u.Email == "" {
+		apiErr := NewApiError(http.StatusBadRequest, ErrorCodeValidation, "A username or email must be provided")
+		apiErr.Field = "username"
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	if u.Role != "" && !validRole(u.Role) {
+		RespondTo(rw, req, invalidRole())
+		return
+	}
+	u.ID = 0
+	u.AccountKey = acct.GetKey(ctx)
+	if _, err = aeutils.Save(ctx, u, aeutils.CreateOnly()); err != nil {
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error saving new user: " + apiErr.Message
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: u,
+	})
+}
+
+// func getUser responds with the user of the authenticated account with the ID at the end of the path
+func getUser(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	u, err := accountUser(ctx, pathParam(req))
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: u,
+	})
+}
+
+// func updateUser replaces the fields of a user of the authenticated account with those of the JSON User sent
+// Users can update themselves, but only account admins can update others, or change anyone's role
+func updateUser(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	u, err := accountUser(ctx, pathParam(req))
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	manager := canManageUsers(ctx)
+	if !manager && !isCurrentUser(ctx, u) {
+		RespondTo(rw, req, manageUsersForbidden())
+		return
+	}
+	key, role, accountKey := u.Key, u.Role, u.AccountKey
+	limitBody(rw, req)
+	err = json.NewDecoder(req.Body).Decode(u)
+	req.Body.Close()
+	if err != nil {
+		RespondTo(rw, req, bodyError(err))
+		return
+	}
+	if u.Role != role {
+		if !manager {
+			apiErr := NewApiError(http.StatusForbidden, ErrorCodeForbidden, "Only account admins can change a user's role")
+			apiErr.Field = "role"
+			RespondTo(rw, req, apiErr)
+			return
+		}
+		if !validRole(u.Role) {
+			RespondTo(rw, req, invalidRole())
+			return
+		}
+	}
+	u.ID, u.Key, u.AccountKey = key.IntID(), key, accountKey
+	if _, err = aeutils.Save(ctx, u, aeutils.WithKey(key), aeutils.UpdateOnly()); err != nil {
+		apiErr := ErrorResponse(err)
+		apiErr.Message = "Error saving user: " + apiErr.Message
+		RespondTo(rw, req, apiErr)
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: u,
+	})
+}
+
+// func deleteUser deletes a user of the authenticated account, for account admins only
+func deleteUser(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	if !canManageUsers(ctx) {
+		RespondTo(rw, req, manageUsersForbidden())
+		return
+	}
+	u, err := accountUser(ctx, pathParam(req))
+	if err == nil {
+		err = aeutils.Delete(ctx, u)
+	}
+	if err != nil {
+		RespondTo(rw, req, ErrorResponse(err))
+		return
+	}
+	RespondTo(rw, req, &utils.ApiResponse{
+		Code:   200,
+		Result: u,
+	})
+}
+
+// func accountUser loads the user with the public ID id (see aeutils.PublicID), or numeric ID if no public ID secret is set,
+// returning a 404 ApiError if there isn't one in the authenticated account
+func accountUser(ctx context.Context, id string) (*User, error) {
+	acct, err := GetAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	notFound := NewApiError(http.StatusNotFound, ErrorCodeNotFound, "No user matches that ID")
+	key, err := aeutils.ResolvePublicID(ctx, id, "User")
+	if err == aeutils.ErrNoPublicIDs {
+		intID, parseErr := strconv.ParseInt(id, 10, 64)
+		if parseErr != nil || intID <= 0 {
+			return nil, notFound
+		}
+		key, err = datastore.NewKey(ctx, "User", "", intID, nil), nil
+	}
+	if _, ok := err.(*aeutils.KeyError); ok {
+		return nil, notFound
+	} else if err != nil {
+		return nil, err
+	}
+	u := &User{}
+	if err = aeutils.GetByKey(ctx, key, u); err == datastore.ErrNoSuchEntity {
+		return nil, notFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !u.AccountKey.Equal(acct.GetKey(ctx)) {
+		return nil, notFound
+	}
+	u.Key = key
+	return u, nil
+}
+
+// func canManageUsers returns whether ctx's request can add, delete and change the roles of the account's users,
+// ie. it was authenticated by an account admin, or at the account level (with the API key, or a session created by it)
+// Sessions for a user are never treated as account level, even if the user couldn't be loaded
+func canManageUsers(ctx context.Context) bool {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return false
+	}
+	if user != nil {
+		return user.IsAdmin()
+	}
+	session, _ := GetSession(ctx)
+	return session == nil || session.User == nil
+}
+
+// func isCurrentUser returns whether u is the user ctx's request was authenticated as
+func isCurrentUser(ctx context.Context, u *User) bool {
+	user, _ := GetUser(ctx)
+	return user != nil && user.GetKey(ctx).Equal(u.Key)
+}
+
+// func validRole returns whether role is one a user can be given
+func validRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember
+}
+
+func invalidRole() *ApiError {
+	apiErr := NewApiError(http.StatusBadRequest, ErrorCodeValidation, "Role must be "+RoleAdmin+" or "+RoleMember)
+	apiErr.Field = "role"
+	return apiErr
+}
+
+func manageUsersForbidden() *ApiError {
+	return NewApiError(http.StatusForbidden, ErrorCodeForbidden, "Only account admins can manage users")
+}
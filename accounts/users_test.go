@@ -0,0 +1,79 @@
+package accounts
+
+import (
+	"encoding/json"
+	"net/http"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func (s *MySuite) TestUserJSON(c *C) {
+	u := &User{Username: "someone", Password: "secret", Role: RoleAdmin}
+	body, err := json.Marshal(u)
+	c.Assert(err, IsNil)
+	fields := map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &fields), IsNil)
+	c.Assert(fields["username"], Equals, "someone")
+	c.Assert(fields["role"], Equals, RoleAdmin)
+	_, ok := fields["password"]
+	c.Assert(ok, Equals, false)
+
+	// Passwords can still be sent in
+	decoded := &User{}
+	c.Assert(json.Unmarshal([]byte(`{"username": "someone", "password": "secret"}`), decoded), IsNil)
+	c.Assert(decoded.Password, Equals, "secret")
+
+	// IDs are sent as public IDs, and ignored when sent in
+	u.ID = 42
+	body, err = json.Marshal(u)
+	c.Assert(err, IsNil)
+	c.Assert(json.Unmarshal(body, &fields), IsNil)
+	public, err := aeutils.EncodePublicID("User", 42)
+	c.Assert(err, IsNil)
+	c.Assert(fields["id"], Equals, public)
+	c.Assert(json.Unmarshal(body, decoded), IsNil)
+	c.Assert(decoded.ID, Equals, int64(0))
+	c.Assert(decoded.Username, Equals, "someone")
+
+	// Without a public ID secret, the numeric ID is sent
+	aeutils.SetPublicIDs(nil)
+	defer aeutils.SetPublicIDSecret(publicIDSecret)
+	body, err = json.Marshal(u)
+	c.Assert(err, IsNil)
+	c.Assert(json.Unmarshal(body, &fields), IsNil)
+	c.Assert(fields["id"], Equals, float64(42))
+	id, err := resourceID(datastore.NewKey(ctx, "Account", "", 42, nil))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, aeutils.EncodeKey(datastore.NewKey(ctx, "Account", "", 42, nil)))
+}
+
+func (s *MySuite) TestUserRoles(c *C) {
+	reqId := appengine.RequestID(ctx)
+	defer delete(authenticatedAccounts, reqId)
+	defer delete(authenticatedSessions, reqId)
+	defer delete(authenticatedUsers, reqId)
+
+	storeAuthenticatedRequest(ctx, validAccount, nil, nil)
+	c.Assert(canManageUsers(ctx), Equals, true)
+	storeAuthenticatedRequest(ctx, validAccount, nil, &User{Role: RoleMember})
+	c.Assert(canManageUsers(ctx), Equals, false)
+	storeAuthenticatedRequest(ctx, validAccount, nil, &User{Role: RoleAdmin})
+	c.Assert(canManageUsers(ctx), Equals, true)
+	// A user's session is never account level, even if the user isn't loaded
+	userSession := &Session{User: datastore.NewKey(ctx, "User", "", 42, nil)}
+	storeAuthenticatedRequest(ctx, validAccount, userSession, nil)
+	c.Assert(canManageUsers(ctx), Equals, false)
+	storeAuthenticatedRequest(ctx, validAccount, &Session{}, nil)
+	c.Assert(canManageUsers(ctx), Equals, true)
+	delete(authenticatedUsers, reqId)
+	c.Assert(canManageUsers(ctx), Equals, false)
+
+	c.Assert(validRole(RoleMember), Equals, true)
+	c.Assert(validRole("owner"), Equals, false)
+	_, err := accountUser(ctx, "not-an-id")
+	c.Assert(ErrorResponse(err).Code, Equals, http.StatusNotFound)
+}
@@ -0,0 +1,132 @@
+package accounts
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+var (
+	// WebhookSignatureHeader carries the signature of an incoming webhook, "sha256=" then the hex HMAC-SHA256
+	// of the timestamp, a ".", then the body (see SignWebhook)
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookTimestampHeader carries the time (in Unix seconds) an incoming webhook was signed
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	// WebhookTolerance is how far the timestamp of an incoming webhook may be from now, so captured requests can't be replayed later
+	WebhookTolerance = 5 * time.Minute
+	// WebhookMaxBytes limits the size of an incoming webhook's body
+	WebhookMaxBytes int64 = 1 << 20
+	// InvalidWebhookSignature is returned when an incoming webhook's signature is missing or doesn't match its body
+	InvalidWebhookSignature = errors.New("Webhook signature is not valid")
+	// WebhookExpired is returned when an incoming webhook's timestamp is missing or outside WebhookTolerance
+	WebhookExpired = errors.New("Webhook timestamp is outside the allowed window")
+)
+
+// WebhookSecretLookup returns the secret webhooks for acct are signed with
+type WebhookSecretLookup func(ctx context.Context, acct *Account) ([]byte, error)
+
+// WebhookFunc handles a verified webhook for acct. Returning an error responds with it (see ErrorResponse)
+type WebhookFunc func(ctx context.Context, acct *Account, body []byte) error
+
+// func SignWebhook returns the signature for a webhook body sent at timestamp, as WebhookReceiver expects in WebhookSignatureHeader
+func SignWebhook(secret []byte, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// func WebhookReceiver returns a handler for incoming webhooks. The account a webhook is for is taken from the account
+// header (see Headers) or "account" query parameter, and its secret from secretLookup. Webhooks are only passed to fn if
+// they're signed with that (non-empty) secret (see SignWebhook) within WebhookTolerance of now, otherwise they're rejected
+// with a 401. Webhooks for deactivated accounts are rejected with a 403
+// While fn runs, the account is authenticated for the request, so GetAccount, aeutils history, etc. work as usual
+func WebhookReceiver(secretLookup WebhookSecretLookup, fn WebhookFunc) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := appengine.NewContext(req)
+		slug := req.Header.Get(header(ctx, "account"))
+		if slug == "" {
+			// Not FormValue, which would consume a form encoded body before it's verified
+			slug = req.URL.Query().Get("account")
+		}
+		if slug == "" {
+			respondAuthError(rw, req, Unauthenticated)
+			return
+		}
+		acct := &Account{}
+		if err := aeutils.GetBySlug(ctx, slug, acct); err != nil {
+			respondAuthError(rw, req, NoSuchAccount)
+			return
+		}
+		if !acct.Deactivated.IsZero() {
+			respondAuthError(rw, req, AccountDeactivated)
+			return
+		}
+		secret, err := secretLookup(ctx, acct)
+		if err != nil {
+			errorf(ctx, "[accounts/WebhookReceiver] %v", err.Error())
+			RespondTo(rw, req, ErrorResponse(err))
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, WebhookMaxBytes+1))
+		req.Body.Close()
+		if err != nil {
+			RespondTo(rw, req, NewApiError(http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error()))
+			return
+		}
+		if int64(len(body)) > WebhookMaxBytes {
+			RespondTo(rw, req, NewApiError(http.StatusRequestEntityTooLarge, ErrorCodeInvalidRequest, "Webhook body is too large"))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err = verifyWebhook(req, secret, body, time.Now()); err != nil {
+			warningf(ctx, "[accounts/WebhookReceiver] %v for %v", err.Error(), slug)
+			respondAuthError(rw, req, err)
+			return
+		}
+		storeAuthenticatedRequest(ctx, acct, nil, nil)
+		defer ClearAuthenticatedRequest(req)
+		if err = fn(ctx, acct, body); err != nil {
+			errorf(ctx, "[accounts/WebhookReceiver] %v", err.Error())
+			RespondTo(rw, req, ErrorResponse(err))
+			return
+		}
+		RespondTo(rw, req, &utils.ApiResponse{Code: 200})
+	})
+}
+
+// func verifyWebhook checks req was signed with secret within WebhookTolerance of now. An empty secret never verifies,
+// as anyone could sign with it
+func verifyWebhook(req *http.Request, secret, body []byte, now time.Time) error {
+	if len(secret) == 0 {
+		return InvalidWebhookSignature
+	}
+	unix, err := strconv.ParseInt(req.Header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return WebhookExpired
+	}
+	timestamp := time.Unix(unix, 0)
+	if timestamp.Before(now.Add(-WebhookTolerance)) || timestamp.After(now.Add(WebhookTolerance)) {
+		return WebhookExpired
+	}
+	signature := strings.TrimSpace(req.Header.Get(WebhookSignatureHeader))
+	if !hmac.Equal([]byte(signature), []byte(SignWebhook(secret, timestamp, body))) {
+		return InvalidWebhookSignature
+	}
+	return nil
+}
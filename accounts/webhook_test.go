@@ -0,0 +1,30 @@
+package accounts
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestVerifyWebhook(c *C) {
+	secret := []byte("webhook-secret")
+	body := []byte(`{"event":"test"}`)
+	now := time.Now()
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	c.Assert(verifyWebhook(req, secret, body, now), Equals, WebhookExpired)
+
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(secret, now, body))
+	c.Assert(verifyWebhook(req, secret, body, now), IsNil)
+	c.Assert(verifyWebhook(req, []byte("other-secret"), body, now), Equals, InvalidWebhookSignature)
+	c.Assert(verifyWebhook(req, secret, []byte(`{"event":"forged"}`), now), Equals, InvalidWebhookSignature)
+	c.Assert(verifyWebhook(req, secret, body, now.Add(WebhookTolerance+time.Minute)), Equals, WebhookExpired)
+
+	// Signed with an empty secret
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(nil, now, body))
+	c.Assert(verifyWebhook(req, nil, body, now), Equals, InvalidWebhookSignature)
+	c.Assert(ErrorResponse(InvalidWebhookSignature).Code, Equals, http.StatusUnauthorized)
+}
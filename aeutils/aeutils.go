@@ -3,143 +3,490 @@
 package aeutils
 
 import (
-	"errors"
-	"fmt"
+	"math"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/mrvdot/golang-utils"
-	"github.com/qedus/nds"
 
-	"appengine"
-	"appengine/datastore"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
 )
 
 var (
-	// Set to true to use NDS package for Put/Get methods
+	// Set to true to use NDS package for Put/Get methods (see NDSBackend)
 	UseNDS = false
+
+	keyType = reflect.TypeOf(&datastore.Key{})
 )
 
 // GenerateUniqueSlug generates a slug that's unique within the datastore for this type
 // Uses utils.GenerateSlug for initial slug, and appends "-N" where N is an auto-incrementing number
 // Until it finds a slug that doesn't already exist for this kind
-func GenerateUniqueSlug(ctx appengine.Context, kind string, s string) (slug string) {
-	slug = utils.GenerateSlug(s)
-	others, err := datastore.NewQuery(kind).
-		Filter("Slug = ", slug).
-		Count(ctx)
+// Existing slugs are found with a single projection query, and the chosen slug is then reserved
+// with a sentinel entity in a transaction, so concurrent calls can never return the same slug
+// (see ReleaseSlug). As it runs a query, it can't be called within a transaction
+func GenerateUniqueSlug(ctx context.Context, kind string, s string) (slug string) {
+	return GenerateUniqueSlugField(ctx, kind, "Slug", s)
+}
+
+// GenerateUniqueSlugField is like GenerateUniqueSlug, but for slugs stored in a property other than 'Slug'
+func GenerateUniqueSlugField(ctx context.Context, kind, field string, s string) (slug string) {
+	return generateUniqueSlug(ctx, nil, kind, field, s)
+}
+
+// GenerateUniqueSlugInNamespace is like GenerateUniqueSlug, but the slug is only unique within namespace
+// (as is the case for any of the slug functions given a namespaced context). Release it with ReleaseSlug and a context for namespace
+func GenerateUniqueSlugInNamespace(ctx context.Context, namespace, kind string, s string) (slug string) {
+	nctx, err := appengine.Namespace(ctx, namespace)
 	if err != nil {
-		ctx.Errorf("[aeutils/GenerateUniqueSlug] %v", err.Error())
+		log.Errorf(ctx, "[aeutils/GenerateUniqueSlug] %v", err.Error())
 		return ""
 	}
-	if others == 0 {
-		return slug
-	}
-	counter := 2
-	baseSlug := slug
-	for others > 0 {
-		slug = fmt.Sprintf("%v-%d", baseSlug, counter)
-		others, err = datastore.NewQuery(kind).
-			Filter("Slug = ", slug).
-			Count(ctx)
-		if err != nil {
-			ctx.Errorf("[aeutils/GenerateUniqueSlug] %v", err.Error())
+	return generateUniqueSlug(nctx, nil, kind, "Slug", s)
+}
+
+// GenerateUniqueSlugWithin is like GenerateUniqueSlugField, but the slug only has to be unique among entities of kind
+// that have ancestor as an ancestor, ie. posts within one account. Release it with ReleaseSlugWithin
+// In production, the query for existing slugs needs a composite index on field with ancestor: yes (see RecordIndexes)
+func GenerateUniqueSlugWithin(ctx context.Context, ancestor *datastore.Key, kind, field string, s string) (slug string) {
+	return generateUniqueSlug(ctx, ancestor, kind, field, s)
+}
+
+// generateUniqueSlug generates a slug for field that's unique within kind, or just the entities of kind under ancestor if it's not nil
+func generateUniqueSlug(ctx context.Context, ancestor *datastore.Key, kind, field string, s string) (slug string) {
+	if ancestor != nil {
+		// Reservations are stored under ancestor, so must be in it's namespace
+		var err error
+		if ctx, err = appengine.Namespace(ctx, ancestor.Namespace()); err != nil {
+			log.Errorf(ctx, "[aeutils/GenerateUniqueSlug] %v", err.Error())
 			return ""
 		}
-		counter = counter + 1
 	}
-	return slug
-}
-
-// PreSave checks for
-// * Method 'BeforeSave' that receives appengine.Context as it's first parameter
-//   This can be used for any on save actions that need to be performed (generate a slug, store LastUpdated, or create Key field (see below))
-func PreSave(ctx appengine.Context, obj interface{}) error {
-	kind, val := reflect.TypeOf(obj), reflect.ValueOf(obj)
-	str := val
-	if val.Kind() == reflect.Ptr {
-		kind, str = kind.Elem(), val.Elem()
+	base := utils.GenerateSlug(s)
+	var existing []datastore.PropertyList
+	_, err := backend().GetAll(ctx, &BackendQuery{
+		Kind:       kind,
+		Ancestor:   ancestor,
+		Projection: []string{field},
+		Filters:    []Filter{{field + " >=", base}, {field + " <", base + "\ufffd"}},
+	}, &existing)
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/GenerateUniqueSlug] %v", err.Error())
+		return ""
 	}
-	if str.Kind() != reflect.Struct {
-		return errors.New(fmt.Sprintf("Must pass a valid object (struct) to aeutils.Save: passed %v", str.Kind()))
+	taken := map[string]bool{}
+	for _, props := range existing {
+		for _, p := range props {
+			if existingSlug, ok := p.Value.(string); ok && p.Name == field {
+				taken[existingSlug] = true
+			}
+		}
 	}
-	preSave(ctx, val)
-	return nil
+	slug, err = reserveSlug(ctx, ancestor, kind, field, base, taken)
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/GenerateUniqueSlug] %v", err.Error())
+		return ""
+	}
+	return slug
 }
 
-// internal presave method that uses values, so we don't have to check twice
-func preSave(ctx appengine.Context, val reflect.Value) {
-	if bsMethod := val.MethodByName("BeforeSave"); bsMethod.IsValid() {
-		bsMethod.Call([]reflect.Value{reflect.ValueOf(ctx)})
+// PreSave sets any zero valued fields tagged `default:"..."` to that value (strings, bools, numbers and time.Duration), then checks for
+// * Method 'BeforeSave' that receives context.Context as it's first parameter
+//   This can be used for any on save actions that need to be performed (generate a slug, store LastUpdated, or create Key field (see below))
+//   BeforeSave may optionally return an error, in which case that error is returned and the save should be aborted
+//   It may also take the *datastore.Key obj is about to be stored at as it's second parameter (see KeyedBeforeSaver),
+//   which is nil if obj doesn't have a key yet (so is being created)
+// * Hooks registered for obj's kind with OnBeforeSave, which run after BeforeSave
+func PreSave(ctx context.Context, obj interface{}) error {
+	_, _, str, err := structValue(obj)
+	if err != nil {
+		return err
 	}
+	return preSave(ctx, obj, str)
 }
 
-// Save takes an appengine.Context and an struct (or pointer to struct) to save in the datastore
+// Save takes an context.Context and an struct (or pointer to struct) to save in the datastore
 // Uses reflection to validate obj is able to be saved. Additionally checks for:
 //
+// * Struct tag `default:"..."` on any fields that should be set to that value if they're still zero values (see PreSave)
 // * Field 'Key' of kind *datastore.Key. If exists and has a valid key, uses that for storing in datastore
 // 	 ** Important. Due to datastore limitations, this field must not actually be stored in the datastore (ie, needs struct tag `datastore:"-")
-// * Field 'ID' of kind int64 to be used as the numeric ID for a datastore key
+// * Field 'StringID' or 'KeyName' of kind string (or any string field tagged `aekey:"name"`) to be used as the string ID
+//   (key name) for a datastore key, if it's not empty and no key was retrieved from the Key field
+// * Field 'ID' of kind int64 to be used as the numeric ID for a datastore key. Any other integer kind (including custom types)
+//   also works, though unsigned fields must be tagged `datastore:"-"` (the datastore package can't store them), and an *IDRangeError
+//   is returned if an ID doesn't fit
 //	 If key was not retrieved from Key field, ID field is used to create a new key based on that ID
 //	 If struct has ID field but no value for it, Save allocates an ID from the datastore and sets it in that field before saving
-// * Method 'AfterSave' that receives appengine.Context and *datastore.Key as it's parameters
+// * Method 'GetParentKey' that receives context.Context (see ParentKeyGetter), or field 'Parent' of kind *datastore.Key
+//   If either returns a key, new keys are created as children of it, storing obj in that entity group
+// * Method 'AfterSave' that receives context.Context and *datastore.Key as it's parameters
 //   Useful for any post save processing that you might want to do
+// * Fields 'CreatedAt' and 'UpdatedAt' of kind time.Time (or any time.Time fields tagged `aetime:"created"` or `aetime:"updated"`)
+//   Created fields are set to the current time if they're still zero, updated fields are set on every save
+// * Field 'Version' of kind int64. If exists, obj is stored within a transaction that first checks the stored entity
+//   still has the same Version, returning a *ConflictError if not. Version is incremented on every successful save
+//   (Note: SaveMulti does not check versions)
+// * Struct tag `aeslug:"source=Title,target=Permalink"` on any field. If the target field (defaulting to the tagged field)
+//   is empty, it's set to a unique slug generated from the source field (defaulting to 'Name') before saving
+//   Add `scope=parent` to the tag for slugs that only need to be unique within obj's parent (see GenerateUniqueSlugWithin)
+// * Struct tag `aeunique:"true"` on any fields that must be unique within the kind. Values are claimed with sentinel
+//   entities in the same transaction obj is stored in, returning a *UniqueError if another entity already has one
+//   Use `aeunique:"scope=AccountKey"` for values that only need to be unique among entities with the same AccountKey
+//   (SaveMulti claims values before storing, but doesn't release previous values)
+// * Struct tag `aecrypt:"true"` on any string or []byte fields that should be encrypted when stored (see SetEncryptionKey)
+//   obj keeps the plaintext values, and the Get and Query helpers decrypt them again when loading
+//   They can't also be tagged `aeunique`, as their stored values differ each time they're saved
+// * Struct tag `aejson:"true"` on any fields the datastore can't store directly (maps, nested structs or slices of them)
+//   They're stored as unindexed JSON encoded []byte properties, and decoded again by the Get and Query helpers
+//   As the datastore package must skip them itself, these fields also need the tag `datastore:"-"`
+// * Struct tag `aesearch:"lower"` on any string fields that need case insensitive lookups (ie. usernames or emails)
+//   A lowercased, trimmed copy of each is stored in an extra indexed property (see SearchProperty, Search and GetBySearch)
+// * Struct tag `aeindex:"text"` on any string fields that need full-text search. Once stored, they're written to a document
+//   in the Search API index for obj's kind (in ctx's namespace), which is removed again by Delete (see the Search function)
+// * Struct tag `aevalidate:"required,max=255,email"` and method 'Validate' (see Validate). If obj is invalid,
+//   it's not stored and a *ValidationError is returned
+// * Entities that are too large for the datastore (see MaxEntitySize), or have an indexed string property that is
+//   (see MaxIndexedSize), aren't stored and an *EntityTooLargeError is returned naming the problem
+// * Kinds with history tracking enabled (see TrackHistory) also get a Revision stored as a child entity
 //
+// If a 'BeforeSave' method returns an error, obj is not stored and that error is returned.
 // Finally, ID and Key fields (if they exist) are set with any generated values from Saving obj
-func Save(ctx appengine.Context, obj interface{}) (key *datastore.Key, err error) {
-	kind, val := reflect.TypeOf(obj), reflect.ValueOf(obj)
-	str := val
+// Pass DryRun() to run all of the above without storing anything, SkipHooks() to store obj without calling BeforeSave
+// or AfterSave, or CreateOnly() or UpdateOnly() to only store obj if it doesn't (or does) already exist
+func Save(ctx context.Context, obj interface{}, opts ...SaveOption) (key *datastore.Key, err error) {
+	options := newSaveOptions(opts)
+	kind, _, str, err := structValue(obj)
+	if err != nil {
+		return nil, err
+	}
+	if options.skipHooks {
+		err = setDefaults(str)
+	} else {
+		err = preSave(ctx, obj, str)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setTimestamps(str)
+	dsKind := getDatastoreKind(kind)
+	if !options.dryRun {
+		// Generating a slug reserves it, so only happens for real
+		if err = setSlug(ctx, obj, str, dsKind); err != nil {
+			return nil, err
+		}
+	}
+	if err = Validate(ctx, obj); err != nil {
+		return nil, err
+	}
+	if err = checkIDField(str, dsKind); err != nil {
+		return nil, err
+	}
+	key = resolveKey(ctx, obj, str, dsKind)
+	if options.key != nil {
+		key = options.key
+	}
+	if key == nil && options.updateOnly {
+		return nil, &ErrNoKey{Kind: dsKind, Op: "update"}
+	} else if key == nil && options.dryRun {
+		key = datastore.NewIncompleteKey(ctx, dsKind, parentKey(ctx, obj, str))
+	} else if key == nil {
+		parent := parentKey(ctx, obj, str)
+		newId, _, err := backend().AllocateIDs(ctx, dsKind, parent, 1)
+		if err == nil {
+			if field, ok := idField(str); ok {
+				if err = setFieldID(field, dsKind, newId); err != nil {
+					return nil, err
+				}
+			}
+			key = datastore.NewKey(ctx, dsKind, "", newId, parent)
+		} else {
+			key = datastore.NewIncompleteKey(ctx, dsKind, parent)
+		}
+	}
+	entity, err := entityFor(obj, str)
+	if err != nil {
+		return nil, err
+	}
+	restore, err := encryptFields(str)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkEntitySize(dsKind, key, entity); err != nil || options.dryRun {
+		restore()
+		if err != nil {
+			log.Errorf(ctx, "[aeutils/Save]: %v", err.Error())
+			return nil, err
+		}
+		return key, nil
+	}
+	target := key
+	start := time.Now()
+	put := func(ctx context.Context) (err error) {
+		if fields := uniqueFields(kind); len(fields) > 0 {
+			key, err = putUnique(ctx, target, entity, str, fields)
+		} else if version, ok := versionField(str); ok {
+			key, err = putVersioned(ctx, target, entity, str, version)
+		} else {
+			key, err = backend().Put(ctx, target, entity)
+		}
+		return
+	}
+	err = withRetry(ctx, func(ctx context.Context) error {
+		if !options.createOnly && !options.updateOnly {
+			return put(ctx)
+		}
+		return ensureTransaction(ctx, func(tc context.Context) error {
+			if err := options.checkExists(tc, target); err != nil {
+				return err
+			}
+			return put(tc)
+		})
+	})
+	trace(ctx, "Put", dsKind, start, err)
+	if err == nil {
+		recordHistory(ctx, []*datastore.Key{key}, []interface{}{obj})
+	}
+	restore()
+	if err != nil {
+		err = saveError(dsKind, target, err)
+		log.Errorf(ctx, "[aeutils/Save]: %v", err.Error())
+	} else {
+		postSave(ctx, obj, str, key, !options.skipHooks)
+	}
+	return
+}
+
+// SaveMulti saves a batch of structs (or pointers to structs) with the same conventions as Save,
+// but with a single PutMulti call. All BeforeSave methods are called first (and if any returns an error, nothing is stored), then any missing IDs are
+// allocated with one AllocateIDs call per kind (and parent), and finally AfterSave is called on each object once stored
+func SaveMulti(ctx context.Context, objs []interface{}) (keys []*datastore.Key, err error) {
+	if len(objs) == 0 {
+		return nil, nil
+	}
+	type idBatch struct {
+		kind    string
+		parent  *datastore.Key
+		indexes []int
+	}
+	strs := make([]reflect.Value, len(objs))
+	keys = make([]*datastore.Key, len(objs))
+	needIds := map[string]*idBatch{}
+	for i, obj := range objs {
+		var kind reflect.Type
+		kind, _, strs[i], err = structValue(obj)
+		if err != nil {
+			return nil, err
+		}
+		if err = preSave(ctx, obj, strs[i]); err != nil {
+			return nil, err
+		}
+		setTimestamps(strs[i])
+		dsKind := getDatastoreKind(kind)
+		if err = setSlug(ctx, obj, strs[i], dsKind); err != nil {
+			return nil, err
+		}
+		if err = Validate(ctx, obj); err != nil {
+			return nil, err
+		}
+		if err = checkIDField(strs[i], dsKind); err != nil {
+			return nil, err
+		}
+		// Checked before any unique values are claimed, as they're encrypted afterwards
+		if _, err = cryptFields(kind); err != nil {
+			return nil, err
+		}
+		if keys[i] = resolveKey(ctx, obj, strs[i], dsKind); keys[i] == nil {
+			parent := parentKey(ctx, obj, strs[i])
+			batchKey := dsKind
+			if parent != nil {
+				batchKey += "|" + parent.Encode()
+			}
+			if needIds[batchKey] == nil {
+				needIds[batchKey] = &idBatch{kind: dsKind, parent: parent}
+			}
+			needIds[batchKey].indexes = append(needIds[batchKey].indexes, i)
+		}
+	}
+	for _, batch := range needIds {
+		low, _, err := backend().AllocateIDs(ctx, batch.kind, batch.parent, len(batch.indexes))
+		for j, i := range batch.indexes {
+			if err != nil {
+				keys[i] = datastore.NewIncompleteKey(ctx, batch.kind, batch.parent)
+				continue
+			}
+			keys[i] = datastore.NewKey(ctx, batch.kind, "", low+int64(j), batch.parent)
+			if field, ok := idField(strs[i]); ok {
+				if err := setFieldID(field, batch.kind, keys[i].IntID()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	// Unique values are claimed ahead of the PutMulti, so give back any new claims if the batch isn't stored
+	var claimed []*datastore.Key
+	defer func() {
+		if err != nil {
+			dropClaims(ctx, claimed)
+		}
+	}()
+	for i, str := range strs {
+		if fields := uniqueFields(str.Type()); len(fields) > 0 {
+			reservations, err := claimUniques(ctx, keys[i], str, fields)
+			if err != nil {
+				return nil, err
+			}
+			claimed = append(claimed, reservations...)
+		}
+	}
+	entities := make([]interface{}, len(objs))
+	for i, obj := range objs {
+		if entities[i], err = entityFor(obj, strs[i]); err != nil {
+			return nil, err
+		}
+	}
+	restores := make([]func(), 0, len(strs))
+	restoreAll := func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+	for _, str := range strs {
+		restore, err := encryptFields(str)
+		if err != nil {
+			restoreAll()
+			return nil, err
+		}
+		restores = append(restores, restore)
+	}
+	for i, entity := range entities {
+		if err = checkEntitySize(keys[i].Kind(), keys[i], entity); err != nil {
+			restoreAll()
+			log.Errorf(ctx, "[aeutils/SaveMulti]: %v", err.Error())
+			return nil, err
+		}
+	}
+	start := time.Now()
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		stored, err := backend().PutMulti(ctx, keys, entities)
+		if err == nil {
+			keys = stored
+		}
+		return
+	})
+	trace(ctx, "PutMulti", KindOf(objs[0]), start, err)
+	if err == nil {
+		recordHistory(ctx, keys, objs)
+	}
+	restoreAll()
+	if err != nil {
+		err = saveError(KindOf(objs[0]), nil, err)
+		log.Errorf(ctx, "[aeutils/SaveMulti]: %v", err.Error())
+		return nil, err
+	}
+	for i, key := range keys {
+		postSave(ctx, objs[i], strs[i], key, true)
+	}
+	return
+}
+
+// structValue validates that obj is a struct (or pointer to struct), and returns its type, value and underlying struct value
+func structValue(obj interface{}) (kind reflect.Type, val, str reflect.Value, err error) {
+	kind, val = reflect.TypeOf(obj), reflect.ValueOf(obj)
+	str = val
 	if val.Kind() == reflect.Ptr {
 		kind, str = kind.Elem(), val.Elem()
 	}
 	if str.Kind() != reflect.Struct {
-		return nil, errors.New(fmt.Sprintf("Must pass a valid object (struct) to aeutils.Save: passed %v", str.Kind()))
+		err = &ErrNotStruct{Type: reflect.TypeOf(obj)}
 	}
-	preSave(ctx, val)
+	return
+}
+
+// resolveKey returns the key obj should be stored at. Checks, in order: the 'Key' field, a complete key from
+// a GetKey method (see KeyGetter), a non-empty key name field (see keyNameField), and a non-zero 'ID' field
+// Returns nil if none are available
+func resolveKey(ctx context.Context, obj interface{}, str reflect.Value, dsKind string) (key *datastore.Key) {
 	//check for key field first
-	keyField := str.FieldByName("Key")
-	if keyField.IsValid() {
+	if keyField := str.FieldByName("Key"); keyField.IsValid() {
 		keyInterface := keyField.Interface()
 		key, _ = keyInterface.(*datastore.Key)
 	}
-	idField := str.FieldByName("ID")
-	dsKind := getDatastoreKind(kind)
 	if key == nil {
-		if idField.IsValid() && isInt(idField.Kind()) && idField.Int() != 0 {
-			key = datastore.NewKey(ctx, dsKind, "", idField.Int(), nil)
-		} else {
-			newId, _, err := datastore.AllocateIDs(ctx, dsKind, nil, 1)
-			if err == nil {
-				if idField.IsValid() && isInt(idField.Kind()) {
-					idField.SetInt(newId)
-				}
-				key = datastore.NewKey(ctx, dsKind, "", newId, nil)
-			} else {
-				key = datastore.NewIncompleteKey(ctx, dsKind, nil)
+		if kg, ok := obj.(KeyGetter); ok {
+			if k := kg.GetKey(ctx); k != nil && !k.Incomplete() {
+				key = k
 			}
 		}
 	}
-	if UseNDS {
-		key, err = nds.Put(ctx, key, obj)
-	} else {
-		key, err = datastore.Put(ctx, key, obj)
+	if key == nil {
+		if nameField, ok := keyNameField(str); ok && nameField.String() != "" {
+			key = datastore.NewKey(ctx, dsKind, nameField.String(), 0, parentKey(ctx, obj, str))
+		}
 	}
-	if err != nil {
-		ctx.Errorf("[aeutils/Save]: %v", err.Error())
-	} else {
-		if keyField.IsValid() {
-			keyField.Set(reflect.ValueOf(key))
+	if key == nil {
+		if field, ok := idField(str); ok {
+			if id, ok := fieldID(field); ok {
+				key = datastore.NewKey(ctx, dsKind, "", id, parentKey(ctx, obj, str))
+			}
 		}
-		if idField.IsValid() && isInt(idField.Kind()) {
-			idField.SetInt(key.IntID())
+	}
+	return
+}
+
+// keyNameField returns the field holding the string ID (key name) for str: the first string field tagged `aekey:"name"`,
+// or otherwise a string field called 'StringID' or 'KeyName'
+func keyNameField(str reflect.Value) (field reflect.Value, ok bool) {
+	t := str.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("aekey") == "name" && t.Field(i).Type.Kind() == reflect.String {
+			return str.Field(i), true
+		}
+	}
+	for _, name := range []string{"StringID", "KeyName"} {
+		if field = str.FieldByName(name); field.IsValid() && field.Kind() == reflect.String {
+			return field, true
 		}
-		if asMethod := val.MethodByName("AfterSave"); asMethod.IsValid() {
-			asMethod.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(key)})
+	}
+	return field, false
+}
+
+// parentKey returns the parent key for obj, from a GetParentKey method (see ParentKeyGetter)
+// or a 'Parent' field of kind *datastore.Key. Returns nil for root entities
+func parentKey(ctx context.Context, obj interface{}, str reflect.Value) (parent *datastore.Key) {
+	if pg, ok := obj.(ParentKeyGetter); ok {
+		if parent = pg.GetParentKey(ctx); parent != nil {
+			return
 		}
 	}
+	if parentField := str.FieldByName("Parent"); parentField.IsValid() {
+		parent, _ = parentField.Interface().(*datastore.Key)
+	}
 	return
 }
 
+// setKeyFields sets the Key, ID, key name and Parent fields (if they exist) from key
+func setKeyFields(str reflect.Value, key *datastore.Key) {
+	if nameField, ok := keyNameField(str); ok && key.StringID() != "" {
+		nameField.SetString(key.StringID())
+	}
+	if keyField := str.FieldByName("Key"); keyField.IsValid() {
+		keyField.Set(reflect.ValueOf(key))
+	}
+	if field, ok := idField(str); ok {
+		// Can only fail if the ID didn't come from this field, so leave it be
+		setFieldID(field, key.Kind(), key.IntID())
+	}
+	if parentField := str.FieldByName("Parent"); parentField.IsValid() && parentField.Type() == keyType && key.Parent() != nil {
+		parentField.Set(reflect.ValueOf(key.Parent()))
+	}
+}
+
 func isInt(kind reflect.Kind) bool {
 	switch kind {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
@@ -149,53 +496,103 @@ func isInt(kind reflect.Kind) bool {
 	}
 }
 
-// ExistsInDatastore takes an appengine Context and an interface checks if that interface already exists in datastore
-// Will call any 'BeforeSave' method as appropriate, in case that method sets up a 'Key' field, otherwise checks for an ID field
-// and assumes that's the datastore IntID
-func ExistsInDatastore(ctx appengine.Context, obj interface{}) bool {
-	kind, val := reflect.TypeOf(obj), reflect.ValueOf(obj)
-	str := val
-	if val.Kind().String() == "ptr" {
-		kind, str = kind.Elem(), val.Elem()
-	}
-	if str.Kind().String() != "struct" {
+func isUint(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	default:
 		return false
 	}
-	dsKind := getDatastoreKind(kind)
-	if bsMethod := val.MethodByName("BeforeSave"); bsMethod.IsValid() {
-		bsMethod.Call([]reflect.Value{reflect.ValueOf(ctx)})
+}
+
+// idField returns str's 'ID' field, if it's of any integer kind (signed or unsigned, including types such as `type UserID int64`)
+func idField(str reflect.Value) (field reflect.Value, ok bool) {
+	field = str.FieldByName("ID")
+	return field, field.IsValid() && (isInt(field.Kind()) || isUint(field.Kind()))
+}
+
+// fieldID returns the numeric ID held in an ID field, and false if it's zero (or too large to be an ID, see checkIDField)
+func fieldID(field reflect.Value) (int64, bool) {
+	if isUint(field.Kind()) {
+		id := field.Uint()
+		return int64(id), id != 0 && id <= math.MaxInt64
 	}
-	var key *datastore.Key
-	//check for key field first
-	keyField := str.FieldByName("Key")
-	if keyField.IsValid() {
-		keyInterface := keyField.Interface()
-		key, _ = keyInterface.(*datastore.Key)
+	return field.Int(), field.Int() != 0
+}
+
+// checkIDField returns an *IDRangeError if str has an unsigned ID field holding a value too large to be a datastore ID
+func checkIDField(str reflect.Value, dsKind string) error {
+	if field, ok := idField(str); ok && isUint(field.Kind()) && field.Uint() > math.MaxInt64 {
+		return &IDRangeError{Kind: dsKind, Type: field.Type(), ID: field.Uint()}
 	}
-	idField := str.FieldByName("ID")
-	if key == nil {
-		if idField.IsValid() && idField.Int() != 0 {
-			key = datastore.NewKey(ctx, dsKind, "", idField.Int(), nil)
+	return nil
+}
+
+// setFieldID sets an ID field to id, returning an *IDRangeError if it doesn't fit in the field's type
+func setFieldID(field reflect.Value, dsKind string, id int64) error {
+	if isUint(field.Kind()) {
+		if id < 0 || field.OverflowUint(uint64(id)) {
+			return &IDRangeError{Kind: dsKind, Type: field.Type(), ID: uint64(id)}
 		}
+		field.SetUint(uint64(id))
+		return nil
 	}
-	if key == nil {
+	if field.OverflowInt(id) {
+		return &IDRangeError{Kind: dsKind, Type: field.Type(), ID: uint64(id)}
+	}
+	field.SetInt(id)
+	return nil
+}
+
+// ExistsInDatastore takes an appengine Context and an interface checks if that interface already exists in datastore
+// The key is resolved the same way Save does, from the 'Key' field, a GetKey method, or a non-zero 'ID' field
+// (which is assumed to be the datastore IntID). obj itself is never modified, and no hooks are called
+func ExistsInDatastore(ctx context.Context, obj interface{}) bool {
+	kind, _, str, err := structValue(obj)
+	if err != nil {
 		return false
 	}
-	var err error
-	if UseNDS {
-		err = nds.Get(ctx, key, obj)
-	} else {
-		err = datastore.Get(ctx, key, obj)
+	key := resolveKey(ctx, obj, str, getDatastoreKind(kind))
+	if key == nil || key.Incomplete() {
+		return false
 	}
+	exists, err := ExistsKey(ctx, key)
 	if err != nil {
-		return false
+		log.Errorf(ctx, "[aeutils/ExistsInDatastore] %v", err.Error())
+	}
+	return exists
+}
+
+// ExistsKey checks whether an entity is stored at key, using a keys only query rather than loading the entity
+// Being an ancestor query, it's strongly consistent and may be used within transactions
+func ExistsKey(ctx context.Context, key *datastore.Key) (bool, error) {
+	if currentTransaction(ctx) == nil {
+		if _, ok := cacheTTL(key.Kind()); ok {
+			if _, err := memcache.Get(ctx, cacheKey(key)); err == nil {
+				return true, nil
+			}
+		}
 	}
-	return true
+	keys, err := backend().GetAll(ctx, &BackendQuery{
+		Kind:     key.Kind(),
+		Ancestor: key,
+		Filters:  []Filter{{"__key__ =", key}},
+		KeysOnly: true,
+		Limit:    1,
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	return len(keys) > 0, nil
 }
 
 // getDatastoreKind takes a reflect kind and returns a valid string value matching that kind
-// Strips off any package namespacing, so 'accounts.Account' becomes just 'Account'
+// Uses the kind registered with RegisterKind or an `aekind` struct tag if available, otherwise
+// strips off any package namespacing, so 'accounts.Account' becomes just 'Account'
 func getDatastoreKind(kind reflect.Type) (dsKind string) {
+	if dsKind = registeredKind(kind); dsKind != "" {
+		return
+	}
 	dsKind = kind.String()
 	if li := strings.LastIndex(dsKind, "."); li >= 0 {
 		//Format kind to be in a standard format used for datastore
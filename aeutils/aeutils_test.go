@@ -1,33 +1,319 @@
 package aeutils
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
 	. "launchpad.net/gocheck"
-	"appengine"
-	"appengine/aetest"
-	"appengine/datastore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
 )
 
 type MySuite struct{}
 type DummyObject struct {
-	Key              *datastore.Key
-	ID               int64
-	Slug             string
-	BeforeSaveCalled bool
-	AfterSaveCalled  bool
+	Key               *datastore.Key
+	ID                int64
+	Slug              string
+	BeforeSaveCalled  bool
+	AfterSaveCalled   bool
+	AfterDeleteCalled bool
+	AfterLoadCalled   bool `datastore:"-"`
 }
 
-func (d *DummyObject) BeforeSave(ctx appengine.Context) {
+func (d *DummyObject) BeforeSave(ctx context.Context) {
 	d.BeforeSaveCalled = true
 }
 
-func (d *DummyObject) AfterSave(ctx appengine.Context, key *datastore.Key) {
+func (d *DummyObject) AfterSave(ctx context.Context, key *datastore.Key) {
 	d.AfterSaveCalled = true
 }
 
+func (d *DummyObject) AfterLoad(ctx context.Context) {
+	d.AfterLoadCalled = true
+}
+
+func (d *DummyObject) AfterDelete(ctx context.Context, key *datastore.Key) {
+	d.AfterDeleteCalled = true
+}
+
+// TimestampedObject uses both the field name and tag conventions for timestamps
+type TimestampedObject struct {
+	ID        int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Published time.Time `aetime:"created"`
+}
+
+// VersionedObject is protected against lost updates by its Version field
+type VersionedObject struct {
+	ID      int64
+	Version int64
+	Name    string
+}
+
+// ArchivableObject is soft deleted by its DeletedAt field
+type ArchivableObject struct {
+	ID        int64
+	Slug      string
+	DeletedAt time.Time
+}
+
+// ChildObject is stored in the entity group of its Parent
+type ChildObject struct {
+	Key    *datastore.Key `datastore:"-"`
+	ID     int64
+	Parent *datastore.Key `datastore:"-"`
+	Name   string
+}
+
+// TaggedObject is stored under a custom kind
+type TaggedObject struct {
+	Key  *datastore.Key `datastore:"-" aekind:"CustomTagged"`
+	Name string
+}
+
+// RegisteredObject is stored under a kind set with RegisterKind
+type RegisteredObject struct {
+	ID int64
+}
+
+// CachedObject is cached in memcache by its kind
+type CachedObject struct {
+	ID   int64
+	Name string
+}
+
+// OwnerObject has many PetObjects
+type OwnerObject struct {
+	Key  *datastore.Key `datastore:"-"`
+	ID   int64
+	Name string
+}
+
+// PetObject belongs to an OwnerObject
+type PetObject struct {
+	ID             int64
+	Name           string
+	OwnerObjectKey *datastore.Key
+	OwnerName      string
+	ownerObject    *OwnerObject
+}
+
+// IndexedObject declares the composite indexes it needs
+type IndexedObject struct {
+	ID        int64
+	Published bool `aeindex:"-Created;ancestor,Title"`
+	Title     string
+	Created   time.Time
+}
+
+// recordingTracer keeps every traced operation
+type recordingTracer struct {
+	ops []*Operation
+}
+
+func (t *recordingTracer) Trace(ctx context.Context, op *Operation) {
+	t.ops = append(t.ops, op)
+}
+
+// ArticleObject generates a slug in Permalink from its Title
+type ArticleObject struct {
+	ID        int64
+	Title     string
+	Permalink string `aeslug:"source=Title"`
+}
+
+// ScopedArticleObject has slugs that are only unique within its Parent
+type ScopedArticleObject struct {
+	ID        int64
+	Parent    *datastore.Key `datastore:"-"`
+	Title     string
+	Permalink string `aeslug:"source=Title,scope=parent"`
+}
+
+// SecretObject has encrypted fields
+type SecretObject struct {
+	ID    int64
+	SSN   string `aecrypt:"true"`
+	Token []byte `aecrypt:"true"`
+}
+
+// ProfileObject stores nested data as JSON
+type ProfileObject struct {
+	ID       int64
+	Name     string
+	Settings map[string]string `datastore:"-" aejson:"true"`
+	Links    []LinkObject      `datastore:"-" aejson:"true"`
+}
+
+type LinkObject struct {
+	Title string
+	URL   string
+}
+
+// BulkObject is exported and imported in bulk
+type BulkObject struct {
+	ID      int64
+	Name    string
+	Count   int
+	Created time.Time
+}
+
+// ValidatedObject checks its fields before saving
+type ValidatedObject struct {
+	ID    int64
+	Name  string `aevalidate:"required,max=10"`
+	Email string `aevalidate:"email"`
+}
+
+func (v *ValidatedObject) Validate(ctx context.Context) error {
+	if v.Name == "forbidden" {
+		return &ValidationError{Fields: map[string]string{"Name": "is not allowed"}}
+	}
+	return nil
+}
+
+// DefaultedObject has default values
+type DefaultedObject struct {
+	ID      int64
+	Status  string        `default:"draft"`
+	Limit   int           `default:"10"`
+	Visible bool          `default:"true"`
+	TTL     time.Duration `default:"3h"`
+}
+
+// KeyedObject records the key BeforeSave was called with
+type KeyedObject struct {
+	ID        int64
+	BeforeKey *datastore.Key `datastore:"-"`
+	Created   bool           `datastore:"-"`
+}
+
+func (k *KeyedObject) BeforeSave(ctx context.Context, key *datastore.Key) error {
+	k.BeforeKey = key
+	k.Created = key == nil
+	return nil
+}
+
+// NamedObject is keyed by a string ID
+type NamedObject struct {
+	Key    *datastore.Key `datastore:"-"`
+	Handle string         `aekey:"name"`
+	Name   string
+}
+
+// MemberObject requires a unique email
+type MemberObject struct {
+	ID    int64
+	Email string `aeunique:"true"`
+}
+
+// TeamMemberObject has an email that only needs to be unique within its team
+type TeamMemberObject struct {
+	ID    int64
+	Team  *datastore.Key
+	Email string `aeunique:"scope=Team"`
+}
+
+// SearchableObject can be looked up by username regardless of case
+type SearchableObject struct {
+	ID       int64
+	Username string `aesearch:"lower"`
+}
+
+// IndexedArticleObject has full-text search over its title and body
+type IndexedArticleObject struct {
+	ID    int64
+	Title string `aeindex:"text"`
+	Body  string `aeindex:"text"`
+	Views int
+}
+
+// UnsignedObject has an unsigned ID, which the datastore package can't store itself
+type UnsignedObject struct {
+	ID   uint64 `datastore:"-"`
+	Name string
+}
+
+type CustomID int64
+
+// CustomIDObject has an ID of a custom integer type
+type CustomIDObject struct {
+	ID   CustomID
+	Name string
+}
+
+// UniqueSecretObject has an encrypted field that's also unique, which isn't supported
+type UniqueSecretObject struct {
+	Email string `aecrypt:"true" aeunique:"true"`
+}
+
+// InvalidModelObject breaks several of aeutils' conventions
+type InvalidModelObject struct {
+	Key    *datastore.Key
+	ID     string
+	Token  int    `aecrypt:"true"`
+	Secret string `aecrypt:"true" aeunique:"true"`
+}
+
+// countingBackend stores entities in the datastore, counting the operations that go through it
+type countingBackend struct {
+	Backend
+	puts, queries int
+}
+
+func (b *countingBackend) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	b.puts++
+	return b.Backend.Put(ctx, key, src)
+}
+
+func (b *countingBackend) GetAll(ctx context.Context, q *BackendQuery, dst interface{}) ([]*datastore.Key, error) {
+	b.queries++
+	return b.Backend.GetAll(ctx, q, dst)
+}
+
+// failingBackend stores entities in the datastore, except for PutMulti calls which always fail
+type failingBackend struct {
+	Backend
+}
+
+func (b *failingBackend) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return nil, errors.New("PutMulti failed")
+}
+
+// RejectedObject always refuses to be saved
+type RejectedObject struct {
+	ID   int64
+	Slug string
+}
+
+var errRejected = errors.New("Rejected object can not be saved")
+
+func (r *RejectedObject) BeforeSave(ctx context.Context) error {
+	return errRejected
+}
+
+// MismatchedObject has a BeforeSave method that doesn't match any hook signature
+type MismatchedObject struct {
+	ID int64
+}
+
+func (m *MismatchedObject) BeforeSave(ctx context.Context, force bool) {}
+
 var (
-	_   = Suite(&MySuite{})
-	ctx aetest.Context
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
 )
 
 // Hook up gocheck testing library to our usual testing tool
@@ -37,14 +323,14 @@ func Test(t *testing.T) {
 
 func (s *MySuite) SetUpSuite(c *C) {
 	var err error
-	ctx, err = aetest.NewContext(nil)
+	ctx, done, err = aetest.NewContext()
 	if err != nil {
 		c.Fatal("Failed to create appengine context")
 	}
 }
 
 func (s *MySuite) TearDownSuite(c *C) {
-	ctx.Close()
+	done()
 }
 
 func (s *MySuite) TestGenerateUniqueSlug(c *C) {
@@ -67,6 +353,18 @@ func (s *MySuite) TestGenerateUniqueSlug(c *C) {
 	c.Assert(slug2, Equals, want2)
 }
 
+func (s *MySuite) TestGenerateUniqueSlugReserves(c *C) {
+	// Nothing stored yet, but the first slug is reserved so the second can't match it
+	slug1 := GenerateUniqueSlug(ctx, "DummyObject", "My reserved string")
+	slug2 := GenerateUniqueSlug(ctx, "DummyObject", "My reserved string")
+	c.Assert(slug1, Equals, "my-reserved-string")
+	c.Assert(slug2, Equals, "my-reserved-string-2")
+
+	c.Assert(ReleaseSlug(ctx, "DummyObject", slug1), IsNil)
+	slug3 := GenerateUniqueSlug(ctx, "DummyObject", "My reserved string")
+	c.Assert(slug3, Equals, slug1)
+}
+
 func (s *MySuite) TestSave(c *C) {
 	dummy := &DummyObject{
 		Slug: "my-awesome-string",
@@ -115,4 +413,1354 @@ func (s *MySuite) TestExistsInDatastore(c *C) {
 
 	dummy2Exists := ExistsInDatastore(ctx, dummy2)
 	c.Assert(dummy2Exists, Equals, false)
+
+	// Checking existence shouldn't touch the object
+	dummy3 := &DummyObject{ID: dummy.ID}
+	c.Assert(ExistsInDatastore(ctx, dummy3), Equals, true)
+	c.Assert(dummy3.Slug, Equals, "")
+	c.Assert(dummy3.BeforeSaveCalled, Equals, false)
+
+	exists, err := ExistsKey(ctx, dummy.Key)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+}
+
+func (s *MySuite) TestSaveMulti(c *C) {
+	dummies := []interface{}{
+		&DummyObject{Slug: "multi-one"},
+		&DummyObject{Slug: "multi-two"},
+	}
+
+	keys, err := SaveMulti(ctx, dummies)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+
+	for i, obj := range dummies {
+		dummy := obj.(*DummyObject)
+		c.Assert(dummy.Key, Equals, keys[i])
+		c.Assert(dummy.ID, Equals, keys[i].IntID())
+		c.Assert(dummy.BeforeSaveCalled, Equals, true)
+		c.Assert(dummy.AfterSaveCalled, Equals, true)
+	}
+	c.Assert(keys[0].IntID(), Not(Equals), keys[1].IntID())
+
+	keys, err = SaveMulti(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(keys, IsNil)
+}
+
+func (s *MySuite) TestDelete(c *C) {
+	dummy := &DummyObject{
+		Slug: "my-deleted-string",
+	}
+
+	key, err := Save(ctx, dummy)
+	c.Assert(err, IsNil)
+
+	err = Delete(ctx, dummy)
+	c.Assert(err, IsNil)
+	c.Assert(dummy.AfterDeleteCalled, Equals, true)
+
+	err = datastore.Get(ctx, key, &DummyObject{})
+	c.Assert(err, Equals, datastore.ErrNoSuchEntity)
+
+	// Objects without a key can't be deleted
+	err = Delete(ctx, &DummyObject{})
+	c.Assert(err, NotNil)
+}
+
+func (s *MySuite) TestGet(c *C) {
+	dummy := &DummyObject{
+		Slug: "my-retrieved-string",
+	}
+
+	key, err := Save(ctx, dummy)
+	c.Assert(err, IsNil)
+
+	// By ID field
+	dummy2 := &DummyObject{ID: dummy.ID}
+	err = Get(ctx, dummy2)
+	c.Assert(err, IsNil)
+	c.Assert(dummy2.Slug, Equals, dummy.Slug)
+	c.Assert(dummy2.Key.Equal(key), Equals, true)
+	c.Assert(dummy2.AfterLoadCalled, Equals, true)
+
+	// By ID, with kind inferred
+	dummy3 := &DummyObject{}
+	err = GetByID(ctx, key.IntID(), dummy3)
+	c.Assert(err, IsNil)
+	c.Assert(dummy3.ID, Equals, key.IntID())
+
+	// By slug
+	dummy4 := &DummyObject{}
+	err = GetBySlug(ctx, dummy.Slug, dummy4)
+	c.Assert(err, IsNil)
+	c.Assert(dummy4.ID, Equals, key.IntID())
+
+	err = GetBySlug(ctx, "my-missing-string", &DummyObject{})
+	c.Assert(err, Equals, datastore.ErrNoSuchEntity)
+}
+
+func (s *MySuite) TestBeforeSaveError(c *C) {
+	rejected := &RejectedObject{
+		Slug: "my-rejected-string",
+	}
+
+	key, err := Save(ctx, rejected)
+	c.Assert(err, Equals, errRejected)
+	c.Assert(key, IsNil)
+	// Never stored, so no ID was assigned
+	c.Assert(rejected.ID, Equals, int64(0))
+
+	_, err = SaveMulti(ctx, []interface{}{&DummyObject{}, rejected})
+	c.Assert(err, Equals, errRejected)
+}
+
+func (s *MySuite) TestMismatchedHook(c *C) {
+	_, err := Save(ctx, &MismatchedObject{})
+	c.Assert(err, NotNil)
+}
+
+func (s *MySuite) TestTimestamps(c *C) {
+	obj := &TimestampedObject{}
+	_, err := Save(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.CreatedAt.IsZero(), Equals, false)
+	c.Assert(obj.UpdatedAt.IsZero(), Equals, false)
+	c.Assert(obj.Published.IsZero(), Equals, false)
+
+	created, updated := obj.CreatedAt, obj.UpdatedAt
+	time.Sleep(time.Millisecond)
+	_, err = Save(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.CreatedAt, Equals, created)
+	c.Assert(obj.UpdatedAt.After(updated), Equals, true)
+}
+
+func (s *MySuite) TestVersionConflict(c *C) {
+	obj := &VersionedObject{Name: "original"}
+	_, err := Save(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.Version, Equals, int64(1))
+
+	// A stale copy loaded before the next save
+	stale := &VersionedObject{ID: obj.ID, Version: obj.Version, Name: "stale"}
+
+	obj.Name = "updated"
+	_, err = Save(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.Version, Equals, int64(2))
+
+	_, err = Save(ctx, stale)
+	conflict, ok := err.(*ConflictError)
+	c.Assert(ok, Equals, true)
+	c.Assert(conflict.Stored, Equals, int64(2))
+	c.Assert(stale.Version, Equals, int64(1))
+}
+
+func (s *MySuite) TestSoftDelete(c *C) {
+	obj := &ArchivableObject{Slug: "my-archived-string"}
+	key, err := Save(ctx, obj)
+	c.Assert(err, IsNil)
+
+	err = Delete(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.DeletedAt.IsZero(), Equals, false)
+
+	// Still stored, but excluded from queries
+	stored := &ArchivableObject{}
+	c.Assert(datastore.Get(ctx, key, stored), IsNil)
+	c.Assert(stored.DeletedAt.IsZero(), Equals, false)
+	c.Assert(GetBySlug(ctx, obj.Slug, &ArchivableObject{}), Equals, datastore.ErrNoSuchEntity)
+
+	err = Restore(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.DeletedAt.IsZero(), Equals, true)
+
+	err = HardDelete(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(datastore.Get(ctx, key, stored), Equals, datastore.ErrNoSuchEntity)
+}
+
+func (s *MySuite) TestQuery(c *C) {
+	dummy := &DummyObject{Slug: "my-queried-string"}
+	key, err := Save(ctx, dummy)
+	c.Assert(err, IsNil)
+	// Have to retrieve from datastore again, otherwise 'eventual consistency' makes this test not work
+	datastore.Get(ctx, key, &DummyObject{})
+
+	var results []*DummyObject
+	keys, err := Query(&DummyObject{}).Filter("Slug =", dummy.Slug).Limit(5).GetAll(ctx, &results)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(results[0].Key.Equal(key), Equals, true)
+	c.Assert(results[0].AfterLoadCalled, Equals, true)
+
+	first := &DummyObject{}
+	_, err = Query(first).Filter("Slug =", dummy.Slug).First(ctx, first)
+	c.Assert(err, IsNil)
+	c.Assert(first.ID, Equals, dummy.ID)
+
+	var wrongType []*VersionedObject
+	_, err = Query(&DummyObject{}).GetAll(ctx, &wrongType)
+	c.Assert(err, Equals, ErrInvalidDestination)
+}
+
+func (s *MySuite) TestRunInTransaction(c *C) {
+	dummy := &DummyObject{Slug: "my-transactional-string"}
+	versioned := &VersionedObject{Name: "transactional"}
+
+	err := RunInTransaction(ctx, func(tc context.Context) error {
+		if _, err := Save(tc, dummy); err != nil {
+			return err
+		}
+		// Key is available straight away, but AfterSave waits for the commit
+		c.Assert(dummy.Key, NotNil)
+		c.Assert(dummy.AfterSaveCalled, Equals, false)
+		_, err := Save(tc, versioned)
+		return err
+	}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(dummy.AfterSaveCalled, Equals, true)
+	c.Assert(versioned.Version, Equals, int64(1))
+
+	// Contexts derived from tc are in the transaction too
+	derived := &DummyObject{Slug: "my-derived-string"}
+	err = RunInTransaction(ctx, func(tc context.Context) error {
+		dc, cancel := context.WithCancel(tc)
+		defer cancel()
+		c.Assert(currentTransaction(dc), NotNil)
+		_, err := Save(dc, derived)
+		c.Assert(derived.AfterSaveCalled, Equals, false)
+		return err
+	}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(derived.AfterSaveCalled, Equals, true)
+	c.Assert(currentTransaction(ctx), IsNil)
+
+	// Nothing from a failed transaction is stored or hooked
+	failed := &DummyObject{Slug: "my-failed-string"}
+	err = RunInTransaction(ctx, func(tc context.Context) error {
+		Save(tc, failed)
+		return errRejected
+	}, nil)
+	c.Assert(err, Equals, errRejected)
+	c.Assert(failed.AfterSaveCalled, Equals, false)
+	c.Assert(datastore.Get(ctx, failed.Key, &DummyObject{}), Equals, datastore.ErrNoSuchEntity)
+}
+
+func (s *MySuite) TestParentKey(c *C) {
+	parentKey, err := Save(ctx, &DummyObject{Slug: "my-parent-string"})
+	c.Assert(err, IsNil)
+
+	child := &ChildObject{Parent: parentKey, Name: "child"}
+	key, err := Save(ctx, child)
+	c.Assert(err, IsNil)
+	c.Assert(key.Parent().Equal(parentKey), Equals, true)
+
+	// Ancestor queries default to the Parent field
+	var children []*ChildObject
+	keys, err := Query(&ChildObject{Parent: parentKey}).GetAll(ctx, &children)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(children[0].Parent.Equal(parentKey), Equals, true)
+
+	loaded := &ChildObject{Parent: parentKey}
+	c.Assert(GetByID(ctx, child.ID, loaded), IsNil)
+	c.Assert(loaded.Name, Equals, child.Name)
+}
+
+func (s *MySuite) TestKinds(c *C) {
+	c.Assert(KindOf(&DummyObject{}), Equals, "DummyObject")
+	c.Assert(KindOf(TaggedObject{}), Equals, "CustomTagged")
+	RegisterKind(&RegisteredObject{}, "CustomRegistered")
+	c.Assert(KindOf(&RegisteredObject{}), Equals, "CustomRegistered")
+
+	key, err := Save(ctx, &TaggedObject{Name: "tagged"})
+	c.Assert(err, IsNil)
+	c.Assert(key.Kind(), Equals, "CustomTagged")
+}
+
+func (s *MySuite) TestCache(c *C) {
+	CacheKind(&CachedObject{}, time.Minute)
+	defer UncacheKind(&CachedObject{})
+
+	obj := &CachedObject{Name: "cached"}
+	key, err := Save(ctx, obj)
+	c.Assert(err, IsNil)
+
+	// Change the stored copy behind the cache's back, Get should still read the cached copy
+	_, err = datastore.Put(ctx, key, &CachedObject{ID: obj.ID, Name: "changed"})
+	c.Assert(err, IsNil)
+	cached := &CachedObject{}
+	c.Assert(GetByKey(ctx, key, cached), IsNil)
+	c.Assert(cached.Name, Equals, "cached")
+
+	c.Assert(HardDelete(ctx, obj), IsNil)
+	c.Assert(GetByKey(ctx, key, &CachedObject{}), Equals, datastore.ErrNoSuchEntity)
+
+	// Invalid keys fail as they would with the datastore, rather than reaching the cache
+	c.Assert(GetByKey(ctx, nil, &CachedObject{}), Equals, datastore.ErrInvalidKey)
+	c.Assert(GetByKey(ctx, datastore.NewIncompleteKey(ctx, "CachedObject", nil), &CachedObject{}), Equals, datastore.ErrInvalidKey)
+}
+
+func (s *MySuite) TestQueryCache(c *C) {
+	CacheQueries(&ChildObject{}, time.Minute)
+	defer UncacheQueries(&ChildObject{})
+
+	parent := datastore.NewKey(ctx, "DummyParent", "query-cache", 0, nil)
+	_, err := Save(ctx, &ChildObject{Parent: parent, Name: "first"})
+	c.Assert(err, IsNil)
+	query := Query(&ChildObject{}).Ancestor(parent)
+	var children []*ChildObject
+	keys, err := query.GetAll(ctx, &children)
+	c.Assert(err, IsNil)
+	c.Assert(children, HasLen, 1)
+
+	// Stored behind the cache's back, so the cached results are still returned
+	_, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "ChildObject", parent), &ChildObject{Name: "hidden"})
+	c.Assert(err, IsNil)
+	children = nil
+	cachedKeys, err := query.GetAll(ctx, &children)
+	c.Assert(err, IsNil)
+	c.Assert(cachedKeys, DeepEquals, keys)
+	c.Assert(children, HasLen, 1)
+	c.Assert(children[0].Name, Equals, "first")
+	c.Assert(children[0].Key, DeepEquals, keys[0])
+
+	// Different queries are cached separately
+	var hidden []ChildObject
+	_, err = query.Filter("Name =", "hidden").GetAll(ctx, &hidden)
+	c.Assert(err, IsNil)
+	c.Assert(hidden, HasLen, 1)
+
+	// Saving through aeutils invalidates every cached query for the kind
+	_, err = Save(ctx, &ChildObject{Parent: parent, Name: "second"})
+	c.Assert(err, IsNil)
+	children = nil
+	_, err = query.GetAll(ctx, &children)
+	c.Assert(err, IsNil)
+	c.Assert(children, HasLen, 3)
+}
+
+func (s *MySuite) TestRelations(c *C) {
+	owner := &OwnerObject{Name: "owner"}
+	ownerKey, err := Save(ctx, owner)
+	c.Assert(err, IsNil)
+	pet := &PetObject{Name: "pet", OwnerObjectKey: ownerKey}
+	petKey, err := Save(ctx, pet)
+	c.Assert(err, IsNil)
+	datastore.Get(ctx, petKey, &PetObject{})
+
+	related, err := LoadRelated(ctx, pet, "OwnerObject")
+	c.Assert(err, IsNil)
+	c.Assert(related.(*OwnerObject).Name, Equals, "owner")
+	c.Assert(pet.ownerObject, Equals, related)
+	// Already loaded, so the same entity is returned
+	again, err := LoadRelated(ctx, pet, "OwnerObject")
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, related)
+
+	_, err = LoadRelated(ctx, pet, "Missing")
+	c.Assert(err, ErrorMatches, ".* has no MissingKey field .*")
+
+	other := &OwnerObject{Name: "other"}
+	otherKey, err := Save(ctx, other)
+	c.Assert(err, IsNil)
+	list := []PetObject{{OwnerObjectKey: ownerKey}, {OwnerObjectKey: otherKey}, {OwnerObjectKey: ownerKey}, {}}
+	c.Assert(PreloadRelated(ctx, list, "OwnerObjectKey"), IsNil)
+	c.Assert(list[0].ownerObject.Name, Equals, "owner")
+	c.Assert(list[1].ownerObject.Name, Equals, "other")
+	c.Assert(list[2].ownerObject, Equals, list[0].ownerObject)
+	c.Assert(list[3].ownerObject, IsNil)
+
+	var pets []*PetObject
+	c.Assert(LoadChildren(ctx, owner, &pets), IsNil)
+	c.Assert(pets, HasLen, 1)
+	c.Assert(pets[0].Name, Equals, "pet")
+	c.Assert(LoadChildren(ctx, &OwnerObject{}, &pets), FitsTypeOf, &ErrNoKey{})
+}
+
+func (s *MySuite) TestIndexes(c *C) {
+	RecordIndexes = true
+	defer func() {
+		RecordIndexes = false
+	}()
+	c.Assert(KindOf(&IndexedObject{}), Equals, "IndexedObject")
+	_, err := Query(&CachedObject{}).Filter("Name =", "indexed").Order("-ID").Keys(ctx)
+	c.Assert(err, IsNil)
+	// Served by built-in indexes, so not recorded
+	_, err = Query(&CachedObject{}).Filter("Name =", "indexed").Keys(ctx)
+	c.Assert(err, IsNil)
+
+	ids := map[string]bool{}
+	for _, idx := range Indexes() {
+		ids[idx.String()] = true
+	}
+	c.Assert(ids["CachedObject(Name,-ID)"], Equals, true)
+	c.Assert(ids["CachedObject(Name)"], Equals, false)
+	c.Assert(ids["IndexedObject(Published,-Created)"], Equals, true)
+	c.Assert(ids["IndexedObject(Published,Title) ancestor"], Equals, true)
+
+	var buf bytes.Buffer
+	c.Assert(WriteIndexYAML(&buf), IsNil)
+	c.Assert(strings.Contains(buf.String(), `
+- kind: CachedObject
+  properties:
+  - name: Name
+  - name: ID
+    direction: desc
+`), Equals, true)
+}
+
+func (s *MySuite) TestTracer(c *C) {
+	tracer := &recordingTracer{}
+	DatastoreTracer = tracer
+	defer func() {
+		DatastoreTracer = nil
+	}()
+	obj := &CachedObject{Name: "traced"}
+	key, err := Save(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(GetByKey(ctx, key, &CachedObject{}), IsNil)
+	_, err = Query(obj).Filter("Name =", "traced").Count(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(HardDelete(ctx, obj), IsNil)
+	c.Assert(GetByKey(ctx, key, &CachedObject{}), Equals, datastore.ErrNoSuchEntity)
+
+	var names []string
+	for _, op := range tracer.ops {
+		c.Assert(op.Kind, Equals, "CachedObject")
+		names = append(names, op.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"Put", "Get", "Count", "Delete", "Get"})
+	c.Assert(tracer.ops[4].Err, Equals, datastore.ErrNoSuchEntity)
+}
+
+func (s *MySuite) TestGetMulti(c *C) {
+	CacheKind(&CachedObject{}, time.Minute)
+	defer UncacheKind(&CachedObject{})
+
+	first, second := &CachedObject{Name: "first"}, &CachedObject{Name: "second"}
+	keys, err := SaveMulti(ctx, []interface{}{first, second})
+	c.Assert(err, IsNil)
+	// Cached, so changes behind the cache's back aren't seen
+	_, err = datastore.Put(ctx, keys[0], &CachedObject{ID: first.ID, Name: "changed"})
+	c.Assert(err, IsNil)
+	missing := datastore.NewKey(ctx, "CachedObject", "", 999999, nil)
+
+	dst := make([]*CachedObject, 3)
+	err = GetMulti(ctx, append(keys, missing), dst)
+	me, ok := err.(appengine.MultiError)
+	c.Assert(ok, Equals, true)
+	c.Assert(me[0], IsNil)
+	c.Assert(me[1], IsNil)
+	c.Assert(me[2], Equals, datastore.ErrNoSuchEntity)
+	c.Assert(dst[0].Name, Equals, "first")
+	c.Assert(dst[1].Name, Equals, "second")
+	c.Assert(dst[1].ID, Equals, second.ID)
+
+	values := make([]CachedObject, 2)
+	c.Assert(GetMulti(ctx, keys, values), IsNil)
+	c.Assert(values[1].Name, Equals, "second")
+	c.Assert(GetMulti(ctx, keys, make([]CachedObject, 1)), Equals, ErrInvalidDestination)
+}
+
+func (s *MySuite) TestRequestCache(c *C) {
+	obj := &CachedObject{Name: "memoized"}
+	key, err := Save(ctx, obj)
+	c.Assert(err, IsNil)
+
+	StartRequestCache(ctx)
+	c.Assert(GetByKey(ctx, key, &CachedObject{}), IsNil)
+	// Changed behind the request cache's back, so not seen within the request
+	_, err = datastore.Put(ctx, key, &CachedObject{ID: obj.ID, Name: "changed"})
+	c.Assert(err, IsNil)
+	memoized := &CachedObject{}
+	c.Assert(GetByKey(ctx, key, memoized), IsNil)
+	c.Assert(memoized.Name, Equals, "memoized")
+
+	// Saving through aeutils removes it from the cache
+	obj.Name = "saved"
+	_, err = Save(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(GetByKey(ctx, key, memoized), IsNil)
+	c.Assert(memoized.Name, Equals, "saved")
+
+	ClearRequestCache(ctx)
+	_, err = datastore.Put(ctx, key, &CachedObject{ID: obj.ID, Name: "changed"})
+	c.Assert(err, IsNil)
+	c.Assert(GetByKey(ctx, key, memoized), IsNil)
+	c.Assert(memoized.Name, Equals, "changed")
+}
+
+func (s *MySuite) TestRetry(c *C) {
+	defer func(backoff time.Duration) {
+		RetryBackoff = backoff
+	}(RetryBackoff)
+	RetryBackoff = time.Millisecond
+	timeout := errors.New("API error 5 (datastore_v3: TIMEOUT): The datastore operation timed out")
+	c.Assert(IsTransient(timeout), Equals, true)
+	c.Assert(IsTransient(appengine.MultiError{nil, timeout}), Equals, true)
+	c.Assert(IsTransient(datastore.ErrNoSuchEntity), Equals, false)
+
+	attempts := 0
+	err := withRetry(ctx, func(ctx context.Context) error {
+		attempts++
+		if attempts < 2 {
+			return timeout
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+
+	attempts = 0
+	err = withRetry(ctx, func(ctx context.Context) error {
+		attempts++
+		return timeout
+	})
+	c.Assert(err, Equals, timeout)
+	c.Assert(attempts, Equals, RetryAttempts)
+
+	attempts = 0
+	err = withRetry(ctx, func(ctx context.Context) error {
+		attempts++
+		return datastore.ErrNoSuchEntity
+	})
+	c.Assert(attempts, Equals, 1)
+}
+
+func (s *MySuite) TestRPCDeadline(c *C) {
+	rctx, cancel := rpcContext(ctx)
+	_, ok := rctx.Deadline()
+	cancel()
+	c.Assert(ok, Equals, false)
+
+	rctx, cancel = rpcContext(WithRPCDeadline(ctx, time.Second))
+	deadline, ok := rctx.Deadline()
+	cancel()
+	c.Assert(ok, Equals, true)
+	c.Assert(deadline.After(time.Now()), Equals, true)
+
+	var seen bool
+	err := withRetry(WithRPCDeadline(ctx, time.Second), func(ctx context.Context) error {
+		_, seen = ctx.Deadline()
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(seen, Equals, true)
+
+	dummy := &DummyObject{}
+	_, err = Save(WithRPCDeadline(ctx, 5*time.Second), dummy)
+	c.Assert(err, IsNil)
+}
+
+func (s *MySuite) TestSlugTag(c *C) {
+	article := &ArticleObject{Title: "My Article Title"}
+	_, err := Save(ctx, article)
+	c.Assert(err, IsNil)
+	c.Assert(article.Permalink, Equals, "my-article-title")
+
+	article2 := &ArticleObject{Title: "My Article Title"}
+	_, err = Save(ctx, article2)
+	c.Assert(err, IsNil)
+	c.Assert(article2.Permalink, Equals, "my-article-title-2")
+}
+
+func (s *MySuite) TestScopedSlugs(c *C) {
+	first := datastore.NewKey(ctx, "OwnerObject", "", 1001, nil)
+	second := datastore.NewKey(ctx, "OwnerObject", "", 1002, nil)
+	articles := []*ScopedArticleObject{
+		{Parent: first, Title: "Scoped Title"},
+		{Parent: second, Title: "Scoped Title"},
+		{Parent: first, Title: "Scoped Title"},
+	}
+	for _, article := range articles {
+		_, err := Save(ctx, article)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(articles[0].Permalink, Equals, "scoped-title")
+	c.Assert(articles[1].Permalink, Equals, "scoped-title")
+	c.Assert(articles[2].Permalink, Equals, "scoped-title-2")
+
+	c.Assert(ReleaseSlugWithin(ctx, first, "ScopedArticleObject", "Permalink", "scoped-title-2"), IsNil)
+	c.Assert(GenerateUniqueSlugWithin(ctx, second, "ScopedArticleObject", "Permalink", "Scoped Title"), Equals, "scoped-title-2")
+
+	c.Assert(GenerateUniqueSlugInNamespace(ctx, "tenant-a", "DummyObject", "Namespaced"), Equals, "namespaced")
+	c.Assert(GenerateUniqueSlugInNamespace(ctx, "tenant-b", "DummyObject", "Namespaced"), Equals, "namespaced")
+}
+
+func (s *MySuite) TestUnique(c *C) {
+	member := &MemberObject{Email: "first@example.com"}
+	_, err := Save(ctx, member)
+	c.Assert(err, IsNil)
+	// Saving again keeps the same claim
+	_, err = Save(ctx, member)
+	c.Assert(err, IsNil)
+
+	_, err = Save(ctx, &MemberObject{Email: "first@example.com"})
+	_, ok := err.(*UniqueError)
+	c.Assert(ok, Equals, true)
+
+	// Changing the value releases the old one
+	member.Email = "second@example.com"
+	_, err = Save(ctx, member)
+	c.Assert(err, IsNil)
+	_, err = Save(ctx, &MemberObject{Email: "first@example.com"})
+	c.Assert(err, IsNil)
+
+	c.Assert(Unique(ctx, "MemberObject", "Email", "second@example.com"), NotNil)
+	c.Assert(Unique(ctx, "MemberObject", "Email", "third@example.com"), IsNil)
+	c.Assert(Unique(ctx, "MemberObject", "Email", "third@example.com"), NotNil)
+	c.Assert(ReleaseUnique(ctx, "MemberObject", "Email", "third@example.com"), IsNil)
+
+	// Scoped values only clash within the same scope
+	team := datastore.NewKey(ctx, "Team", "first", 0, nil)
+	teamMember := &TeamMemberObject{Team: team, Email: "first@example.com"}
+	_, err = Save(ctx, teamMember)
+	c.Assert(err, IsNil)
+	_, err = Save(ctx, &TeamMemberObject{Team: team, Email: "first@example.com"})
+	c.Assert(err, FitsTypeOf, &UniqueError{})
+	_, err = Save(ctx, &TeamMemberObject{Team: datastore.NewKey(ctx, "Team", "second", 0, nil), Email: "first@example.com"})
+	c.Assert(err, IsNil)
+	// Moving to another scope releases the value in the old one
+	teamMember.Team = datastore.NewKey(ctx, "Team", "third", 0, nil)
+	_, err = Save(ctx, teamMember)
+	c.Assert(err, IsNil)
+	_, err = Save(ctx, &TeamMemberObject{Team: team, Email: "first@example.com"})
+	c.Assert(err, IsNil)
+
+	// Values claimed by a batch that isn't stored are released again
+	_, err = SaveMulti(ctx, []interface{}{
+		&MemberObject{Email: "batch@example.com"},
+		&MemberObject{Email: "batch@example.com"},
+	})
+	c.Assert(err, FitsTypeOf, &UniqueError{})
+	StorageBackend = &failingBackend{Backend: DatastoreBackend}
+	_, err = SaveMulti(ctx, []interface{}{&MemberObject{Email: "failed@example.com"}})
+	StorageBackend = nil
+	c.Assert(err, NotNil)
+	_, err = SaveMulti(ctx, []interface{}{
+		&MemberObject{Email: "batch@example.com"},
+		&MemberObject{Email: "failed@example.com"},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *MySuite) TestCrypt(c *C) {
+	secret := &SecretObject{SSN: "123-45-6789", Token: []byte("token")}
+	_, err := Save(ctx, secret)
+	c.Assert(err, Equals, ErrNoEncryptionKey)
+
+	c.Assert(SetEncryptionKey([]byte("my test key 1234")), IsNil)
+	key, err := Save(ctx, secret)
+	c.Assert(err, IsNil)
+	// Plaintext is kept in memory
+	c.Assert(secret.SSN, Equals, "123-45-6789")
+	c.Assert(string(secret.Token), Equals, "token")
+
+	stored := &SecretObject{}
+	c.Assert(datastore.Get(ctx, key, stored), IsNil)
+	c.Assert(stored.SSN, Not(Equals), secret.SSN)
+	c.Assert(stored.Token, Not(DeepEquals), secret.Token)
+
+	loaded := &SecretObject{}
+	c.Assert(GetByKey(ctx, key, loaded), IsNil)
+	c.Assert(loaded.SSN, Equals, secret.SSN)
+	c.Assert(loaded.Token, DeepEquals, secret.Token)
+
+	// Altered values are rejected
+	ciphertext, err := Encrypt([]byte("token"))
+	c.Assert(err, IsNil)
+	ciphertext[len(ciphertext)-1] ^= 1
+	_, err = Decrypt(ciphertext)
+	c.Assert(err, NotNil)
+
+	// Encrypted values could never collide, so can't be unique
+	_, err = Save(ctx, &UniqueSecretObject{Email: "someone@example.com"})
+	c.Assert(err, ErrorMatches, ".*Email can't also be aeunique")
+	_, err = SaveMulti(ctx, []interface{}{&UniqueSecretObject{Email: "someone@example.com"}})
+	c.Assert(err, ErrorMatches, ".*Email can't also be aeunique")
+
+	// Cached copies are encrypted too
+	CacheKind(&SecretObject{}, time.Minute)
+	defer UncacheKind(&SecretObject{})
+	key, err = Save(ctx, secret)
+	c.Assert(err, IsNil)
+	cached := &SecretObject{}
+	_, err = memcache.Gob.Get(ctx, cacheKey(key), cached)
+	c.Assert(err, IsNil)
+	c.Assert(cached.SSN, Not(Equals), secret.SSN)
+	c.Assert(cached.Token, Not(DeepEquals), secret.Token)
+	loaded = &SecretObject{}
+	c.Assert(GetByKey(ctx, key, loaded), IsNil)
+	c.Assert(loaded.SSN, Equals, secret.SSN)
+	c.Assert(loaded.Token, DeepEquals, secret.Token)
+}
+
+func (s *MySuite) TestJSONFields(c *C) {
+	profile := &ProfileObject{
+		Name:     "Profile",
+		Settings: map[string]string{"theme": "dark"},
+		Links:    []LinkObject{{Title: "Home", URL: "http://example.com"}},
+	}
+	key, err := Save(ctx, profile)
+	c.Assert(err, IsNil)
+
+	loaded := &ProfileObject{}
+	c.Assert(GetByKey(ctx, key, loaded), IsNil)
+	c.Assert(loaded, DeepEquals, profile)
+
+	var profiles []ProfileObject
+	_, err = Query(&ProfileObject{}).Ancestor(key).GetAll(ctx, &profiles)
+	c.Assert(err, IsNil)
+	c.Assert(profiles, HasLen, 1)
+	c.Assert(profiles[0].Links, DeepEquals, profile.Links)
+}
+
+func (s *MySuite) TestProject(c *C) {
+	dummy := &DummyObject{Slug: "my-projected-string", BeforeSaveCalled: true}
+	key, err := Save(ctx, dummy)
+	c.Assert(err, IsNil)
+	datastore.Get(ctx, key, &DummyObject{})
+
+	keys, results, err := Project(ctx, &DummyObject{}, []string{"Slug"},
+		Filter{"Slug >=", dummy.Slug},
+		Filter{"Slug <", dummy.Slug + "\ufffd"})
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	projected := results[0].(*DummyObject)
+	c.Assert(projected.Slug, Equals, dummy.Slug)
+	c.Assert(projected.ID, Equals, dummy.ID)
+	// Fields that weren't projected are left empty
+	c.Assert(projected.BeforeSaveCalled, Equals, false)
+}
+
+func (s *MySuite) TestIterate(c *C) {
+	parent := datastore.NewKey(ctx, "DummyParent", "iterate", 0, nil)
+	for i := 0; i < 5; i++ {
+		_, err := Save(ctx, &ChildObject{Parent: parent, Name: "iterated"})
+		c.Assert(err, IsNil)
+	}
+	defer func(size int) {
+		IterateBatchSize = size
+	}(IterateBatchSize)
+	IterateBatchSize = 2
+
+	count := 0
+	cursor, err := Iterate(ctx, datastore.NewQuery("ChildObject").Ancestor(parent), &ChildObject{}, func(obj interface{}, key *datastore.Key) error {
+		child := obj.(*ChildObject)
+		c.Assert(child.Name, Equals, "iterated")
+		c.Assert(child.ID, Equals, key.IntID())
+		count++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(cursor, Equals, datastore.Cursor{})
+	c.Assert(count, Equals, 5)
+}
+
+func (s *MySuite) TestBulk(c *C) {
+	original := &BulkObject{Name: "Bulk", Count: 3, Created: time.Now().Truncate(time.Second)}
+	key, err := Save(ctx, original)
+	c.Assert(err, IsNil)
+	datastore.Get(ctx, key, &BulkObject{})
+
+	for _, format := range []Format{JSON, CSV} {
+		var buf bytes.Buffer
+		n, err := ExportKind(ctx, &BulkObject{}, &buf, format)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1)
+
+		c.Assert(HardDelete(ctx, original), IsNil)
+		n, err = ImportKind(ctx, &BulkObject{}, &buf, format)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1)
+
+		imported := &BulkObject{ID: original.ID}
+		c.Assert(Get(ctx, imported), IsNil)
+		c.Assert(imported.Name, Equals, original.Name)
+		c.Assert(imported.Count, Equals, original.Count)
+		c.Assert(imported.Created.Equal(original.Created), Equals, true)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportKind(ctx, &BulkObject{}, &buf, Avro)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(bytes.HasPrefix(buf.Bytes(), []byte("Obj\x01")), Equals, true)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte(`{"name":"Name","type":"string"}`)), Equals, true)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte(original.Name)), Equals, true)
+	_, err = ImportKind(ctx, &BulkObject{}, &buf, Avro)
+	c.Assert(err, Equals, ErrUnknownFormat)
+
+	_, err = ExportKind(ctx, &BulkObject{}, &bytes.Buffer{}, Format(-1))
+	c.Assert(err, Equals, ErrUnknownFormat)
+}
+
+func (s *MySuite) TestHistory(c *C) {
+	TrackHistory(&VersionedObject{})
+	defer UntrackHistory(&VersionedObject{})
+	HistoryActor = func(ctx context.Context) string {
+		return "tester"
+	}
+	defer func() {
+		HistoryActor = nil
+	}()
+
+	versioned := &VersionedObject{Name: "first"}
+	_, err := Save(ctx, versioned)
+	c.Assert(err, IsNil)
+	versioned.Name = "second"
+	_, err = Save(ctx, versioned)
+	c.Assert(err, IsNil)
+
+	revisions, err := History(ctx, versioned)
+	c.Assert(err, IsNil)
+	c.Assert(revisions, HasLen, 2)
+	c.Assert(revisions[0].Actor, Equals, "tester")
+	c.Assert(revisions[0].Version, Equals, int64(2))
+
+	previous := &VersionedObject{}
+	c.Assert(revisions[1].Decode(previous), IsNil)
+	c.Assert(previous.Name, Equals, "first")
+	c.Assert(previous.ID, Equals, versioned.ID)
+}
+
+func (s *MySuite) TestDryRun(c *C) {
+	dummy := &DummyObject{Slug: "my-dry-run-string"}
+	key, err := Save(ctx, dummy, DryRun())
+	c.Assert(err, IsNil)
+	c.Assert(key.Incomplete(), Equals, true)
+	c.Assert(dummy.BeforeSaveCalled, Equals, true)
+	c.Assert(dummy.AfterSaveCalled, Equals, false)
+	c.Assert(dummy.ID, Equals, int64(0))
+	count, err := Query(dummy).Filter("Slug =", dummy.Slug).Count(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 0)
+
+	_, err = Save(ctx, &ValidatedObject{Email: "valid@example.com"}, DryRun())
+	c.Assert(StatusCode(err), Equals, 422)
+
+	c.Assert(SetEncryptionKey([]byte("my test key 1234")), IsNil)
+	_, err = Save(ctx, &SecretObject{Token: make([]byte, MaxEntitySize)}, DryRun())
+	c.Assert(err, FitsTypeOf, &EntityTooLargeError{})
+	c.Assert(StatusCode(err), Equals, 413)
+}
+
+func (s *MySuite) TestSearch(c *C) {
+	searchable := &SearchableObject{Username: "  MixedCase "}
+	key, err := Save(ctx, searchable)
+	c.Assert(err, IsNil)
+	c.Assert(searchable.Username, Equals, "  MixedCase ")
+
+	loaded := &SearchableObject{}
+	c.Assert(GetBySearch(ctx, "Username", "mixedcase", loaded), IsNil)
+	c.Assert(loaded.ID, Equals, key.IntID())
+	c.Assert(loaded.Username, Equals, "  MixedCase ")
+
+	var results []SearchableObject
+	_, err = Query(&SearchableObject{}).Search("Username", "MIXEDCASE").GetAll(ctx, &results)
+	c.Assert(err, IsNil)
+	c.Assert(len(results), Equals, 1)
+
+	c.Assert(GetBySearch(ctx, "Username", "other", loaded), Equals, datastore.ErrNoSuchEntity)
+}
+
+func (s *MySuite) TestFullTextSearch(c *C) {
+	article := &IndexedArticleObject{Title: "Datastore tips", Body: "Batch your gets with GetMulti"}
+	key, err := Save(ctx, article)
+	c.Assert(err, IsNil)
+	_, err = Save(ctx, &IndexedArticleObject{Title: "Memcache tips", Body: "Cache what you can"})
+	c.Assert(err, IsNil)
+
+	keys, err := Search(ctx, &IndexedArticleObject{}, "Body:GetMulti")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []*datastore.Key{key})
+	keys, err = Search(ctx, &IndexedArticleObject{}, "tips")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+
+	c.Assert(Delete(ctx, article), IsNil)
+	keys, err = Search(ctx, &IndexedArticleObject{}, "Body:GetMulti")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+
+	_, err = indexFields(reflect.TypeOf(struct {
+		Views int `aeindex:"text"`
+	}{}))
+	c.Assert(err, NotNil)
+}
+
+func (s *MySuite) TestPrefixQuery(c *C) {
+	for _, username := range []string{"Prefix-Alice", "prefix-albert", "prefix-bob", "other"} {
+		_, err := Save(ctx, &SearchableObject{Username: username})
+		c.Assert(err, IsNil)
+	}
+	var results []SearchableObject
+	_, err := PrefixQuery(&SearchableObject{}, "Username", "PREFIX-al").GetAll(ctx, &results)
+	c.Assert(err, IsNil)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(results[0].Username, Equals, "prefix-albert")
+	c.Assert(results[1].Username, Equals, "Prefix-Alice")
+
+	// Fields that aren't tagged match exactly
+	var articles []ArticleObject
+	_, err = Save(ctx, &ArticleObject{Title: "Prefixed Title"})
+	c.Assert(err, IsNil)
+	_, err = PrefixQuery(&ArticleObject{}, "Title", "prefixed").GetAll(ctx, &articles)
+	c.Assert(err, IsNil)
+	c.Assert(len(articles), Equals, 0)
+	_, err = PrefixQuery(&ArticleObject{}, "Title", "Prefixed").GetAll(ctx, &articles)
+	c.Assert(err, IsNil)
+	c.Assert(len(articles), Equals, 1)
+}
+
+func (s *MySuite) TestKindStats(c *C) {
+	stat := &KindStat{Kind: "DummyObject", Count: 3, Bytes: 1024, Timestamp: time.Now()}
+	_, err := datastore.Put(ctx, datastore.NewKey(ctx, "__Stat_Kind__", "DummyObject", 0, nil), stat)
+	c.Assert(err, IsNil)
+	stat.Kind, stat.Bytes = "CachedObject", 4096
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "__Stat_Kind__", "CachedObject", 0, nil), stat)
+	c.Assert(err, IsNil)
+
+	stats, err := KindStats(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(len(stats), Equals, 2)
+	c.Assert(stats[0].Kind, Equals, "CachedObject")
+	c.Assert(stats[1].Count, Equals, int64(3))
+}
+
+func (s *MySuite) TestMirror(c *C) {
+	RegisterMirror(&PetObject{}, "OwnerName", &OwnerObject{}, "Name")
+	owner := &OwnerObject{Name: "Original"}
+	ownerKey, err := Save(ctx, owner)
+	c.Assert(err, IsNil)
+	pet := &PetObject{Name: "Rex", OwnerObjectKey: ownerKey, OwnerName: owner.Name}
+	petKey, err := Save(ctx, pet)
+	c.Assert(err, IsNil)
+
+	owner.Name = "Renamed"
+	_, err = Save(ctx, owner)
+	c.Assert(err, IsNil)
+	// Run the queued task's work directly
+	c.Assert(syncMirrors(ctx, ownerKey, 0, ""), IsNil)
+	loaded := &PetObject{}
+	c.Assert(GetByKey(ctx, petKey, loaded), IsNil)
+	c.Assert(loaded.OwnerName, Equals, "Renamed")
+
+	c.Assert(func() { RegisterMirror(&PetObject{}, "Missing", &OwnerObject{}, "Name") }, PanicMatches, ".*no Missing field.*")
+}
+
+func (s *MySuite) TestIDTypes(c *C) {
+	unsigned := &UnsignedObject{Name: "Unsigned"}
+	key, err := Save(ctx, unsigned)
+	c.Assert(err, IsNil)
+	c.Assert(unsigned.ID, Equals, uint64(key.IntID()))
+	loaded := &UnsignedObject{}
+	c.Assert(GetByKey(ctx, key, loaded), IsNil)
+	c.Assert(loaded.ID, Equals, unsigned.ID)
+
+	_, err = Save(ctx, &UnsignedObject{ID: math.MaxUint64})
+	c.Assert(err, FitsTypeOf, &IDRangeError{})
+
+	custom := &CustomIDObject{ID: 42, Name: "Custom"}
+	key, err = Save(ctx, custom)
+	c.Assert(err, IsNil)
+	c.Assert(key.IntID(), Equals, int64(42))
+}
+
+func (s *MySuite) TestSaveOptions(c *C) {
+	dummy := &DummyObject{Slug: "skipped-hooks"}
+	_, err := Save(ctx, dummy, SkipHooks())
+	c.Assert(err, IsNil)
+	c.Assert(dummy.BeforeSaveCalled, Equals, false)
+	c.Assert(dummy.AfterSaveCalled, Equals, false)
+
+	named := &NamedObject{Handle: "create-only", Name: "First"}
+	_, err = Save(ctx, named, CreateOnly())
+	c.Assert(err, IsNil)
+	named.Name = "Second"
+	_, err = Save(ctx, named, CreateOnly())
+	c.Assert(err, Equals, ErrEntityExists)
+	c.Assert(StatusCode(err), Equals, 409)
+	_, err = Save(ctx, named, UpdateOnly())
+	c.Assert(err, IsNil)
+
+	_, err = Save(ctx, &NamedObject{Handle: "update-only"}, UpdateOnly())
+	c.Assert(err, Equals, datastore.ErrNoSuchEntity)
+	_, err = Save(ctx, &DummyObject{}, UpdateOnly())
+	c.Assert(err, FitsTypeOf, &ErrNoKey{})
+}
+
+func (s *MySuite) TestKindHooks(c *C) {
+	var saved, deleted []*datastore.Key
+	OnBeforeSave("RejectedObject", func(ctx context.Context, obj interface{}) error {
+		c.Error("OnBeforeSave hook called after BeforeSave failed")
+		return nil
+	})
+	OnBeforeSave("TimestampedObject", func(ctx context.Context, obj interface{}) error {
+		if obj.(*TimestampedObject).ID < 0 {
+			return errRejected
+		}
+		return nil
+	})
+	OnAfterSave("TimestampedObject", func(ctx context.Context, obj interface{}, key *datastore.Key) {
+		saved = append(saved, key)
+	})
+	OnAfterDelete(AllKinds, func(ctx context.Context, obj interface{}, key *datastore.Key) {
+		deleted = append(deleted, key)
+	})
+
+	_, err := Save(ctx, &RejectedObject{})
+	c.Assert(err, Equals, errRejected)
+	_, err = Save(ctx, &TimestampedObject{ID: -1})
+	c.Assert(err, Equals, errRejected)
+
+	timestamped := &TimestampedObject{}
+	key, err := Save(ctx, timestamped)
+	c.Assert(err, IsNil)
+	c.Assert(len(saved), Equals, 1)
+	c.Assert(saved[0].Equal(key), Equals, true)
+	_, err = Save(ctx, timestamped, SkipHooks())
+	c.Assert(err, IsNil)
+	c.Assert(len(saved), Equals, 1)
+
+	c.Assert(Delete(ctx, timestamped), IsNil)
+	c.Assert(len(deleted), Equals, 1)
+	c.Assert(deleted[0].Equal(key), Equals, true)
+}
+
+func (s *MySuite) TestRegisterModel(c *C) {
+	c.Assert(RegisterModel(&ChildObject{}), IsNil)
+	c.Assert(RegisterModel(&ProfileObject{}), IsNil)
+	c.Assert(RegisterModel("not a struct"), FitsTypeOf, &ErrNotStruct{})
+
+	err := RegisterModel(&InvalidModelObject{})
+	merr, ok := err.(*ModelError)
+	c.Assert(ok, Equals, true)
+	c.Assert(merr.Problems, DeepEquals, []string{
+		"Key field must be tagged `datastore:\"-\"`, or it's stored as a property",
+		"ID field must be an integer, is string",
+		"aecrypt field Token must be a string or []byte, is int",
+		"aecrypt field Secret can't also be aeunique",
+	})
+}
+
+func (s *MySuite) TestStorageBackend(c *C) {
+	counting := &countingBackend{Backend: DatastoreBackend}
+	StorageBackend = counting
+	defer func() { StorageBackend = nil }()
+
+	dummy := &DummyObject{Slug: "backend"}
+	_, err := Save(ctx, dummy)
+	c.Assert(err, IsNil)
+	c.Assert(counting.puts, Equals, 1)
+
+	loaded := &DummyObject{}
+	_, err = Query(&DummyObject{}).Filter("Slug =", "backend").First(ctx, loaded)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Slug, Equals, "backend")
+	c.Assert(counting.queries, Equals, 1)
+}
+
+func (s *MySuite) TestMemoryBackend(c *C) {
+	memory := NewMemoryBackend()
+	StorageBackend = memory
+	defer func() { StorageBackend = nil }()
+
+	parentKey := datastore.NewKey(ctx, "OwnerObject", "", 1, nil)
+	for _, name := range []string{"b", "c", "a"} {
+		_, err := Save(ctx, &ChildObject{Parent: parentKey, Name: name})
+		c.Assert(err, IsNil)
+	}
+	_, err := Save(ctx, &ChildObject{Name: "orphan"})
+	c.Assert(err, IsNil)
+	c.Assert(memory.Len(), Equals, 4)
+
+	var children []*ChildObject
+	keys, err := Query(&ChildObject{}).Ancestor(parentKey).Filter("Name >", "a").Order("-Name").GetAll(ctx, &children)
+	c.Assert(err, IsNil)
+	c.Assert(len(keys), Equals, 2)
+	c.Assert(children[0].Name, Equals, "c")
+	c.Assert(children[1].Name, Equals, "b")
+	c.Assert(children[1].Key.Equal(keys[1]), Equals, true)
+
+	archived := &ArchivableObject{Slug: "archived"}
+	archivedKey, err := Save(ctx, archived)
+	c.Assert(err, IsNil)
+	c.Assert(Delete(ctx, archived), IsNil)
+	n, err := Query(&ArchivableObject{}).Count(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+	c.Assert(GetByKey(ctx, archivedKey, &ArchivableObject{}), IsNil)
+
+	err = RunInTransaction(ctx, func(tc context.Context) error {
+		if _, err := Save(tc, &ChildObject{Name: "rolled back"}); err != nil {
+			return err
+		}
+		return errRejected
+	}, nil)
+	c.Assert(err, Equals, errRejected)
+	c.Assert(memory.Len(), Equals, 5)
+}
+
+func (s *MySuite) TestEntitySize(c *C) {
+	dummy := &DummyObject{Slug: strings.Repeat("a", MaxIndexedSize+1)}
+	_, err := Save(ctx, dummy)
+	terr, ok := err.(*EntityTooLargeError)
+	c.Assert(ok, Equals, true)
+	c.Assert(terr.Property, Equals, "Slug")
+	c.Assert(terr.Size, Equals, MaxIndexedSize+1)
+	c.Assert(dummy.AfterSaveCalled, Equals, false)
+
+	_, err = SaveMulti(ctx, []interface{}{&DummyObject{Slug: "fine"}, dummy})
+	c.Assert(err, FitsTypeOf, &EntityTooLargeError{})
+
+	dummy.Slug = strings.Repeat("a", MaxIndexedSize)
+	_, err = Save(ctx, dummy)
+	c.Assert(err, IsNil)
+}
+
+func (s *MySuite) TestValidate(c *C) {
+	_, err := Save(ctx, &ValidatedObject{Email: "not an email"})
+	verr, ok := err.(*ValidationError)
+	c.Assert(ok, Equals, true)
+	c.Assert(verr.Fields, DeepEquals, map[string]string{
+		"Name":  "is required",
+		"Email": "must be a valid email address",
+	})
+	c.Assert(verr.Response().Code, Equals, 422)
+
+	err = Validate(ctx, &ValidatedObject{Name: "much too long a name"})
+	c.Assert(err, ErrorMatches, "Invalid ValidatedObject: Name must be at most 10 characters")
+	err = Validate(ctx, &ValidatedObject{Name: "forbidden"})
+	c.Assert(err, ErrorMatches, "Invalid ValidatedObject: Name is not allowed")
+
+	_, err = Save(ctx, &ValidatedObject{Name: "valid", Email: "valid@example.com"})
+	c.Assert(err, IsNil)
+}
+
+func (s *MySuite) TestDefaults(c *C) {
+	defaulted := &DefaultedObject{Limit: 5}
+	_, err := Save(ctx, defaulted)
+	c.Assert(err, IsNil)
+	c.Assert(defaulted.Status, Equals, "draft")
+	c.Assert(defaulted.Limit, Equals, 5)
+	c.Assert(defaulted.Visible, Equals, true)
+	c.Assert(defaulted.TTL, Equals, 3*time.Hour)
+}
+
+func (s *MySuite) TestPatch(c *C) {
+	key, err := Save(ctx, &ValidatedObject{Name: "original", Email: "patch@example.com"})
+	c.Assert(err, IsNil)
+
+	patch := &ValidatedObject{Name: "patched"}
+	c.Assert(Patch(ctx, key, patch, []string{"Name"}), IsNil)
+	c.Assert(patch.Email, Equals, "patch@example.com")
+	stored := &ValidatedObject{}
+	c.Assert(GetByKey(ctx, key, stored), IsNil)
+	c.Assert(stored.Name, Equals, "patched")
+	c.Assert(stored.Email, Equals, "patch@example.com")
+
+	c.Assert(Patch(ctx, key, &ValidatedObject{}, []string{"Missing"}), ErrorMatches, ".* has no exported field Missing .*")
+	// The patched entity is still validated
+	_, ok := Patch(ctx, key, &ValidatedObject{}, []string{"Name"}).(*ValidationError)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *MySuite) TestApplyMergePatch(c *C) {
+	profile := &ProfileObject{Settings: map[string]string{"theme": "dark", "lang": "en"}}
+	_, err := Save(ctx, profile)
+	c.Assert(err, IsNil)
+
+	key, err := ApplyMergePatch(ctx, profile, []byte(`{"settings": {"lang": "fr", "theme": null}, "unknown": 1}`))
+	c.Assert(err, IsNil)
+	c.Assert(profile.Settings, DeepEquals, map[string]string{"lang": "fr"})
+	stored := &ProfileObject{}
+	c.Assert(GetByKey(ctx, key, stored), IsNil)
+	c.Assert(stored.Settings, DeepEquals, map[string]string{"lang": "fr"})
+
+	_, err = ApplyMergePatch(ctx, profile, []byte(`{"Settings": "not a map"}`))
+	c.Assert(err, FitsTypeOf, &ValidationError{})
+	_, err = ApplyMergePatch(ctx, profile, []byte(`["not an object"]`))
+	c.Assert(err, Equals, ErrInvalidPatch)
+	c.Assert(StatusCode(err), Equals, 400)
+	c.Assert(profile.Settings, DeepEquals, map[string]string{"lang": "fr"})
+
+	// Patches can't move the entity, but may repeat its ID
+	_, err = ApplyMergePatch(ctx, profile, []byte(`{"ID": 12345, "Name": "moved"}`))
+	c.Assert(err, ErrorMatches, ".*ID can't be changed by a patch.*")
+	c.Assert(profile.Name, Equals, "")
+	patched, err := ApplyMergePatch(ctx, profile, []byte(fmt.Sprintf(`{"ID": %d, "Name": "renamed"}`, profile.ID)), WithKey(key), UpdateOnly())
+	c.Assert(err, IsNil)
+	c.Assert(patched.Equal(key), Equals, true)
+	c.Assert(profile.Name, Equals, "renamed")
+}
+
+func (s *MySuite) TestDecodeKey(c *C) {
+	key := datastore.NewKey(ctx, "CachedObject", "", 42, nil)
+	encoded := EncodeKey(key)
+	decoded, err := DecodeKey(ctx, encoded, &CachedObject{})
+	c.Assert(err, IsNil)
+	c.Assert(decoded.Equal(key), Equals, true)
+	_, err = DecodeKey(ctx, encoded, "CachedObject")
+	c.Assert(err, IsNil)
+	c.Assert(EncodeKey(nil), Equals, "")
+
+	_, err = DecodeKey(ctx, encoded, &DummyObject{})
+	c.Assert(err, ErrorMatches, "Invalid DummyObject key .*: key is for CachedObject")
+	c.Assert(StatusCode(err), Equals, 400)
+	_, err = DecodeKey(ctx, "not a key", "CachedObject")
+	c.Assert(err, FitsTypeOf, &KeyError{})
+	_, err = DecodeKey(ctx, EncodeKey(datastore.NewIncompleteKey(ctx, "CachedObject", nil)), "CachedObject")
+	c.Assert(err, ErrorMatches, ".*: key is incomplete")
+}
+
+func (s *MySuite) TestPublicID(c *C) {
+	defer SetPublicIDs(currentPublicIDs())
+	SetPublicIDs(nil)
+	key := datastore.NewKey(ctx, "CachedObject", "", 42, nil)
+	_, err := PublicID(key)
+	c.Assert(err, Equals, ErrNoPublicIDs)
+	_, err = ResolvePublicID(ctx, "abc", "CachedObject")
+	c.Assert(err, Equals, ErrNoPublicIDs)
+	c.Assert(SetPublicIDSecret([]byte("short")), NotNil)
+	c.Assert(SetPublicIDSecret([]byte("my test secret, long enough")), IsNil)
+
+	public, err := PublicID(key)
+	c.Assert(err, IsNil)
+	c.Assert(public, Not(Equals), "42")
+	c.Assert(len(public) <= 11, Equals, true)
+	resolved, err := ResolvePublicID(ctx, public, &CachedObject{})
+	c.Assert(err, IsNil)
+	c.Assert(resolved.Equal(key), Equals, true)
+	// Each kind (and secret) gives different strings
+	other, _ := PublicID(datastore.NewKey(ctx, "DummyObject", "", 42, nil))
+	c.Assert(other, Not(Equals), public)
+	other, _ = EncodePublicID("CachedObject", 43)
+	c.Assert(other, Not(Equals), public)
+	other, err = PublicID(datastore.NewKey(ctx, "CachedObject", "named", 0, nil))
+	c.Assert(err, IsNil)
+	c.Assert(other, Equals, "")
+
+	_, err = ResolvePublicID(ctx, "not-valid!", "CachedObject")
+	c.Assert(err, FitsTypeOf, &KeyError{})
+	c.Assert(StatusCode(err), Equals, 400)
+}
+
+func (s *MySuite) TestGetOrCreate(c *C) {
+	first := &DummyObject{Slug: "get-or-create"}
+	created, err := GetOrCreate(ctx, first, Filter{"Slug =", "get-or-create"})
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, true)
+	c.Assert(first.ID, Not(Equals), int64(0))
+
+	second := &DummyObject{Slug: "get-or-create"}
+	created, err = GetOrCreate(ctx, second, Filter{"Slug =", "get-or-create"})
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, false)
+	c.Assert(second.ID, Equals, first.ID)
+
+	_, err = GetOrCreate(ctx, &DummyObject{}, Filter{"Slug >", "get"})
+	c.Assert(err, NotNil)
+
+	byKey := &DummyObject{ID: first.ID}
+	created, err = GetOrCreate(ctx, byKey)
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, false)
+	c.Assert(byKey.Slug, Equals, first.Slug)
+}
+
+func (s *MySuite) TestWithLock(c *C) {
+	ran := false
+	err := WithLock(ctx, "test-lock", time.Minute, func() error {
+		ran = true
+		// Can't be taken again while held
+		c.Assert(WithLock(ctx, "test-lock", time.Minute, func() error {
+			c.Fatal("Lock taken twice")
+			return nil
+		}), Equals, ErrLocked)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ran, Equals, true)
+
+	// And is released afterwards
+	c.Assert(WithLock(ctx, "test-lock", time.Minute, func() error {
+		return errRejected
+	}), Equals, errRejected)
+
+	// Locks that have since been taken by someone else are left alone
+	c.Assert(memcache.Set(ctx, &memcache.Item{Key: "aeutils-lock-test-lock", Value: []byte("other")}), IsNil)
+	unlock(ctx, "aeutils-lock-test-lock", []byte("mine"))
+	item, err := memcache.Get(ctx, "aeutils-lock-test-lock")
+	c.Assert(err, IsNil)
+	c.Assert(string(item.Value), Equals, "other")
+}
+
+func (s *MySuite) TestSaveAsync(c *C) {
+	c.Assert(SaveAsync(ctx, &BulkObject{Name: "unregistered"}), NotNil)
+	RegisterAsync(&BulkObject{})
+	c.Assert(SaveAsync(ctx, &BulkObject{Name: "async"}), IsNil)
+}
+
+func (s *MySuite) TestKeyedBeforeSave(c *C) {
+	keyed := &KeyedObject{}
+	key, err := Save(ctx, keyed)
+	c.Assert(err, IsNil)
+	c.Assert(keyed.Created, Equals, true)
+
+	_, err = Save(ctx, keyed)
+	c.Assert(err, IsNil)
+	c.Assert(keyed.Created, Equals, false)
+	c.Assert(keyed.BeforeKey.Equal(key), Equals, true)
+}
+
+func (s *MySuite) TestErrors(c *C) {
+	_, err := Save(ctx, "not a struct")
+	_, ok := err.(*ErrNotStruct)
+	c.Assert(ok, Equals, true)
+	c.Assert(StatusCode(err), Equals, 500)
+
+	err = Get(ctx, &DummyObject{})
+	_, ok = err.(*ErrNoKey)
+	c.Assert(ok, Equals, true)
+	c.Assert(StatusCode(err), Equals, 400)
+
+	c.Assert(StatusCode(GetByID(ctx, 123456789, &DummyObject{})), Equals, 404)
+	c.Assert(StatusCode(&SaveError{Kind: "DummyObject", Err: datastore.ErrConcurrentTransaction}), Equals, 503)
+	c.Assert(StatusCode(nil), Equals, 200)
+}
+
+func (s *MySuite) TestStringID(c *C) {
+	named := &NamedObject{Handle: "my-handle", Name: "Named"}
+	key, err := Save(ctx, named)
+	c.Assert(err, IsNil)
+	c.Assert(key.StringID(), Equals, "my-handle")
+
+	loaded := &NamedObject{}
+	c.Assert(GetByName(ctx, "my-handle", loaded), IsNil)
+	c.Assert(loaded.Name, Equals, named.Name)
+	c.Assert(loaded.Handle, Equals, named.Handle)
+	c.Assert(loaded.Key.Equal(key), Equals, true)
+}
+
+func (s *MySuite) TestETag(c *C) {
+	versioned := &VersionedObject{Name: "Tagged"}
+	key, err := Save(ctx, versioned)
+	c.Assert(err, IsNil)
+	etag := ETag(key, versioned)
+	c.Assert(etag, Matches, `"[0-9a-f]{24}"`)
+	c.Assert(ETag(key, versioned), Equals, etag)
+	_, err = Save(ctx, versioned)
+	c.Assert(err, IsNil)
+	c.Assert(ETag(key, versioned), Not(Equals), etag)
+
+	dummy := &DummyObject{Slug: "etag"}
+	etag = ETag(nil, dummy)
+	dummy.Slug = "etag-changed"
+	c.Assert(ETag(nil, dummy), Not(Equals), etag)
+	c.Assert(ETag(nil, "not a struct"), Equals, "")
 }
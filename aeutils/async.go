@@ -0,0 +1,57 @@
+package aeutils
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+var (
+	// AsyncQueue is the task queue SaveAsync adds tasks to (the default queue if empty)
+	AsyncQueue = ""
+
+	asyncTypes   = map[reflect.Type]bool{}
+	asyncTypesMu sync.RWMutex
+
+	saveLater = delay.Func("aeutils-save-async", func(ctx context.Context, obj interface{}) error {
+		_, err := Save(ctx, obj)
+		return err
+	})
+)
+
+// RegisterAsync registers the type of obj (a pointer to a struct) so it can be passed to SaveAsync
+// As tasks may run on any instance, it must be called from an init function
+func RegisterAsync(obj interface{}) {
+	gob.Register(obj)
+	asyncTypesMu.Lock()
+	defer asyncTypesMu.Unlock()
+	asyncTypes[reflect.TypeOf(obj)] = true
+}
+
+// SaveAsync gob encodes obj (a pointer to a struct registered with RegisterAsync) and adds a task to AsyncQueue
+// which stores it with Save, returning as soon as the task is added. The task is retried until Save succeeds
+// Useful for high volume writes (analytics events, logs) where latency matters more than the entity being stored straight away
+// As obj is only saved later, its Key and ID fields aren't set and AfterSave is called within the task
+func SaveAsync(ctx context.Context, obj interface{}) error {
+	asyncTypesMu.RLock()
+	registered := asyncTypes[reflect.TypeOf(obj)]
+	asyncTypesMu.RUnlock()
+	if !registered {
+		return errors.New(fmt.Sprintf("%v must be registered with aeutils.RegisterAsync before calling SaveAsync", reflect.TypeOf(obj)))
+	}
+	task, err := saveLater.Task(obj)
+	if err == nil {
+		_, err = taskqueue.Add(ctx, task, AsyncQueue)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/SaveAsync] %v", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package aeutils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// avroWriter writes entities as an Avro object container file (see https://avro.apache.org/docs/1.8.2/spec.html),
+// with a record schema built from the same fields as CSV. Times are written as timestamp-micros, keys as their encoded
+// string and every integer kind as a long
+type avroWriter struct {
+	w      io.Writer
+	fields []int
+	sync   []byte
+	block  bytes.Buffer
+	count  int64
+}
+
+func newAvroWriter(w io.Writer, t reflect.Type) (*avroWriter, error) {
+	aw := &avroWriter{w: w, fields: csvFields(t), sync: make([]byte, 16)}
+	if _, err := rand.Read(aw.sync); err != nil {
+		return nil, err
+	}
+	schema, err := avroSchema(t, aw.fields)
+	if err != nil {
+		return nil, err
+	}
+	header := &bytes.Buffer{}
+	header.WriteString("Obj\x01")
+	// File metadata is a map of a single block
+	writeAvroLong(header, 2)
+	writeAvroBytes(header, []byte("avro.schema"))
+	writeAvroBytes(header, schema)
+	writeAvroBytes(header, []byte("avro.codec"))
+	writeAvroBytes(header, []byte("null"))
+	writeAvroLong(header, 0)
+	header.Write(aw.sync)
+	_, err = w.Write(header.Bytes())
+	return aw, err
+}
+
+// avroSchema returns the JSON schema for records of the fields of t
+func avroSchema(t reflect.Type, fields []int) ([]byte, error) {
+	type avroField struct {
+		Name string      `json:"name"`
+		Type interface{} `json:"type"`
+	}
+	schemaFields := make([]avroField, len(fields))
+	for j, i := range fields {
+		field := t.Field(i)
+		schemaFields[j].Name = field.Name
+		switch {
+		case field.Type == timeType:
+			schemaFields[j].Type = map[string]string{"type": "long", "logicalType": "timestamp-micros"}
+		case field.Type == keyType || field.Type.Kind() == reflect.String:
+			schemaFields[j].Type = "string"
+		case field.Type == bytesType:
+			schemaFields[j].Type = "bytes"
+		case field.Type.Kind() == reflect.Bool:
+			schemaFields[j].Type = "boolean"
+		case field.Type.Kind() == reflect.Float32 || field.Type.Kind() == reflect.Float64:
+			schemaFields[j].Type = "double"
+		default:
+			schemaFields[j].Type = "long"
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"type":   "record",
+		"name":   getDatastoreKind(t),
+		"fields": schemaFields,
+	})
+}
+
+// write adds the entity in str to the current block, writing the block out once it holds ImportBatchSize entities
+func (aw *avroWriter) write(str reflect.Value) error {
+	for _, i := range aw.fields {
+		v := str.Field(i)
+		switch x := v.Interface().(type) {
+		case time.Time:
+			if x.IsZero() {
+				writeAvroLong(&aw.block, 0)
+			} else {
+				writeAvroLong(&aw.block, x.UnixNano()/int64(time.Microsecond))
+			}
+			continue
+		case *datastore.Key:
+			if x == nil {
+				writeAvroBytes(&aw.block, nil)
+			} else {
+				writeAvroBytes(&aw.block, []byte(x.Encode()))
+			}
+			continue
+		case []byte:
+			writeAvroBytes(&aw.block, x)
+			continue
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			if v.Bool() {
+				aw.block.WriteByte(1)
+			} else {
+				aw.block.WriteByte(0)
+			}
+		case reflect.Float32, reflect.Float64:
+			binary.Write(&aw.block, binary.LittleEndian, math.Float64bits(v.Float()))
+		case reflect.String:
+			writeAvroBytes(&aw.block, []byte(v.String()))
+		default:
+			writeAvroLong(&aw.block, v.Int())
+		}
+	}
+	if aw.count++; aw.count == int64(ImportBatchSize) {
+		return aw.flush()
+	}
+	return nil
+}
+
+// flush writes out the current block, if it holds any entities
+func (aw *avroWriter) flush() error {
+	if aw.count == 0 {
+		return nil
+	}
+	header := &bytes.Buffer{}
+	writeAvroLong(header, aw.count)
+	writeAvroLong(header, int64(aw.block.Len()))
+	for _, b := range [][]byte{header.Bytes(), aw.block.Bytes(), aw.sync} {
+		if _, err := aw.w.Write(b); err != nil {
+			return err
+		}
+	}
+	aw.block.Reset()
+	aw.count = 0
+	return nil
+}
+
+// writeAvroLong writes n zig-zag encoded, as a variable length integer
+func writeAvroLong(buf *bytes.Buffer, n int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutVarint(b, n)])
+}
+
+// writeAvroBytes writes b prefixed by its length, as Avro encodes both bytes and strings
+func writeAvroBytes(buf *bytes.Buffer, b []byte) {
+	writeAvroLong(buf, int64(len(b)))
+	buf.Write(b)
+}
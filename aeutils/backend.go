@@ -0,0 +1,165 @@
+package aeutils
+
+import (
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Backend stores and loads the entities aeutils works with. Save, the Get helpers, Delete, QueryBuilder and transactions
+// all go through it, so the conventions they implement (hooks, keys, encryption, etc.) work the same with any storage
+// that implements it. Arguments and results are as for the datastore package functions of the same names
+// Iterate, mirrors and KindStats need the datastore itself, so always use it directly
+type Backend interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	AllocateIDs(ctx context.Context, kind string, parent *datastore.Key, n int) (low, high int64, err error)
+	RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error
+	// GetAll runs q, loading results into dst (unless q is KeysOnly) like datastore.Query.GetAll
+	GetAll(ctx context.Context, q *BackendQuery, dst interface{}) ([]*datastore.Key, error)
+	Count(ctx context.Context, q *BackendQuery) (int, error)
+}
+
+var (
+	// StorageBackend, if set, is the Backend aeutils uses. Otherwise it uses NDSBackend if UseNDS is set, or DatastoreBackend
+	StorageBackend Backend
+
+	// DatastoreBackend stores entities with the datastore package
+	DatastoreBackend Backend = datastoreBackend{}
+	// NDSBackend stores entities with the nds package, which caches them in memcache. Queries and
+	// ID allocation still go to the datastore package, as nds doesn't handle them
+	NDSBackend Backend = ndsBackend{}
+)
+
+// backend returns the Backend currently in use
+func backend() Backend {
+	if StorageBackend != nil {
+		return StorageBackend
+	} else if UseNDS {
+		return NDSBackend
+	}
+	return DatastoreBackend
+}
+
+// BackendQuery is a query for a Backend to run, with the same options as datastore.Query
+// The namespace is that of the context it's run with
+type BackendQuery struct {
+	Kind       string
+	Ancestor   *datastore.Key
+	Filters    []Filter // In the format of datastore.Query.Filter
+	Orders     []string // In the format of datastore.Query.Order
+	Projection []string
+	Limit      int // 0 for no limit
+	Offset     int
+	Start      datastore.Cursor
+	KeysOnly   bool
+}
+
+// datastoreQuery returns q as a datastore.Query
+func (q *BackendQuery) datastoreQuery() *datastore.Query {
+	dq := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		dq = dq.Ancestor(q.Ancestor)
+	}
+	for _, f := range q.Filters {
+		dq = dq.Filter(f.Field, f.Value)
+	}
+	for _, order := range q.Orders {
+		dq = dq.Order(order)
+	}
+	if len(q.Projection) > 0 {
+		dq = dq.Project(q.Projection...)
+	}
+	if q.Limit != 0 {
+		dq = dq.Limit(q.Limit)
+	}
+	if q.Offset != 0 {
+		dq = dq.Offset(q.Offset)
+	}
+	if q.Start != (datastore.Cursor{}) {
+		dq = dq.Start(q.Start)
+	}
+	if q.KeysOnly {
+		dq = dq.KeysOnly()
+	}
+	return dq
+}
+
+type datastoreBackend struct{}
+
+func (datastoreBackend) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return datastore.Get(ctx, key, dst)
+}
+
+func (datastoreBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return datastore.GetMulti(ctx, keys, dst)
+}
+
+func (datastoreBackend) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return datastore.Put(ctx, key, src)
+}
+
+func (datastoreBackend) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return datastore.PutMulti(ctx, keys, src)
+}
+
+func (datastoreBackend) Delete(ctx context.Context, key *datastore.Key) error {
+	return datastore.Delete(ctx, key)
+}
+
+func (datastoreBackend) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+func (datastoreBackend) AllocateIDs(ctx context.Context, kind string, parent *datastore.Key, n int) (int64, int64, error) {
+	return datastore.AllocateIDs(ctx, kind, parent, n)
+}
+
+func (datastoreBackend) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(ctx, f, opts)
+}
+
+func (datastoreBackend) GetAll(ctx context.Context, q *BackendQuery, dst interface{}) ([]*datastore.Key, error) {
+	return q.datastoreQuery().GetAll(ctx, dst)
+}
+
+func (datastoreBackend) Count(ctx context.Context, q *BackendQuery) (int, error) {
+	return q.datastoreQuery().Count(ctx)
+}
+
+type ndsBackend struct {
+	datastoreBackend
+}
+
+func (ndsBackend) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return nds.Get(ctx, key, dst)
+}
+
+func (ndsBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return nds.GetMulti(ctx, keys, dst)
+}
+
+func (ndsBackend) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return nds.Put(ctx, key, src)
+}
+
+func (ndsBackend) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return nds.PutMulti(ctx, keys, src)
+}
+
+func (ndsBackend) Delete(ctx context.Context, key *datastore.Key) error {
+	return nds.Delete(ctx, key)
+}
+
+func (ndsBackend) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return nds.DeleteMulti(ctx, keys)
+}
+
+func (ndsBackend) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	return nds.RunInTransaction(ctx, f, opts)
+}
@@ -0,0 +1,256 @@
+package aeutils
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Format is a file format for ExportKind and ImportKind
+type Format int
+
+const (
+	// JSON is newline delimited JSON, one object per line, encoded with encoding/json (so json struct tags apply)
+	JSON Format = iota
+	// CSV has a header row of field names, then one row per entity. Only fields of kinds the datastore stores directly
+	// (strings, bools, ints, floats, time.Time, *datastore.Key and []byte) are included
+	CSV
+	// Avro is an Avro object container file, with a record schema of the same fields as CSV. Export only
+	Avro
+)
+
+var (
+	// ImportBatchSize is the number of entities ImportKind saves with each SaveMulti call
+	ImportBatchSize = 100
+
+	// ErrUnknownFormat is returned by ExportKind for any Format other than JSON, CSV or Avro, and by ImportKind for any
+	// other than JSON or CSV
+	ErrUnknownFormat = errors.New("[aeutils] Unknown bulk format, must be JSON, CSV or (for exports) Avro")
+)
+
+// ExportKind writes every entity of the kind of obj (a struct or pointer to struct) to w in format,
+// including soft deleted ones, returning the number written. Entities are loaded with Iterate,
+// so a very large kind may return ErrIterateDeadline, in which case it should be exported from a task or backend instead
+func ExportKind(ctx context.Context, obj interface{}, w io.Writer, format Format) (n int, err error) {
+	kind, _, _, err := structValue(obj)
+	if err != nil {
+		return 0, err
+	}
+	var write func(str reflect.Value) error
+	switch format {
+	case JSON:
+		enc := json.NewEncoder(w)
+		write = func(str reflect.Value) error {
+			return enc.Encode(str.Interface())
+		}
+	case CSV:
+		cw := csv.NewWriter(w)
+		defer cw.Flush()
+		fields := csvFields(kind)
+		header := make([]string, len(fields))
+		for j, i := range fields {
+			header[j] = kind.Field(i).Name
+		}
+		if err = cw.Write(header); err != nil {
+			return 0, err
+		}
+		write = func(str reflect.Value) error {
+			row := make([]string, len(fields))
+			for j, i := range fields {
+				row[j] = formatCSV(str.Field(i))
+			}
+			return cw.Write(row)
+		}
+	case Avro:
+		aw, err := newAvroWriter(w, kind)
+		if err != nil {
+			return 0, err
+		}
+		write = aw.write
+		defer func() {
+			if err == nil {
+				err = aw.flush()
+			}
+		}()
+	default:
+		return 0, ErrUnknownFormat
+	}
+	q := datastore.NewQuery(getDatastoreKind(kind))
+	_, err = Iterate(ctx, q, obj, func(obj interface{}, key *datastore.Key) error {
+		n++
+		return write(reflect.ValueOf(obj).Elem())
+	})
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/ExportKind] %v", err.Error())
+	}
+	return
+}
+
+// ImportKind reads entities of the kind of obj (a struct or pointer to struct) from r in format, as written by ExportKind,
+// and stores them with SaveMulti in batches of ImportBatchSize, returning the number stored
+// Entities with Key or ID fields overwrite whatever is stored at that key, others are given new IDs
+func ImportKind(ctx context.Context, obj interface{}, r io.Reader, format Format) (n int, err error) {
+	kind, _, _, err := structValue(obj)
+	if err != nil {
+		return 0, err
+	}
+	var read func() (interface{}, error)
+	switch format {
+	case JSON:
+		dec := json.NewDecoder(r)
+		read = func() (interface{}, error) {
+			val := reflect.New(kind)
+			return val.Interface(), dec.Decode(val.Interface())
+		}
+	case CSV:
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return 0, err
+		}
+		fields := make([]int, len(header))
+		for j, name := range header {
+			field, ok := kind.FieldByName(name)
+			if !ok || len(field.Index) > 1 || !csvSupported(field.Type) {
+				return 0, errors.New(fmt.Sprintf("[aeutils/ImportKind] %v has no field %v to import", kind, name))
+			}
+			fields[j] = field.Index[0]
+		}
+		read = func() (interface{}, error) {
+			row, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			val := reflect.New(kind)
+			for j, i := range fields {
+				if err = parseCSV(val.Elem().Field(i), row[j]); err != nil {
+					return nil, err
+				}
+			}
+			return val.Interface(), nil
+		}
+	default:
+		return 0, ErrUnknownFormat
+	}
+	batch := make([]interface{}, 0, ImportBatchSize)
+	for {
+		obj, readErr := read()
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			log.Errorf(ctx, "[aeutils/ImportKind] %v", readErr.Error())
+			return n, readErr
+		}
+		if batch = append(batch, obj); len(batch) == ImportBatchSize {
+			if _, err = SaveMulti(ctx, batch); err != nil {
+				return n, err
+			}
+			n += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if _, err = SaveMulti(ctx, batch); err != nil {
+			return n, err
+		}
+		n += len(batch)
+	}
+	return n, nil
+}
+
+// csvFields returns the indexes of all exported fields of t that can be written as CSV
+func csvFields(t reflect.Type) (fields []int) {
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); field.PkgPath == "" && csvSupported(field.Type) {
+			fields = append(fields, i)
+		}
+	}
+	return
+}
+
+func csvSupported(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return isInt(t.Kind()) || t == timeType || t == keyType || t == bytesType
+}
+
+func formatCSV(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case time.Time:
+		if x.IsZero() {
+			return ""
+		}
+		return x.Format(time.RFC3339Nano)
+	case *datastore.Key:
+		if x == nil {
+			return ""
+		}
+		return x.Encode()
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case reflect.String:
+		return v.String()
+	}
+	return strconv.FormatInt(v.Int(), 10)
+}
+
+// parseCSV sets v from s, as written by formatCSV. Empty strings leave v as its zero value
+func parseCSV(v reflect.Value, s string) error {
+	if s == "" {
+		return nil
+	}
+	switch v.Type() {
+	case timeType:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err == nil {
+			v.Set(reflect.ValueOf(t))
+		}
+		return err
+	case keyType:
+		key, err := datastore.DecodeKey(s)
+		if err == nil {
+			v.Set(reflect.ValueOf(key))
+		}
+		return err
+	case bytesType:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err == nil {
+			v.SetBytes(b)
+		}
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		v.SetBool(b)
+		return err
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		v.SetFloat(f)
+		return err
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	v.SetInt(i)
+	return err
+}
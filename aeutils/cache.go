@@ -0,0 +1,205 @@
+package aeutils
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+var (
+	cachedKinds   = map[string]time.Duration{}
+	cachedKindsMu sync.RWMutex
+)
+
+// CacheKind enables a write-through memcache cache for the kind of obj (a struct or pointer to struct)
+// Save and SaveMulti store a gob encoded copy of each entity in memcache, keyed by its encoded datastore key,
+// which the Get helpers read from before falling back on the datastore. Entries expire after ttl (0 for no expiry),
+// and are removed when the entity is deleted. Useful for hot single-entity reads like accounts and settings
+// aecrypt fields are cached encrypted, as they're stored, and decrypted when read back
+// This is independent of UseNDS, and shouldn't generally be combined with it
+func CacheKind(obj interface{}, ttl time.Duration) {
+	cachedKindsMu.Lock()
+	defer cachedKindsMu.Unlock()
+	cachedKinds[KindOf(obj)] = ttl
+}
+
+// UncacheKind disables caching for the kind of obj. Existing entries are left to expire
+func UncacheKind(obj interface{}) {
+	cachedKindsMu.Lock()
+	defer cachedKindsMu.Unlock()
+	delete(cachedKinds, KindOf(obj))
+}
+
+// cacheTTL returns the TTL for a kind, and whether that kind is cached at all
+func cacheTTL(dsKind string) (ttl time.Duration, ok bool) {
+	cachedKindsMu.RLock()
+	defer cachedKindsMu.RUnlock()
+	ttl, ok = cachedKinds[dsKind]
+	return
+}
+
+func cacheKey(key *datastore.Key) string {
+	return "aeutils-" + key.Encode()
+}
+
+// cacheSet stores obj in memcache, if its kind is cached
+func cacheSet(ctx context.Context, key *datastore.Key, obj interface{}) {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	ttl, ok := cacheTTL(key.Kind())
+	if !ok {
+		return
+	}
+	obj, err := cacheObject(obj)
+	if err == nil {
+		err = memcache.Gob.Set(ctx, &memcache.Item{
+			Key:        cacheKey(key),
+			Object:     obj,
+			Expiration: ttl,
+		})
+	}
+	if err != nil {
+		log.Warningf(ctx, "[aeutils/cacheSet] %v", err.Error())
+	}
+}
+
+// cacheGet loads key from memcache into str, returning true if it was found
+// Always misses within a transaction, so transactional reads come from the datastore
+func cacheGet(ctx context.Context, key *datastore.Key, str reflect.Value) bool {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	if _, ok := cacheTTL(key.Kind()); !ok || currentTransaction(ctx) != nil {
+		return false
+	}
+	// Decode into a fresh value, since gob skips zero values and would leave any existing values in str
+	fresh := reflect.New(str.Type())
+	if _, err := memcache.Gob.Get(ctx, cacheKey(key), fresh.Interface()); err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Warningf(ctx, "[aeutils/cacheGet] %v", err.Error())
+		}
+		return false
+	}
+	if err := decryptFields(fresh.Elem()); err != nil {
+		log.Warningf(ctx, "[aeutils/cacheGet] %v", err.Error())
+		return false
+	}
+	str.Set(fresh.Elem())
+	return true
+}
+
+// cacheDelete removes keys from memcache, for any that are of a cached kind
+func cacheDelete(ctx context.Context, keys ...*datastore.Key) {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	var cacheKeys []string
+	for _, key := range keys {
+		if _, ok := cacheTTL(key.Kind()); ok {
+			cacheKeys = append(cacheKeys, cacheKey(key))
+		}
+	}
+	if len(cacheKeys) == 0 {
+		return
+	}
+	err := memcache.DeleteMulti(ctx, cacheKeys)
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, err := range me {
+			if err != nil && err != memcache.ErrCacheMiss {
+				log.Warningf(ctx, "[aeutils/cacheDelete] %v", err.Error())
+			}
+		}
+	} else if err != nil {
+		log.Warningf(ctx, "[aeutils/cacheDelete] %v", err.Error())
+	}
+}
+
+// cacheGetMulti is like cacheGet for many keys at once (with a single memcache call), loading each hit into vals[i]
+// (a pointer to a struct) and setting hits[i]. Keys that are already hits are skipped
+func cacheGetMulti(ctx context.Context, keys []*datastore.Key, vals []reflect.Value, hits []bool) {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	if currentTransaction(ctx) != nil {
+		return
+	}
+	var cacheKeys []string
+	for i, key := range keys {
+		if _, ok := cacheTTL(key.Kind()); ok && !hits[i] {
+			cacheKeys = append(cacheKeys, cacheKey(key))
+		}
+	}
+	if len(cacheKeys) == 0 {
+		return
+	}
+	items, err := memcache.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		log.Warningf(ctx, "[aeutils/cacheGetMulti] %v", err.Error())
+		return
+	}
+	for i, key := range keys {
+		item, ok := items[cacheKey(key)]
+		if !ok || hits[i] {
+			continue
+		}
+		// As in cacheGet, decode into a fresh value
+		fresh := reflect.New(vals[i].Type().Elem())
+		err := memcache.Gob.Unmarshal(item.Value, fresh.Interface())
+		if err == nil {
+			err = decryptFields(fresh.Elem())
+		}
+		if err != nil {
+			log.Warningf(ctx, "[aeutils/cacheGetMulti] %v", err.Error())
+			continue
+		}
+		vals[i].Elem().Set(fresh.Elem())
+		requestCacheSet(ctx, key, fresh.Elem())
+		hits[i] = true
+	}
+}
+
+// cacheSetMulti is like cacheSet for many objects at once, with a single memcache call
+func cacheSetMulti(ctx context.Context, keys []*datastore.Key, objs []interface{}) {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	var items []*memcache.Item
+	for i, key := range keys {
+		if ttl, ok := cacheTTL(key.Kind()); ok {
+			obj, err := cacheObject(objs[i])
+			if err != nil {
+				log.Warningf(ctx, "[aeutils/cacheSetMulti] %v", err.Error())
+				continue
+			}
+			items = append(items, &memcache.Item{
+				Key:        cacheKey(key),
+				Object:     obj,
+				Expiration: ttl,
+			})
+		}
+	}
+	if len(items) == 0 {
+		return
+	}
+	if err := memcache.Gob.SetMulti(ctx, items); err != nil {
+		log.Warningf(ctx, "[aeutils/cacheSetMulti] %v", err.Error())
+	}
+}
+
+// cacheObject returns what to store in memcache for obj: obj itself, or if it has aecrypt fields, a copy with them
+// encrypted, so their plaintext is never cached
+func cacheObject(obj interface{}) (interface{}, error) {
+	str := reflect.Indirect(reflect.ValueOf(obj))
+	fields, err := cryptFields(str.Type())
+	if err != nil || len(fields) == 0 {
+		return obj, err
+	}
+	encrypted := reflect.New(str.Type())
+	encrypted.Elem().Set(str)
+	if _, err = encryptFields(encrypted.Elem()); err != nil {
+		return nil, err
+	}
+	return encrypted.Interface(), nil
+}
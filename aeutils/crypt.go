@@ -0,0 +1,210 @@
+package aeutils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrNoEncryptionKey is returned when saving or loading a struct with encrypted fields before SetEncryptionKey is called
+	ErrNoEncryptionKey = errors.New("No encryption key set for aecrypt fields, see aeutils.SetEncryptionKey")
+
+	// Header of values encrypted with AES-GCM, ending in the format version. It's several bytes long, so values encrypted
+	// with AES-CFB before it was added (which start with a random IV) are all but never mistaken for one
+	gcmHeader = []byte("aec\x01")
+
+	encryptionKey   []byte
+	encryptionKeyMu sync.RWMutex
+	bytesType       = reflect.TypeOf([]byte(nil))
+)
+
+// SetEncryptionKey sets the key used for fields tagged `aecrypt:"true"`, and by Encrypt and Decrypt
+// Must be a valid size AES encryption key (16, 24, or 32 bytes)
+func SetEncryptionKey(key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	encryptionKeyMu.Lock()
+	defer encryptionKeyMu.Unlock()
+	encryptionKey = key
+	return nil
+}
+
+// HasEncryptionKey returns whether a key has been set with SetEncryptionKey
+func HasEncryptionKey() bool {
+	return len(currentEncryptionKey()) > 0
+}
+
+func currentEncryptionKey() []byte {
+	encryptionKeyMu.RLock()
+	defer encryptionKeyMu.RUnlock()
+	return encryptionKey
+}
+
+// cryptFields returns the indexes of all fields of t tagged `aecrypt:"true"`, which must be strings or []byte
+func cryptFields(t reflect.Type) (fields []int, err error) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("aecrypt") != "true" {
+			continue
+		}
+		if field.Type.Kind() != reflect.String && field.Type != bytesType {
+			return nil, errors.New(fmt.Sprintf("aecrypt field %v.%v must be a string or []byte, is %v", t, field.Name, field.Type))
+		}
+		// Values are claimed as they're stored, and each encryption gives different ciphertext, so they'd never collide
+		if field.Tag.Get("aeunique") != "" {
+			return nil, errors.New(fmt.Sprintf("aecrypt field %v.%v can't also be aeunique", t, field.Name))
+		}
+		fields = append(fields, i)
+	}
+	if len(fields) > 0 && !HasEncryptionKey() {
+		return nil, ErrNoEncryptionKey
+	}
+	return
+}
+
+// encryptFields encrypts the aecrypt fields of str in place, returning a function that restores their plaintext values
+// []byte fields hold the raw ciphertext, string fields hold it base64 encoded. Empty values are left as is
+func encryptFields(str reflect.Value) (restore func(), err error) {
+	fields, err := cryptFields(str.Type())
+	if err != nil {
+		return nil, err
+	}
+	plaintexts := make([]reflect.Value, len(fields))
+	restore = func() {
+		for j, i := range fields {
+			if plaintexts[j].IsValid() {
+				str.Field(i).Set(plaintexts[j])
+			}
+		}
+	}
+	for j, i := range fields {
+		field := str.Field(i)
+		plaintext := fieldBytes(field)
+		if len(plaintext) == 0 {
+			continue
+		}
+		ciphertext, err := Encrypt(plaintext)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		plaintexts[j] = reflect.ValueOf(field.Interface())
+		if field.Kind() == reflect.String {
+			field.SetString(base64.StdEncoding.EncodeToString(ciphertext))
+		} else {
+			field.SetBytes(ciphertext)
+		}
+	}
+	return restore, nil
+}
+
+// decryptFields decrypts the aecrypt fields of str in place, after it's been loaded from the datastore
+func decryptFields(str reflect.Value) error {
+	fields, err := cryptFields(str.Type())
+	if err != nil {
+		return err
+	}
+	for _, i := range fields {
+		field := str.Field(i)
+		ciphertext := fieldBytes(field)
+		if len(ciphertext) == 0 {
+			continue
+		}
+		if field.Kind() == reflect.String {
+			if ciphertext, err = base64.StdEncoding.DecodeString(field.String()); err != nil {
+				return err
+			}
+		}
+		plaintext, err := Decrypt(ciphertext)
+		if err != nil {
+			return err
+		}
+		if field.Kind() == reflect.String {
+			field.SetString(string(plaintext))
+		} else {
+			field.SetBytes(plaintext)
+		}
+	}
+	return nil
+}
+
+func fieldBytes(field reflect.Value) []byte {
+	if field.Kind() == reflect.String {
+		return []byte(field.String())
+	}
+	return field.Bytes()
+}
+
+// Encrypt returns plaintext encrypted with AES-GCM and the key set with SetEncryptionKey, prefixed by a version header
+// and its nonce
+func Encrypt(plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	size := len(gcmHeader) + gcm.NonceSize()
+	prefix := make([]byte, size, size+len(plaintext)+gcm.Overhead())
+	copy(prefix, gcmHeader)
+	nonce := prefix[len(gcmHeader):]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(prefix, nonce, plaintext, nil), nil
+}
+
+// Decrypt returns the plaintext of ciphertext from Encrypt, or an error if it's been altered
+// Values without the version header were encrypted with AES-CFB by earlier versions, and are decrypted as such
+// (without authentication) so they can still be loaded. They're encrypted with AES-GCM when next saved
+func Decrypt(ciphertext []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, gcmHeader) {
+		return decryptCFB(ciphertext)
+	}
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[len(gcmHeader):]
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("aecrypt ciphertext too short")
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+func newGCM() (cipher.AEAD, error) {
+	key := currentEncryptionKey()
+	if len(key) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptCFB decrypts values encrypted with AES-CFB, prefixed by their IV, as they were before Encrypt used AES-GCM
+func decryptCFB(ciphertext []byte) ([]byte, error) {
+	key := currentEncryptionKey()
+	if len(key) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("aecrypt ciphertext too short")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	cipher.NewCFBDecrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(plaintext, ciphertext[aes.BlockSize:])
+	return plaintext, nil
+}
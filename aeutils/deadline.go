@@ -0,0 +1,38 @@
+package aeutils
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// RPCDeadline, if set, is the deadline aeutils applies to each datastore and memcache RPC it makes, so a slow query
+	// fails fast (and is retried, see RetryAttempts) rather than using up the whole request. Override it for a single
+	// call with WithRPCDeadline. RPCs within a transaction are left to the transaction's own deadline
+	RPCDeadline time.Duration
+)
+
+type rpcDeadlineKey struct{}
+
+// WithRPCDeadline returns a copy of ctx that makes aeutils use deadline for each RPC it makes, rather than RPCDeadline
+// Unlike context.WithTimeout, the deadline applies to each attempt separately, rather than to every call made with ctx
+// A deadline of 0 disables it. As transactions are tracked by their context, don't use it within one
+//
+// 	err := aeutils.Query(&Post{}).Filter("Tag =", tag).GetAll(aeutils.WithRPCDeadline(ctx, 5*time.Second), &posts)
+func WithRPCDeadline(ctx context.Context, deadline time.Duration) context.Context {
+	return context.WithValue(ctx, rpcDeadlineKey{}, deadline)
+}
+
+// rpcContext returns a context to make a single RPC with, with the deadline for ctx applied (if any)
+// The returned cancel func must be called once the RPC is done
+func rpcContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline := RPCDeadline
+	if d, ok := ctx.Value(rpcDeadlineKey{}).(time.Duration); ok {
+		deadline = d
+	}
+	if deadline <= 0 || currentTransaction(ctx) != nil {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, deadline)
+}
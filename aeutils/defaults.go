@@ -0,0 +1,59 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setDefaults sets any zero valued fields of str tagged `default:"..."` to that value
+// Supports strings, bools, ints, floats and time.Duration (in time.ParseDuration format, ie `default:"3h"`)
+// As false is a bool's zero value, a bool field defaulting to true can't be saved as false
+func setDefaults(str reflect.Value) error {
+	if !str.CanSet() {
+		return nil
+	}
+	t := str.Type()
+	for i := 0; i < t.NumField(); i++ {
+		def := t.Field(i).Tag.Get("default")
+		field := str.Field(i)
+		if def == "" || !field.CanSet() || !reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+			continue
+		}
+		var err error
+		switch kind := field.Kind(); {
+		case field.Type() == durationType:
+			var d time.Duration
+			if d, err = time.ParseDuration(def); err == nil {
+				field.SetInt(int64(d))
+			}
+		case kind == reflect.String:
+			field.SetString(def)
+		case kind == reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(def); err == nil {
+				field.SetBool(b)
+			}
+		case kind == reflect.Float32 || kind == reflect.Float64:
+			var f float64
+			if f, err = strconv.ParseFloat(def, 64); err == nil {
+				field.SetFloat(f)
+			}
+		case isInt(kind):
+			var n int64
+			if n, err = strconv.ParseInt(def, 10, 64); err == nil {
+				field.SetInt(n)
+			}
+		default:
+			err = errors.New("unsupported type " + field.Type().String())
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid default for %v.%v: %v", t, t.Field(i).Name, err.Error()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Delete takes an context.Context and a struct (or pointer to struct) and removes it from the datastore
+// The key is resolved the same way Save does, from the 'Key' field first, then from a non-zero 'ID' field.
+// Additionally checks for:
+//
+// * Method 'BeforeDelete' that receives context.Context as it's first parameter (see BeforeDeleter)
+//   If it returns an error, obj is not deleted and that error is returned
+// * Method 'AfterDelete' that receives context.Context and *datastore.Key as it's parameters (see AfterDeleter)
+// * Field 'DeletedAt' of kind time.Time. If exists, obj is soft deleted instead: DeletedAt is set to the current time
+//   and obj is saved, which excludes it from the query helpers until it's restored (see Restore and HardDelete)
+//
+// When UseNDS is set, deletes go through nds so its memcache entries are cleared as well,
+// and any entry in the aeutils cache (see CacheKind) is removed, along with cached queries of the kind (see CacheQueries). Values of unique fields are released
+// once an entity is actually removed (soft deleted entities keep them)
+func Delete(ctx context.Context, obj interface{}) error {
+	return deleteObj(ctx, obj, true)
+}
+
+// HardDelete is like Delete, but always removes obj from the datastore, even if it has a 'DeletedAt' field
+func HardDelete(ctx context.Context, obj interface{}) error {
+	return deleteObj(ctx, obj, false)
+}
+
+// Restore undoes a soft delete, clearing the 'DeletedAt' field of obj and saving it again
+func Restore(ctx context.Context, obj interface{}) error {
+	_, _, str, err := structValue(obj)
+	if err != nil {
+		return err
+	}
+	deletedAt, ok := deletedAtField(str)
+	if !ok {
+		return errors.New(fmt.Sprintf("%v has no DeletedAt field, so can't be restored", str.Type()))
+	}
+	deletedAt.Set(reflect.ValueOf(time.Time{}))
+	_, err = Save(ctx, obj)
+	return err
+}
+
+// DeleteMulti removes a batch of structs (or pointers to structs) from the datastore with a single
+// DeleteMulti call, calling BeforeDelete on all objects first (and if any returns an error, nothing is deleted)
+// and AfterDelete on each once removed. Objects with a 'DeletedAt' field are soft deleted with a single SaveMulti call
+func DeleteMulti(ctx context.Context, objs []interface{}) error {
+	return deleteMulti(ctx, objs, true)
+}
+
+// HardDeleteMulti is like DeleteMulti, but always removes objs from the datastore, even if they have a 'DeletedAt' field
+func HardDeleteMulti(ctx context.Context, objs []interface{}) error {
+	return deleteMulti(ctx, objs, false)
+}
+
+func deleteObj(ctx context.Context, obj interface{}, soft bool) error {
+	kind, _, str, err := structValue(obj)
+	if err != nil {
+		return err
+	}
+	key := resolveKey(ctx, obj, str, getDatastoreKind(kind))
+	if key == nil || key.Incomplete() {
+		return &ErrNoKey{Kind: getDatastoreKind(kind), Op: "delete"}
+	}
+	if err = preDelete(ctx, obj); err != nil {
+		return err
+	}
+	if deletedAt, ok := deletedAtField(str); soft && ok {
+		previous := deletedAt.Interface()
+		deletedAt.Set(reflect.ValueOf(time.Now()))
+		if _, err = Save(ctx, obj); err != nil {
+			deletedAt.Set(reflect.ValueOf(previous))
+		}
+	} else {
+		start := time.Now()
+		err = withRetry(ctx, func(ctx context.Context) error {
+			return backend().Delete(ctx, key)
+		})
+		trace(ctx, "Delete", key.Kind(), start, err)
+		if err == nil {
+			afterCommit(ctx, func(ctx context.Context) {
+				cacheDelete(ctx, key)
+				requestCacheDelete(ctx, key)
+				invalidateQueries(ctx, key)
+			})
+			if fields := uniqueFields(kind); len(fields) > 0 {
+				err = releaseUniques(ctx, key, str, fields)
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/Delete]: %v", err.Error())
+		return err
+	}
+	postDelete(ctx, obj, key)
+	return nil
+}
+
+func deleteMulti(ctx context.Context, objs []interface{}, soft bool) error {
+	keys := make([]*datastore.Key, len(objs))
+	var hardKeys []*datastore.Key
+	var softObjs []interface{}
+	for i, obj := range objs {
+		kind, _, str, err := structValue(obj)
+		if err != nil {
+			return err
+		}
+		keys[i] = resolveKey(ctx, obj, str, getDatastoreKind(kind))
+		if keys[i] == nil || keys[i].Incomplete() {
+			return &ErrNoKey{Kind: getDatastoreKind(kind), Op: "delete"}
+		}
+		if _, ok := deletedAtField(str); soft && ok {
+			softObjs = append(softObjs, obj)
+		} else {
+			hardKeys = append(hardKeys, keys[i])
+		}
+	}
+	for _, obj := range objs {
+		if err := preDelete(ctx, obj); err != nil {
+			return err
+		}
+	}
+	if len(softObjs) > 0 {
+		now := reflect.ValueOf(time.Now())
+		for _, obj := range softObjs {
+			deletedAt, _ := deletedAtField(reflect.Indirect(reflect.ValueOf(obj)))
+			deletedAt.Set(now)
+		}
+		if _, err := SaveMulti(ctx, softObjs); err != nil {
+			return err
+		}
+	}
+	if len(hardKeys) > 0 {
+		var err error
+		start := time.Now()
+		err = withRetry(ctx, func(ctx context.Context) error {
+			return backend().DeleteMulti(ctx, hardKeys)
+		})
+		trace(ctx, "DeleteMulti", hardKeys[0].Kind(), start, err)
+		if err != nil {
+			log.Errorf(ctx, "[aeutils/DeleteMulti]: %v", err.Error())
+			return err
+		}
+		afterCommit(ctx, func(ctx context.Context) {
+			cacheDelete(ctx, hardKeys...)
+			requestCacheDelete(ctx, hardKeys...)
+			invalidateQueries(ctx, hardKeys...)
+		})
+		for i, obj := range objs {
+			str := reflect.Indirect(reflect.ValueOf(obj))
+			if _, ok := deletedAtField(str); soft && ok {
+				continue
+			}
+			if fields := uniqueFields(str.Type()); len(fields) > 0 {
+				if err := releaseUniques(ctx, keys[i], str, fields); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for i, obj := range objs {
+		postDelete(ctx, obj, keys[i])
+	}
+	return nil
+}
+
+// deletedAtField returns the 'DeletedAt' field of str, if it exists and is a time.Time
+func deletedAtField(str reflect.Value) (field reflect.Value, ok bool) {
+	field = str.FieldByName("DeletedAt")
+	return field, field.IsValid() && field.Type() == timeType
+}
+
+// excludeDeleted adds a filter to q excluding soft deleted entities, if kind has a 'DeletedAt' field
+func excludeDeleted(q *BackendQuery, kind reflect.Type) {
+	if field, ok := kind.FieldByName("DeletedAt"); ok && field.Type == timeType {
+		q.Filters = append(q.Filters, Filter{"DeletedAt =", time.Time{}})
+	}
+}
@@ -0,0 +1,129 @@
+package aeutils
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrNotStruct is returned when an object passed to aeutils isn't a struct (or pointer to struct),
+// or isn't a pointer when it needs to be loaded into
+type ErrNotStruct struct {
+	Type    reflect.Type
+	Pointer bool // A pointer to a struct was required
+}
+
+func (e *ErrNotStruct) Error() string {
+	if e.Pointer {
+		return fmt.Sprintf("Must pass a pointer to a struct to load into: passed %v", e.Type)
+	}
+	return fmt.Sprintf("Must pass a valid object (struct) to aeutils: passed %v", e.Type)
+}
+
+// ErrNoKey is returned when the key for an object can't be determined from its Key or ID fields or GetKey method
+type ErrNoKey struct {
+	Kind string
+	Op   string // What the key was needed for (get, delete, ...)
+}
+
+func (e *ErrNoKey) Error() string {
+	return fmt.Sprintf("Unable to determine key for %v to %v", e.Kind, e.Op)
+}
+
+// SaveError wraps any datastore error returned while storing an object in Save or SaveMulti
+// Errors aeutils itself checks for (*ConflictError, *UniqueError, *ValidationError, etc.) are returned as is
+type SaveError struct {
+	Kind string
+	Key  *datastore.Key // Key obj was being stored at, if known
+	Err  error          // Underlying datastore error
+}
+
+func (e *SaveError) Error() string {
+	if e.Key != nil {
+		return fmt.Sprintf("[aeutils/Save] Error saving %v %v: %v", e.Kind, e.Key.String(), e.Err.Error())
+	}
+	return fmt.Sprintf("[aeutils/Save] Error saving %v: %v", e.Kind, e.Err.Error())
+}
+
+// EntityTooLargeError is returned by Save and SaveMulti (before anything is stored) when obj is too large to store,
+// either as a whole (see MaxEntitySize) or because of a single indexed string property (see MaxIndexedSize)
+type EntityTooLargeError struct {
+	Kind     string
+	Property string // The indexed property that's too large, or "" if it's the whole entity
+	Size     int    // Size of the property, or estimated size of the entity, in bytes
+}
+
+func (e *EntityTooLargeError) Error() string {
+	if e.Property != "" {
+		return fmt.Sprintf("%v property %v is too large to index: %d bytes (max %d), tag it `datastore:\",noindex\"`", e.Kind, e.Property, e.Size, MaxIndexedSize)
+	}
+	return fmt.Sprintf("%v entity is too large to store: %d bytes (max %d)", e.Kind, e.Size, MaxEntitySize)
+}
+
+// IDRangeError is returned by Save and SaveMulti when an 'ID' field of a type other than int64 can't hold an ID:
+// an unsigned value too large to be a datastore ID, or an allocated ID too large for the field
+type IDRangeError struct {
+	Kind string
+	Type reflect.Type // Type of the ID field
+	ID   uint64
+}
+
+func (e *IDRangeError) Error() string {
+	return fmt.Sprintf("%v ID %d does not fit in an ID field of type %v", e.Kind, e.ID, e.Type)
+}
+
+// saveError wraps err in a *SaveError, unless it's one of aeutils' own error types
+func saveError(kind string, key *datastore.Key, err error) error {
+	switch err.(type) {
+	case *ConflictError, *UniqueError, *ValidationError, *ErrNotStruct, *ErrNoKey, *SaveError, *EntityTooLargeError, *IDRangeError:
+		return err
+	}
+	switch err {
+	case ErrNoEncryptionKey, ErrEntityExists, datastore.ErrNoSuchEntity:
+		return err
+	}
+	return &SaveError{Kind: kind, Key: key, Err: err}
+}
+
+// StatusCode maps an error returned by aeutils to the HTTP status code a handler should respond with
+//
+// * 404 for datastore.ErrNoSuchEntity
+// * 400 for *ErrNoKey, *KeyError and ErrInvalidPatch
+// * 409 for *ConflictError, *UniqueError, ErrLocked and ErrEntityExists
+// * 413 for *EntityTooLargeError
+// * 422 for *ValidationError
+// * 503 for datastore.ErrConcurrentTransaction
+// * 500 for anything else (including *ErrNotStruct, which is a programming error)
+//
+// *SaveError and *QueryError are mapped by the error they wrap. Returns 200 for a nil error
+func StatusCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return http.StatusOK
+	case *SaveError:
+		return StatusCode(e.Err)
+	case *QueryError:
+		return StatusCode(e.Err)
+	case *ErrNoKey, *KeyError:
+		return http.StatusBadRequest
+	case *ConflictError, *UniqueError:
+		return http.StatusConflict
+	case *ValidationError:
+		return 422 // Unprocessable Entity
+	case *EntityTooLargeError:
+		return http.StatusRequestEntityTooLarge
+	}
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return http.StatusNotFound
+	case ErrInvalidPatch:
+		return http.StatusBadRequest
+	case ErrLocked, ErrEntityExists:
+		return http.StatusConflict
+	case datastore.ErrConcurrentTransaction:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
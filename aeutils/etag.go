@@ -0,0 +1,58 @@
+package aeutils
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// ETag returns an entity tag (quoted, as sent in an ETag header) for obj as stored at key, which changes whenever obj is saved:
+//
+// * For objects with a 'Version' field (see Save), the version, so a request's If-Match can be checked against the version
+//   Save will check when storing it, and there's no window for another save to slip between the two
+// * For objects with an 'UpdatedAt' field (or a time.Time field tagged `aetime:"updated"`), the time it was last saved
+// * Otherwise, a hash of obj's JSON encoding
+//
+// Returns "" if obj isn't a struct (or pointer to struct)
+func ETag(key *datastore.Key, obj interface{}) string {
+	_, _, str, err := structValue(obj)
+	if err != nil {
+		return ""
+	}
+	h := sha1.New()
+	if key != nil {
+		h.Write([]byte(key.String()))
+	}
+	if version, ok := versionField(str); ok {
+		fmt.Fprintf(h, "\x00v%d", version.Int())
+	} else if updated, ok := updatedField(str); ok {
+		fmt.Fprintf(h, "\x00u%d", updated.Interface().(time.Time).UnixNano())
+	} else {
+		encoded, err := json.Marshal(obj)
+		if err != nil {
+			return ""
+		}
+		h.Write([]byte{0})
+		h.Write(encoded)
+	}
+	return fmt.Sprintf("\"%x\"", h.Sum(nil)[:12])
+}
+
+// updatedField returns the field of str setTimestamps sets on every save, if there is one
+func updatedField(str reflect.Value) (field reflect.Value, ok bool) {
+	t := str.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type != timeType || f.PkgPath != "" {
+			continue
+		}
+		if tag := f.Tag.Get("aetime"); tag == "updated" || (tag == "" && f.Name == "UpdatedAt") {
+			return str.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
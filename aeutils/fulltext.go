@@ -0,0 +1,110 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/search"
+)
+
+var (
+	// SearchLimit is the most keys Search returns for a query
+	SearchLimit = 100
+)
+
+// indexFields returns the indexes of all fields of t tagged `aeindex:"text"`, which must be strings
+// Save writes them to a document in the Search API index for t's kind (see Search)
+func indexFields(t reflect.Type) (fields []int, err error) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		mode := field.Tag.Get("aeindex")
+		if mode == "" {
+			continue
+		}
+		if mode != "text" {
+			return nil, errors.New(fmt.Sprintf("aeindex field %v.%v has unknown mode %q", t, field.Name, mode))
+		}
+		if field.Type.Kind() != reflect.String {
+			return nil, errors.New(fmt.Sprintf("aeindex field %v.%v must be a string", t, field.Name))
+		}
+		fields = append(fields, i)
+	}
+	return
+}
+
+// searchIndexName returns the name of the Search API index for dsKind. Indexes are per namespace, like entities
+func searchIndexName(dsKind string) string {
+	return "aeutils-" + dsKind
+}
+
+// indexDocument writes the fields of str tagged `aeindex:"text"` to the Search API index for key's kind, in a document
+// identified by the encoded key. Failures are logged rather than returned, as the entity itself has already been stored
+func indexDocument(ctx context.Context, key *datastore.Key, str reflect.Value) {
+	fields, err := indexFields(str.Type())
+	if err != nil || len(fields) == 0 {
+		return
+	}
+	index, err := search.Open(searchIndexName(key.Kind()))
+	if err == nil {
+		doc := make(search.FieldList, len(fields))
+		for i, field := range fields {
+			doc[i] = search.Field{Name: str.Type().Field(field).Name, Value: str.Field(field).String()}
+		}
+		_, err = index.Put(ctx, EncodeKey(key), &doc)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/Save] Error indexing %v: %v", key, err.Error())
+	}
+}
+
+// unindexDocument removes the document for key from its kind's Search API index, if obj has any fields tagged `aeindex`
+func unindexDocument(ctx context.Context, obj interface{}, key *datastore.Key) {
+	kind, _, _, err := structValue(obj)
+	if err != nil {
+		return
+	}
+	if fields, err := indexFields(kind); err != nil || len(fields) == 0 {
+		return
+	}
+	index, err := search.Open(searchIndexName(key.Kind()))
+	if err == nil {
+		err = index.Delete(ctx, EncodeKey(key))
+	}
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/Delete] Error removing %v from search index: %v", key, err.Error())
+	}
+}
+
+// Search runs query (in the Search API's query language) against the fields tagged `aeindex:"text"` of entities of obj's kind
+// (a struct or pointer to struct) in ctx's namespace, returning the keys of up to SearchLimit matches, best first
+// Entities are indexed when they're saved through aeutils, so those stored before the tag was added need saving again
+//
+// 	keys, err := aeutils.Search(ctx, &Article{}, "Body:appengine")
+func Search(ctx context.Context, obj interface{}, query string) ([]*datastore.Key, error) {
+	index, err := search.Open(searchIndexName(KindOf(obj)))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*datastore.Key
+	it := index.Search(ctx, query, &search.SearchOptions{IDsOnly: true, Limit: SearchLimit})
+	for {
+		id, err := it.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			log.Errorf(ctx, "[aeutils/Search] %v", err.Error())
+			return nil, err
+		}
+		key, err := datastore.DecodeKey(id)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
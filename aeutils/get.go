@@ -0,0 +1,254 @@
+package aeutils
+
+import (
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Get takes an context.Context and a pointer to a struct, and loads it from the datastore
+// The key is resolved the same way Save does, from the 'Key' field first, then from a non-zero 'ID' field
+func Get(ctx context.Context, obj interface{}) error {
+	kind, val, str, err := pointerValue(obj)
+	if err != nil {
+		return err
+	}
+	key := resolveKey(ctx, obj, str, getDatastoreKind(kind))
+	if key == nil || key.Incomplete() {
+		return &ErrNoKey{Kind: getDatastoreKind(kind), Op: "get"}
+	}
+	return get(ctx, key, val, str)
+}
+
+// GetByKey loads the entity stored at key into dst, which must be a pointer to a struct
+func GetByKey(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	_, val, str, err := pointerValue(dst)
+	if err != nil {
+		return err
+	}
+	return get(ctx, key, val, str)
+}
+
+// GetMulti loads the entities stored at keys into dst, a slice (or pointer to a slice) of structs or pointers to structs
+// with the same length as keys, like datastore.GetMulti. nil pointers in dst are set to new structs
+// For kinds that are cached (see CacheKind), all keys are read from memcache first, with a single call. Any misses are then
+// fetched with a single datastore GetMulti and added to the cache. Each entity is loaded with the same conventions as Get,
+// including AfterLoad. If any key couldn't be loaded, an appengine.MultiError is returned with the error for each key
+// (ie. datastore.ErrNoSuchEntity), and the rest are still loaded
+func GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	slice := reflect.Indirect(reflect.ValueOf(dst))
+	if slice.Kind() != reflect.Slice || slice.Len() != len(keys) {
+		return ErrInvalidDestination
+	}
+	vals := make([]reflect.Value, len(keys))
+	for i := range vals {
+		elem := slice.Index(i)
+		if elem.Kind() == reflect.Ptr {
+			if elem.IsNil() {
+				elem.Set(reflect.New(elem.Type().Elem()))
+			}
+		} else {
+			elem = elem.Addr()
+		}
+		if elem.Elem().Kind() != reflect.Struct {
+			return ErrInvalidDestination
+		}
+		vals[i] = elem
+	}
+	return getMulti(ctx, keys, vals)
+}
+
+// GetByID loads the entity with the numeric ID id into dst, which must be a pointer to a struct
+// The datastore kind is inferred from the type of dst, and the parent from dst's 'Parent' field or GetParentKey method (if any)
+func GetByID(ctx context.Context, id int64, dst interface{}) error {
+	kind, val, str, err := pointerValue(dst)
+	if err != nil {
+		return err
+	}
+	key := datastore.NewKey(ctx, getDatastoreKind(kind), "", id, parentKey(ctx, dst, str))
+	return get(ctx, key, val, str)
+}
+
+// GetByName loads the entity with the string ID (key name) name into dst, which must be a pointer to a struct
+// The datastore kind is inferred from the type of dst, and the parent from dst's 'Parent' field or GetParentKey method (if any)
+func GetByName(ctx context.Context, name string, dst interface{}) error {
+	kind, val, str, err := pointerValue(dst)
+	if err != nil {
+		return err
+	}
+	key := datastore.NewKey(ctx, getDatastoreKind(kind), name, 0, parentKey(ctx, dst, str))
+	return get(ctx, key, val, str)
+}
+
+// GetBySlug loads the first entity whose 'Slug' property matches slug into dst, which must be a pointer to a struct
+// The datastore kind is inferred from the type of dst, and soft deleted entities are ignored (see Delete)
+// Returns datastore.ErrNoSuchEntity if no entity matches
+func GetBySlug(ctx context.Context, slug string, dst interface{}) error {
+	_, val, str, err := pointerValue(dst)
+	if err != nil {
+		return err
+	}
+	keys, err := Query(dst).
+		Filter("Slug = ", slug).
+		Limit(1).
+		Keys(ctx)
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/GetBySlug] %v", err.Error())
+		return err
+	}
+	if len(keys) == 0 {
+		return datastore.ErrNoSuchEntity
+	}
+	return get(ctx, keys[0], val, str)
+}
+
+// pointerValue is like structValue, but requires obj be a pointer so it can be loaded into
+func pointerValue(obj interface{}) (kind reflect.Type, val, str reflect.Value, err error) {
+	kind, val, str, err = structValue(obj)
+	if err == nil && val.Kind() != reflect.Ptr {
+		err = &ErrNotStruct{Type: reflect.TypeOf(obj), Pointer: true}
+	}
+	return
+}
+
+// internal get method, loads key into val (from the request cache first, if there is one - see StartRequestCache,
+// then memcache, if the kind is cached - see CacheKind),
+// decodes any aejson fields, decrypts any aecrypt fields and then populates Key/ID fields and calls any 'AfterLoad' method
+func get(ctx context.Context, key *datastore.Key, val, str reflect.Value) (err error) {
+	// The caches need a complete key, so check it as the datastore would
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	obj := val.Interface()
+	if requestCacheGet(ctx, key, str) {
+		setKeyFields(str, key)
+		postLoad(ctx, obj)
+		return nil
+	}
+	if cacheGet(ctx, key, str) {
+		requestCacheSet(ctx, key, str)
+		setKeyFields(str, key)
+		postLoad(ctx, obj)
+		return nil
+	}
+	entity, err := entityFor(obj, str)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = withRetry(ctx, func(ctx context.Context) error {
+		return backend().Get(ctx, key, entity)
+	})
+	trace(ctx, "Get", key.Kind(), start, err)
+	if err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			if err != datastore.ErrNoSuchEntity {
+				log.Errorf(ctx, "[aeutils/Get] %v", err.Error())
+			}
+			return err
+		}
+	}
+	if cryptErr := decryptFields(str); cryptErr != nil {
+		log.Errorf(ctx, "[aeutils/Get] %v", cryptErr.Error())
+		return cryptErr
+	}
+	if err == nil && currentTransaction(ctx) == nil {
+		// Backfill the caches (memcache only if this kind is cached) so the next read is a hit
+		cacheSet(ctx, key, obj)
+		requestCacheSet(ctx, key, str)
+	}
+	setKeyFields(str, key)
+	postLoad(ctx, obj)
+	return err
+}
+
+// PostLoad checks for
+// * Method 'AfterLoad' that receives context.Context as it's first parameter
+//   This can be used for any actions that need to be performed once an entity has been fetched (decrypt fields, compute derived values, or cache a Key field)
+// It is called automatically by the Get helpers, and should be called on anything loaded directly via the datastore package
+func PostLoad(ctx context.Context, obj interface{}) error {
+	if _, _, _, err := structValue(obj); err != nil {
+		return err
+	}
+	postLoad(ctx, obj)
+	return nil
+}
+
+// internal getMulti method, like get but for many keys, loading each into vals[i] (a pointer to a struct)
+// Reads from the request cache and memcache (for cached kinds) first, then fetches any misses with a single GetMulti
+// Returns an appengine.MultiError if any key couldn't be loaded
+func getMulti(ctx context.Context, keys []*datastore.Key, vals []reflect.Value) error {
+	hits := make([]bool, len(keys))
+	for i, key := range keys {
+		hits[i] = requestCacheGet(ctx, key, vals[i].Elem())
+	}
+	cacheGetMulti(ctx, keys, vals, hits)
+	errs := make(appengine.MultiError, len(keys))
+	var missKeys []*datastore.Key
+	var missing []int
+	var entities []interface{}
+	for i, key := range keys {
+		if hits[i] {
+			continue
+		}
+		entity, err := entityFor(vals[i].Interface(), vals[i].Elem())
+		if err != nil {
+			return err
+		}
+		missKeys = append(missKeys, key)
+		missing = append(missing, i)
+		entities = append(entities, entity)
+	}
+	failed := false
+	if len(missKeys) > 0 {
+		start := time.Now()
+		err := withRetry(ctx, func(ctx context.Context) error {
+			return backend().GetMulti(ctx, missKeys, entities)
+		})
+		trace(ctx, "GetMulti", missKeys[0].Kind(), start, err)
+		me, isMulti := err.(appengine.MultiError)
+		if err != nil && !isMulti {
+			log.Errorf(ctx, "[aeutils/GetMulti] %v", err.Error())
+			return err
+		}
+		var loadedKeys []*datastore.Key
+		var loaded []interface{}
+		for j, i := range missing {
+			if isMulti && me[j] != nil {
+				errs[i], failed = me[j], true
+				if _, ok := me[j].(*datastore.ErrFieldMismatch); !ok {
+					continue
+				}
+			}
+			if cryptErr := decryptFields(vals[i].Elem()); cryptErr != nil {
+				errs[i], failed = cryptErr, true
+				continue
+			}
+			if errs[i] == nil {
+				loadedKeys = append(loadedKeys, keys[i])
+				loaded = append(loaded, vals[i].Interface())
+			}
+		}
+		if currentTransaction(ctx) == nil {
+			// Backfill the caches (memcache only for cached kinds) so the next read is a hit
+			cacheSetMulti(ctx, loadedKeys, loaded)
+			for i, key := range loadedKeys {
+				requestCacheSet(ctx, key, reflect.ValueOf(loaded[i]).Elem())
+			}
+		}
+	}
+	for i, key := range keys {
+		if _, ok := errs[i].(*datastore.ErrFieldMismatch); errs[i] == nil || ok {
+			setKeyFields(vals[i].Elem(), key)
+			postLoad(ctx, vals[i].Interface())
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
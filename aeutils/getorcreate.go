@@ -0,0 +1,102 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Kind of the sentinel entities GetOrCreate uses to serialize creation for a set of filters
+const createdSentinelKind = "AEGetOrCreate"
+
+type createdSentinel struct {
+	Owner *datastore.Key
+}
+
+// GetOrCreate loads the entity of obj's kind matching filters (which must all be equality filters) into obj, a pointer to a struct,
+// or if there isn't one saves obj, returning whether it was created
+//
+// 	user := &User{Email: email, Name: name}
+// 	created, err := aeutils.GetOrCreate(ctx, user, aeutils.Filter{"Email =", email})
+//
+// Creation happens in a transaction along with a sentinel entity for the filter values, so concurrent calls with the same
+// filters can't both create an entity. Without filters, obj's key is used instead (see Get), and it must be resolvable
+// As it runs a query when given filters, it can't be called within a transaction
+func GetOrCreate(ctx context.Context, obj interface{}, filters ...Filter) (created bool, err error) {
+	kind, val, str, err := pointerValue(obj)
+	if err != nil {
+		return false, err
+	}
+	dsKind := getDatastoreKind(kind)
+	if len(filters) == 0 {
+		key := resolveKey(ctx, obj, str, dsKind)
+		if key == nil || key.Incomplete() {
+			return false, &ErrNoKey{Kind: dsKind, Op: "get or create"}
+		}
+		err = ensureTransaction(ctx, func(tc context.Context) error {
+			created = false
+			found := reflect.New(kind)
+			err := get(tc, key, found, found.Elem())
+			if err == nil {
+				val.Elem().Set(found.Elem())
+				return nil
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			created = true
+			_, err = Save(tc, obj)
+			return err
+		})
+		return
+	}
+
+	// Entities created without GetOrCreate won't have a sentinel, so look for an existing match first
+	qb := Query(obj)
+	values := make([]string, len(filters))
+	for i, f := range filters {
+		field := strings.TrimSpace(f.Field)
+		if !strings.HasSuffix(field, "=") || strings.ContainsAny(field[:len(field)-1], "<>!") {
+			return false, errors.New(fmt.Sprintf("GetOrCreate requires equality filters, got %q", f.Field))
+		}
+		qb = qb.Filter(f.Field, f.Value)
+		values[i] = fmt.Sprintf("%v%v", strings.Replace(field, " ", "", -1), f.Value)
+	}
+	found := reflect.New(kind)
+	if _, err = qb.First(ctx, found.Interface()); err == nil {
+		val.Elem().Set(found.Elem())
+		return false, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+
+	sentinelKey := datastore.NewKey(ctx, createdSentinelKind, dsKind+"|"+strings.Join(values, "|"), 0, nil)
+	err = RunInTransaction(ctx, func(tc context.Context) error {
+		created = false
+		sentinel := &createdSentinel{}
+		err := backend().Get(tc, sentinelKey, sentinel)
+		if err == nil {
+			found := reflect.New(kind)
+			if err = get(tc, sentinel.Owner, found, found.Elem()); err == nil {
+				val.Elem().Set(found.Elem())
+				return nil
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			// Owner has since been deleted, so create a new one
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		key, err := Save(tc, obj)
+		if err != nil {
+			return err
+		}
+		created = true
+		_, err = backend().Put(tc, sentinelKey, &createdSentinel{Owner: key})
+		return err
+	}, nil)
+	return
+}
@@ -0,0 +1,163 @@
+package aeutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Kind of the revision entities stored as children of each tracked entity
+const revisionKind = "AERevision"
+
+var (
+	// HistoryActor returns who is making changes in ctx, stored with each revision (see TrackHistory)
+	// The accounts package sets this to the authenticated user or account for the request
+	HistoryActor func(ctx context.Context) string
+
+	trackedKinds   = map[string]bool{}
+	trackedKindsMu sync.RWMutex
+)
+
+// Revision is a snapshot of an entity, stored each time it's saved if its kind is tracked (see TrackHistory)
+type Revision struct {
+	Key       *datastore.Key `json:"-" datastore:"-"`
+	Actor     string         `json:"actor"`
+	Timestamp time.Time      `json:"timestamp"`
+	Version   int64          `json:"version"`                // 'Version' field of the entity when saved, if it has one
+	Snapshot  []byte         `json:"-" datastore:",noindex"` // gzipped JSON encoding of the entity
+}
+
+// TrackHistory enables change history for the kind of obj (a struct or pointer to struct)
+// Each time Save or SaveMulti stores an entity of this kind, a Revision is stored as a child entity of it with
+// a gzipped JSON snapshot (so fields tagged `json:"-"` aren't included, and aecrypt fields stay encrypted),
+// who made the change (see HistoryActor), when, and its version. Read them back with History
+func TrackHistory(obj interface{}) {
+	trackedKindsMu.Lock()
+	defer trackedKindsMu.Unlock()
+	trackedKinds[KindOf(obj)] = true
+}
+
+// UntrackHistory disables change history for the kind of obj. Existing revisions are kept
+func UntrackHistory(obj interface{}) {
+	trackedKindsMu.Lock()
+	defer trackedKindsMu.Unlock()
+	delete(trackedKinds, KindOf(obj))
+}
+
+func historyTracked(dsKind string) bool {
+	trackedKindsMu.RLock()
+	defer trackedKindsMu.RUnlock()
+	return trackedKinds[dsKind]
+}
+
+// History returns the revisions stored for obj, newest first
+// The key is resolved the same way Save does, from the 'Key' field, a GetKey method, or a non-zero 'ID' field
+func History(ctx context.Context, obj interface{}) ([]*Revision, error) {
+	kind, _, str, err := structValue(obj)
+	if err != nil {
+		return nil, err
+	}
+	key := resolveKey(ctx, obj, str, getDatastoreKind(kind))
+	if key == nil || key.Incomplete() {
+		return nil, &ErrNoKey{Kind: getDatastoreKind(kind), Op: "get history"}
+	}
+	var revisions []*Revision
+	keys, err := backend().GetAll(ctx, &BackendQuery{
+		Kind:     revisionKind,
+		Ancestor: key,
+		Orders:   []string{"-Timestamp"},
+	}, &revisions)
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/History] %v", err.Error())
+		return nil, err
+	}
+	for i, key := range keys {
+		revisions[i].Key = key
+	}
+	return revisions, nil
+}
+
+// Decode loads the entity as it was in this revision into dst, which must be a pointer to a struct of the entity's type
+func (r *Revision) Decode(dst interface{}) error {
+	_, _, str, err := pointerValue(dst)
+	if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(r.Snapshot))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, dst); err != nil {
+		return err
+	}
+	if r.Key != nil && r.Key.Parent() != nil {
+		setKeyFields(str, r.Key.Parent())
+	}
+	return decryptFields(str)
+}
+
+// recordHistory stores a revision for each of objs that's of a tracked kind, as a child of the key it was stored at
+// Failures are logged rather than returned, as the entities themselves have already been stored
+func recordHistory(ctx context.Context, keys []*datastore.Key, objs []interface{}) {
+	var revisionKeys []*datastore.Key
+	var revisions []*Revision
+	var actor string
+	if HistoryActor != nil {
+		actor = HistoryActor(ctx)
+	}
+	for i, key := range keys {
+		if !historyTracked(key.Kind()) {
+			continue
+		}
+		snapshot, err := compressJSON(objs[i])
+		if err != nil {
+			log.Warningf(ctx, "[aeutils/History] Unable to snapshot %v: %v", key.String(), err.Error())
+			continue
+		}
+		revision := &Revision{
+			Actor:     actor,
+			Timestamp: time.Now(),
+			Snapshot:  snapshot,
+		}
+		if version, ok := versionField(reflect.Indirect(reflect.ValueOf(objs[i]))); ok {
+			revision.Version = version.Int()
+		}
+		revisionKeys = append(revisionKeys, datastore.NewIncompleteKey(ctx, revisionKind, key))
+		revisions = append(revisions, revision)
+	}
+	if len(revisions) == 0 {
+		return
+	}
+	if _, err := backend().PutMulti(ctx, revisionKeys, revisions); err != nil {
+		log.Errorf(ctx, "[aeutils/History] %v", err.Error())
+	}
+}
+
+func compressJSON(obj interface{}) ([]byte, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err = zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,191 @@
+package aeutils
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// BeforeSaver is implemented by objects that need to act before being stored (generate a slug, store LastUpdated, create a Key field...)
+// Returning an error aborts the save
+type BeforeSaver interface {
+	BeforeSave(ctx context.Context) error
+}
+
+// Validator is implemented by objects that check their own values before being stored (see Validate)
+// Returning a *ValidationError adds its fields to any from struct tags, any other error is returned as is
+type Validator interface {
+	Validate(ctx context.Context) error
+}
+
+// KeyedBeforeSaver is like BeforeSaver, but also receives the key obj is about to be stored at,
+// so it can tell a create from an update. The key is nil if it isn't known yet (ie. an ID will be allocated)
+type KeyedBeforeSaver interface {
+	BeforeSave(ctx context.Context, key *datastore.Key) error
+}
+
+// AfterSaver is implemented by objects that need to act once they've been stored at key
+type AfterSaver interface {
+	AfterSave(ctx context.Context, key *datastore.Key)
+}
+
+// AfterLoader is implemented by objects that need to act once they've been fetched from the datastore
+type AfterLoader interface {
+	AfterLoad(ctx context.Context)
+}
+
+// BeforeDeleter is implemented by objects that need to act before being deleted
+// Returning an error aborts the delete
+type BeforeDeleter interface {
+	BeforeDelete(ctx context.Context) error
+}
+
+// AfterDeleter is implemented by objects that need to act once they've been deleted from key
+type AfterDeleter interface {
+	AfterDelete(ctx context.Context, key *datastore.Key)
+}
+
+// KeyGetter is implemented by objects that know their own datastore key
+// If the returned key is complete, it is used in preference to an 'ID' field
+type KeyGetter interface {
+	GetKey(ctx context.Context) *datastore.Key
+}
+
+// ParentKeyGetter is implemented by objects that belong to an entity group
+// New keys for the object are created as children of the returned key (if it's not nil)
+type ParentKeyGetter interface {
+	GetParentKey(ctx context.Context) *datastore.Key
+}
+
+// Variants of the hooks above without an error result, kept so existing models don't need to change
+type simpleBeforeSaver interface {
+	BeforeSave(ctx context.Context)
+}
+
+type simpleKeyedBeforeSaver interface {
+	BeforeSave(ctx context.Context, key *datastore.Key)
+}
+
+type simpleBeforeDeleter interface {
+	BeforeDelete(ctx context.Context)
+}
+
+// hookMismatch returns an error if obj has a method called name, but it didn't match any of the supported hook signatures
+func hookMismatch(obj interface{}, name string) error {
+	if method, ok := reflect.TypeOf(obj).MethodByName(name); ok {
+		return fmt.Errorf("%v.%v has type %v, which does not match any aeutils hook signature", reflect.TypeOf(obj), name, method.Type)
+	}
+	return nil
+}
+
+// internal presave method, sets any `default` tagged fields that are still zero values, then calls 'BeforeSave' if it exists
+// and any hooks registered with OnBeforeSave
+func preSave(ctx context.Context, obj interface{}, str reflect.Value) error {
+	if err := setDefaults(str); err != nil {
+		return err
+	}
+	if err := beforeSave(ctx, obj, str); err != nil {
+		return err
+	}
+	return runBeforeHooks(ctx, beforeSaveHooks, getDatastoreKind(str.Type()), obj)
+}
+
+// beforeSave calls obj's 'BeforeSave' method, if it has one
+func beforeSave(ctx context.Context, obj interface{}, str reflect.Value) error {
+	switch hook := obj.(type) {
+	case BeforeSaver:
+		return hook.BeforeSave(ctx)
+	case simpleBeforeSaver:
+		hook.BeforeSave(ctx)
+		return nil
+	case KeyedBeforeSaver:
+		return hook.BeforeSave(ctx, intendedKey(ctx, obj, str))
+	case simpleKeyedBeforeSaver:
+		hook.BeforeSave(ctx, intendedKey(ctx, obj, str))
+		return nil
+	}
+	return hookMismatch(obj, "BeforeSave")
+}
+
+// intendedKey returns the key Save will store obj at, if it's already known
+func intendedKey(ctx context.Context, obj interface{}, str reflect.Value) *datastore.Key {
+	if key := resolveKey(ctx, obj, str, getDatastoreKind(str.Type())); key != nil && !key.Incomplete() {
+		return key
+	}
+	return nil
+}
+
+// internal postsave method, sets the Key and ID fields (if they exist) from the stored key, updates the caches
+// (see CacheKind and CacheQueries) and calls 'AfterSave' if it exists and any hooks registered with OnAfterSave (if hooks is set)
+// Within a transaction, everything but setting fields waits until it commits
+func postSave(ctx context.Context, obj interface{}, str reflect.Value, key *datastore.Key, hooks bool) {
+	setKeyFields(str, key)
+	hook, ok := obj.(AfterSaver)
+	if !hooks {
+		ok = false
+	} else if !ok {
+		if err := hookMismatch(obj, "AfterSave"); err != nil {
+			log.Warningf(ctx, "[aeutils/Save] %v", err.Error())
+		}
+	}
+	afterCommit(ctx, func(ctx context.Context) {
+		cacheSet(ctx, key, obj)
+		requestCacheDelete(ctx, key)
+		invalidateQueries(ctx, key)
+		queueMirrorSync(ctx, key)
+		indexDocument(ctx, key, str)
+		if ok {
+			hook.AfterSave(ctx, key)
+		}
+		if hooks {
+			runAfterHooks(ctx, afterSaveHooks, obj, key)
+		}
+	})
+}
+
+// internal postload method, calls 'AfterLoad' if it exists
+func postLoad(ctx context.Context, obj interface{}) {
+	if hook, ok := obj.(AfterLoader); ok {
+		hook.AfterLoad(ctx)
+	} else if err := hookMismatch(obj, "AfterLoad"); err != nil {
+		log.Warningf(ctx, "[aeutils/Get] %v", err.Error())
+	}
+}
+
+// internal predelete method, calls 'BeforeDelete' if it exists, then any hooks registered with OnBeforeDelete
+func preDelete(ctx context.Context, obj interface{}) error {
+	var err error
+	switch hook := obj.(type) {
+	case BeforeDeleter:
+		err = hook.BeforeDelete(ctx)
+	case simpleBeforeDeleter:
+		hook.BeforeDelete(ctx)
+	default:
+		err = hookMismatch(obj, "BeforeDelete")
+	}
+	if err != nil {
+		return err
+	}
+	return runBeforeHooks(ctx, beforeDeleteHooks, KindOf(obj), obj)
+}
+
+// internal postdelete method, calls 'AfterDelete' if it exists, then any hooks registered with OnAfterDelete
+// Within a transaction, they're only called once it commits
+func postDelete(ctx context.Context, obj interface{}, key *datastore.Key) {
+	hook, ok := obj.(AfterDeleter)
+	if !ok {
+		if err := hookMismatch(obj, "AfterDelete"); err != nil {
+			log.Warningf(ctx, "[aeutils/Delete] %v", err.Error())
+		}
+	}
+	afterCommit(ctx, func(ctx context.Context) {
+		unindexDocument(ctx, obj, key)
+		if ok {
+			hook.AfterDelete(ctx, key)
+		}
+		runAfterHooks(ctx, afterDeleteHooks, obj, key)
+	})
+}
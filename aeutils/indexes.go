@@ -0,0 +1,234 @@
+package aeutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// RecordIndexes makes QueryBuilder record the composite index each query it runs needs, to be written out with
+	// WriteIndexYAML (or IndexHandler) along with those declared in `aeindex` tags. Missing indexes are otherwise only
+	// found when a query fails in production, so set it in development and exercise the app:
+	//
+	// 	aeutils.RecordIndexes = appengine.IsDevAppServer()
+	RecordIndexes = false
+
+	recordedIndexes   = map[string]Index{}
+	recordedIndexesMu sync.Mutex
+)
+
+// IndexProperty is a single property of a composite index
+type IndexProperty struct {
+	Name string
+	Desc bool
+}
+
+// Index is a composite datastore index, as defined in index.yaml
+type Index struct {
+	Kind       string
+	Ancestor   bool
+	Properties []IndexProperty
+}
+
+// String returns a single line description of idx, which identifies it
+func (idx Index) String() string {
+	props := make([]string, len(idx.Properties))
+	for i, p := range idx.Properties {
+		props[i] = p.Name
+		if p.Desc {
+			props[i] = "-" + p.Name
+		}
+	}
+	s := idx.Kind + "(" + strings.Join(props, ",") + ")"
+	if idx.Ancestor {
+		s += " ancestor"
+	}
+	return s
+}
+
+// Indexes returns all composite indexes that are known to be needed, sorted by kind: those declared with `aeindex`
+// struct tags on any type aeutils has been used with (or registered, see RegisterKind), and any recorded from queries (see RecordIndexes)
+//
+// An `aeindex` tag declares an index starting with the tagged field, followed by the properties listed (prefixed with
+// '-' for descending order). Separate multiple indexes with ';', and include 'ancestor' for ancestor queries:
+//
+// 	Published bool `aeindex:"-Created;ancestor,Title"`
+func Indexes() []Index {
+	kindRegistryMu.RLock()
+	types := make([]reflect.Type, 0, len(kindRegistry))
+	for t := range kindRegistry {
+		types = append(types, t)
+	}
+	kindRegistryMu.RUnlock()
+
+	indexes := map[string]Index{}
+	for _, t := range types {
+		for _, idx := range taggedIndexes(t) {
+			indexes[idx.String()] = idx
+		}
+	}
+	recordedIndexesMu.Lock()
+	for id, idx := range recordedIndexes {
+		indexes[id] = idx
+	}
+	recordedIndexesMu.Unlock()
+
+	ids := make([]string, 0, len(indexes))
+	for id := range indexes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	sorted := make([]Index, len(ids))
+	for i, id := range ids {
+		sorted[i] = indexes[id]
+	}
+	return sorted
+}
+
+// WriteIndexYAML writes all known indexes (see Indexes) to w in index.yaml format
+func WriteIndexYAML(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("indexes:\n")
+	for _, idx := range Indexes() {
+		fmt.Fprintf(&buf, "\n- kind: %v\n", idx.Kind)
+		if idx.Ancestor {
+			buf.WriteString("  ancestor: yes\n")
+		}
+		buf.WriteString("  properties:\n")
+		for _, p := range idx.Properties {
+			fmt.Fprintf(&buf, "  - name: %v\n", p.Name)
+			if p.Desc {
+				buf.WriteString("    direction: desc\n")
+			}
+		}
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// GenerateIndexYAML writes the indexes declared with `aeindex` tags on objs (structs or pointers to structs) to filename
+// in index.yaml format. Intended for go generate, via a small program in the app:
+//
+// 	//go:generate go run gen_indexes.go
+//
+// 	func main() {
+// 		if err := aeutils.GenerateIndexYAML("index.yaml", &Post{}, &Comment{}); err != nil {
+// 			log.Fatal(err)
+// 		}
+// 	}
+func GenerateIndexYAML(filename string, objs ...interface{}) error {
+	for _, obj := range objs {
+		// Makes sure the kind is known to Indexes
+		KindOf(obj)
+	}
+	var buf bytes.Buffer
+	if err := WriteIndexYAML(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// IndexHandler responds with all known indexes in index.yaml format, for use in development
+// (see RecordIndexes). It shouldn't generally be routed in production
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := WriteIndexYAML(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// taggedIndexes returns the indexes declared with `aeindex` tags on the fields of t
+func taggedIndexes(t reflect.Type) []Index {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var indexes []Index
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("aeindex")
+		if tag == "" {
+			continue
+		}
+		for _, def := range strings.Split(tag, ";") {
+			idx := Index{Kind: getDatastoreKind(t), Properties: []IndexProperty{{Name: field.Name}}}
+			for _, name := range strings.Split(def, ",") {
+				name = strings.TrimSpace(name)
+				switch {
+				case name == "":
+				case name == "ancestor":
+					idx.Ancestor = true
+				case strings.HasPrefix(name, "-"):
+					idx.Properties = append(idx.Properties, IndexProperty{Name: name[1:], Desc: true})
+				default:
+					idx.Properties = append(idx.Properties, IndexProperty{Name: name})
+				}
+			}
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
+
+// recordIndex records the composite index qb needs, if any
+func recordIndex(qb *QueryBuilder) {
+	if idx, ok := qb.index(); ok {
+		recordedIndexesMu.Lock()
+		recordedIndexes[idx.String()] = idx
+		recordedIndexesMu.Unlock()
+	}
+}
+
+// index returns the composite index needed to run qb, and false if the built-in indexes are enough
+// Properties are ordered as the datastore requires: equality filters, then the inequality filter, then sort orders,
+// followed by any other projected properties
+func (qb *QueryBuilder) index() (idx Index, ok bool) {
+	idx = Index{Kind: qb.dsKind, Ancestor: qb.ancestor != nil}
+	seen := map[string]bool{}
+	add := func(name string, desc bool) {
+		if !seen[name] {
+			seen[name] = true
+			idx.Properties = append(idx.Properties, IndexProperty{Name: name, Desc: desc})
+		}
+	}
+	var inequality string
+	if field, ok := qb.kind.FieldByName("DeletedAt"); ok && field.Type == timeType && !qb.includeDeleted {
+		add("DeletedAt", false)
+	}
+	for _, filter := range qb.query.Filters {
+		f := strings.TrimSpace(filter.Field)
+		name := strings.TrimSpace(strings.TrimRight(f, "<=>!"))
+		if op := strings.TrimSpace(f[len(name):]); op == "=" {
+			add(name, false)
+		} else if inequality == "" {
+			inequality = name
+		}
+	}
+	equalities := len(idx.Properties)
+	orders := qb.query.Orders
+	if inequality != "" {
+		// The inequality property must come first, using the direction of the first sort order if that's on it
+		desc := len(orders) > 0 && orders[0] == "-"+inequality
+		if len(orders) > 0 && strings.TrimPrefix(orders[0], "-") == inequality {
+			orders = orders[1:]
+		}
+		add(inequality, desc)
+	}
+	for _, order := range orders {
+		add(strings.TrimPrefix(order, "-"), strings.HasPrefix(order, "-"))
+	}
+	for _, name := range qb.query.Projection {
+		add(name, false)
+	}
+	// Equality filters alone are served by merging built-in indexes, as is a single property without an ancestor
+	if len(idx.Properties) == equalities || (!idx.Ancestor && len(idx.Properties) <= 1) {
+		return idx, false
+	}
+	return idx, true
+}
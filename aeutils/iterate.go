@@ -0,0 +1,84 @@
+package aeutils
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	// IterateBatchSize is the number of entities Iterate loads per query batch
+	IterateBatchSize = 100
+	// IterateDeadline is how long Iterate runs before stopping (between batches), to stay clear of the 60s request limit
+	IterateDeadline = 50 * time.Second
+
+	// ErrIterateDeadline is returned by Iterate when it stops early because IterateDeadline has passed
+	ErrIterateDeadline = errors.New("[aeutils/Iterate] Deadline passed before query was finished")
+)
+
+// Iterate runs q in batches of IterateBatchSize, chaining cursors between them, and calls fn with each result
+// Each result is a new pointer to a struct of the same type as dst, loaded the same way as the Get helpers
+// (aejson/aecrypt fields decoded, Key/ID fields populated and AfterLoad called)
+//
+// If fn returns an error, Iterate stops and returns it. If IterateDeadline passes, Iterate stops once the current batch
+// is finished and returns ErrIterateDeadline. Either way, the returned cursor can be passed to q.Start to resume
+// (for example from a task) from the start of the batch it stopped in, so fn should be safe to call again for the same entity
+// Once all results are processed it returns an empty cursor and nil
+// As q is a datastore.Query it always runs against the datastore, whatever StorageBackend is set to
+//
+// 	cursor, err := aeutils.Iterate(ctx, datastore.NewQuery("Post"), &Post{}, func(obj interface{}, key *datastore.Key) error {
+// 		post := obj.(*Post)
+// 		...
+// 	})
+func Iterate(ctx context.Context, q *datastore.Query, dst interface{}, fn func(obj interface{}, key *datastore.Key) error) (datastore.Cursor, error) {
+	kind, _, _, err := structValue(dst)
+	if err != nil {
+		return datastore.Cursor{}, err
+	}
+	deadline := time.Now().Add(IterateDeadline)
+	var cursor datastore.Cursor
+	for started := false; ; started = true {
+		batch := q.Limit(IterateBatchSize)
+		if started {
+			batch = batch.Start(cursor)
+		}
+		iter := batch.Run(ctx)
+		n := 0
+		for ; ; n++ {
+			val := reflect.New(kind)
+			entity, err := entityFor(val.Interface(), val.Elem())
+			if err != nil {
+				return cursor, err
+			}
+			key, err := iter.Next(entity)
+			if err == datastore.Done {
+				break
+			}
+			if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+				log.Errorf(ctx, "[aeutils/Iterate] %v", err.Error())
+				return cursor, err
+			}
+			if err = decryptFields(val.Elem()); err != nil {
+				return cursor, err
+			}
+			setKeyFields(val.Elem(), key)
+			postLoad(ctx, val.Interface())
+			if err = fn(val.Interface(), key); err != nil {
+				return cursor, err
+			}
+		}
+		if n < IterateBatchSize {
+			return datastore.Cursor{}, nil
+		}
+		if cursor, err = iter.Cursor(); err != nil {
+			return cursor, err
+		}
+		if time.Now().After(deadline) {
+			return cursor, ErrIterateDeadline
+		}
+	}
+}
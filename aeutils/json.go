@@ -0,0 +1,114 @@
+package aeutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// jsonEntity wraps a struct with fields tagged `aejson:"true"`, storing each of them as a JSON encoded, unindexed []byte
+// property named after the field, or `aesearch:"lower"`, storing a normalized copy of each of them (see SearchProperty)
+// It implements datastore.PropertyLoadSaver, with all other fields handled as usual
+type jsonEntity struct {
+	obj    interface{}
+	str    reflect.Value
+	fields []int
+	search []int
+}
+
+// jsonFields returns the indexes of all fields of t tagged `aejson:"true"`
+// As the datastore package can't store them itself, they must also be tagged `datastore:"-"`
+func jsonFields(t reflect.Type) (fields []int, err error) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("aejson") != "true" {
+			continue
+		}
+		if strings.Split(field.Tag.Get("datastore"), ",")[0] != "-" {
+			return nil, errors.New(fmt.Sprintf("aejson field %v.%v must also be tagged `datastore:\"-\"`", t, field.Name))
+		}
+		fields = append(fields, i)
+	}
+	return
+}
+
+// entityFor returns what should be passed to the datastore package to store or load obj:
+// obj itself, or a *jsonEntity wrapping it if it has any aejson or aesearch fields
+func entityFor(obj interface{}, str reflect.Value) (interface{}, error) {
+	fields, err := jsonFields(str.Type())
+	if err != nil {
+		return nil, err
+	}
+	search, err := searchFields(str.Type())
+	if err != nil || len(fields)+len(search) == 0 {
+		return obj, err
+	}
+	return &jsonEntity{obj: obj, str: str, fields: fields, search: search}, nil
+}
+
+func (e *jsonEntity) Load(props []datastore.Property) error {
+	names := map[string]int{}
+	for _, i := range e.fields {
+		names[e.str.Type().Field(i).Name] = i
+	}
+	// Search properties are derived from their fields, so there's nothing to load
+	shadows := map[string]bool{}
+	for _, i := range e.search {
+		shadows[SearchProperty(e.str.Type().Field(i).Name)] = true
+	}
+	var rest, encoded []datastore.Property
+	for _, p := range props {
+		if _, ok := names[p.Name]; ok {
+			encoded = append(encoded, p)
+		} else if shadows[p.Name] {
+			continue
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	err := datastore.LoadStruct(e.obj, rest)
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return err
+	}
+	for _, p := range encoded {
+		b, _ := p.Value.([]byte)
+		field := e.str.Field(names[p.Name])
+		value := reflect.New(field.Type())
+		if len(b) > 0 {
+			if jsonErr := json.Unmarshal(b, value.Interface()); jsonErr != nil {
+				return jsonErr
+			}
+		}
+		field.Set(value.Elem())
+	}
+	return err
+}
+
+func (e *jsonEntity) Save() ([]datastore.Property, error) {
+	props, err := datastore.SaveStruct(e.obj)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range e.fields {
+		b, err := json.Marshal(e.str.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, datastore.Property{
+			Name:    e.str.Type().Field(i).Name,
+			Value:   b,
+			NoIndex: true,
+		})
+	}
+	for _, i := range e.search {
+		props = append(props, datastore.Property{
+			Name:  SearchProperty(e.str.Type().Field(i).Name),
+			Value: NormalizeSearch(e.str.Field(i).String()),
+		})
+	}
+	return props, nil
+}
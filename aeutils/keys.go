@@ -0,0 +1,54 @@
+package aeutils
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// KeyError is returned by DecodeKey when a string isn't a valid key for the expected kind
+type KeyError struct {
+	Encoded string // String that was decoded
+	Kind    string // Kind that was expected
+	Reason  string
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("Invalid %v key %q: %v", e.Kind, e.Encoded, e.Reason)
+}
+
+// EncodeKey returns a web safe string for key, suitable for use in URLs (see DecodeKey). Returns "" for a nil key
+func EncodeKey(key *datastore.Key) string {
+	if key == nil {
+		return ""
+	}
+	return key.Encode()
+}
+
+// DecodeKey decodes a string from EncodeKey (ie. from a URL), checking it's a complete key for expectedKind,
+// in the namespace of ctx, so handlers can't be given keys to other kinds or namespaces
+// expectedKind may be a kind name, or a struct (or pointer to struct) to use the kind of. Returns a *KeyError if s isn't valid
+//
+// 	key, err := aeutils.DecodeKey(ctx, r.FormValue("post"), &Post{})
+func DecodeKey(ctx context.Context, s string, expectedKind interface{}) (*datastore.Key, error) {
+	kind, ok := expectedKind.(string)
+	if !ok {
+		kind = KindOf(expectedKind)
+	}
+	key, err := datastore.DecodeKey(s)
+	if err != nil {
+		return nil, &KeyError{Encoded: s, Kind: kind, Reason: "not a valid key"}
+	}
+	if key.Kind() != kind {
+		return nil, &KeyError{Encoded: s, Kind: kind, Reason: fmt.Sprintf("key is for %v", key.Kind())}
+	}
+	if key.Incomplete() {
+		return nil, &KeyError{Encoded: s, Kind: kind, Reason: "key is incomplete"}
+	}
+	// A new key takes the namespace (and app) of ctx
+	if current := datastore.NewIncompleteKey(ctx, kind, nil); key.Namespace() != current.Namespace() || key.AppID() != current.AppID() {
+		return nil, &KeyError{Encoded: s, Kind: kind, Reason: "key is for another app or namespace"}
+	}
+	return key, nil
+}
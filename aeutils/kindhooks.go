@@ -0,0 +1,80 @@
+package aeutils
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// AllKinds can be passed to OnBeforeSave, OnAfterSave, OnBeforeDelete and OnAfterDelete to register a hook for every kind
+const AllKinds = "*"
+
+var (
+	beforeSaveHooks   = map[string][]func(ctx context.Context, obj interface{}) error{}
+	afterSaveHooks    = map[string][]func(ctx context.Context, obj interface{}, key *datastore.Key){}
+	beforeDeleteHooks = map[string][]func(ctx context.Context, obj interface{}) error{}
+	afterDeleteHooks  = map[string][]func(ctx context.Context, obj interface{}, key *datastore.Key){}
+	kindHooksMu       sync.RWMutex
+)
+
+// OnBeforeSave registers fn to be called whenever an entity of kind (or any kind, for AllKinds) is about to be stored by
+// Save or SaveMulti, after its own BeforeSave method. obj is the struct (or pointer to struct) passed to Save, and returning
+// an error aborts the save like BeforeSave does. Useful for concerns that cut across kinds you don't own, ie. audit logging
+// Hooks run in the order they were registered, so they should be registered from init functions
+//
+// 	aeutils.OnBeforeSave("Account", func(ctx context.Context, obj interface{}) error {
+// 		return audit.Record(ctx, obj)
+// 	})
+func OnBeforeSave(kind string, fn func(ctx context.Context, obj interface{}) error) {
+	kindHooksMu.Lock()
+	defer kindHooksMu.Unlock()
+	beforeSaveHooks[kind] = append(beforeSaveHooks[kind], fn)
+}
+
+// OnAfterSave registers fn to be called once an entity of kind (or any kind, for AllKinds) has been stored at key,
+// after its own AfterSave method (so within a transaction, only once it commits)
+func OnAfterSave(kind string, fn func(ctx context.Context, obj interface{}, key *datastore.Key)) {
+	kindHooksMu.Lock()
+	defer kindHooksMu.Unlock()
+	afterSaveHooks[kind] = append(afterSaveHooks[kind], fn)
+}
+
+// OnBeforeDelete registers fn to be called whenever an entity of kind (or any kind, for AllKinds) is about to be deleted,
+// after its own BeforeDelete method. Returning an error aborts the delete
+func OnBeforeDelete(kind string, fn func(ctx context.Context, obj interface{}) error) {
+	kindHooksMu.Lock()
+	defer kindHooksMu.Unlock()
+	beforeDeleteHooks[kind] = append(beforeDeleteHooks[kind], fn)
+}
+
+// OnAfterDelete registers fn to be called once an entity of kind (or any kind, for AllKinds) has been deleted from key,
+// after its own AfterDelete method (so within a transaction, only once it commits)
+func OnAfterDelete(kind string, fn func(ctx context.Context, obj interface{}, key *datastore.Key)) {
+	kindHooksMu.Lock()
+	defer kindHooksMu.Unlock()
+	afterDeleteHooks[kind] = append(afterDeleteHooks[kind], fn)
+}
+
+// runBeforeHooks calls each of the hooks registered in registry for kind and AllKinds, stopping at the first error
+func runBeforeHooks(ctx context.Context, registry map[string][]func(ctx context.Context, obj interface{}) error, kind string, obj interface{}) error {
+	kindHooksMu.RLock()
+	hooks := append(append([]func(ctx context.Context, obj interface{}) error{}, registry[kind]...), registry[AllKinds]...)
+	kindHooksMu.RUnlock()
+	for _, fn := range hooks {
+		if err := fn(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAfterHooks calls each of the hooks registered in registry for the kind of key and AllKinds
+func runAfterHooks(ctx context.Context, registry map[string][]func(ctx context.Context, obj interface{}, key *datastore.Key), obj interface{}, key *datastore.Key) {
+	kindHooksMu.RLock()
+	hooks := append(append([]func(ctx context.Context, obj interface{}, key *datastore.Key){}, registry[key.Kind()]...), registry[AllKinds]...)
+	kindHooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx, obj, key)
+	}
+}
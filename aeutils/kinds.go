@@ -0,0 +1,61 @@
+package aeutils
+
+import (
+	"reflect"
+	"sync"
+)
+
+var (
+	kindRegistry   = map[reflect.Type]string{}
+	kindRegistryMu sync.RWMutex
+)
+
+// RegisterKind sets the datastore kind used for obj's type (a struct or pointer to struct) by Save, Get, Query, etc.
+// Useful when two packages define structs with the same name, or to rename a type without migrating its kind
+//
+// 	aeutils.RegisterKind(&Item{}, "InventoryItem")
+//
+// Alternatively, the kind can be set with an `aekind` tag on any field of the struct (usually Key)
+//
+// 	Key *datastore.Key `datastore:"-" aekind:"InventoryItem"`
+func RegisterKind(obj interface{}, kind string) {
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	kindRegistryMu.Lock()
+	defer kindRegistryMu.Unlock()
+	kindRegistry[t] = kind
+}
+
+// KindOf returns the datastore kind aeutils uses for obj, a struct or pointer to struct
+func KindOf(obj interface{}) string {
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return getDatastoreKind(t)
+}
+
+// registeredKind returns the kind registered for t, or set with an `aekind` struct tag
+// Returns an empty string if neither exists
+func registeredKind(t reflect.Type) string {
+	kindRegistryMu.RLock()
+	kind, ok := kindRegistry[t]
+	kindRegistryMu.RUnlock()
+	if ok {
+		return kind
+	}
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			if kind = t.Field(i).Tag.Get("aekind"); kind != "" {
+				break
+			}
+		}
+	}
+	// Cache the result (even if empty) so we only have to walk the fields once
+	kindRegistryMu.Lock()
+	kindRegistry[t] = kind
+	kindRegistryMu.Unlock()
+	return kind
+}
@@ -0,0 +1,81 @@
+package aeutils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+var (
+	// ErrLocked is returned by WithLock when another caller already holds the lock
+	ErrLocked = errors.New("[aeutils/WithLock] Lock is already held")
+)
+
+// WithLock runs fn while holding a distributed lock called name, returning ErrLocked without running fn
+// if it's already held. The lock is a memcache entry added with memcache.Add, so only one caller across all instances
+// can hold it at a time, and it's released when fn returns. ttl should be longer than fn can run for,
+// as the lock expires after that regardless (so a crashed instance can't hold it forever)
+//
+// As memcache can evict entries at any time, this prevents concurrent runs of cron jobs and the like in practice,
+// but isn't a guarantee. Where correctness depends on it, use a datastore transaction instead
+func WithLock(ctx context.Context, name string, ttl time.Duration, fn func() error) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	key := "aeutils-lock-" + name
+	value := []byte(hex.EncodeToString(token))
+	err := memcache.Add(ctx, &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: ttl,
+	})
+	if err == memcache.ErrNotStored {
+		err = takeReleased(ctx, key, value, ttl)
+	}
+	if err == ErrLocked {
+		return err
+	} else if err != nil {
+		log.Errorf(ctx, "[aeutils/WithLock] %v", err.Error())
+		return err
+	}
+	defer unlock(ctx, key, value)
+	return fn()
+}
+
+// takeReleased takes the lock at key if it's been released (see unlock) but not yet expired, or returns ErrLocked
+func takeReleased(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	item, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss || (err == nil && len(item.Value) > 0) {
+		return ErrLocked
+	} else if err != nil {
+		return err
+	}
+	item.Value, item.Expiration = value, ttl
+	err = memcache.CompareAndSwap(ctx, item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return ErrLocked
+	}
+	return err
+}
+
+// unlock releases the lock at key, as long as it's still held with value (ie. it hasn't expired and been taken by someone else)
+// It's swapped for an empty value that expires a second later (the shortest memcache allows) rather than deleted, so
+// it can't be taken in between checking it's still ours and releasing it. WithLock can take a released lock straight away
+func unlock(ctx context.Context, key string, value []byte) {
+	item, err := memcache.Get(ctx, key)
+	if err != nil || !bytes.Equal(item.Value, value) {
+		return
+	}
+	item.Value, item.Expiration = []byte{}, time.Second
+	err = memcache.CompareAndSwap(ctx, item)
+	if err != nil && err != memcache.ErrCASConflict && err != memcache.ErrNotStored {
+		log.Warningf(ctx, "[aeutils/WithLock] Unable to release %v: %v", key, err.Error())
+	}
+}
@@ -0,0 +1,579 @@
+package aeutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// ErrCursorUnsupported is returned by MemoryBackend for queries with a start cursor
+	ErrCursorUnsupported = errors.New("[aeutils/MemoryBackend] Queries with a start cursor aren't supported")
+)
+
+// MemoryBackend is a Backend that keeps entities in memory, for unit tests that shouldn't need aetest and
+// the dev_appserver. Set StorageBackend to one (created with NewMemoryBackend) and Save, the Get helpers,
+// Delete, QueryBuilder and RunInTransaction all work as usual against it
+//
+// 	backend := aeutils.NewMemoryBackend()
+// 	aeutils.StorageBackend = backend
+// 	defer func() { aeutils.StorageBackend = nil }()
+//
+// Queries support kinds, ancestors, equality and inequality filters (on '__key__' too), orders, projections, limits and offsets,
+// matching and ordering values of the same type the way the datastore does. Unindexed properties can't be filtered or
+// sorted on, and entities without a filtered or sorted property aren't returned. Cursors aren't supported, and
+// queries are always strongly consistent
+// Transactions are serialised, and rolled back by restoring the entities as they were when it started, so are only
+// isolated from other transactions
+// Only the datastore is replaced, so caching (see CacheEntities and CacheQueries), task queue based features and
+// logging still need an App Engine context
+type MemoryBackend struct {
+	mu       sync.RWMutex
+	entities map[string]*memoryEntity
+	nextID   int64
+	txMu     sync.Mutex
+}
+
+// memoryEntity is an entity as stored by MemoryBackend
+type memoryEntity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// NewMemoryBackend returns an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		entities: map[string]*memoryEntity{},
+		nextID:   1,
+	}
+}
+
+// Reset removes all entities stored in b
+func (b *MemoryBackend) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entities = map[string]*memoryEntity{}
+}
+
+// Len returns how many entities are stored in b
+func (b *MemoryBackend) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.entities)
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	b.mu.RLock()
+	entity, ok := b.entities[key.Encode()]
+	b.mu.RUnlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return loadProperties(dst, entity.props)
+}
+
+func (b *MemoryBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return errors.New(fmt.Sprintf("[aeutils/MemoryBackend] dst must be a slice with the same length as keys, is %T", dst))
+	}
+	multi := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if multi[i] = b.Get(ctx, key, multiElem(v.Index(i))); multi[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return multi
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if key == nil {
+		return nil, datastore.ErrInvalidKey
+	}
+	props, err := saveProperties(src)
+	if err != nil {
+		return nil, err
+	}
+	if key.Incomplete() {
+		low, _, err := b.AllocateIDs(ctx, key.Kind(), key.Parent(), 1)
+		if err != nil {
+			return nil, err
+		}
+		nctx, err := appengine.Namespace(ctx, key.Namespace())
+		if err != nil {
+			return nil, err
+		}
+		key = datastore.NewKey(nctx, key.Kind(), "", low, key.Parent())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entities[key.Encode()] = &memoryEntity{key: key, props: props}
+	return key, nil
+}
+
+func (b *MemoryBackend) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, errors.New(fmt.Sprintf("[aeutils/MemoryBackend] src must be a slice with the same length as keys, is %T", src))
+	}
+	stored := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		var err error
+		if stored[i], err = b.Put(ctx, key, multiElem(v.Index(i))); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+func (b *MemoryBackend) Delete(ctx context.Context, key *datastore.Key) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entities, key.Encode())
+	return nil
+}
+
+func (b *MemoryBackend) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	for _, key := range keys {
+		if err := b.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllocateIDs allocates from a single counter for all kinds, so IDs are unique across b
+func (b *MemoryBackend) AllocateIDs(ctx context.Context, kind string, parent *datastore.Key, n int) (int64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	low := b.nextID
+	b.nextID += int64(n)
+	return low, b.nextID, nil
+}
+
+// memoryTransactionKey marks the context of a MemoryBackend transaction
+type memoryTransactionKey struct{}
+
+func (b *MemoryBackend) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	if ctx.Value(memoryTransactionKey{}) != nil {
+		return errors.New("[aeutils/MemoryBackend] Nested transactions are not supported")
+	}
+	// Like the datastore, f gets a context of its own
+	tc := context.WithValue(ctx, memoryTransactionKey{}, b)
+	b.txMu.Lock()
+	defer b.txMu.Unlock()
+	b.mu.RLock()
+	snapshot := make(map[string]*memoryEntity, len(b.entities))
+	for k, entity := range b.entities {
+		snapshot[k] = entity
+	}
+	b.mu.RUnlock()
+	if err := f(tc); err != nil {
+		b.mu.Lock()
+		b.entities = snapshot
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (b *MemoryBackend) GetAll(ctx context.Context, q *BackendQuery, dst interface{}) ([]*datastore.Key, error) {
+	results, err := b.run(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, len(results))
+	for i, entity := range results {
+		keys[i] = entity.key
+	}
+	if q.KeysOnly {
+		return keys, nil
+	}
+	slice := reflect.ValueOf(dst)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return nil, ErrInvalidDestination
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	// Like the datastore, field mismatches don't stop the query, and the first is returned once all results are loaded
+	for _, entity := range results {
+		var elem reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			elem = reflect.New(elemType.Elem())
+		} else {
+			elem = reflect.New(elemType)
+		}
+		loadErr := loadProperties(elem.Interface(), entity.props)
+		if _, ok := loadErr.(*datastore.ErrFieldMismatch); loadErr != nil && !ok {
+			return nil, loadErr
+		} else if loadErr != nil && err == nil {
+			err = loadErr
+		}
+		if elemType.Kind() != reflect.Ptr {
+			elem = elem.Elem()
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+	return keys, err
+}
+
+func (b *MemoryBackend) Count(ctx context.Context, q *BackendQuery) (int, error) {
+	results, err := b.run(ctx, q)
+	return len(results), err
+}
+
+// run returns the entities matching q, in order and with any projection, limit and offset applied
+func (b *MemoryBackend) run(ctx context.Context, q *BackendQuery) ([]*memoryEntity, error) {
+	if q.Start != (datastore.Cursor{}) {
+		return nil, ErrCursorUnsupported
+	}
+	filters := make([]memoryFilter, len(q.Filters))
+	for i, f := range q.Filters {
+		var err error
+		if filters[i], err = parseMemoryFilter(f); err != nil {
+			return nil, err
+		}
+	}
+	orders := make([]memoryOrder, len(q.Orders))
+	for i, order := range q.Orders {
+		order = strings.TrimSpace(order)
+		orders[i] = memoryOrder{name: strings.TrimPrefix(order, "-"), desc: strings.HasPrefix(order, "-")}
+	}
+	namespace := datastore.NewIncompleteKey(ctx, q.Kind, nil).Namespace()
+	b.mu.RLock()
+	var results []*memoryEntity
+	for _, entity := range b.entities {
+		if entity.key.Namespace() != namespace || (q.Kind != "" && entity.key.Kind() != q.Kind) {
+			continue
+		}
+		if q.Ancestor != nil && !hasAncestor(entity.key, q.Ancestor) {
+			continue
+		}
+		if entity.matches(filters, orders, q.Projection) {
+			results = append(results, entity)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Sort(memoryResults{entities: results, orders: orders})
+	if q.Offset > 0 {
+		if q.Offset >= len(results) {
+			results = nil
+		} else {
+			results = results[q.Offset:]
+		}
+	}
+	if q.Limit > 0 && q.Limit < len(results) {
+		results = results[:q.Limit]
+	}
+	if len(q.Projection) > 0 {
+		for i, entity := range results {
+			projected := &memoryEntity{key: entity.key}
+			for _, name := range q.Projection {
+				if values := entity.values(name); len(values) > 0 {
+					projected.props = append(projected.props, datastore.Property{Name: name, Value: values[0]})
+				}
+			}
+			results[i] = projected
+		}
+	}
+	return results, nil
+}
+
+// memoryFilter is a parsed BackendQuery filter
+type memoryFilter struct {
+	name  string
+	op    string
+	value interface{}
+}
+
+func parseMemoryFilter(f Filter) (memoryFilter, error) {
+	field := strings.TrimSpace(f.Field)
+	name := strings.TrimSpace(strings.TrimRight(field, "<=>!"))
+	op := strings.TrimSpace(field[len(name):])
+	switch op {
+	case "=", "<", "<=", ">", ">=", "!=":
+	default:
+		return memoryFilter{}, errors.New(fmt.Sprintf("[aeutils/MemoryBackend] Invalid filter %q", f.Field))
+	}
+	return memoryFilter{name: name, op: op, value: normalizeValue(f.Value)}, nil
+}
+
+// memoryOrder is a parsed BackendQuery order
+type memoryOrder struct {
+	name string
+	desc bool
+}
+
+// values returns the indexed values of the named property, or the key for '__key__'
+func (e *memoryEntity) values(name string) (values []interface{}) {
+	if name == "__key__" {
+		return []interface{}{e.key}
+	}
+	for _, p := range e.props {
+		if p.Name == name && !p.NoIndex {
+			values = append(values, normalizeValue(p.Value))
+		}
+	}
+	return
+}
+
+// matches returns true if any value of each filtered property matches, and e has all ordered and projected properties
+func (e *memoryEntity) matches(filters []memoryFilter, orders []memoryOrder, projection []string) bool {
+	for _, f := range filters {
+		matched := false
+		for _, v := range e.values(f.name) {
+			c, ok := compareValues(v, f.value)
+			if !ok {
+				continue
+			}
+			switch f.op {
+			case "=":
+				matched = c == 0
+			case "<":
+				matched = c < 0
+			case "<=":
+				matched = c <= 0
+			case ">":
+				matched = c > 0
+			case ">=":
+				matched = c >= 0
+			case "!=":
+				matched = c != 0
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, order := range orders {
+		if len(e.values(order.name)) == 0 {
+			return false
+		}
+	}
+	for _, name := range projection {
+		if len(e.values(name)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// memoryResults sorts entities by orders, then by key as the datastore does
+type memoryResults struct {
+	entities []*memoryEntity
+	orders   []memoryOrder
+}
+
+func (r memoryResults) Len() int      { return len(r.entities) }
+func (r memoryResults) Swap(i, j int) { r.entities[i], r.entities[j] = r.entities[j], r.entities[i] }
+func (r memoryResults) Less(i, j int) bool {
+	for _, order := range r.orders {
+		// Multi-valued properties sort by their smallest value ascending, or largest descending
+		a, b := extremeValue(r.entities[i].values(order.name), order.desc), extremeValue(r.entities[j].values(order.name), order.desc)
+		c, ok := compareValues(a, b)
+		if !ok || c == 0 {
+			continue
+		}
+		if order.desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	return compareKeys(r.entities[i].key, r.entities[j].key) < 0
+}
+
+func extremeValue(values []interface{}, largest bool) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	extreme := values[0]
+	for _, v := range values[1:] {
+		if c, ok := compareValues(v, extreme); ok && ((largest && c > 0) || (!largest && c < 0)) {
+			extreme = v
+		}
+	}
+	return extreme
+}
+
+// normalizeValue converts v to the type the datastore stores it as, so values of different Go types can be compared
+func normalizeValue(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, *datastore.Key, time.Time, []byte, datastore.ByteString, appengine.GeoPoint:
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case isInt(rv.Kind()):
+		return rv.Int()
+	case isUint(rv.Kind()):
+		return int64(rv.Uint())
+	case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+		return rv.Float()
+	case rv.Kind() == reflect.String:
+		return rv.String()
+	case rv.Kind() == reflect.Bool:
+		return rv.Bool()
+	}
+	return v
+}
+
+// compareValues compares two normalized values, returning false if they're of different types and can't be compared
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case nil:
+		return 0, b == nil
+	case int64:
+		if b, ok := b.(int64); ok {
+			return compareInts(a, b), true
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
+			}
+			return 1, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1, true
+			case a.After(b):
+				return 1, true
+			}
+			return 0, true
+		}
+	case *datastore.Key:
+		if b, ok := b.(*datastore.Key); ok {
+			return compareKeys(a, b), true
+		}
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(a, b), true
+		}
+	case datastore.ByteString:
+		if b, ok := b.(datastore.ByteString); ok {
+			return bytes.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareKeys orders keys by their paths from the root, with numeric IDs before string IDs
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ka, kb := pa[i], pb[i]
+		if c := strings.Compare(ka.Kind(), kb.Kind()); c != 0 {
+			return c
+		}
+		if (ka.StringID() == "") != (kb.StringID() == "") {
+			if ka.StringID() == "" {
+				return -1
+			}
+			return 1
+		}
+		if c := compareInts(ka.IntID(), kb.IntID()); c != 0 {
+			return c
+		}
+		if c := strings.Compare(ka.StringID(), kb.StringID()); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
+
+// keyPath returns the keys from the root of key's path down to key
+func keyPath(key *datastore.Key) (path []*datastore.Key) {
+	for ; key != nil; key = key.Parent() {
+		path = append([]*datastore.Key{key}, path...)
+	}
+	return
+}
+
+// hasAncestor returns true if ancestor is key, or one of its parents
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	for ; key != nil; key = key.Parent() {
+		if key.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// multiElem returns the entity in an element of a GetMulti or PutMulti slice, as Get or Put expects it
+func multiElem(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		v = v.Addr()
+	}
+	return v.Interface()
+}
+
+// loadProperties loads props into dst, a PropertyLoadSaver or pointer to struct
+func loadProperties(dst interface{}, props []datastore.Property) error {
+	props = append([]datastore.Property(nil), props...)
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+// saveProperties returns the properties of src, a PropertyLoadSaver or pointer to struct
+func saveProperties(src interface{}) ([]datastore.Property, error) {
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(src)
+}
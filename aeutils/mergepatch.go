@@ -0,0 +1,163 @@
+package aeutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// ErrInvalidPatch is returned by ApplyMergePatch when the patch isn't a JSON object
+	ErrInvalidPatch = errors.New("Merge patch must be a JSON object")
+)
+
+// ApplyMergePatch applies patch, a JSON merge patch (RFC 7396), to obj (a pointer to a struct) and then saves it,
+// so PATCH handlers can take a request body directly. Members of patch are matched to fields by their json name:
+//
+// * null sets the field to it's zero value
+// * An object merges into struct and map fields (recursively), rather than replacing them
+// * Anything else replaces the field's value
+//
+// Members that don't match a field, or match one that isn't stored (unexported, tagged `json:"-"`, or tagged `datastore:"-"`
+// without being an aejson field), are ignored. Values that can't be decoded into their field are returned as a *ValidationError
+// (leaving obj unchanged), as is anything Save's validation catches. obj is usually loaded first, ie. with GetByKey
+// If patch isn't an object, ErrInvalidPatch is returned
+//
+// As they decide where obj is stored, patches can't change its Key, ID, key name, Parent or Version fields. opts are
+// passed to Save, ie. WithKey and UpdateOnly to make sure the entity loaded is the one that's saved
+func ApplyMergePatch(ctx context.Context, obj interface{}, patch []byte, opts ...SaveOption) (*datastore.Key, error) {
+	kind, _, str, err := pointerValue(obj)
+	if err != nil {
+		return nil, err
+	}
+	var members map[string]json.RawMessage
+	if err = json.Unmarshal(patch, &members); err != nil || members == nil {
+		return nil, ErrInvalidPatch
+	}
+	verr := &ValidationError{Kind: getDatastoreKind(kind)}
+	keyFields := keyFieldNames(kind)
+	updated := reflect.New(kind).Elem()
+	updated.Set(str)
+	for name, raw := range members {
+		field, ok := patchField(kind, name)
+		if !ok {
+			continue
+		}
+		value := updated.FieldByIndex(field.Index)
+		if err := mergeField(value, raw); err != nil {
+			verr.Add(field.Name, "is invalid: "+err.Error())
+		} else if keyFields[field.Name] && !reflect.DeepEqual(value.Interface(), str.FieldByIndex(field.Index).Interface()) {
+			verr.Add(field.Name, "can't be changed by a patch")
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+	str.Set(updated)
+	return Save(ctx, obj, opts...)
+}
+
+// keyFieldNames returns the names of the fields of kind that decide where it's stored: Key, ID, Parent, Version
+// and its key name field (see keyNameField)
+func keyFieldNames(kind reflect.Type) map[string]bool {
+	names := map[string]bool{"Key": true, "ID": true, "Parent": true, "Version": true, "StringID": true, "KeyName": true}
+	for i := 0; i < kind.NumField(); i++ {
+		if kind.Field(i).Tag.Get("aekey") == "name" {
+			names[kind.Field(i).Name] = true
+		}
+	}
+	return names
+}
+
+// patchField returns the stored field of kind with the json name name, matching case insensitively like encoding/json if needed
+func patchField(kind reflect.Type, name string) (field reflect.StructField, ok bool) {
+	var folded *reflect.StructField
+	for i := 0; i < kind.NumField(); i++ {
+		f := kind.Field(i)
+		if f.PkgPath != "" || (f.Tag.Get("datastore") == "-" && f.Tag.Get("aejson") == "") {
+			continue
+		}
+		jsonName := strings.Split(f.Tag.Get("json"), ",")[0]
+		if jsonName == "-" {
+			continue
+		} else if jsonName == "" {
+			jsonName = f.Name
+		}
+		if jsonName == name {
+			return f, true
+		} else if folded == nil && strings.EqualFold(jsonName, name) {
+			folded = &f
+		}
+	}
+	if folded != nil {
+		return *folded, true
+	}
+	return field, false
+}
+
+// mergeField applies a merge patch value to a single field
+func mergeField(value reflect.Value, raw json.RawMessage) error {
+	if string(bytes.TrimSpace(raw)) == "null" {
+		value.Set(reflect.Zero(value.Type()))
+		return nil
+	}
+	fresh := reflect.New(value.Type())
+	kind := value.Kind()
+	if kind == reflect.Ptr {
+		kind = value.Type().Elem().Kind()
+	}
+	if (kind == reflect.Struct || kind == reflect.Map) && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		// Merge into the current value, so members the patch leaves out are kept
+		current, err := json.Marshal(value.Interface())
+		if err != nil {
+			return err
+		}
+		var target, patch interface{}
+		if err = decodeJSON(current, &target); err != nil {
+			return err
+		}
+		if err = decodeJSON(raw, &patch); err != nil {
+			return err
+		}
+		if raw, err = json.Marshal(mergePatch(target, patch)); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(raw, fresh.Interface()); err != nil {
+		return err
+	}
+	value.Set(fresh.Elem())
+	return nil
+}
+
+// mergePatch applies patch to target, both decoded JSON values, as RFC 7396 describes
+func mergePatch(target, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged, ok := target.(map[string]interface{})
+	if !ok {
+		merged = map[string]interface{}{}
+	}
+	for name, value := range members {
+		if value == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = mergePatch(merged[name], value)
+		}
+	}
+	return merged
+}
+
+// decodeJSON decodes data into v, keeping numbers as json.Number so large integers survive being merged
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,145 @@
+package aeutils
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+var (
+	// MirrorQueue is the task queue updates to mirrored fields are added to (the default queue if empty), see RegisterMirror
+	MirrorQueue = ""
+
+	// Mirrors registered for each source kind
+	mirrors   = map[string][]mirror{}
+	mirrorsMu sync.RWMutex
+
+	syncMirrorsLater *delay.Function
+)
+
+func init() {
+	// Assigned here, as syncMirrors saves dependents, which can queue this again
+	syncMirrorsLater = delay.Func("aeutils-sync-mirrors", syncMirrors)
+}
+
+// mirror is a field of dependent that holds a copy of a field of source
+type mirror struct {
+	source      reflect.Type
+	sourceField string
+	dependent   reflect.Type
+	field       string
+	keyField    string // *datastore.Key field of dependent that refers to the source entity
+}
+
+// RegisterMirror declares that field of dependent holds a denormalized copy of sourceField of source (both structs or
+// pointers to structs), so it doesn't drift when the source entity changes. Dependents refer to their source entity
+// with a *datastore.Key field named after the source type (ie. 'AccountKey', as in LoadRelated). Whenever a source entity
+// is saved through aeutils, a task is added to MirrorQueue that updates (with Save) every dependent whose copy differs
+//
+// 	aeutils.RegisterMirror(&Order{}, "AccountName", &Account{}, "Name")
+//
+// Like RegisterAsync, it must be called from an init function, and panics if the fields don't exist or their types differ
+func RegisterMirror(dependent interface{}, field string, source interface{}, sourceField string) {
+	depKind, _, _, err := structValue(dependent)
+	if err != nil {
+		panic(err)
+	}
+	srcKind, _, _, err := structValue(source)
+	if err != nil {
+		panic(err)
+	}
+	m := mirror{source: srcKind, sourceField: sourceField, dependent: depKind, field: field, keyField: srcKind.Name() + "Key"}
+	if f, ok := depKind.FieldByName(m.keyField); !ok || f.Type != keyType {
+		panic(fmt.Sprintf("%v has no %v field of kind *datastore.Key to mirror %v with", depKind, m.keyField, srcKind))
+	}
+	from, ok := srcKind.FieldByName(sourceField)
+	if !ok {
+		panic(fmt.Sprintf("%v has no %v field to mirror", srcKind, sourceField))
+	}
+	if to, ok := depKind.FieldByName(field); !ok || to.Type != from.Type {
+		panic(fmt.Sprintf("%v has no %v field of kind %v to mirror %v.%v in", depKind, field, from.Type, srcKind, sourceField))
+	}
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+	dsKind := getDatastoreKind(srcKind)
+	mirrors[dsKind] = append(mirrors[dsKind], m)
+}
+
+// mirrorsOf returns the mirrors registered with dsKind as their source
+func mirrorsOf(dsKind string) []mirror {
+	mirrorsMu.RLock()
+	defer mirrorsMu.RUnlock()
+	return mirrors[dsKind]
+}
+
+// queueMirrorSync adds a task to update the dependents of the entity at key, if its kind has any mirrors
+func queueMirrorSync(ctx context.Context, key *datastore.Key) {
+	if len(mirrorsOf(key.Kind())) == 0 {
+		return
+	}
+	if err := queueSyncMirrors(ctx, key, 0, ""); err != nil {
+		log.Errorf(ctx, "[aeutils/queueMirrorSync] %v", err.Error())
+	}
+}
+
+func queueSyncMirrors(ctx context.Context, key *datastore.Key, from int, cursor string) error {
+	task, err := syncMirrorsLater.Task(key, from, cursor)
+	if err == nil {
+		_, err = taskqueue.Add(ctx, task, MirrorQueue)
+	}
+	return err
+}
+
+// syncMirrors copies the current values of the entity at key into the dependents of each of its mirrors, starting from
+// the mirror at index from, with its query starting at cursor. If it runs out of time, it adds a task to continue
+func syncMirrors(ctx context.Context, key *datastore.Key, from int, cursor string) error {
+	ctx, err := appengine.Namespace(ctx, key.Namespace())
+	if err != nil {
+		return err
+	}
+	registered := mirrorsOf(key.Kind())
+	if from >= len(registered) {
+		return nil
+	}
+	source := reflect.New(registered[0].source)
+	if err = GetByKey(ctx, key, source.Interface()); err == datastore.ErrNoSuchEntity {
+		// Deleted since the task was added, so there's nothing to copy
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i := from; i < len(registered); i++ {
+		m := registered[i]
+		value := source.Elem().FieldByName(m.sourceField)
+		q := datastore.NewQuery(getDatastoreKind(m.dependent)).Filter(m.keyField+" =", key)
+		if i == from && cursor != "" {
+			start, err := datastore.DecodeCursor(cursor)
+			if err != nil {
+				return err
+			}
+			q = q.Start(start)
+		}
+		next, err := Iterate(ctx, q, reflect.New(m.dependent).Interface(), func(obj interface{}, depKey *datastore.Key) error {
+			field := reflect.ValueOf(obj).Elem().FieldByName(m.field)
+			if reflect.DeepEqual(field.Interface(), value.Interface()) {
+				return nil
+			}
+			field.Set(value)
+			_, err := Save(ctx, obj, WithKey(depKey))
+			return err
+		})
+		if err == ErrIterateDeadline {
+			return queueSyncMirrors(ctx, key, i, next.String())
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package aeutils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// ModelError is returned by RegisterModel when a struct doesn't follow the conventions aeutils relies on
+type ModelError struct {
+	Type     reflect.Type
+	Problems []string
+}
+
+func (e *ModelError) Error() string {
+	return fmt.Sprintf("%v is not a valid aeutils model: %v", e.Type, strings.Join(e.Problems, "; "))
+}
+
+// RegisterModel checks that obj's type (a struct or pointer to struct) follows the conventions aeutils relies on,
+// returning a *ModelError listing every problem. Mistakes such as a Key field without `datastore:"-"` (which is then
+// stored as a property) or an ID field that isn't an integer (which is then ignored) otherwise only show up as bad data
+// Call it from an init function for each model, so problems are found at startup:
+//
+// 	func init() {
+// 		if err := aeutils.RegisterModel(&Post{}); err != nil {
+// 			panic(err)
+// 		}
+// 	}
+func RegisterModel(obj interface{}) error {
+	kind, _, _, err := structValue(obj)
+	if err != nil {
+		return err
+	}
+	if problems := modelProblems(kind); len(problems) > 0 {
+		return &ModelError{Type: kind, Problems: problems}
+	}
+	return nil
+}
+
+// modelProblems returns a description of each way t doesn't follow aeutils' conventions
+func modelProblems(t reflect.Type) (problems []string) {
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	skipped := func(field reflect.StructField) bool {
+		return strings.Split(field.Tag.Get("datastore"), ",")[0] == "-"
+	}
+	if field, ok := t.FieldByName("Key"); ok {
+		if field.Type != keyType {
+			add("Key field must be a *datastore.Key, is %v", field.Type)
+		} else if !skipped(field) {
+			add("Key field must be tagged `datastore:\"-\"`, or it's stored as a property")
+		}
+	}
+	if field, ok := t.FieldByName("ID"); ok {
+		if !isInt(field.Type.Kind()) && !isUint(field.Type.Kind()) {
+			add("ID field must be an integer, is %v", field.Type)
+		} else if isUint(field.Type.Kind()) && !skipped(field) {
+			add("ID field of type %v must be tagged `datastore:\"-\"`, as the datastore can't store unsigned integers", field.Type)
+		}
+	}
+	if field, ok := t.FieldByName("Parent"); ok && field.Type != keyType {
+		add("Parent field must be a *datastore.Key, is %v", field.Type)
+	}
+	if field, ok := t.FieldByName("Version"); ok && !isInt(field.Type.Kind()) {
+		add("Version field must be an integer, is %v", field.Type)
+	}
+	if field, ok := t.FieldByName("DeletedAt"); ok && field.Type != timeType {
+		add("DeletedAt field must be a time.Time, is %v", field.Type)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if tag := field.Tag.Get("aetime"); tag != "" && field.Type != timeType {
+			add("aetime field %v must be a time.Time, is %v", field.Name, field.Type)
+		}
+		if field.Tag.Get("aecrypt") == "true" && field.Type.Kind() != reflect.String && field.Type != bytesType {
+			add("aecrypt field %v must be a string or []byte, is %v", field.Name, field.Type)
+		}
+		if field.Tag.Get("aecrypt") == "true" && field.Tag.Get("aeunique") != "" {
+			add("aecrypt field %v can't also be aeunique", field.Name)
+		}
+		if scope := strings.TrimPrefix(field.Tag.Get("aeunique"), "scope="); scope != field.Tag.Get("aeunique") {
+			if _, ok := t.FieldByName(scope); !ok {
+				add("aeunique field %v is scoped by %v, which doesn't exist", field.Name, scope)
+			}
+		}
+		if field.Tag.Get("aekey") == "name" && field.Type.Kind() != reflect.String {
+			add("aekey field %v must be a string, is %v", field.Name, field.Type)
+		}
+	}
+	if _, err := jsonFields(t); err != nil {
+		add("%v", err.Error())
+	}
+	if _, err := searchFields(t); err != nil {
+		add("%v", err.Error())
+	}
+	if _, err := indexFields(t); err != nil {
+		add("%v", err.Error())
+	}
+	if source, target, _, ok := slugTag(t); ok {
+		for _, name := range []string{source, target} {
+			if field, ok := t.FieldByName(name); !ok || field.Type.Kind() != reflect.String {
+				add("aeslug field %v must be a string field", name)
+			}
+		}
+	}
+	// Anything else the datastore package can't store
+	if _, err := datastore.SaveStruct(reflect.New(t).Interface()); err != nil {
+		add("%v", err.Error())
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package aeutils
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Patch updates the entity stored at key with only the named fields of obj (a pointer to a struct of the entity's type),
+// leaving every other stored field as it was, for PATCH endpoints where the client only sends some fields
+// The stored entity is loaded, the fields copied onto it and the result saved (with all of Save's conventions)
+// within a transaction. On success, obj is replaced with the full entity as stored
+//
+// 	// Client only sent a new title
+// 	err := aeutils.Patch(ctx, key, &Post{Title: title}, []string{"Title"})
+func Patch(ctx context.Context, key *datastore.Key, obj interface{}, fields []string) error {
+	kind, _, str, err := pointerValue(obj)
+	if err != nil {
+		return err
+	}
+	for _, name := range fields {
+		if field, ok := kind.FieldByName(name); !ok || field.PkgPath != "" {
+			return fmt.Errorf("%v has no exported field %v to patch", kind, name)
+		}
+	}
+	var stored reflect.Value
+	err = ensureTransaction(ctx, func(tc context.Context) error {
+		stored = reflect.New(kind)
+		if err := GetByKey(tc, key, stored.Interface()); err != nil {
+			return err
+		}
+		for _, name := range fields {
+			stored.Elem().FieldByName(name).Set(str.FieldByName(name))
+		}
+		_, err := Save(tc, stored.Interface(), WithKey(key))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	str.Set(stored.Elem())
+	return nil
+}
@@ -0,0 +1,66 @@
+package aeutils
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// PrefixQuery returns a query for entities of the kind of obj (a struct or pointer to struct) whose field starts with prefix,
+// ordered by field. If field is tagged `aesearch:"lower"`, its search property is used (see SearchProperty) and prefix is
+// normalized to match, so the match ignores case, otherwise it's exact. The query has inequality filters on field,
+// so can't have any on other fields, and can be ordered further (ie. with Limit) as usual
+//
+// 	aeutils.PrefixQuery(&User{}, "Username", "bo").Limit(10).GetAll(ctx, &users)
+func PrefixQuery(obj interface{}, field, prefix string) *QueryBuilder {
+	property := field
+	if isSearchField(reflect.TypeOf(obj), field) {
+		property, prefix = SearchProperty(field), NormalizeSearch(prefix)
+	}
+	qb := Query(obj)
+	if prefix != "" {
+		// \ufffd sorts after any character likely to follow prefix, so this covers every string starting with it
+		qb = qb.Filter(property+" >=", prefix).Filter(property+" <", prefix+"\ufffd")
+	}
+	return qb.Order(property)
+}
+
+// TypeaheadHandler returns a handler that responds with a JSON array of up to limit entities of the kind of obj whose field
+// starts with the "q" query parameter (see PrefixQuery), for autocomplete inputs. An empty "q" responds with an empty array
+//
+// 	http.Handle("/typeahead/users", aeutils.TypeaheadHandler(&User{}, "Username", 10))
+func TypeaheadHandler(obj interface{}, field string, limit int) http.HandlerFunc {
+	kind, _, _, err := structValue(obj)
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		results := reflect.New(reflect.SliceOf(kind))
+		results.Elem().Set(reflect.MakeSlice(results.Elem().Type(), 0, 0))
+		if prefix := r.FormValue("q"); prefix != "" {
+			if _, err := PrefixQuery(obj, field, prefix).Limit(limit).GetAll(ctx, results.Interface()); err != nil {
+				log.Errorf(ctx, "[aeutils/TypeaheadHandler] %v", err.Error())
+				http.Error(w, err.Error(), StatusCode(err))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(results.Elem().Interface())
+	}
+}
+
+// isSearchField returns true if t (a struct or pointer to struct) has a field named field tagged `aesearch`
+func isSearchField(t reflect.Type, field string) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := t.FieldByName(field)
+	return ok && f.Tag.Get("aesearch") != ""
+}
@@ -0,0 +1,177 @@
+package aeutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const publicIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var (
+	// ErrInvalidPublicID is returned by an IDEncoder when a string can't be decoded
+	ErrInvalidPublicID = errors.New("Not a valid public ID")
+
+	// ErrNoPublicIDs is returned by PublicID and ResolvePublicID until an encoder is set with SetPublicIDSecret
+	// or SetPublicIDs, as IDs encoded without a secret are only obscure
+	ErrNoPublicIDs = errors.New("No public ID secret has been set")
+
+	// MinPublicIDSecret is the shortest secret SetPublicIDSecret accepts, in bytes
+	MinPublicIDSecret = 16
+
+	publicIDs   IDEncoder
+	publicIDsMu sync.RWMutex
+)
+
+// IDEncoder reversibly converts numeric IDs of a kind to and from opaque strings, see PublicID
+type IDEncoder interface {
+	EncodeID(kind string, id int64) string
+	DecodeID(kind string, s string) (int64, error)
+}
+
+// NewIDEncoder returns an IDEncoder that scrambles IDs with a keyed permutation (a Feistel network using HMAC-SHA256 with secret),
+// so each ID maps to a unique, short (up to 11 characters) alphanumeric string, and the same ID gives a different string for each kind
+// Without the secret, neither the IDs nor how many there are can be worked out from the strings
+func NewIDEncoder(secret []byte) IDEncoder {
+	return &feistelEncoder{secret: secret}
+}
+
+// SetPublicIDSecret makes PublicID and ResolvePublicID use NewIDEncoder with secret, which should be kept out of
+// source control (ie. in the config package). Changing it changes every public ID, so links using them will break
+//
+// 	secret, err := config.Secret(ctx, "app.publicIDSecret")
+// 	err = aeutils.SetPublicIDSecret(secret)
+func SetPublicIDSecret(secret []byte) error {
+	if len(secret) < MinPublicIDSecret {
+		return fmt.Errorf("Public ID secret must be at least %d bytes", MinPublicIDSecret)
+	}
+	SetPublicIDs(NewIDEncoder(secret))
+	return nil
+}
+
+// SetPublicIDs replaces the encoder used by PublicID and ResolvePublicID, ie. with an IDEncoder of your own
+// Passing nil unsets it
+func SetPublicIDs(encoder IDEncoder) {
+	publicIDsMu.Lock()
+	defer publicIDsMu.Unlock()
+	publicIDs = encoder
+}
+
+// HasPublicIDs returns whether an encoder has been set with SetPublicIDSecret or SetPublicIDs
+func HasPublicIDs() bool {
+	return currentPublicIDs() != nil
+}
+
+func currentPublicIDs() IDEncoder {
+	publicIDsMu.RLock()
+	defer publicIDsMu.RUnlock()
+	return publicIDs
+}
+
+// PublicID returns an opaque string for key to expose externally (ie. in URLs or JSON), rather than it's sequential ID,
+// which would leak how many entities there are and let clients enumerate them. See ResolvePublicID to get the key back
+// Only root keys with numeric IDs are supported, for anything else "" is returned. Returns ErrNoPublicIDs if no
+// encoder has been set
+func PublicID(key *datastore.Key) (string, error) {
+	if key == nil || key.IntID() == 0 || key.Parent() != nil {
+		return "", nil
+	}
+	return EncodePublicID(key.Kind(), key.IntID())
+}
+
+// EncodePublicID is PublicID for the numeric id of a root key of kind, ie. when only a model's ID field is at hand
+func EncodePublicID(kind string, id int64) (string, error) {
+	encoder := currentPublicIDs()
+	if encoder == nil {
+		return "", ErrNoPublicIDs
+	}
+	return encoder.EncodeID(kind, id), nil
+}
+
+// ResolvePublicID returns the key a string from PublicID refers to, in the namespace of ctx
+// kind may be a kind name, or a struct (or pointer to struct) to use the kind of. Returns a *KeyError if s isn't valid,
+// or ErrNoPublicIDs if no encoder has been set
+//
+// 	key, err := aeutils.ResolvePublicID(ctx, mux.Vars(r)["id"], &Post{})
+func ResolvePublicID(ctx context.Context, s string, kind interface{}) (*datastore.Key, error) {
+	encoder := currentPublicIDs()
+	if encoder == nil {
+		return nil, ErrNoPublicIDs
+	}
+	dsKind, ok := kind.(string)
+	if !ok {
+		dsKind = KindOf(kind)
+	}
+	id, err := encoder.DecodeID(dsKind, s)
+	if err != nil {
+		return nil, &KeyError{Encoded: s, Kind: dsKind, Reason: err.Error()}
+	}
+	return datastore.NewKey(ctx, dsKind, "", id, nil), nil
+}
+
+type feistelEncoder struct {
+	secret []byte
+}
+
+const feistelRounds = 4
+
+func (e *feistelEncoder) EncodeID(kind string, id int64) string {
+	left, right := uint32(uint64(id)>>32), uint32(id)
+	for round := 0; round < feistelRounds; round++ {
+		left, right = right, left^e.round(kind, round, right)
+	}
+	n := uint64(left)<<32 | uint64(right)
+	var buf []byte
+	for {
+		buf = append(buf, publicIDAlphabet[n%62])
+		if n /= 62; n == 0 {
+			break
+		}
+	}
+	// Digits were added least significant first
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return string(buf)
+}
+
+func (e *feistelEncoder) DecodeID(kind string, s string) (int64, error) {
+	if s == "" || len(s) > 11 {
+		return 0, ErrInvalidPublicID
+	}
+	var n uint64
+	for _, c := range []byte(s) {
+		digit := strings.IndexByte(publicIDAlphabet, c)
+		if digit < 0 || n > (1<<64-1-uint64(digit))/62 {
+			return 0, ErrInvalidPublicID
+		}
+		n = n*62 + uint64(digit)
+	}
+	left, right := uint32(n>>32), uint32(n)
+	for round := feistelRounds - 1; round >= 0; round-- {
+		left, right = right^e.round(kind, round, left), left
+	}
+	id := int64(uint64(left)<<32 | uint64(right))
+	if id <= 0 {
+		return 0, ErrInvalidPublicID
+	}
+	return id, nil
+}
+
+// round is the Feistel round function, keyed by the secret, kind and round number
+func (e *feistelEncoder) round(kind string, round int, half uint32) uint32 {
+	mac := hmac.New(sha256.New, e.secret)
+	var buf [5]byte
+	buf[0] = byte(round)
+	binary.BigEndian.PutUint32(buf[1:], half)
+	mac.Write([]byte(kind))
+	mac.Write(buf[:])
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
@@ -0,0 +1,406 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// ErrInvalidDestination is returned by QueryBuilder when dst isn't a pointer to a slice of the query's struct type
+	ErrInvalidDestination = errors.New("Destination must be a pointer to a slice of structs (or pointers to structs) of the query's kind")
+)
+
+// QueryError wraps any error returned by the datastore while running a QueryBuilder
+type QueryError struct {
+	Kind string // Datastore kind being queried
+	Op   string // Operation that failed (GetAll, First, Count, Keys)
+	Err  error  // Underlying datastore error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("[aeutils/%v] Error querying %v: %v", e.Op, e.Kind, e.Err.Error())
+}
+
+// Filter is a single field-based filter for Project, with the same format as datastore.Query.Filter
+//
+// 	aeutils.Filter{"Active =", true}
+type Filter struct {
+	Field string
+	Value interface{}
+}
+
+// QueryBuilder builds a query (run by the current Backend) with the datastore kind inferred from a struct,
+// so results can be loaded with the same conventions as the Get helpers. Create one with Query
+// Like datastore.Query, each method returns a new QueryBuilder, leaving the original unchanged
+type QueryBuilder struct {
+	kind           reflect.Type
+	dsKind         string
+	query          BackendQuery
+	namespace      string
+	ancestor       *datastore.Key
+	includeDeleted bool
+	desc           []string // Filters, orders etc. applied so far, to identify the query for caching (see CacheQueries)
+	err            error
+}
+
+// Query creates a QueryBuilder for the kind of obj, a struct (or pointer to struct)
+// If obj has a non-nil 'Parent' field of kind *datastore.Key, it is used as the default ancestor for the query
+// Soft deleted entities are excluded unless IncludeDeleted is called (see Delete)
+//
+// 	var posts []*Post
+// 	keys, err := aeutils.Query(&Post{}).Filter("Slug =", s).Order("-Created").Limit(20).GetAll(ctx, &posts)
+func Query(obj interface{}) *QueryBuilder {
+	kind, _, str, err := structValue(obj)
+	if err != nil {
+		return &QueryBuilder{err: err}
+	}
+	qb := &QueryBuilder{
+		kind:   kind,
+		dsKind: getDatastoreKind(kind),
+	}
+	qb.query.Kind = qb.dsKind
+	if parent := str.FieldByName("Parent"); parent.IsValid() {
+		qb.ancestor, _ = parent.Interface().(*datastore.Key)
+	}
+	return qb
+}
+
+func (qb *QueryBuilder) clone() *QueryBuilder {
+	c := *qb
+	return &c
+}
+
+// describe records an operation applied to qb, to identify the query for caching
+func (qb *QueryBuilder) describe(format string, args ...interface{}) {
+	qb.desc = appendCopy(qb.desc, fmt.Sprintf(format, args...))
+}
+
+// appendCopy appends values to a copy of s, so it's never shared with the query qb was cloned from
+func appendCopy(s []string, values ...string) []string {
+	return append(append([]string(nil), s...), values...)
+}
+
+// Filter returns a derivative query with a field-based filter, see datastore.Query.Filter
+func (qb *QueryBuilder) Filter(filterStr string, value interface{}) *QueryBuilder {
+	c := qb.clone()
+	c.describe("Filter %q %T %v", filterStr, value, value)
+	c.query.Filters = append(append([]Filter(nil), c.query.Filters...), Filter{filterStr, value})
+	return c
+}
+
+// Order returns a derivative query with a field-based sort order, see datastore.Query.Order
+func (qb *QueryBuilder) Order(fieldName string) *QueryBuilder {
+	c := qb.clone()
+	c.describe("Order %q", fieldName)
+	c.query.Orders = appendCopy(c.query.Orders, fieldName)
+	return c
+}
+
+// Limit returns a derivative query that has a limit on the number of results returned
+func (qb *QueryBuilder) Limit(limit int) *QueryBuilder {
+	c := qb.clone()
+	c.describe("Limit %d", limit)
+	c.query.Limit = limit
+	return c
+}
+
+// Offset returns a derivative query that has an offset of how many keys to skip over before returning results
+func (qb *QueryBuilder) Offset(offset int) *QueryBuilder {
+	c := qb.clone()
+	c.describe("Offset %d", offset)
+	c.query.Offset = offset
+	return c
+}
+
+// Start returns a derivative query with the given start point
+func (qb *QueryBuilder) Start(cursor datastore.Cursor) *QueryBuilder {
+	c := qb.clone()
+	c.describe("Start %v", cursor)
+	c.query.Start = cursor
+	return c
+}
+
+// Project returns a derivative query that only loads the named properties, see datastore.Query.Project
+// See Project for index requirements, and RecordIndexes to work them out
+func (qb *QueryBuilder) Project(fieldNames ...string) *QueryBuilder {
+	c := qb.clone()
+	c.describe("Project %q", fieldNames)
+	c.query.Projection = appendCopy(c.query.Projection, fieldNames...)
+	return c
+}
+
+// Ancestor returns a derivative query restricted to descendants of ancestor, overriding any default from the 'Parent' field
+func (qb *QueryBuilder) Ancestor(ancestor *datastore.Key) *QueryBuilder {
+	c := qb.clone()
+	c.ancestor = ancestor
+	return c
+}
+
+// Namespace returns a derivative query run within namespace, rather than the namespace of the context it's run with
+func (qb *QueryBuilder) Namespace(namespace string) *QueryBuilder {
+	c := qb.clone()
+	c.namespace = namespace
+	return c
+}
+
+// IncludeDeleted returns a derivative query that also returns soft deleted entities
+func (qb *QueryBuilder) IncludeDeleted() *QueryBuilder {
+	c := qb.clone()
+	c.includeDeleted = true
+	return c
+}
+
+// build returns the BackendQuery and context to run it with, with all defaults applied
+func (qb *QueryBuilder) build(ctx context.Context) (context.Context, *BackendQuery, error) {
+	if qb.err != nil {
+		return nil, nil, qb.err
+	}
+	var err error
+	if qb.namespace != "" {
+		if ctx, err = appengine.Namespace(ctx, qb.namespace); err != nil {
+			return nil, nil, err
+		}
+	}
+	q := qb.query
+	q.Filters = append([]Filter(nil), q.Filters...)
+	q.Ancestor = qb.ancestor
+	if !qb.includeDeleted {
+		excludeDeleted(&q, qb.kind)
+	}
+	if RecordIndexes {
+		recordIndex(qb)
+	}
+	return ctx, &q, nil
+}
+
+// GetAll runs the query, loading all results into dst, which must be a pointer to a slice of
+// the query's struct type (or pointers to it). aejson fields are decoded, aecrypt fields are decrypted, Key and ID fields are populated and AfterLoad is called on each result
+// If the kind's queries are cached (see CacheQueries), results are read from memcache when possible
+func (qb *QueryBuilder) GetAll(ctx context.Context, dst interface{}) ([]*datastore.Key, error) {
+	ctx, q, err := qb.build(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slice := reflect.ValueOf(dst)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return nil, ErrInvalidDestination
+	}
+	if elemType := slice.Type().Elem().Elem(); elemType != qb.kind && elemType != reflect.PtrTo(qb.kind) {
+		return nil, ErrInvalidDestination
+	}
+	slice = slice.Elem()
+	cacheKey, ttl, cached := qb.cacheKey(ctx)
+	if cached {
+		if keys, results, ok := queryCacheGet(ctx, cacheKey, qb.kind); ok {
+			offset := slice.Len()
+			for i, key := range keys {
+				elem := results.Index(i)
+				setKeyFields(elem, key)
+				if slice.Type().Elem().Kind() == reflect.Ptr {
+					elem = elem.Addr()
+				}
+				slice.Set(reflect.Append(slice, elem))
+			}
+			for i := range keys {
+				elem := slice.Index(offset + i)
+				if elem.Kind() != reflect.Ptr {
+					elem = elem.Addr()
+				}
+				postLoad(ctx, elem.Interface())
+			}
+			return keys, nil
+		}
+	}
+	fields, err := jsonFields(qb.kind)
+	if err != nil {
+		return nil, err
+	}
+	search, err := searchFields(qb.kind)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*datastore.Key
+	var lists []datastore.PropertyList
+	start := time.Now()
+	before := slice.Len()
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		// Drop anything a failed attempt appended
+		slice.SetLen(before)
+		if len(fields)+len(search) > 0 {
+			// aejson fields need decoding (and aesearch properties skipping), so load raw properties first
+			lists = nil
+			keys, err = backend().GetAll(ctx, q, &lists)
+		} else {
+			keys, err = backend().GetAll(ctx, q, dst)
+		}
+		return
+	})
+	trace(ctx, "GetAll", qb.dsKind, start, err)
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return nil, &QueryError{Kind: qb.dsKind, Op: "GetAll", Err: err}
+	}
+	// Results are appended to dst, after anything already in it
+	offset := slice.Len()
+	if lists == nil {
+		offset -= len(keys)
+	}
+	results := make([]reflect.Value, len(keys))
+	for i, key := range keys {
+		if lists != nil {
+			elem := reflect.New(qb.kind)
+			loadErr := (&jsonEntity{obj: elem.Interface(), str: elem.Elem(), fields: fields, search: search}).Load(lists[i])
+			if _, ok := loadErr.(*datastore.ErrFieldMismatch); loadErr != nil && !ok {
+				return nil, &QueryError{Kind: qb.dsKind, Op: "GetAll", Err: loadErr}
+			} else if loadErr != nil {
+				err = loadErr
+			}
+			if slice.Type().Elem().Kind() != reflect.Ptr {
+				elem = elem.Elem()
+			}
+			slice.Set(reflect.Append(slice, elem))
+		}
+		elem := slice.Index(offset + i)
+		if elem.Kind() != reflect.Ptr {
+			elem = elem.Addr()
+		}
+		if cryptErr := decryptFields(elem.Elem()); cryptErr != nil {
+			return nil, &QueryError{Kind: qb.dsKind, Op: "GetAll", Err: cryptErr}
+		}
+		setKeyFields(elem.Elem(), key)
+		results[i] = elem
+	}
+	// Cache results before AfterLoad, so it runs against the stored values on a hit too
+	if cached && err == nil {
+		queryCacheSet(ctx, cacheKey, ttl, qb.kind, keys, results)
+	}
+	for _, elem := range results {
+		postLoad(ctx, elem.Interface())
+	}
+	return keys, err
+}
+
+// First runs the query, loading the first result into dst, which must be a pointer to the query's struct type
+// Returns datastore.ErrNoSuchEntity if there are no results
+func (qb *QueryBuilder) First(ctx context.Context, dst interface{}) (*datastore.Key, error) {
+	ctx, q, err := qb.build(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kind, _, str, err := pointerValue(dst)
+	if err != nil {
+		return nil, err
+	}
+	if kind != qb.kind {
+		return nil, ErrInvalidDestination
+	}
+	entity, err := entityFor(dst, str)
+	if err != nil {
+		return nil, err
+	}
+	q.Limit = 1
+	start := time.Now()
+	var keys []*datastore.Key
+	var lists []datastore.PropertyList
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		lists = nil
+		keys, err = backend().GetAll(ctx, q, &lists)
+		return
+	})
+	trace(ctx, "First", qb.dsKind, start, err)
+	if err == nil && len(keys) == 0 {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	var key *datastore.Key
+	if err == nil {
+		key = keys[0]
+		if pls, ok := entity.(datastore.PropertyLoadSaver); ok {
+			err = pls.Load(lists[0])
+		} else {
+			err = datastore.LoadStruct(entity, lists[0])
+		}
+	}
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return nil, &QueryError{Kind: qb.dsKind, Op: "First", Err: err}
+	}
+	if cryptErr := decryptFields(str); cryptErr != nil {
+		return nil, &QueryError{Kind: qb.dsKind, Op: "First", Err: cryptErr}
+	}
+	setKeyFields(str, key)
+	postLoad(ctx, dst)
+	return key, err
+}
+
+// Keys runs the query as a keys only query, returning the keys of all results
+func (qb *QueryBuilder) Keys(ctx context.Context) ([]*datastore.Key, error) {
+	ctx, q, err := qb.build(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.KeysOnly = true
+	start := time.Now()
+	var keys []*datastore.Key
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		keys, err = backend().GetAll(ctx, q, nil)
+		return
+	})
+	trace(ctx, "Keys", qb.dsKind, start, err)
+	if err != nil {
+		return nil, &QueryError{Kind: qb.dsKind, Op: "Keys", Err: err}
+	}
+	return keys, nil
+}
+
+// Count returns the number of results for the query
+func (qb *QueryBuilder) Count(ctx context.Context) (int, error) {
+	ctx, q, err := qb.build(ctx)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	var n int
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		n, err = backend().Count(ctx, q)
+		return
+	})
+	trace(ctx, "Count", qb.dsKind, start, err)
+	if err != nil {
+		return 0, &QueryError{Kind: qb.dsKind, Op: "Count", Err: err}
+	}
+	return n, nil
+}
+
+// Project runs a projection query for the kind of obj (a struct or pointer to struct), loading only the named fields
+// Results are new pointers to structs of obj's type with just those fields (and Key/ID fields) populated,
+// which is much cheaper than loading whole entities for list views
+//
+// 	keys, posts, err := aeutils.Project(ctx, &Post{}, []string{"Title", "Created"}, aeutils.Filter{"Published =", true})
+//
+// Index requirements: unless it's a single field with no filters, a projection needs a composite index (in index.yaml)
+// on all projected fields, plus any filtered ones (including 'DeletedAt' for soft deletable kinds, see Delete).
+// Only indexed properties can be projected (so not aejson fields, or unindexed []byte and long string fields),
+// and a field can't be both projected and used in an equality filter
+func Project(ctx context.Context, obj interface{}, fields []string, filters ...Filter) ([]*datastore.Key, []interface{}, error) {
+	qb := Query(obj).Project(fields...)
+	for _, f := range filters {
+		qb = qb.Filter(f.Field, f.Value)
+	}
+	if qb.err != nil {
+		return nil, nil, qb.err
+	}
+	dst := reflect.New(reflect.SliceOf(reflect.PtrTo(qb.kind)))
+	keys, err := qb.GetAll(ctx, dst.Interface())
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return nil, nil, err
+	}
+	results := make([]interface{}, dst.Elem().Len())
+	for i := range results {
+		results[i] = dst.Elem().Index(i).Interface()
+	}
+	return keys, results, err
+}
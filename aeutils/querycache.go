@@ -0,0 +1,160 @@
+package aeutils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+var (
+	cachedQueries   = map[string]time.Duration{}
+	cachedQueriesMu sync.RWMutex
+)
+
+// CacheQueries enables a memcache cache of QueryBuilder.GetAll (and so Project) results for the kind of obj (a struct or pointer to struct)
+// Each distinct query is cached separately, and entries expire after ttl (0 for no expiry). Rather than tracking which
+// queries an entity appears in, every Save or Delete of the kind bumps a per-kind generation counter that's part of
+// each entry's key, so all cached queries for that kind miss from then on and old entries are left to expire
+// Useful for read-mostly list endpoints. Queries within a transaction always go to the datastore, and writes that don't
+// go through aeutils (ie. directly via the datastore package) aren't seen until entries expire
+func CacheQueries(obj interface{}, ttl time.Duration) {
+	cachedQueriesMu.Lock()
+	defer cachedQueriesMu.Unlock()
+	cachedQueries[KindOf(obj)] = ttl
+}
+
+// UncacheQueries disables query caching for the kind of obj. Existing entries are left to expire
+func UncacheQueries(obj interface{}) {
+	cachedQueriesMu.Lock()
+	defer cachedQueriesMu.Unlock()
+	delete(cachedQueries, KindOf(obj))
+}
+
+// queryCacheTTL returns the TTL for queries of a kind, and whether they're cached at all
+func queryCacheTTL(dsKind string) (ttl time.Duration, ok bool) {
+	cachedQueriesMu.RLock()
+	defer cachedQueriesMu.RUnlock()
+	ttl, ok = cachedQueries[dsKind]
+	return
+}
+
+func generationKey(dsKind string) string {
+	return "aeutils-generation-" + dsKind
+}
+
+// bumpGeneration increments the generation counter for dsKind by delta and returns the new value
+// A missing counter starts from the current time, so one evicted from memcache can't restart
+// at a generation that older entries were cached with
+func bumpGeneration(ctx context.Context, dsKind string, delta int64) (uint64, error) {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	return memcache.Increment(ctx, generationKey(dsKind), delta, uint64(time.Now().UnixNano()))
+}
+
+// invalidateQueries bumps the generation counter for the kinds of keys, for any whose queries are cached
+func invalidateQueries(ctx context.Context, keys ...*datastore.Key) {
+	bumped := map[string]bool{}
+	for _, key := range keys {
+		dsKind := key.Kind()
+		if _, ok := queryCacheTTL(dsKind); !ok || bumped[dsKind] {
+			continue
+		}
+		bumped[dsKind] = true
+		if _, err := bumpGeneration(ctx, dsKind, 1); err != nil {
+			log.Warningf(ctx, "[aeutils/invalidateQueries] %v", err.Error())
+		}
+	}
+}
+
+// cacheKey returns the memcache key for qb's results at the current generation of its kind, and whether they should be cached
+// ctx should be the context returned by build, so entries are stored in the query's namespace
+func (qb *QueryBuilder) cacheKey(ctx context.Context) (key string, ttl time.Duration, ok bool) {
+	if ttl, ok = queryCacheTTL(qb.dsKind); !ok || currentTransaction(ctx) != nil {
+		return "", 0, false
+	}
+	generation, err := bumpGeneration(ctx, qb.dsKind, 0)
+	if err != nil {
+		log.Warningf(ctx, "[aeutils/GetAll] %v", err.Error())
+		return "", 0, false
+	}
+	desc := strings.Join(qb.desc, "\n")
+	if qb.ancestor != nil {
+		desc += "\nAncestor " + qb.ancestor.Encode()
+	}
+	if qb.includeDeleted {
+		desc += "\nIncludeDeleted"
+	}
+	return fmt.Sprintf("aeutils-query-%v-%d-%x", qb.dsKind, generation, sha1.Sum([]byte(desc))), ttl, true
+}
+
+// queryCacheGet loads cached results from memcache into a new slice of kind, returning false on a miss
+func queryCacheGet(ctx context.Context, cacheKey string, kind reflect.Type) (keys []*datastore.Key, results reflect.Value, ok bool) {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	item, err := memcache.Get(ctx, cacheKey)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Warningf(ctx, "[aeutils/queryCacheGet] %v", err.Error())
+		}
+		return nil, results, false
+	}
+	var encoded []string
+	results = reflect.New(reflect.SliceOf(kind))
+	dec := gob.NewDecoder(bytes.NewReader(item.Value))
+	if err = dec.Decode(&encoded); err == nil {
+		err = dec.DecodeValue(results)
+	}
+	if err == nil {
+		keys = make([]*datastore.Key, len(encoded))
+		for i, s := range encoded {
+			if keys[i], err = datastore.DecodeKey(s); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Warningf(ctx, "[aeutils/queryCacheGet] %v", err.Error())
+		return nil, results, false
+	}
+	return keys, results.Elem(), true
+}
+
+// queryCacheSet stores keys and results (pointers to structs of kind) in memcache
+func queryCacheSet(ctx context.Context, cacheKey string, ttl time.Duration, kind reflect.Type, keys []*datastore.Key, results []reflect.Value) {
+	ctx, cancel := rpcContext(ctx)
+	defer cancel()
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = key.Encode()
+	}
+	values := reflect.MakeSlice(reflect.SliceOf(kind), 0, len(results))
+	for _, result := range results {
+		values = reflect.Append(values, result.Elem())
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(encoded)
+	if err == nil {
+		err = enc.EncodeValue(values)
+	}
+	if err == nil {
+		err = memcache.Set(ctx, &memcache.Item{
+			Key:        cacheKey,
+			Value:      buf.Bytes(),
+			Expiration: ttl,
+		})
+	}
+	if err != nil {
+		log.Warningf(ctx, "[aeutils/queryCacheSet] %v", err.Error())
+	}
+}
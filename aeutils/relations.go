@@ -0,0 +1,191 @@
+package aeutils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// LoadRelated loads the entity a 'BelongsTo' relationship of obj (a pointer to a struct) refers to
+// The relationship is made up of two fields, given the name "Account":
+//
+// * Field 'AccountKey' of kind *datastore.Key, which is stored and refers to the related entity
+// * Field 'Account' (or 'account' if that name is taken, ie. by a method) that's a pointer to the related struct type
+//   The loaded entity is kept here, so it's only fetched once. It must not be stored itself (so needs the
+//   struct tag `datastore:"-"` if exported)
+//
+// 	type User struct {
+// 		AccountKey *datastore.Key
+// 		account    *Account
+// 	}
+//
+// 	func (u *User) Account(ctx context.Context) *Account {
+// 		acct, _ := aeutils.LoadRelated(ctx, u, "Account")
+// 		...
+//
+// Returns a pointer to the related struct (or nil if the key field is nil), loaded with the Get helpers
+// (so CacheKind applies). If the key field has changed since it was loaded, the entity is fetched again
+func LoadRelated(ctx context.Context, obj interface{}, name string) (interface{}, error) {
+	_, _, str, err := pointerValue(obj)
+	if err != nil {
+		return nil, err
+	}
+	keyField, target, err := relatedFields(str, name)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := keyField.Interface().(*datastore.Key)
+	if key == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil, nil
+	}
+	if !target.IsNil() && relatedKey(ctx, target).Equal(key) {
+		return target.Interface(), nil
+	}
+	related := reflect.New(target.Type().Elem())
+	if err = get(ctx, key, related, related.Elem()); err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return nil, err
+		}
+	}
+	target.Set(related)
+	return related.Interface(), err
+}
+
+// PreloadRelated loads the related entity of a 'BelongsTo' relationship (see LoadRelated) for every element of objs,
+// a slice of structs or pointers to structs (or a pointer to one), with a single GetMulti call. field is either the relationship's
+// key field ('AccountKey') or it's name ('Account'). Elements that refer to the same entity share the same loaded struct,
+// and any related entities that don't exist are left nil. Avoids a datastore Get per element when rendering lists
+//
+// 	var users []*User
+// 	aeutils.Query(&User{}).GetAll(ctx, &users)
+// 	err := aeutils.PreloadRelated(ctx, users, "AccountKey")
+func PreloadRelated(ctx context.Context, objs interface{}, field string) error {
+	slice := reflect.Indirect(reflect.ValueOf(objs))
+	if slice.Kind() != reflect.Slice {
+		return ErrInvalidDestination
+	}
+	name := strings.TrimSuffix(field, "Key")
+	targets := map[string][]reflect.Value{}
+	var keys []*datastore.Key
+	for i := 0; i < slice.Len(); i++ {
+		str := reflect.Indirect(slice.Index(i))
+		if str.Kind() != reflect.Struct {
+			return ErrInvalidDestination
+		}
+		keyField, target, err := relatedFields(str, name)
+		if err != nil {
+			return err
+		}
+		key, _ := keyField.Interface().(*datastore.Key)
+		if key == nil {
+			target.Set(reflect.Zero(target.Type()))
+			continue
+		}
+		encoded := key.Encode()
+		if _, ok := targets[encoded]; !ok {
+			keys = append(keys, key)
+		}
+		targets[encoded] = append(targets[encoded], target)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	relatedType := targets[keys[0].Encode()][0].Type().Elem()
+	related := make([]reflect.Value, len(keys))
+	for i := range related {
+		related[i] = reflect.New(relatedType)
+	}
+	if err := getMulti(ctx, keys, related); err != nil {
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		for i, err := range me {
+			if err == datastore.ErrNoSuchEntity {
+				related[i] = reflect.Zero(related[i].Type())
+			} else if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+				return err
+			}
+		}
+	}
+	for i, key := range keys {
+		for _, target := range targets[key.Encode()] {
+			target.Set(related[i])
+		}
+	}
+	return nil
+}
+
+// LoadChildren loads all entities that belong to obj (a struct or pointer to struct) into dst, a pointer to a slice of structs
+// (or pointers to structs), for a 'HasMany' relationship. Given obj is an Account, children are found by:
+//
+// * Field 'AccountKey' of kind *datastore.Key on the child struct. If it exists, children are those whose AccountKey is obj's key
+// * Otherwise, children are entities of the child kind that have obj's key as an ancestor (see the 'Parent' field in Save)
+//
+// Children are loaded with QueryBuilder.GetAll, so cached queries (see CacheQueries) are used for kinds that enable them
+func LoadChildren(ctx context.Context, obj interface{}, dst interface{}) error {
+	kind, _, str, err := structValue(obj)
+	if err != nil {
+		return err
+	}
+	dsKind := getDatastoreKind(kind)
+	key := resolveKey(ctx, obj, str, dsKind)
+	if key == nil || key.Incomplete() {
+		return &ErrNoKey{Kind: dsKind, Op: "load children"}
+	}
+	slice := reflect.TypeOf(dst)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return ErrInvalidDestination
+	}
+	childKind := slice.Elem().Elem()
+	if childKind.Kind() == reflect.Ptr {
+		childKind = childKind.Elem()
+	}
+	if childKind.Kind() != reflect.Struct {
+		return ErrInvalidDestination
+	}
+	qb := Query(reflect.New(childKind).Interface())
+	if field, ok := childKind.FieldByName(kind.Name() + "Key"); ok && field.Type == keyType {
+		qb = qb.Filter(field.Name+" =", key)
+	} else {
+		qb = qb.Ancestor(key)
+	}
+	_, err = qb.GetAll(ctx, dst)
+	return err
+}
+
+// relatedFields returns the key and target fields of the relationship called name on str (see LoadRelated)
+// The target field is always settable, even if it's unexported
+func relatedFields(str reflect.Value, name string) (keyField, target reflect.Value, err error) {
+	keyField = str.FieldByName(name + "Key")
+	if !keyField.IsValid() || keyField.Type() != keyType {
+		return keyField, target, fmt.Errorf("%v has no %vKey field of kind *datastore.Key", str.Type(), name)
+	}
+	field, ok := str.Type().FieldByName(name)
+	if !ok {
+		r, n := utf8.DecodeRuneInString(name)
+		field, ok = str.Type().FieldByName(string(unicode.ToLower(r)) + name[n:])
+	}
+	if !ok || field.Type.Kind() != reflect.Ptr || field.Type.Elem().Kind() != reflect.Struct {
+		return keyField, target, fmt.Errorf("%v has no %v field that's a pointer to a struct", str.Type(), name)
+	}
+	target = str.FieldByIndex(field.Index)
+	if !target.CanSet() {
+		// Unexported, so reflect won't set it directly (see LoadRelated for why the field may need to be unexported)
+		target = reflect.NewAt(target.Type(), unsafe.Pointer(target.UnsafeAddr())).Elem()
+	}
+	return keyField, target, nil
+}
+
+// relatedKey returns the key of a previously loaded related entity (a pointer to a struct)
+func relatedKey(ctx context.Context, related reflect.Value) *datastore.Key {
+	return resolveKey(ctx, related.Interface(), related.Elem(), getDatastoreKind(related.Type().Elem()))
+}
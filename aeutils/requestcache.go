@@ -0,0 +1,78 @@
+package aeutils
+
+import (
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// Entities loaded during each request with a request cache, by request ID then encoded key
+	requestCaches   = map[string]map[string]interface{}{}
+	requestCachesMu sync.Mutex
+)
+
+// StartRequestCache enables a per-request, in memory cache of entities for ctx's request, so repeated Gets of the same entity
+// within the request (ie. the current account) come from memory rather than memcache or the datastore
+// Entities loaded by the Get helpers (including GetMulti and LoadRelated) are kept until ClearRequestCache is called,
+// which must be done once the request is finished (accounts.AuthenticatedFunc and AuthenticatedHandler do both)
+// Saving or deleting an entity through aeutils removes it from the cache, and transactions always read from the datastore
+//
+// 	aeutils.StartRequestCache(ctx)
+// 	defer aeutils.ClearRequestCache(ctx)
+func StartRequestCache(ctx context.Context) {
+	requestCachesMu.Lock()
+	defer requestCachesMu.Unlock()
+	if _, ok := requestCaches[appengine.RequestID(ctx)]; !ok {
+		requestCaches[appengine.RequestID(ctx)] = map[string]interface{}{}
+	}
+}
+
+// ClearRequestCache removes all entities cached for ctx's request, and disables the cache for it (see StartRequestCache)
+func ClearRequestCache(ctx context.Context) {
+	requestCachesMu.Lock()
+	defer requestCachesMu.Unlock()
+	delete(requestCaches, appengine.RequestID(ctx))
+}
+
+// requestCacheGet copies the entity cached for key in ctx's request into str, returning true if there was one
+func requestCacheGet(ctx context.Context, key *datastore.Key, str reflect.Value) bool {
+	if currentTransaction(ctx) != nil {
+		return false
+	}
+	requestCachesMu.Lock()
+	defer requestCachesMu.Unlock()
+	cache, ok := requestCaches[appengine.RequestID(ctx)]
+	if !ok {
+		return false
+	}
+	cached, ok := cache[key.Encode()]
+	if !ok || reflect.TypeOf(cached) != str.Type() {
+		return false
+	}
+	str.Set(reflect.ValueOf(cached))
+	return true
+}
+
+// requestCacheSet keeps a copy of str as the entity at key, if ctx's request has a cache
+func requestCacheSet(ctx context.Context, key *datastore.Key, str reflect.Value) {
+	requestCachesMu.Lock()
+	defer requestCachesMu.Unlock()
+	if cache, ok := requestCaches[appengine.RequestID(ctx)]; ok {
+		cache[key.Encode()] = str.Interface()
+	}
+}
+
+// requestCacheDelete removes keys from ctx's request cache, if it has one
+func requestCacheDelete(ctx context.Context, keys ...*datastore.Key) {
+	requestCachesMu.Lock()
+	defer requestCachesMu.Unlock()
+	if cache, ok := requestCaches[appengine.RequestID(ctx)]; ok {
+		for _, key := range keys {
+			delete(cache, key.Encode())
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package aeutils
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	// RetryAttempts is how many times aeutils tries a datastore Put, Get, Delete or query that fails with a transient error
+	// (a timeout, or the datastore being briefly unavailable) before returning the error. Set to 1 to disable retries
+	// Operations within a transaction aren't retried, as the whole transaction should be instead
+	RetryAttempts = 3
+	// RetryBackoff is how long to wait before the first retry, doubling before each one after that
+	RetryBackoff = 100 * time.Millisecond
+
+	// Datastore error codes that are worth retrying
+	transientCodes = []string{"TIMEOUT", "INTERNAL_ERROR", "BIGTABLE_ERROR", "TRY_ALTERNATE_BACKEND"}
+)
+
+// IsTransient returns true if err (or any error in an appengine.MultiError) is a datastore error that may succeed if
+// the operation is simply retried, ie. a timeout
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, err := range me {
+			if IsTransient(err) {
+				return true
+			}
+		}
+		return false
+	}
+	if appengine.IsTimeoutError(err) {
+		return true
+	}
+	msg := err.Error()
+	for _, code := range transientCodes {
+		if strings.Contains(msg, "datastore_v3: "+code) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry calls fn until it succeeds, returns an error that isn't transient, or RetryAttempts is reached
+// Each attempt gets it's own context with any RPC deadline applied (see RPCDeadline), which fn should use for its RPCs
+func withRetry(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	backoff := RetryBackoff
+	for attempt := 1; ; attempt++ {
+		rctx, cancel := rpcContext(ctx)
+		err = fn(rctx)
+		cancel()
+		if attempt >= RetryAttempts || !IsTransient(err) || currentTransaction(ctx) != nil {
+			return
+		}
+		log.Warningf(ctx, "[aeutils/retry] Attempt %d failed, retrying in %v: %v", attempt, backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,102 @@
+package aeutils
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// ErrEntityExists is returned by Save with CreateOnly when an entity is already stored at obj's key
+	ErrEntityExists = errors.New("Entity already exists")
+)
+
+// SaveOption changes how Save stores an object, see DryRun, SkipHooks, CreateOnly and UpdateOnly
+type SaveOption func(*saveOptions)
+
+type saveOptions struct {
+	dryRun     bool
+	skipHooks  bool
+	createOnly bool
+	updateOnly bool
+	key        *datastore.Key // Overrides the key obj would otherwise be stored at
+}
+
+// DryRun makes Save do everything short of storing obj: BeforeSave, defaults and timestamps, validation,
+// key resolution, encryption and an entity size check all run, so any error Save would return is returned
+// Nothing is written, so no ID is allocated (the returned key is incomplete if obj didn't already have one),
+// empty aeslug fields aren't generated, unique values aren't claimed, and AfterSave isn't called
+// Useful for "validate only" API requests, and for testing hooks without writes
+//
+// 	if _, err := aeutils.Save(ctx, post, aeutils.DryRun()); err != nil {
+// 		w.WriteHeader(aeutils.StatusCode(err))
+// 	}
+func DryRun() SaveOption {
+	return func(o *saveOptions) {
+		o.dryRun = true
+	}
+}
+
+// SkipHooks makes Save store obj without calling its BeforeSave or AfterSave methods (see BeforeSaver and AfterSaver)
+// Everything else, including defaults, timestamps and validation, still applies. Useful for import jobs and
+// migrations, which shouldn't send notifications or touch fields BeforeSave would
+func SkipHooks() SaveOption {
+	return func(o *saveOptions) {
+		o.skipHooks = true
+	}
+}
+
+// CreateOnly makes Save fail with ErrEntityExists (mapped to 409 by StatusCode) if an entity is already stored at obj's key,
+// rather than overwriting it, ie. for a PUT that must only create. The check and the write happen in one transaction
+func CreateOnly() SaveOption {
+	return func(o *saveOptions) {
+		o.createOnly = true
+	}
+}
+
+// UpdateOnly makes Save fail with datastore.ErrNoSuchEntity (mapped to 404 by StatusCode) unless an entity is already stored
+// at obj's key, rather than creating it. As it must have a key, no ID is allocated: without one, Save returns an *ErrNoKey
+// The check and the write happen in one transaction
+func UpdateOnly() SaveOption {
+	return func(o *saveOptions) {
+		o.updateOnly = true
+	}
+}
+
+// WithKey makes Save store obj at key, regardless of its Key or ID fields, ie. a key taken from a URL (see DecodeKey)
+func WithKey(key *datastore.Key) SaveOption {
+	return func(o *saveOptions) {
+		o.key = key
+	}
+}
+
+func newSaveOptions(opts []SaveOption) *saveOptions {
+	options := &saveOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// checkExists returns ErrEntityExists or datastore.ErrNoSuchEntity if whether an entity is stored at key doesn't match the
+// CreateOnly or UpdateOnly option. It should be called within the transaction that stores the entity
+func (o *saveOptions) checkExists(ctx context.Context, key *datastore.Key) error {
+	if !o.createOnly && !o.updateOnly {
+		return nil
+	}
+	exists := false
+	if !key.Incomplete() {
+		err := backend().Get(ctx, key, &datastore.PropertyList{})
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		exists = err == nil
+	}
+	if o.createOnly && exists {
+		return ErrEntityExists
+	} else if o.updateOnly && !exists {
+		return datastore.ErrNoSuchEntity
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// searchFields returns the indexes of all fields of t tagged `aesearch:"lower"`, which must be strings
+// Save stores a normalized copy of each of them in an extra indexed property (see SearchProperty)
+func searchFields(t reflect.Type) (fields []int, err error) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		mode := field.Tag.Get("aesearch")
+		if mode == "" {
+			continue
+		}
+		if mode != "lower" {
+			return nil, errors.New(fmt.Sprintf("aesearch field %v.%v has unknown mode %q", t, field.Name, mode))
+		}
+		if field.Type.Kind() != reflect.String {
+			return nil, errors.New(fmt.Sprintf("aesearch field %v.%v must be a string", t, field.Name))
+		}
+		fields = append(fields, i)
+	}
+	return
+}
+
+// SearchProperty returns the name of the property Save stores the normalized value of field in,
+// for fields tagged `aesearch:"lower"`. It can be used in Filter and Order like any other property
+//
+// 	aeutils.Query(&User{}).Order(aeutils.SearchProperty("Name"))
+func SearchProperty(field string) string {
+	return field + "_search"
+}
+
+// NormalizeSearch returns s as it's stored in the search property of a field tagged `aesearch:"lower"`:
+// lowercased, with leading and trailing whitespace removed
+func NormalizeSearch(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// Search returns a derivative query filtered to entities whose field (tagged `aesearch:"lower"`) matches value,
+// ignoring case and surrounding whitespace
+//
+// 	aeutils.Query(&User{}).Search("Email", " Bob@Example.com").First(ctx, user)
+func (qb *QueryBuilder) Search(field, value string) *QueryBuilder {
+	return qb.Filter(SearchProperty(field)+" =", NormalizeSearch(value))
+}
+
+// GetBySearch loads the first entity whose field (tagged `aesearch:"lower"`) matches value, ignoring case and surrounding
+// whitespace, into dst, which must be a pointer to a struct. Soft deleted entities are ignored (see Delete)
+// Returns datastore.ErrNoSuchEntity if no entity matches
+func GetBySearch(ctx context.Context, field, value string, dst interface{}) error {
+	_, val, str, err := pointerValue(dst)
+	if err != nil {
+		return err
+	}
+	keys, err := Query(dst).
+		Search(field, value).
+		Limit(1).
+		Keys(ctx)
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/GetBySearch] %v", err.Error())
+		return err
+	}
+	if len(keys) == 0 {
+		return datastore.ErrNoSuchEntity
+	}
+	return get(ctx, keys[0], val, str)
+}
@@ -0,0 +1,77 @@
+package aeutils
+
+import (
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// MaxEntitySize is the largest entity (in bytes) the datastore will store
+	MaxEntitySize = 1048572
+	// MaxIndexedSize is the longest string (in bytes) the datastore will store in an indexed property
+	MaxIndexedSize = 1500
+)
+
+// checkEntitySize returns an *EntityTooLargeError if entity (as passed to datastore.Put) can't be stored at key, either
+// because it's over MaxEntitySize or has an indexed string property over MaxIndexedSize. The datastore would reject it anyway,
+// but with an error that doesn't say which entity or property was the problem
+func checkEntitySize(dsKind string, key *datastore.Key, entity interface{}) error {
+	var props []datastore.Property
+	var err error
+	if pls, ok := entity.(datastore.PropertyLoadSaver); ok {
+		props, err = pls.Save()
+	} else {
+		props, err = datastore.SaveStruct(entity)
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range props {
+		if p.NoIndex {
+			continue
+		}
+		var size int
+		switch v := p.Value.(type) {
+		case string:
+			size = len(v)
+		case datastore.ByteString:
+			size = len(v)
+		}
+		if size > MaxIndexedSize {
+			return &EntityTooLargeError{Kind: dsKind, Property: p.Name, Size: size}
+		}
+	}
+	if size := entitySize(key, props); size > MaxEntitySize {
+		return &EntityTooLargeError{Kind: dsKind, Size: size}
+	}
+	return nil
+}
+
+// entitySize estimates the stored size of an entity with props, from its key and the names and values of each property
+func entitySize(key *datastore.Key, props []datastore.Property) int {
+	size := len(key.Encode())
+	for _, p := range props {
+		size += len(p.Name)
+		switch v := p.Value.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		case datastore.ByteString:
+			size += len(v)
+		case appengine.BlobKey:
+			size += len(v)
+		case *datastore.Key:
+			if v != nil {
+				size += len(v.Encode())
+			}
+		case appengine.GeoPoint:
+			size += 16
+		case time.Time, int64, float64, bool:
+			size += 8
+		}
+	}
+	return size
+}
@@ -0,0 +1,155 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// Kind of the sentinel entities used to reserve slugs
+	slugReservationKind = "AEUniqueSlug"
+	// How many candidates to try reserving before giving up
+	maxSlugAttempts = 10
+)
+
+var errSlugTaken = errors.New("Slug is already reserved")
+
+// slugReservation is stored to reserve a slug for a kind, keyed by "<kind>:<slug>"
+type slugReservation struct {
+	Kind     string
+	Slug     string
+	Reserved time.Time
+}
+
+// slugReservationKey returns the sentinel key for slug. Slugs in the 'Slug' field are keyed "<kind>:<slug>",
+// and those in other fields "<kind>.<field>:<slug>". Slugs scoped to an ancestor are reserved with a child of it
+func slugReservationKey(ctx context.Context, ancestor *datastore.Key, kind, field, slug string) *datastore.Key {
+	if field != "Slug" {
+		kind = kind + "." + field
+	}
+	return datastore.NewKey(ctx, slugReservationKind, kind+":"+slug, 0, ancestor)
+}
+
+// reserveSlug claims the first of base, base-2, base-3... that isn't in taken, by creating its sentinel in a transaction
+func reserveSlug(ctx context.Context, ancestor *datastore.Key, kind, field, base string, taken map[string]bool) (string, error) {
+	counter := 1
+	for attempt := 0; attempt < maxSlugAttempts; attempt++ {
+		slug := base
+		for taken[slug] {
+			counter = counter + 1
+			slug = fmt.Sprintf("%v-%d", base, counter)
+		}
+		key := slugReservationKey(ctx, ancestor, kind, field, slug)
+		err := backend().RunInTransaction(ctx, func(tc context.Context) error {
+			err := backend().Get(tc, key, &slugReservation{})
+			if err == nil {
+				return errSlugTaken
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			_, err = backend().Put(tc, key, &slugReservation{
+				Kind:     kind,
+				Slug:     slug,
+				Reserved: time.Now(),
+			})
+			return err
+		}, nil)
+		switch err {
+		case nil:
+			return slug, nil
+		case errSlugTaken, datastore.ErrConcurrentTransaction:
+			taken[slug] = true
+		default:
+			return "", err
+		}
+	}
+	return "", errors.New(fmt.Sprintf("Unable to reserve a unique slug for %v after %d attempts", base, maxSlugAttempts))
+}
+
+// ReleaseSlug removes the reservation GenerateUniqueSlug made for slug, so it can be generated again
+// Call it when an entity's slug changes, or the entity is permanently deleted
+func ReleaseSlug(ctx context.Context, kind, slug string) error {
+	return ReleaseSlugField(ctx, kind, "Slug", slug)
+}
+
+// ReleaseSlugField removes the reservation GenerateUniqueSlugField made for slug
+func ReleaseSlugField(ctx context.Context, kind, field, slug string) error {
+	return ReleaseSlugWithin(ctx, nil, kind, field, slug)
+}
+
+// ReleaseSlugWithin removes the reservation GenerateUniqueSlugWithin made for slug under ancestor
+func ReleaseSlugWithin(ctx context.Context, ancestor *datastore.Key, kind, field, slug string) error {
+	if ancestor != nil {
+		var err error
+		if ctx, err = appengine.Namespace(ctx, ancestor.Namespace()); err != nil {
+			return err
+		}
+	}
+	err := backend().Delete(ctx, slugReservationKey(ctx, ancestor, kind, field, slug))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// slugTag returns the source and target fields from an `aeslug` struct tag, if t has one, and whether it has `scope=parent`
+// Source defaults to 'Name', and target to the field the tag is on (so `aeslug:"true"` uses both defaults)
+func slugTag(t reflect.Type) (source, target string, parentScope, ok bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("aeslug")
+		if tag == "" {
+			continue
+		}
+		source, target = "Name", field.Name
+		for _, opt := range strings.Split(tag, ",") {
+			if parts := strings.SplitN(strings.TrimSpace(opt), "=", 2); len(parts) == 2 {
+				switch parts[0] {
+				case "source":
+					source = parts[1]
+				case "target":
+					target = parts[1]
+				case "scope":
+					parentScope = parts[1] == "parent"
+				}
+			}
+		}
+		return source, target, parentScope, true
+	}
+	return
+}
+
+// setSlug fills in an empty slug field for structs with an `aeslug` tag
+func setSlug(ctx context.Context, obj interface{}, str reflect.Value, dsKind string) error {
+	source, target, parentScope, ok := slugTag(str.Type())
+	if !ok {
+		return nil
+	}
+	targetField, sourceField := str.FieldByName(target), str.FieldByName(source)
+	if targetField.Kind() != reflect.String || sourceField.Kind() != reflect.String {
+		return errors.New(fmt.Sprintf("aeslug fields %v and %v of %v must both be strings", source, target, str.Type()))
+	}
+	if targetField.String() != "" {
+		return nil
+	}
+	if currentTransaction(ctx) != nil {
+		return errors.New(fmt.Sprintf("Can't generate a slug for %v within a transaction, set %v before saving", str.Type(), target))
+	}
+	var ancestor *datastore.Key
+	if parentScope {
+		ancestor = parentKey(ctx, obj, str)
+	}
+	slug := generateUniqueSlug(ctx, ancestor, dsKind, target, sourceField.String())
+	if slug == "" {
+		return errors.New(fmt.Sprintf("Unable to generate a unique slug for %v", str.Type()))
+	}
+	targetField.SetString(slug)
+	return nil
+}
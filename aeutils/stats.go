@@ -0,0 +1,85 @@
+package aeutils
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// KindStat is the datastore's statistics for a single kind, as of Timestamp
+// Statistics are only updated periodically (roughly daily), and aren't generated by the development server
+type KindStat struct {
+	Kind      string    `datastore:"kind_name" json:"kind"`
+	Count     int64     `datastore:"count" json:"count"`
+	Bytes     int64     `datastore:"bytes" json:"bytes"` // Total size of entities and their indexes
+	Timestamp time.Time `datastore:"timestamp" json:"timestamp"`
+}
+
+type kindStatsByBytes []KindStat
+
+func (s kindStatsByBytes) Len() int           { return len(s) }
+func (s kindStatsByBytes) Less(i, j int) bool { return s[i].Bytes > s[j].Bytes }
+func (s kindStatsByBytes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// KindStats returns the entity count and size of every kind across all namespaces (from the __Stat_Kind__ entities),
+// largest first. Kinds with no statistics yet are left out
+func KindStats(ctx context.Context) ([]KindStat, error) {
+	return kindStats(ctx, "__Stat_Kind__")
+}
+
+// NamespaceKindStats returns the entity count and size of every kind in namespace (from the __Stat_Ns_Kind__ entities),
+// largest first, ie. to see how much each tenant is storing
+func NamespaceKindStats(ctx context.Context, namespace string) ([]KindStat, error) {
+	nctx, err := appengine.Namespace(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return kindStats(nctx, "__Stat_Ns_Kind__")
+}
+
+func kindStats(ctx context.Context, statKind string) ([]KindStat, error) {
+	var stats []KindStat
+	start := time.Now()
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		stats = nil
+		_, err = datastore.NewQuery(statKind).GetAll(ctx, &stats)
+		return
+	})
+	trace(ctx, "GetAll", statKind, start, err)
+	// Statistics entities have many more properties than KindStat needs
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return nil, &QueryError{Kind: statKind, Op: "GetAll", Err: err}
+	}
+	sort.Sort(kindStatsByBytes(stats))
+	return stats, nil
+}
+
+// StatsHandler responds with a JSON array of KindStat for all namespaces, or for a single namespace if the
+// "namespace" query parameter is given (including empty, for the default namespace). As it exposes the size of
+// every kind, it should only be routed for admins, ie. with `login: admin` in app.yaml
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	var stats []KindStat
+	var err error
+	if namespace, ok := r.URL.Query()["namespace"]; ok {
+		stats, err = NamespaceKindStats(ctx, namespace[0])
+	} else {
+		stats, err = KindStats(ctx)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[aeutils/StatsHandler] %v", err.Error())
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+	if stats == nil {
+		stats = []KindStat{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(stats)
+}
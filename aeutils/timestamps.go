@@ -0,0 +1,30 @@
+package aeutils
+
+import (
+	"reflect"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// setTimestamps populates time.Time fields named 'CreatedAt' or tagged `aetime:"created"` if they're still zero,
+// and always sets fields named 'UpdatedAt' or tagged `aetime:"updated"` to now
+func setTimestamps(str reflect.Value) {
+	now := time.Now()
+	t := str.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type != timeType || field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("aetime")
+		switch {
+		case tag == "created" || (tag == "" && field.Name == "CreatedAt"):
+			if f := str.Field(i); f.Interface().(time.Time).IsZero() {
+				f.Set(reflect.ValueOf(now))
+			}
+		case tag == "updated" || (tag == "" && field.Name == "UpdatedAt"):
+			str.Field(i).Set(reflect.ValueOf(now))
+		}
+	}
+}
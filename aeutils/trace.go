@@ -0,0 +1,57 @@
+package aeutils
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	// DatastoreTracer, if set, is called after every datastore Put, Get, Delete and query aeutils runs
+	// (including the *Multi variants, but not reads served from a cache), so apps can see where datastore time goes
+	//
+	// 	aeutils.DatastoreTracer = aeutils.LogTracer{}
+	DatastoreTracer Tracer
+)
+
+// Operation describes a single datastore operation run by aeutils, see Tracer
+type Operation struct {
+	Name     string // Put, PutMulti, Get, GetMulti, Delete, DeleteMulti, GetAll, First, Keys or Count
+	Kind     string
+	Duration time.Duration // Including any retries (see RetryAttempts)
+	Err      error         // Error returned by the datastore, if any (datastore.Done isn't counted as one)
+}
+
+// Tracer is implemented by anything that wants to record datastore operations, ie. to collect metrics (see DatastoreTracer)
+type Tracer interface {
+	Trace(ctx context.Context, op *Operation)
+}
+
+// LogTracer is a Tracer that logs each operation at the info level (or error, if it failed)
+type LogTracer struct{}
+
+func (LogTracer) Trace(ctx context.Context, op *Operation) {
+	if op.Err != nil {
+		log.Errorf(ctx, "[aeutils/trace] %v %v took %v: %v", op.Name, op.Kind, op.Duration, op.Err.Error())
+	} else {
+		log.Infof(ctx, "[aeutils/trace] %v %v took %v", op.Name, op.Kind, op.Duration)
+	}
+}
+
+// trace passes an operation that started at start to DatastoreTracer, if it's set
+func trace(ctx context.Context, name, kind string, start time.Time, err error) {
+	if DatastoreTracer == nil {
+		return
+	}
+	if err == datastore.Done {
+		err = nil
+	}
+	DatastoreTracer.Trace(ctx, &Operation{
+		Name:     name,
+		Kind:     kind,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+}
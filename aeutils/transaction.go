@@ -0,0 +1,76 @@
+package aeutils
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// transaction tracks state for a transaction started by RunInTransaction
+type transaction struct {
+	afterCommit []func(ctx context.Context)
+	mu          sync.Mutex
+}
+
+// transactionKey is the context key RunInTransaction stores the current *transaction under
+type transactionKey struct{}
+
+// RunInTransaction runs f in a datastore transaction, like datastore.RunInTransaction, but in a way the rest of
+// aeutils understands. Within f, Save, SaveMulti, Get, Delete, etc. may be called with tc and will:
+//
+// * Go through the current Backend (ie. nds when UseNDS is set, so nds can keep its cache consistent)
+// * Set Key and ID fields immediately, but only call AfterSave and AfterDelete once the transaction has committed
+// * Check 'Version' fields as part of this transaction rather than starting their own
+//
+// If opts is nil, the transaction is cross-group (XG), so entities of different entity groups can be saved together
+// Note that queries (including GetBySlug) within a transaction must be ancestor queries
+func RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	if opts == nil {
+		opts = &datastore.TransactionOptions{XG: true}
+	}
+	var tx *transaction
+	err := runInTransaction(ctx, func(tc context.Context) error {
+		// f may be called multiple times if the transaction is retried, so always start fresh
+		tx = &transaction{}
+		return f(context.WithValue(tc, transactionKey{}, tx))
+	}, opts)
+	if err != nil {
+		return err
+	}
+	for _, fn := range tx.afterCommit {
+		fn(ctx)
+	}
+	return nil
+}
+
+// currentTransaction returns the transaction ctx (or the context it's derived from) is running in, or nil if it
+// wasn't started by RunInTransaction
+func currentTransaction(ctx context.Context) *transaction {
+	tx, _ := ctx.Value(transactionKey{}).(*transaction)
+	return tx
+}
+
+// afterCommit calls fn once the current transaction has committed, or immediately if ctx is not in a transaction
+func afterCommit(ctx context.Context, fn func(ctx context.Context)) {
+	if tx := currentTransaction(ctx); tx != nil {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		tx.afterCommit = append(tx.afterCommit, fn)
+		return
+	}
+	fn(ctx)
+}
+
+// ensureTransaction runs f within the current transaction if there is one, otherwise in a new cross-group transaction
+func ensureTransaction(ctx context.Context, f func(tc context.Context) error) error {
+	if currentTransaction(ctx) != nil {
+		return f(ctx)
+	}
+	return RunInTransaction(ctx, f, nil)
+}
+
+// runInTransaction runs f in a transaction of the current Backend
+func runInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	return backend().RunInTransaction(ctx, f, opts)
+}
@@ -0,0 +1,267 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Kind of the sentinel entities used to enforce unique constraints
+const uniqueReservationKind = "AEUnique"
+
+// UniqueError is returned when a value for a unique field is already claimed by another entity
+type UniqueError struct {
+	Kind  string
+	Field string
+	Value string
+}
+
+func (e *UniqueError) Error() string {
+	return fmt.Sprintf("%v with %v %q already exists", e.Kind, e.Field, e.Value)
+}
+
+// uniqueReservation is stored to claim a value for a kind and field, keyed by "<kind>.<field>:<value>", or
+// "<kind>.<field>@<scope>:<value>" for fields that are only unique within a scope
+type uniqueReservation struct {
+	Kind    string
+	Field   string
+	Scope   string
+	Value   string
+	Owner   *datastore.Key // Entity that owns this value, nil if reserved with Unique
+	Claimed time.Time
+}
+
+func uniqueReservationKey(ctx context.Context, kind, field, scope, value string) *datastore.Key {
+	name := kind + "." + field
+	if scope != "" {
+		name += "@" + scope
+	}
+	return datastore.NewKey(ctx, uniqueReservationKind, name+":"+value, 0, nil)
+}
+
+// Unique reserves value for field within kind, returning a *UniqueError if it's already been reserved
+// or claimed by an entity saved with an `aeunique` tag on that field. Reservations are kept until ReleaseUnique is called
+// Useful for enforcing uniqueness of values that aren't saved through aeutils
+func Unique(ctx context.Context, kind, field string, value interface{}) error {
+	v, ok := uniqueValue(reflect.ValueOf(value))
+	if !ok {
+		return nil
+	}
+	return ensureTransaction(ctx, func(tc context.Context) error {
+		_, err := claimUnique(tc, kind, field, "", v, nil)
+		return err
+	})
+}
+
+// ReleaseUnique removes the reservation made with Unique for value, so it can be used again
+func ReleaseUnique(ctx context.Context, kind, field string, value interface{}) error {
+	v, ok := uniqueValue(reflect.ValueOf(value))
+	if !ok {
+		return nil
+	}
+	return ensureTransaction(ctx, func(tc context.Context) error {
+		return releaseUnique(tc, kind, field, "", v, nil)
+	})
+}
+
+// uniqueField is a field tagged `aeunique:"true"`, or `aeunique:"scope=OtherField"` if it only needs to be unique
+// among entities with the same value of OtherField
+type uniqueField struct {
+	name  string
+	scope string
+}
+
+// uniqueFields returns all fields of t tagged `aeunique`
+func uniqueFields(t reflect.Type) (fields []uniqueField) {
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("aeunique")
+		if tag == "true" {
+			fields = append(fields, uniqueField{name: t.Field(i).Name})
+		} else if strings.HasPrefix(tag, "scope=") {
+			fields = append(fields, uniqueField{name: t.Field(i).Name, scope: strings.TrimPrefix(tag, "scope=")})
+		}
+	}
+	return
+}
+
+// values returns the scope (if any) and value of f in str, or false if the value is a zero value
+// Keys are scoped by their encoded form, anything else as uniqueValue returns it
+func (f uniqueField) values(str reflect.Value) (scope, value string, ok bool) {
+	if value, ok = uniqueValue(str.FieldByName(f.name)); !ok || f.scope == "" {
+		return "", value, ok
+	}
+	// A missing scope field is reported by RegisterModel, and scopes nothing
+	scopeField := str.FieldByName(f.scope)
+	if scopeField.IsValid() && scopeField.Type() == keyType {
+		if key := scopeField.Interface().(*datastore.Key); key != nil {
+			scope = key.Encode()
+		}
+	} else {
+		scope, _ = uniqueValue(scopeField)
+	}
+	return scope, value, true
+}
+
+// uniqueValue returns the string form of a unique field's value, or false if it's a zero value
+// Zero values (empty strings, 0) aren't constrained, so optional fields can be left blank
+func uniqueValue(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), v.String() != ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), v.Int() != 0
+	case reflect.Invalid:
+		return "", false
+	default:
+		if reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+			return "", false
+		}
+		return fmt.Sprint(v.Interface()), true
+	}
+}
+
+// claimUnique claims value (within scope, if it's set) for owner, failing if anyone else has it. Returns the key of the
+// reservation if a new one was stored (nil if owner already held it). Must be called within a transaction
+func claimUnique(tc context.Context, kind, field, scope, value string, owner *datastore.Key) (*datastore.Key, error) {
+	key := uniqueReservationKey(tc, kind, field, scope, value)
+	existing := &uniqueReservation{}
+	err := backend().Get(tc, key, existing)
+	if err == nil {
+		if owner != nil && existing.Owner != nil && existing.Owner.Equal(owner) {
+			return nil, nil
+		}
+		return nil, &UniqueError{Kind: kind, Field: field, Value: value}
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if _, err = backend().Put(tc, key, &uniqueReservation{
+		Kind:    kind,
+		Field:   field,
+		Scope:   scope,
+		Value:   value,
+		Owner:   owner,
+		Claimed: time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// releaseUnique removes the claim on value (within scope), if owner holds it. Must be called within a transaction
+func releaseUnique(tc context.Context, kind, field, scope, value string, owner *datastore.Key) error {
+	key := uniqueReservationKey(tc, kind, field, scope, value)
+	existing := &uniqueReservation{}
+	err := backend().Get(tc, key, existing)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if (owner == nil && existing.Owner != nil) || (owner != nil && (existing.Owner == nil || !existing.Owner.Equal(owner))) {
+		return nil
+	}
+	return backend().Delete(tc, key)
+}
+
+// claimUniques claims the values of all unique fields of str for key, in a single transaction.
+// Returns the keys of the reservations it stored, so they can be dropped with dropClaims if the entity isn't saved
+func claimUniques(ctx context.Context, key *datastore.Key, str reflect.Value, fields []uniqueField) (claimed []*datastore.Key, err error) {
+	if key.Incomplete() {
+		return nil, errors.New(fmt.Sprintf("Unique fields of %v require a complete key", str.Type()))
+	}
+	err = ensureTransaction(ctx, func(tc context.Context) error {
+		// Reset on each attempt, in case the transaction is retried
+		claimed = nil
+		for _, field := range fields {
+			if scope, value, ok := field.values(str); ok {
+				reservation, err := claimUnique(tc, key.Kind(), field.name, scope, value, key)
+				if err != nil {
+					return err
+				}
+				if reservation != nil {
+					claimed = append(claimed, reservation)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// dropClaims deletes reservations stored by claimUniques for entities that then failed to save
+func dropClaims(ctx context.Context, claimed []*datastore.Key) {
+	if len(claimed) == 0 {
+		return
+	}
+	if err := backend().DeleteMulti(ctx, claimed); err != nil {
+		log.Errorf(ctx, "[aeutils/unique] Failed to release %d unique values: %v", len(claimed), err.Error())
+	}
+}
+
+// releaseUniques releases the values of all unique fields of str held by key, in a single transaction
+func releaseUniques(ctx context.Context, key *datastore.Key, str reflect.Value, fields []uniqueField) error {
+	return ensureTransaction(ctx, func(tc context.Context) error {
+		for _, field := range fields {
+			if scope, value, ok := field.values(str); ok {
+				if err := releaseUnique(tc, key.Kind(), field.name, scope, value, key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// putUnique stores obj at key within a transaction (or the current one, see RunInTransaction), claiming the values
+// of its unique fields and releasing any previous values it held. Fails with a *UniqueError if a value is taken
+func putUnique(ctx context.Context, key *datastore.Key, obj interface{}, str reflect.Value, fields []uniqueField) (*datastore.Key, error) {
+	if key.Incomplete() {
+		return nil, errors.New(fmt.Sprintf("Unique fields of %v require a complete key", str.Type()))
+	}
+	var newKey *datastore.Key
+	err := ensureTransaction(ctx, func(tc context.Context) (err error) {
+		stored := reflect.New(str.Type())
+		err = backend().Get(tc, key, stored.Interface())
+		_, mismatch := err.(*datastore.ErrFieldMismatch)
+		exists := err == nil || mismatch
+		if !exists && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		for _, field := range fields {
+			scope, value, ok := field.values(str)
+			if ok {
+				if _, err = claimUnique(tc, key.Kind(), field.name, scope, value, key); err != nil {
+					return err
+				}
+			}
+			if !exists {
+				continue
+			}
+			if oldScope, old, ok := field.values(stored.Elem()); ok && (old != value || oldScope != scope) {
+				if err = releaseUnique(tc, key.Kind(), field.name, oldScope, old, key); err != nil {
+					return err
+				}
+			}
+		}
+		if version, ok := versionField(str); ok {
+			newKey, err = putVersioned(tc, key, obj, str, version)
+		} else {
+			newKey, err = backend().Put(tc, key, obj)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newKey, nil
+}
@@ -0,0 +1,156 @@
+package aeutils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// ValidationError is returned by Save (and Validate) when obj fails validation, with a message for each invalid field
+type ValidationError struct {
+	Kind   string            `json:"kind"`
+	Fields map[string]string `json:"fields"` // Field name to what's wrong with it
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = name + " " + e.Fields[name]
+	}
+	return fmt.Sprintf("Invalid %v: %v", e.Kind, strings.Join(messages, ", "))
+}
+
+// Add records a message for field, keeping the first if it already has one
+// Useful for building a ValidationError within a Validate method
+func (e *ValidationError) Add(field, message string) {
+	if e.Fields == nil {
+		e.Fields = map[string]string{}
+	}
+	if _, exists := e.Fields[field]; !exists {
+		e.Fields[field] = message
+	}
+}
+
+// Response returns a 422 utils.ApiResponse for e, with the invalid fields as its Data
+func (e *ValidationError) Response() *utils.ApiResponse {
+	return &utils.ApiResponse{
+		Code:    422, // Unprocessable Entity
+		Message: e.Error(),
+		Data:    e.Fields,
+	}
+}
+
+// Validate checks obj (a struct or pointer to struct) the same way Save does before storing it. Struct tags are checked first:
+//
+// * `aevalidate:"required"` fields must not be a zero value
+// * `aevalidate:"max=255"` and `aevalidate:"min=1"` limit the length of strings and slices, and the value of numbers
+// * `aevalidate:"email"` strings must be empty or look like an email address
+//
+// Rules are combined with commas, ie `aevalidate:"required,max=255,email"`. Then a 'Validate' method (see Validator) is called
+// Returns a *ValidationError listing every invalid field, or nil if obj is valid
+func Validate(ctx context.Context, obj interface{}) error {
+	kind, _, str, err := structValue(obj)
+	if err != nil {
+		return err
+	}
+	verr := &ValidationError{Kind: getDatastoreKind(kind)}
+	for i := 0; i < kind.NumField(); i++ {
+		field := kind.Field(i)
+		tag := field.Tag.Get("aevalidate")
+		if tag == "" {
+			continue
+		}
+		for _, rule := range strings.Split(tag, ",") {
+			message, err := checkRule(str.Field(i), rule)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%v.%v: %v", kind, field.Name, err.Error()))
+			}
+			if message != "" {
+				verr.Add(field.Name, message)
+			}
+		}
+	}
+	if v, ok := obj.(Validator); ok {
+		switch err := v.Validate(ctx).(type) {
+		case nil:
+		case *ValidationError:
+			for field, message := range err.Fields {
+				verr.Add(field, message)
+			}
+		default:
+			return err
+		}
+	} else if err := hookMismatch(obj, "Validate"); err != nil {
+		log.Warningf(ctx, "[aeutils/Validate] %v", err.Error())
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// checkRule returns a message if v fails rule, or an error if rule isn't valid for v
+func checkRule(v reflect.Value, rule string) (message string, err error) {
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+	switch name {
+	case "required":
+		if reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+			return "is required", nil
+		}
+	case "email":
+		if v.Kind() != reflect.String {
+			return "", errors.New("aevalidate email rule requires a string field")
+		}
+		if v.String() != "" && !emailPattern.MatchString(v.String()) {
+			return "must be a valid email address", nil
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("aevalidate %v rule requires a number, got %q", name, arg))
+		}
+		var size float64
+		unit := ""
+		switch v.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map:
+			size, unit = float64(v.Len()), " characters"
+			if v.Kind() != reflect.String {
+				unit = " items"
+			}
+		case reflect.Float32, reflect.Float64:
+			size = v.Float()
+		default:
+			if !isInt(v.Kind()) {
+				return "", errors.New(fmt.Sprintf("aevalidate %v rule not supported for %v", name, v.Type()))
+			}
+			size = float64(v.Int())
+		}
+		if name == "min" && size < limit {
+			return fmt.Sprintf("must be at least %v%v", arg, unit), nil
+		} else if name == "max" && size > limit {
+			return fmt.Sprintf("must be at most %v%v", arg, unit), nil
+		}
+	default:
+		return "", errors.New(fmt.Sprintf("unknown aevalidate rule %q", rule))
+	}
+	return "", nil
+}
@@ -0,0 +1,59 @@
+package aeutils
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ConflictError is returned by Save when an object's 'Version' field doesn't match the version currently stored,
+// meaning the entity was changed by someone else since obj was loaded
+type ConflictError struct {
+	Key     *datastore.Key
+	Version int64 // Version of the object being saved
+	Stored  int64 // Version currently in the datastore
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Conflict saving %v: version %d does not match stored version %d", e.Key, e.Version, e.Stored)
+}
+
+// versionField returns the 'Version' field of str, if it exists and is an integer
+func versionField(str reflect.Value) (field reflect.Value, ok bool) {
+	field = str.FieldByName("Version")
+	return field, field.IsValid() && isInt(field.Kind())
+}
+
+// putVersioned stores obj at key within a transaction (or the current one, see RunInTransaction), after checking the stored entity (if any) has the same
+// version as obj. On success the version field is incremented, on any failure it's left as it was
+func putVersioned(ctx context.Context, key *datastore.Key, obj interface{}, str, version reflect.Value) (*datastore.Key, error) {
+	current := version.Int()
+	err := ensureTransaction(ctx, func(tc context.Context) (err error) {
+		if !key.Incomplete() {
+			stored := reflect.New(str.Type())
+			err = backend().Get(tc, key, stored.Interface())
+			if _, ok := err.(*datastore.ErrFieldMismatch); err == nil || ok {
+				if storedVersion := stored.Elem().FieldByName("Version").Int(); storedVersion != current {
+					return &ConflictError{Key: key, Version: current, Stored: storedVersion}
+				}
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		version.SetInt(current + 1)
+		newKey, err := backend().Put(tc, key, obj)
+		if err != nil {
+			version.SetInt(current)
+			return err
+		}
+		key = newKey
+		return nil
+	})
+	if err != nil {
+		version.SetInt(current)
+		return nil, err
+	}
+	return key, nil
+}
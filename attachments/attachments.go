@@ -0,0 +1,234 @@
+// Package attachments stores files for any entity in Google Cloud Storage, recording an Attachment entity (a child
+// of the entity it belongs to) for each, and hands out signed URLs to serve or download them without going through the app.
+//
+// 	att, err := attachments.Upload(ctx, post.Key, "report.pdf", "application/pdf", file)
+// 	link, err := att.DownloadURL(ctx, time.Hour)
+//
+// Files can also be uploaded straight from the browser to an UploadURL, then recorded with SaveUploads.
+// Call Cascade for each kind with attachments, so deleting an entity removes its files as well
+package attachments
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/gcs"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	// Bucket is the Cloud Storage bucket attachments are stored in. If empty, the app's default bucket is used
+	Bucket = ""
+	// ObjectPrefix is prepended to the name of every object stored, to keep attachments apart from anything else in Bucket
+	ObjectPrefix = "attachments"
+	// MaxBytes limits the size of each file uploaded to an UploadURL
+	MaxBytes int64 = 32 << 20
+
+	// Kinds Cascade has registered hooks for, so they're only registered once per kind
+	cascadeKinds   = map[string]bool{}
+	cascadeKindsMu sync.Mutex
+)
+
+// Attachment records a file stored in Cloud Storage for an entity. It's stored as a child of that entity,
+// in the same namespace, with the kind EntityAttachment (so it doesn't clash with accounts.Attachment)
+type Attachment struct {
+	Key         *datastore.Key `json:"-" datastore:"-" aekind:"EntityAttachment"`
+	ID          int64          `json:"id"`
+	Parent      *datastore.Key `json:"-"` // Entity the file is attached to
+	Created     time.Time      `json:"created" aetime:"created"`
+	Filename    string         `json:"filename"`
+	ContentType string         `json:"contentType"`
+	Size        int64          `json:"size"`
+	Bucket      string         `json:"-"`
+	Object      string         `json:"-"` // Name of the Cloud Storage object within Bucket
+}
+
+// Upload stores the contents of r in Cloud Storage and records an Attachment for it, linked to parent
+// If the attachment can't be recorded, the stored file is removed again
+func Upload(ctx context.Context, parent *datastore.Key, filename, contentType string, r io.Reader) (*Attachment, error) {
+	bucket, err := gcs.Bucket(ctx, Bucket)
+	if err != nil {
+		log.Errorf(ctx, "[attachments/Upload] %v", err.Error())
+		return nil, err
+	}
+	att := &Attachment{
+		Parent:      parent,
+		Filename:    filename,
+		ContentType: contentType,
+		Bucket:      bucket,
+		Object:      objectName(parent),
+	}
+	w := gcs.NewWriter(ctx, att.Bucket, att.Object, contentType)
+	if att.Size, err = io.Copy(w, r); err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Errorf(ctx, "[attachments/Upload] %v", err.Error())
+		return nil, err
+	}
+	if _, err = aeutils.Save(ctx, att); err != nil {
+		log.Errorf(ctx, "[attachments/Upload] %v", err.Error())
+		if delErr := gcs.Delete(ctx, att.Bucket, att.Object); delErr != nil {
+			log.Warningf(ctx, "[attachments/Upload] Error removing stored file: %v", delErr.Error())
+		}
+		return nil, err
+	}
+	return att, nil
+}
+
+// UploadURL returns a one-time URL the client should POST multipart form files to. App Engine streams each file
+// to Bucket, then calls successPath with the upload, which should record them with SaveUploads
+func UploadURL(ctx context.Context, successPath string) (*url.URL, error) {
+	bucket, err := gcs.Bucket(ctx, Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return blobstore.UploadURL(ctx, successPath, &blobstore.UploadURLOptions{
+		MaxUploadBytesPerBlob: MaxBytes,
+		StorageBucket:         bucket + "/" + ObjectPrefix,
+	})
+}
+
+// SaveUploads records an Attachment linked to parent for each file in req, an upload callback (see UploadURL)
+// If any can't be recorded, none of the uploaded files are kept
+func SaveUploads(ctx context.Context, req *http.Request, parent *datastore.Key) ([]*Attachment, error) {
+	blobs, _, err := blobstore.ParseUpload(req)
+	if err != nil {
+		return nil, err
+	}
+	var attachments []*Attachment
+	for _, infos := range blobs {
+		for _, info := range infos {
+			// Uploads to Cloud Storage are named "/gs/<bucket>/<object>"
+			parts := strings.SplitN(strings.TrimPrefix(info.ObjectName, "/gs/"), "/", 2)
+			if len(parts) != 2 {
+				err = fmt.Errorf("[attachments] %v wasn't uploaded to Cloud Storage", info.Filename)
+				break
+			}
+			attachments = append(attachments, &Attachment{
+				Parent:      parent,
+				Filename:    info.Filename,
+				ContentType: info.ContentType,
+				Size:        info.Size,
+				Bucket:      parts[0],
+				Object:      parts[1],
+			})
+		}
+	}
+	for _, att := range attachments {
+		if err != nil {
+			break
+		}
+		_, err = aeutils.Save(ctx, att)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[attachments/SaveUploads] %v", err.Error())
+		for _, att := range attachments {
+			if att.Key != nil {
+				aeutils.HardDelete(ctx, att)
+			}
+		}
+		for _, infos := range blobs {
+			for _, info := range infos {
+				if delErr := blobstore.Delete(ctx, info.BlobKey); delErr != nil {
+					log.Warningf(ctx, "[attachments/SaveUploads] Error removing uploaded file: %v", delErr.Error())
+				}
+			}
+		}
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// List returns the attachments linked to parent, oldest first
+func List(ctx context.Context, parent *datastore.Key) ([]*Attachment, error) {
+	var attachments []*Attachment
+	_, err := aeutils.Query(&Attachment{Parent: parent}).Order("Created").GetAll(ctx, &attachments)
+	return attachments, err
+}
+
+// URL returns a signed URL that serves the file (with its ContentType) to anyone who has it, until it expires
+func (att *Attachment) URL(ctx context.Context, expires time.Duration) (string, error) {
+	return gcs.SignedURL(ctx, att.Bucket, att.Object, time.Now().Add(expires), nil)
+}
+
+// DownloadURL is like URL, but the file is sent as a download, saved under its original Filename
+func (att *Attachment) DownloadURL(ctx context.Context, expires time.Duration) (string, error) {
+	disposition := "attachment"
+	if att.Filename != "" {
+		disposition = fmt.Sprintf("attachment; filename=%q", att.Filename)
+	}
+	return gcs.SignedURL(ctx, att.Bucket, att.Object, time.Now().Add(expires), url.Values{
+		"response-content-disposition": {disposition},
+	})
+}
+
+// Delete removes the file of att from Cloud Storage, along with its Attachment
+func Delete(ctx context.Context, att *Attachment) error {
+	if err := gcs.Delete(ctx, att.Bucket, att.Object); err != nil {
+		log.Errorf(ctx, "[attachments/Delete] %v", err.Error())
+		return err
+	}
+	return aeutils.HardDelete(ctx, att)
+}
+
+// DeleteAll removes every attachment linked to parent. Every attachment is tried, even if one fails,
+// and the first error is returned
+func DeleteAll(ctx context.Context, parent *datastore.Key) error {
+	attachments, err := List(ctx, parent)
+	if err != nil {
+		return err
+	}
+	for _, att := range attachments {
+		if delErr := Delete(ctx, att); delErr != nil && err == nil {
+			err = delErr
+		}
+	}
+	return err
+}
+
+// Cascade registers hooks so that once an entity of any of kinds (structs, or pointers to structs) is deleted
+// through aeutils, its attachments are deleted as well. Soft deleted entities keep their attachments,
+// so they're still there if the entity is restored
+//
+// 	func init() {
+// 		attachments.Cascade(&Post{}, &Comment{})
+// 	}
+func Cascade(kinds ...interface{}) {
+	cascadeKindsMu.Lock()
+	defer cascadeKindsMu.Unlock()
+	for _, kind := range kinds {
+		name := aeutils.KindOf(kind)
+		if cascadeKinds[name] {
+			continue
+		}
+		cascadeKinds[name] = true
+		aeutils.OnAfterDelete(name, cascadeDelete)
+	}
+}
+
+// func cascadeDelete deletes the attachments of key, if the entity has actually been removed rather than soft deleted
+func cascadeDelete(ctx context.Context, obj interface{}, key *datastore.Key) {
+	exists, err := aeutils.ExistsKey(ctx, key)
+	if err == nil && !exists {
+		err = DeleteAll(ctx, key)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[attachments/Cascade] Error deleting attachments of %v: %v", key, err.Error())
+	}
+}
+
+// func objectName returns a new, unique name for an object attached to parent
+func objectName(parent *datastore.Key) string {
+	return fmt.Sprintf("%v/%v/%d", ObjectPrefix, aeutils.EncodeKey(parent), time.Now().UnixNano())
+}
@@ -0,0 +1,61 @@
+package attachments_test
+
+import (
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/attachments"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+type MySuite struct{}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestList(c *C) {
+	parent := datastore.NewKey(ctx, "Post", "", 2, nil)
+	other := datastore.NewKey(ctx, "Post", "", 3, nil)
+	for i, key := range []*datastore.Key{parent, parent, other} {
+		att := &attachments.Attachment{
+			Parent:   key,
+			Filename: []string{"a.txt", "b.txt", "c.txt"}[i],
+			Bucket:   "bucket",
+			Object:   "attachments/test",
+		}
+		_, err := aeutils.Save(ctx, att)
+		c.Assert(err, IsNil)
+		c.Assert(att.Key.Parent().Equal(key), Equals, true)
+		c.Assert(att.Key.Kind(), Equals, "EntityAttachment")
+	}
+	atts, err := attachments.List(ctx, parent)
+	c.Assert(err, IsNil)
+	c.Assert(atts, HasLen, 2)
+	c.Assert(atts[0].Filename, Equals, "a.txt")
+	c.Assert(atts[1].Filename, Equals, "b.txt")
+	c.Assert(atts[0].Parent.Equal(parent), Equals, true)
+}
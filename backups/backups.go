@@ -0,0 +1,256 @@
+// Package backups exports registered kinds to Google Cloud Storage on a schedule, from the default namespace and
+// optionally from the namespace of every account, and removes exports once they're older than Retention.
+//
+// Register the kinds to export at init time, and mount Handler for App Engine cron to call:
+//
+// 	func init() {
+// 		backups.Register(&Plan{})
+// 		backups.RegisterAccounts(&Post{}, &Comment{})
+// 		http.HandleFunc("/_cron/backups", backups.Handler)
+// 	}
+//
+// With a cron.yaml entry such as:
+//
+// 	- description: nightly backup
+// 	  url: /_cron/backups
+// 	  schedule: every day 03:00
+//
+// Each kind is exported by its own task, to <Prefix>/<time>/<Kind>.<format> for the default namespace,
+// and <Prefix>/<time>/accounts/<slug>/<Kind>.<format> for each account
+package backups
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/accounts"
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/gcs"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+var (
+	// Bucket is the Cloud Storage bucket exports are written to. If empty, the app's default bucket is used
+	Bucket = ""
+	// Prefix is prepended to the name of every export, and only objects under it are removed by Prune
+	Prefix = "backups"
+	// Format is the format kinds are exported in (see aeutils.ExportKind)
+	Format = aeutils.JSON
+	// Retention is how long exports are kept before Prune removes them. Zero keeps them forever
+	Retention = 30 * 24 * time.Hour
+	// Queue is the task queue exports run in (the default queue if empty)
+	Queue = ""
+
+	// Kinds exported from the default namespace, and from each account's, by name
+	kinds        = map[string]interface{}{}
+	accountKinds = map[string]interface{}{}
+	kindsMu      sync.RWMutex
+
+	exportTask = delay.Func("backups-export", exportKind)
+
+	extensions = map[aeutils.Format]string{
+		aeutils.JSON: "json",
+		aeutils.CSV:  "csv",
+		aeutils.Avro: "avro",
+	}
+	contentTypes = map[aeutils.Format]string{
+		aeutils.JSON: "application/x-ndjson",
+		aeutils.CSV:  "text/csv",
+		aeutils.Avro: "avro/binary",
+	}
+)
+
+func init() {
+	// Lets admins run a backup outside of its schedule, with a POST to the accounts admin route /admin/jobs/backups
+	accounts.RegisterAdminJob("backups", func(ctx context.Context) (interface{}, error) {
+		scheduled, err := Schedule(ctx)
+		return map[string]interface{}{"scheduled": scheduled}, err
+	})
+}
+
+// Register adds kinds (structs, or pointers to structs) to be exported from the default namespace
+// Like delay.Func, it must be called at init time, so every instance can run the exports
+func Register(objs ...interface{}) {
+	register(kinds, objs)
+}
+
+// RegisterAccounts adds kinds (structs, or pointers to structs) to be exported from the namespace of every account
+// (see accounts.NamespaceFor), each to its own file
+func RegisterAccounts(objs ...interface{}) {
+	register(accountKinds, objs)
+}
+
+func register(registry map[string]interface{}, objs []interface{}) {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	for _, obj := range objs {
+		registry[aeutils.KindOf(obj)] = obj
+	}
+}
+
+// Handler schedules an export of every registered kind (see Schedule), then removes expired exports (see Prune)
+// It only runs for App Engine cron, or admins of the app (see accounts.CronOnly)
+func Handler(rw http.ResponseWriter, req *http.Request) {
+	accounts.CronOnly(backup)(rw, req)
+}
+
+func backup(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	scheduled, err := Schedule(ctx)
+	if err != nil {
+		accounts.RespondTo(rw, req, accounts.ErrorResponse(err))
+		return
+	}
+	pruned, err := Prune(ctx)
+	if err != nil {
+		accounts.RespondTo(rw, req, accounts.ErrorResponse(err))
+		return
+	}
+	accounts.RespondTo(rw, req, &utils.ApiResponse{
+		Code: 200,
+		Data: map[string]interface{}{
+			"scheduled": scheduled,
+			"pruned":    pruned,
+		},
+	})
+}
+
+// Schedule adds a task to export each registered kind, from the default namespace and each account's,
+// and returns how many were added. Every export is under a folder named for the time it was scheduled
+func Schedule(ctx context.Context) (int, error) {
+	folder := fmt.Sprintf("%v/%v", Prefix, time.Now().UTC().Format("20060102T150405Z"))
+	kindsMu.RLock()
+	defer kindsMu.RUnlock()
+	var slugs []string
+	if len(accountKinds) > 0 {
+		keys, err := aeutils.Query(&accounts.Account{}).Keys(ctx)
+		if err != nil {
+			log.Errorf(ctx, "[backups/Schedule] %v", err.Error())
+			return 0, err
+		}
+		for _, key := range keys {
+			slugs = append(slugs, key.StringID())
+		}
+	}
+	var tasks []*taskqueue.Task
+	for kind := range kinds {
+		task, err := exportTask.Task("", kind, exportName(folder, "", kind))
+		if err != nil {
+			return 0, err
+		}
+		tasks = append(tasks, task)
+	}
+	for _, slug := range slugs {
+		for kind := range accountKinds {
+			task, err := exportTask.Task(slug, kind, exportName(folder, slug, kind))
+			if err != nil {
+				return 0, err
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	// The task queue takes at most 100 tasks per call
+	for start := 0; start < len(tasks); start += 100 {
+		end := start + 100
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		if _, err := taskqueue.AddMulti(ctx, tasks[start:end], Queue); err != nil {
+			log.Errorf(ctx, "[backups/Schedule] %v", err.Error())
+			return start, err
+		}
+	}
+	return len(tasks), nil
+}
+
+// Export writes every entity of the kind of obj (a struct or pointer to struct), in ctx's namespace, to object in Bucket
+// in Format, returning the number exported. The object is only created if every entity is written
+// Entities are loaded with aeutils.Iterate, so a kind that takes longer than aeutils.IterateDeadline to export fails.
+// Exports run in tasks, which may run for 10 minutes, so apps with large kinds can raise it accordingly
+func Export(ctx context.Context, obj interface{}, object string) (int, error) {
+	bucket, err := gcs.Bucket(ctx, Bucket)
+	if err != nil {
+		return 0, err
+	}
+	w := gcs.NewWriter(ctx, bucket, object, contentTypes[Format])
+	n, err := aeutils.ExportKind(ctx, obj, w, Format)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Errorf(ctx, "[backups/Export] %v", err.Error())
+	}
+	return n, err
+}
+
+// Prune removes exports older than Retention, returning how many objects were removed
+func Prune(ctx context.Context) (int, error) {
+	if Retention <= 0 {
+		return 0, nil
+	}
+	bucket, err := gcs.Bucket(ctx, Bucket)
+	if err != nil {
+		return 0, err
+	}
+	objects, err := gcs.List(ctx, bucket, Prefix+"/")
+	if err != nil {
+		log.Errorf(ctx, "[backups/Prune] %v", err.Error())
+		return 0, err
+	}
+	cutoff := time.Now().Add(-Retention)
+	pruned := 0
+	for _, object := range objects {
+		if !object.Updated.Before(cutoff) {
+			continue
+		}
+		if err = gcs.Delete(ctx, bucket, object.Name); err != nil {
+			log.Errorf(ctx, "[backups/Prune] %v", err.Error())
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// func exportKind exports kind from the namespace of the account with slug (or the default namespace) to object
+// Run by the tasks Schedule adds
+func exportKind(ctx context.Context, slug, kind, object string) error {
+	kindsMu.RLock()
+	obj, ok := kinds[kind]
+	if slug != "" {
+		obj, ok = accountKinds[kind]
+	}
+	kindsMu.RUnlock()
+	if !ok {
+		// Registrations changed between deploys, retrying won't help
+		log.Errorf(ctx, "[backups/Export] %v isn't registered", kind)
+		return nil
+	}
+	ctx, err := accounts.NamespaceFor(ctx, slug)
+	if err != nil {
+		return err
+	}
+	n, err := Export(ctx, obj, object)
+	if err == nil {
+		log.Infof(ctx, "[backups/Export] Exported %d %v to %v", n, kind, object)
+	}
+	return err
+}
+
+// func exportName returns the name of the object kind is exported to, for the account with slug if any
+func exportName(folder, slug, kind string) string {
+	parts := []string{folder}
+	if slug != "" {
+		parts = append(parts, "accounts", slug)
+	}
+	return strings.Join(append(parts, kind+"."+extensions[Format]), "/")
+}
@@ -0,0 +1,36 @@
+package backups
+
+import (
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+)
+
+type MySuite struct{}
+
+type BackedUpObject struct {
+	ID   int64
+	Name string
+}
+
+var _ = Suite(&MySuite{})
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) TestRegister(c *C) {
+	Register(&BackedUpObject{})
+	RegisterAccounts(BackedUpObject{})
+	c.Assert(kinds["BackedUpObject"], FitsTypeOf, &BackedUpObject{})
+	c.Assert(accountKinds["BackedUpObject"], FitsTypeOf, BackedUpObject{})
+}
+
+func (s *MySuite) TestExportName(c *C) {
+	c.Assert(exportName("backups/20160102T030405Z", "", "Plan"), Equals, "backups/20160102T030405Z/Plan.json")
+	defer func(format aeutils.Format) { Format = format }(Format)
+	Format = aeutils.Avro
+	c.Assert(exportName("backups/20160102T030405Z", "acme", "Post"), Equals, "backups/20160102T030405Z/accounts/acme/Post.avro")
+}
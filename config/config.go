@@ -0,0 +1,240 @@
+// Package config stores the app's configuration as named values in a single datastore entity, cached in memcache
+// and briefly in each instance, so settings can be changed without a deploy.
+//
+// 	ttl := config.Duration(ctx, "accounts.sessionTTL", 3*time.Hour)
+// 	err := config.Set(ctx, "accounts.sessionTTL", "12h")
+//
+// Secrets, such as encryption keys, are set with SetSecret and kept apart from other values, so they're never listed
+// by All. They're stored as they are in the datastore, so should only be read by the app
+//
+// 	key, err := config.Secret(ctx, "accounts.encryptionKey")
+//
+// Names are conventionally prefixed by the package they configure. Values are always stored in the default namespace
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	// CacheFor is how long each instance keeps the values it has loaded before checking for changes
+	// Values set by an instance are seen by it immediately, and by others once their copy expires
+	CacheFor = time.Minute
+
+	// ErrNotSet is returned for a name that has no value set
+	ErrNotSet = errors.New("[config] No value is set for that name")
+
+	// Key name of the singleton settings entity
+	settingsName = "default"
+
+	cached   *values
+	cachedAt time.Time
+	cachedMu sync.RWMutex
+)
+
+// settings is the singleton entity every value is stored in, with values and secrets JSON encoded as datastore
+// doesn't store maps
+type settings struct {
+	Name    string    `datastore:"-" aekey:"name" aekind:"Config"`
+	Values  []byte    `datastore:",noindex"`
+	Secrets []byte    `datastore:",noindex"`
+	Updated time.Time `aetime:"updated"`
+}
+
+// values is the decoded form of settings
+type values struct {
+	Values  map[string]string
+	Secrets map[string][]byte
+}
+
+func init() {
+	aeutils.CacheKind(&settings{}, 0)
+}
+
+// String returns the value set for name, or def if none is set (or it can't be loaded)
+func String(ctx context.Context, name, def string) string {
+	value, err := Get(ctx, name)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// Int returns the value set for name as an int, or def if none is set or it isn't an integer
+func Int(ctx context.Context, name string, def int) int {
+	value, err := Get(ctx, name)
+	if err != nil {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warningf(ctx, "[config/Int] %v: %v", name, err.Error())
+		return def
+	}
+	return n
+}
+
+// Duration returns the value set for name as a time.Duration (in the format of time.ParseDuration, ie. "90m"),
+// or def if none is set or it isn't a duration
+func Duration(ctx context.Context, name string, def time.Duration) time.Duration {
+	value, err := Get(ctx, name)
+	if err != nil {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warningf(ctx, "[config/Duration] %v: %v", name, err.Error())
+		return def
+	}
+	return d
+}
+
+// Get returns the value set for name, or ErrNotSet
+func Get(ctx context.Context, name string) (string, error) {
+	vals, err := load(ctx)
+	if err != nil {
+		return "", err
+	}
+	value, ok := vals.Values[name]
+	if !ok {
+		return "", ErrNotSet
+	}
+	return value, nil
+}
+
+// Secret returns the secret set for name with SetSecret, or ErrNotSet
+func Secret(ctx context.Context, name string) ([]byte, error) {
+	vals, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := vals.Secrets[name]
+	if !ok {
+		return nil, ErrNotSet
+	}
+	return secret, nil
+}
+
+// All returns every value set, by name. Secrets aren't included
+func All(ctx context.Context) (map[string]string, error) {
+	vals, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]string, len(vals.Values))
+	for name, value := range vals.Values {
+		all[name] = value
+	}
+	return all, nil
+}
+
+// Set stores value for name, replacing any value already set
+func Set(ctx context.Context, name, value string) error {
+	return update(ctx, func(vals *values) {
+		vals.Values[name] = value
+	})
+}
+
+// SetSecret stores secret for name, replacing any secret already set
+func SetSecret(ctx context.Context, name string, secret []byte) error {
+	return update(ctx, func(vals *values) {
+		vals.Secrets[name] = secret
+	})
+}
+
+// Unset removes the value and secret set for name, if any
+func Unset(ctx context.Context, name string) error {
+	return update(ctx, func(vals *values) {
+		delete(vals.Values, name)
+		delete(vals.Secrets, name)
+	})
+}
+
+// func load returns the values this instance has cached, loading them again if they're older than CacheFor
+func load(ctx context.Context) (*values, error) {
+	cachedMu.RLock()
+	vals, loadedAt := cached, cachedAt
+	cachedMu.RUnlock()
+	if vals != nil && time.Since(loadedAt) < CacheFor {
+		return vals, nil
+	}
+	vals, err := get(ctx)
+	if err != nil {
+		log.Errorf(ctx, "[config/load] %v", err.Error())
+		return nil, err
+	}
+	setCached(vals)
+	return vals, nil
+}
+
+// func get loads the settings entity (from memcache if it's there) and decodes it. Missing settings have no values
+func get(ctx context.Context) (*values, error) {
+	ctx, err := appengine.Namespace(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	s := &settings{}
+	if err = aeutils.GetByName(ctx, settingsName, s); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	vals := &values{Values: map[string]string{}, Secrets: map[string][]byte{}}
+	if len(s.Values) > 0 {
+		if err = json.Unmarshal(s.Values, &vals.Values); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.Secrets) > 0 {
+		if err = json.Unmarshal(s.Secrets, &vals.Secrets); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+// func update applies fn to the stored values in a transaction, and caches the result for this instance
+func update(ctx context.Context, fn func(vals *values)) error {
+	ctx, err := appengine.Namespace(ctx, "")
+	if err != nil {
+		return err
+	}
+	var vals *values
+	err = aeutils.RunInTransaction(ctx, func(tc context.Context) error {
+		if vals, err = get(tc); err != nil {
+			return err
+		}
+		fn(vals)
+		s := &settings{Name: settingsName}
+		if s.Values, err = json.Marshal(vals.Values); err != nil {
+			return err
+		}
+		if s.Secrets, err = json.Marshal(vals.Secrets); err != nil {
+			return err
+		}
+		_, err = aeutils.Save(tc, s)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(ctx, "[config/update] %v", err.Error())
+		return err
+	}
+	setCached(vals)
+	return nil
+}
+
+// func setCached replaces the values this instance has cached
+func setCached(vals *values) {
+	cachedMu.Lock()
+	defer cachedMu.Unlock()
+	cached, cachedAt = vals, time.Now()
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"testing"
+	"time"
+	. "gopkg.in/check.v1"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+type MySuite struct{}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestGetters(c *C) {
+	c.Assert(String(ctx, "test.string", "default"), Equals, "default")
+	_, err := Get(ctx, "test.string")
+	c.Assert(err, Equals, ErrNotSet)
+
+	c.Assert(Set(ctx, "test.string", "value"), IsNil)
+	c.Assert(Set(ctx, "test.int", "42"), IsNil)
+	c.Assert(Set(ctx, "test.duration", "90m"), IsNil)
+	c.Assert(String(ctx, "test.string", "default"), Equals, "value")
+	c.Assert(Int(ctx, "test.int", 0), Equals, 42)
+	c.Assert(Duration(ctx, "test.duration", 0), Equals, 90*time.Minute)
+	// Values that don't parse fall back on the default
+	c.Assert(Int(ctx, "test.string", 7), Equals, 7)
+	c.Assert(Duration(ctx, "test.string", time.Second), Equals, time.Second)
+
+	c.Assert(Unset(ctx, "test.string"), IsNil)
+	c.Assert(String(ctx, "test.string", "default"), Equals, "default")
+}
+
+func (s *MySuite) TestSecrets(c *C) {
+	_, err := Secret(ctx, "test.secret")
+	c.Assert(err, Equals, ErrNotSet)
+
+	c.Assert(SetSecret(ctx, "test.secret", []byte("my test key 1234")), IsNil)
+	secret, err := Secret(ctx, "test.secret")
+	c.Assert(err, IsNil)
+	c.Assert(string(secret), Equals, "my test key 1234")
+	all, err := All(ctx)
+	c.Assert(err, IsNil)
+	_, listed := all["test.secret"]
+	c.Assert(listed, Equals, false)
+}
+
+func (s *MySuite) TestReload(c *C) {
+	c.Assert(Set(ctx, "test.reload", "stored"), IsNil)
+	// Drop this instance's copy, so values are loaded again from memcache or the datastore
+	setCached(nil)
+	c.Assert(String(ctx, "test.reload", ""), Equals, "stored")
+}
@@ -0,0 +1,206 @@
+// Package emails renders named templates into emails, branded for the current account, and sends them with
+// App Engine's mail API or another Provider (ie. SendGrid).
+//
+// Templates are registered at init time, and get the data passed to Send as .Data and the account's Branding as .Branding:
+//
+// 	func init() {
+// 		emails.Register("invite", "{{.Branding.Name}} invited you",
+// 			"Join {{.Branding.Name}} at {{.Data.URL}}",
+// 			`<p>Join <a href="{{.Data.URL}}">{{.Branding.Name}}</a></p>`)
+// 	}
+//
+// 	err := emails.Send(ctx, "invite", []string{user.Email}, map[string]string{"URL": inviteURL})
+package emails
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	netmail "net/mail"
+	"sync"
+	"text/template"
+
+	"github.com/mrvdot/appengine/accounts"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+)
+
+var (
+	// Sender is the address emails are sent from, noreply@<app id>.appspotmail.com if empty
+	// For App Engine's mail API it must be an authorized sender of the app
+	Sender = ""
+	// DefaultProvider sends emails, App Engine's mail API unless replaced (ie. with a SendGrid)
+	DefaultProvider Provider = MailProvider{}
+	// DefaultBranding is the branding of emails sent without an authenticated account, which the default
+	// BrandingFor starts from for those with one
+	DefaultBranding = Branding{}
+	// BrandingFor returns the branding for emails sent for ctx's request, which by default is DefaultBranding
+	// with the name of the authenticated account. Replace it to load branding settings stored for each account
+	BrandingFor = accountBranding
+
+	// ErrNoSuchTemplate is returned when sending or rendering a template that hasn't been registered
+	ErrNoSuchTemplate = errors.New("[emails] No template is registered with that name")
+
+	registry   = map[string]*emailTemplate{}
+	registryMu sync.RWMutex
+)
+
+// Provider sends rendered emails
+type Provider interface {
+	Send(ctx context.Context, msg *mail.Message) error
+}
+
+// MailProvider sends emails with App Engine's mail API
+type MailProvider struct{}
+
+func (MailProvider) Send(ctx context.Context, msg *mail.Message) error {
+	return mail.Send(ctx, msg)
+}
+
+// Branding customizes emails for an account, and is available to templates as .Branding
+type Branding struct {
+	Name     string // Shown as the sender's name, unless FromName is set
+	FromName string
+	ReplyTo  string
+	LogoURL  string
+	Color    string // Accent color for HTML templates, ie. "#0066cc"
+	Footer   string
+}
+
+// TemplateData is what templates are executed with
+type TemplateData struct {
+	Data     interface{}
+	Branding Branding
+}
+
+type emailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// Register parses and registers templates for the subject, plain text body and HTML body of the email name. Either
+// body may be empty (but not both), and HTML is escaped as in html/template. Register panics if a template can't be
+// parsed, or if name has already been registered, so it should be called from an init function
+func Register(name, subject, text, html string) {
+	if text == "" && html == "" {
+		panic("[emails] " + name + " must have a text or HTML body")
+	}
+	et := &emailTemplate{
+		subject: template.Must(template.New(name + " subject").Parse(subject)),
+	}
+	if text != "" {
+		et.text = template.Must(template.New(name + " text").Parse(text))
+	}
+	if html != "" {
+		et.html = htmltemplate.Must(htmltemplate.New(name + " html").Parse(html))
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("[emails] " + name + " registered twice")
+	}
+	registry[name] = et
+}
+
+// Registered returns whether a template has been registered for name
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[name]
+	return ok
+}
+
+// Render renders the email name for to, executing its templates with data and the branding for ctx's request
+func Render(ctx context.Context, name string, to []string, data interface{}) (*mail.Message, error) {
+	registryMu.RLock()
+	et, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, ErrNoSuchTemplate
+	}
+	branding := BrandingFor(ctx)
+	td := TemplateData{Data: data, Branding: branding}
+	msg := &mail.Message{
+		Sender:  sender(ctx, branding),
+		ReplyTo: branding.ReplyTo,
+		To:      to,
+	}
+	var buf bytes.Buffer
+	if err := et.subject.Execute(&buf, td); err != nil {
+		return nil, err
+	}
+	msg.Subject = buf.String()
+	if et.text != nil {
+		buf.Reset()
+		if err := et.text.Execute(&buf, td); err != nil {
+			return nil, err
+		}
+		msg.Body = buf.String()
+	}
+	if et.html != nil {
+		buf.Reset()
+		if err := et.html.Execute(&buf, td); err != nil {
+			return nil, err
+		}
+		msg.HTMLBody = buf.String()
+	}
+	return msg, nil
+}
+
+// Send renders the email name for to (see Render) and sends it with DefaultProvider
+func Send(ctx context.Context, name string, to []string, data interface{}) error {
+	msg, err := Render(ctx, name, to, data)
+	if err == nil {
+		err = DefaultProvider.Send(ctx, msg)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[emails/Send] Error sending %v: %v", name, err.Error())
+	}
+	return err
+}
+
+// SendText sends a plain text email to to with DefaultProvider, from Sender and with the branding for ctx's request,
+// for messages that don't have a template of their own
+func SendText(ctx context.Context, to []string, subject, body string) error {
+	branding := BrandingFor(ctx)
+	err := DefaultProvider.Send(ctx, &mail.Message{
+		Sender:  sender(ctx, branding),
+		ReplyTo: branding.ReplyTo,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	})
+	if err != nil {
+		log.Errorf(ctx, "[emails/SendText] %v", err.Error())
+	}
+	return err
+}
+
+// func sender returns the address emails are sent from, with the branding's name
+func sender(ctx context.Context, branding Branding) string {
+	address := Sender
+	if address == "" {
+		address = "noreply@" + appengine.AppID(ctx) + ".appspotmail.com"
+	}
+	name := branding.FromName
+	if name == "" {
+		name = branding.Name
+	}
+	if name == "" {
+		return address
+	}
+	return (&netmail.Address{Name: name, Address: address}).String()
+}
+
+// func accountBranding returns DefaultBranding, named for the account ctx's request was authenticated as, if any
+func accountBranding(ctx context.Context) Branding {
+	branding := DefaultBranding
+	if acct, err := accounts.GetAccount(ctx); err == nil && acct.Name != "" {
+		branding.Name = acct.Name
+	}
+	return branding
+}
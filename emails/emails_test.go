@@ -0,0 +1,77 @@
+package emails
+
+import (
+	"encoding/json"
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/mail"
+)
+
+type MySuite struct{}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestRender(c *C) {
+	Register("test-invite", "Join {{.Branding.Name}}", "Visit {{.Data.URL}}", `<a href="{{.Data.URL}}">{{.Data.Name}}</a>`)
+	c.Assert(func() { Register("test-invite", "Again", "Again", "") }, PanicMatches, ".*registered twice")
+	c.Assert(func() { Register("test-empty", "Empty", "", "") }, PanicMatches, ".*must have a text or HTML body")
+
+	defer func(branding Branding) { DefaultBranding = branding }(DefaultBranding)
+	DefaultBranding = Branding{Name: "Widgets", ReplyTo: "help@example.com"}
+	msg, err := Render(ctx, "test-invite", []string{"someone@example.com"}, map[string]string{
+		"URL":  "https://example.com/join",
+		"Name": "<b>Widgets</b>",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(msg.Subject, Equals, "Join Widgets")
+	c.Assert(msg.Body, Equals, "Visit https://example.com/join")
+	c.Assert(msg.HTMLBody, Equals, `<a href="https://example.com/join">&lt;b&gt;Widgets&lt;/b&gt;</a>`)
+	c.Assert(msg.ReplyTo, Equals, "help@example.com")
+	c.Assert(msg.To, DeepEquals, []string{"someone@example.com"})
+
+	_, err = Render(ctx, "test-missing", nil, nil)
+	c.Assert(err, Equals, ErrNoSuchTemplate)
+}
+
+func (s *MySuite) TestSendGridPayload(c *C) {
+	payload, err := sendGridPayload(&mail.Message{
+		Sender:  `"Widgets" <noreply@example.com>`,
+		To:      []string{"someone@example.com"},
+		Subject: "Hello",
+		Body:    "Hi",
+	})
+	c.Assert(err, IsNil)
+	sgm := &sendGridMessage{}
+	c.Assert(json.Unmarshal(payload, sgm), IsNil)
+	c.Assert(sgm.From, Equals, sendGridAddress{Email: "noreply@example.com", Name: "Widgets"})
+	c.Assert(sgm.Personalizations[0]["to"], DeepEquals, []sendGridAddress{{Email: "someone@example.com"}})
+	c.Assert(sgm.Content, DeepEquals, []sendGridContent{{Type: "text/plain", Value: "Hi"}})
+	c.Assert(sgm.ReplyTo, IsNil)
+
+	_, err = sendGridPayload(&mail.Message{Sender: "not an address"})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,117 @@
+package emails
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	netmail "net/mail"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/urlfetch"
+)
+
+var (
+	// SendGridURL is the SendGrid v3 API endpoint a SendGrid provider posts emails to
+	SendGridURL = "https://api.sendgrid.com/v3/mail/send"
+)
+
+// SendGrid sends emails through the SendGrid API over urlfetch, for apps that need more than App Engine's mail quota
+//
+// 	emails.DefaultProvider = emails.SendGrid{APIKey: os.Getenv("SENDGRID_API_KEY")}
+type SendGrid struct {
+	APIKey string
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridMessage struct {
+	Personalizations []map[string][]sendGridAddress `json:"personalizations"`
+	From             sendGridAddress                `json:"from"`
+	ReplyTo          *sendGridAddress               `json:"reply_to,omitempty"`
+	Subject          string                         `json:"subject"`
+	Content          []sendGridContent              `json:"content"`
+}
+
+func (sg SendGrid) Send(ctx context.Context, msg *mail.Message) error {
+	payload, err := sendGridPayload(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", SendGridURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("[emails] SendGrid responded %v: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// func sendGridPayload encodes msg as a SendGrid v3 API request
+func sendGridPayload(msg *mail.Message) ([]byte, error) {
+	from, err := sendGridAddresses([]string{msg.Sender})
+	if err != nil {
+		return nil, err
+	}
+	personalization := map[string][]sendGridAddress{}
+	for field, addresses := range map[string][]string{"to": msg.To, "cc": msg.Cc, "bcc": msg.Bcc} {
+		if len(addresses) == 0 {
+			continue
+		}
+		if personalization[field], err = sendGridAddresses(addresses); err != nil {
+			return nil, err
+		}
+	}
+	sgm := &sendGridMessage{
+		Personalizations: []map[string][]sendGridAddress{personalization},
+		From:             from[0],
+		Subject:          msg.Subject,
+	}
+	if msg.ReplyTo != "" {
+		replyTo, err := sendGridAddresses([]string{msg.ReplyTo})
+		if err != nil {
+			return nil, err
+		}
+		sgm.ReplyTo = &replyTo[0]
+	}
+	// SendGrid requires text/plain before text/html
+	if msg.Body != "" {
+		sgm.Content = append(sgm.Content, sendGridContent{Type: "text/plain", Value: msg.Body})
+	}
+	if msg.HTMLBody != "" {
+		sgm.Content = append(sgm.Content, sendGridContent{Type: "text/html", Value: msg.HTMLBody})
+	}
+	return json.Marshal(sgm)
+}
+
+// func sendGridAddresses parses addresses, which may include names (ie. "Name <address@example.com>")
+func sendGridAddresses(addresses []string) ([]sendGridAddress, error) {
+	parsed := make([]sendGridAddress, len(addresses))
+	for i, address := range addresses {
+		addr, err := netmail.ParseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = sendGridAddress{Email: addr.Address, Name: addr.Name}
+	}
+	return parsed, nil
+}
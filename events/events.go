@@ -0,0 +1,157 @@
+// Package events is an in-process event bus, so features like audit logging or search indexing can subscribe to
+// what happens in the app rather than being called from everywhere it happens.
+//
+// Saving or deleting an entity through aeutils publishes "<Kind>.saved" or "<Kind>.deleted", and the accounts package
+// publishes its authentication events (see accounts.EventLogin). Apps publish their own with Publish
+//
+// 	func init() {
+// 		events.Subscribe("Account.saved", func(ctx context.Context, e *events.Event) error {
+// 			return audit.Record(ctx, e.Key, e.Data)
+// 		})
+// 		// Runs in a task for each entity deleted, of any kind
+// 		events.SubscribeAsync("*.deleted", func(ctx context.Context, e *events.Event) error {
+// 			return search.Remove(ctx, e.Key)
+// 		})
+// 	}
+package events
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mrvdot/appengine/aeutils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+// Actions of the events published when entities are saved or deleted through aeutils, ie. "Account.saved"
+const (
+	Saved   = "saved"
+	Deleted = "deleted"
+)
+
+var (
+	// Queue is the task queue asynchronous subscribers are run in (the default queue if empty)
+	Queue = ""
+
+	subscribers      = map[string][]Subscriber{}
+	asyncSubscribers = map[string][]Subscriber{}
+	subscribersMu    sync.RWMutex
+
+	// Runs a single asynchronous subscriber, so a failing one is retried without running the rest again
+	dispatch = delay.Func("events-dispatch", dispatchAsync)
+)
+
+// Event is something that happened, passed to each of its subscribers
+type Event struct {
+	Name string         // "<Kind>.<action>", ie. "Account.saved"
+	Key  *datastore.Key // Entity the event is about, if any
+	// Data about the event, ie. the entity saved or deleted. Events dispatched to asynchronous subscribers are gob
+	// encoded, so the types of their Data must be registered with gob.Register
+	Data interface{}
+}
+
+// Subscriber handles events it's subscribed to
+type Subscriber func(ctx context.Context, e *Event) error
+
+func init() {
+	aeutils.OnAfterSave(aeutils.AllKinds, func(ctx context.Context, obj interface{}, key *datastore.Key) {
+		Publish(ctx, &Event{Name: key.Kind() + "." + Saved, Key: key, Data: obj})
+	})
+	aeutils.OnAfterDelete(aeutils.AllKinds, func(ctx context.Context, obj interface{}, key *datastore.Key) {
+		Publish(ctx, &Event{Name: key.Kind() + "." + Deleted, Key: key, Data: obj})
+	})
+}
+
+// Subscribe registers fn to be called, during Publish, with each event named name. A name of "*.<action>"
+// subscribes to the action for every kind, ie. "*.deleted". Subscribers are called in the order they were
+// subscribed, so they should be subscribed from init functions
+func Subscribe(name string, fn Subscriber) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers[name] = append(subscribers[name], fn)
+}
+
+// SubscribeAsync is like Subscribe, but fn is called later, in a task on Queue, in the namespace the event was
+// published in. If fn returns an error, the task (for fn alone) is retried, so fn should be safe to call more than once
+// Like delay.Func, it must be called at init time, so every instance registers the same subscribers in the same order
+func SubscribeAsync(name string, fn Subscriber) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	asyncSubscribers[name] = append(asyncSubscribers[name], fn)
+}
+
+// Publish calls each subscriber to e (see Subscribe) and adds a task for each asynchronous subscriber (see SubscribeAsync)
+// Every subscriber is called, even if one fails, and the first error is returned
+func Publish(ctx context.Context, e *Event) error {
+	var firstErr error
+	for _, fn := range matching(subscribers, e.Name) {
+		if err := fn(ctx, e); err != nil {
+			log.Errorf(ctx, "[events/Publish] %v: %v", e.Name, err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	names := []string{e.Name}
+	if wildcard := wildcardName(e.Name); wildcard != "" {
+		names = append(names, wildcard)
+	}
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	namespace := datastore.NewIncompleteKey(ctx, "Event", nil).Namespace()
+	for _, name := range names {
+		for i := range asyncSubscribers[name] {
+			if err := dispatch.Call(ctx, namespace, name, i, e); err != nil {
+				log.Errorf(ctx, "[events/Publish] Error adding task for %v: %v", e.Name, err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// func dispatchAsync runs the index'th asynchronous subscriber to name with e, in namespace
+func dispatchAsync(ctx context.Context, namespace, name string, index int, e *Event) error {
+	subscribersMu.RLock()
+	subscribed := asyncSubscribers[name]
+	subscribersMu.RUnlock()
+	if index >= len(subscribed) {
+		// Subscribers changed between deploys, retrying won't help
+		log.Errorf(ctx, "[events/SubscribeAsync] No subscriber %d to %v", index, name)
+		return nil
+	}
+	ctx, err := appengine.Namespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	if err = subscribed[index](ctx, e); err != nil {
+		log.Errorf(ctx, "[events/SubscribeAsync] %v: %v", e.Name, err.Error())
+	}
+	return err
+}
+
+// func matching returns the subscribers in registry to events named name, including those to its wildcard
+func matching(registry map[string][]Subscriber, name string) []Subscriber {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	fns := append([]Subscriber{}, registry[name]...)
+	if wildcard := wildcardName(name); wildcard != "" {
+		fns = append(fns, registry[wildcard]...)
+	}
+	return fns
+}
+
+// func wildcardName returns the "*.<action>" name matching every event with the same action as name, if name has one
+func wildcardName(name string) string {
+	if dot := strings.Index(name, "."); dot >= 0 && name[:dot] != "*" {
+		return "*" + name[dot:]
+	}
+	return ""
+}
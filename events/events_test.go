@@ -0,0 +1,85 @@
+package events_test
+
+import (
+	"errors"
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/events"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+type MySuite struct{}
+
+type EventedObject struct {
+	ID   int64
+	Name string
+}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestPublish(c *C) {
+	var names []string
+	events.Subscribe("Widget.created", func(ctx context.Context, e *events.Event) error {
+		names = append(names, "exact:"+e.Name)
+		return errors.New("failed")
+	})
+	events.Subscribe("*.created", func(ctx context.Context, e *events.Event) error {
+		names = append(names, "wildcard:"+e.Name)
+		return nil
+	})
+	err := events.Publish(ctx, &events.Event{Name: "Widget.created"})
+	c.Assert(err, ErrorMatches, "failed")
+	c.Assert(names, DeepEquals, []string{"exact:Widget.created", "wildcard:Widget.created"})
+
+	names = nil
+	c.Assert(events.Publish(ctx, &events.Event{Name: "Gadget.created"}), IsNil)
+	c.Assert(events.Publish(ctx, &events.Event{Name: "Gadget.removed"}), IsNil)
+	c.Assert(names, DeepEquals, []string{"wildcard:Gadget.created"})
+}
+
+func (s *MySuite) TestEntityEvents(c *C) {
+	var published []*events.Event
+	record := func(ctx context.Context, e *events.Event) error {
+		published = append(published, e)
+		return nil
+	}
+	events.Subscribe("EventedObject."+events.Saved, record)
+	events.Subscribe("EventedObject."+events.Deleted, record)
+
+	obj := &EventedObject{Name: "Test"}
+	key, err := aeutils.Save(ctx, obj)
+	c.Assert(err, IsNil)
+	c.Assert(aeutils.Delete(ctx, obj), IsNil)
+
+	c.Assert(published, HasLen, 2)
+	c.Assert(published[0].Name, Equals, "EventedObject.saved")
+	c.Assert(published[0].Key.Equal(key), Equals, true)
+	c.Assert(published[0].Data, Equals, obj)
+	c.Assert(published[1].Name, Equals, "EventedObject.deleted")
+	c.Assert(published[1].Key.Equal(key), Equals, true)
+}
@@ -0,0 +1,159 @@
+// Package gcs is a small Google Cloud Storage client for App Engine, calling the JSON API over urlfetch with the app's
+// service account, for the packages here that store files in Cloud Storage.
+//
+// 	w := gcs.NewWriter(ctx, bucket, "reports/2016.csv", "text/csv")
+// 	_, err := io.Copy(w, report)
+// 	if err == nil {
+// 		err = w.Close()
+// 	}
+//
+// Objects are served to clients with a SignedURL, rather than through the app
+package gcs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/urlfetch"
+)
+
+var (
+	// StorageURL is the Cloud Storage endpoint objects are uploaded to, listed, deleted from and served by
+	StorageURL = "https://storage.googleapis.com"
+	// Scope of the access token used for Cloud Storage API calls
+	storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// Error is returned when a Cloud Storage API call is rejected
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("[gcs] Cloud Storage responded %v: %v", e.StatusCode, e.Body)
+}
+
+// Object describes a stored object, as listed by List
+type Object struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size,string"`
+	Updated time.Time `json:"updated"`
+}
+
+// Bucket returns bucket, or the app's default bucket if bucket is empty
+func Bucket(ctx context.Context, bucket string) (string, error) {
+	if bucket != "" {
+		return bucket, nil
+	}
+	return file.DefaultBucketName(ctx)
+}
+
+// Delete removes object from bucket. An object that's already gone isn't an error
+func Delete(ctx context.Context, bucket, object string) error {
+	req, err := http.NewRequest("DELETE", objectURL(bucket, object), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := do(ctx, req)
+	if storageErr, ok := err.(*Error); ok && storageErr.StatusCode == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the objects in bucket whose names start with prefix
+func List(ctx context.Context, bucket, prefix string) ([]*Object, error) {
+	var objects []*Object
+	params := url.Values{"prefix": {prefix}}
+	for {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/storage/v1/b/%v/o?%v", StorageURL, url.PathEscape(bucket), params.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := do(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		page := &struct {
+			Items         []*Object `json:"items"`
+			NextPageToken string    `json:"nextPageToken"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Items...)
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		params.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// SignedURL returns a URL that allows a GET of object in bucket until expires, signed by the app's service account
+// (see https://cloud.google.com/storage/docs/access-control/signed-urls-v2). params are added to the query unsigned,
+// ie. response-content-disposition to override how the object is served
+func SignedURL(ctx context.Context, bucket, object string, expires time.Time, params url.Values) (string, error) {
+	account, err := appengine.ServiceAccount(ctx)
+	if err != nil {
+		return "", err
+	}
+	resource := "/" + bucket + "/" + object
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	_, signature, err := appengine.SignBytes(ctx, []byte("GET\n\n\n"+expiry+"\n"+resource))
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	for name, values := range params {
+		query[name] = values
+	}
+	query.Set("GoogleAccessId", account)
+	query.Set("Expires", expiry)
+	query.Set("Signature", base64.StdEncoding.EncodeToString(signature))
+	return StorageURL + resource + "?" + query.Encode(), nil
+}
+
+// func objectURL returns the JSON API URL of object in bucket
+func objectURL(bucket, object string) string {
+	return fmt.Sprintf("%v/storage/v1/b/%v/o/%v", StorageURL, url.PathEscape(bucket), url.PathEscape(object))
+}
+
+// func do sends req to Cloud Storage with the app's service account credentials, returning an Error for any response
+// with a status other than 2xx or one of ok. The caller must close the response body
+func do(ctx context.Context, req *http.Request, ok ...int) (*http.Response, error) {
+	token, _, err := appengine.AccessToken(ctx, storageScope)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	// Sent straight through the transport, as http.Client won't return the 308s of resumable uploads, which have no Location
+	resp, err := (&urlfetch.Transport{Context: ctx}).RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	accepted := resp.StatusCode >= 200 && resp.StatusCode < 300
+	for _, status := range ok {
+		accepted = accepted || resp.StatusCode == status
+	}
+	if !accepted {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &Error{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return resp, nil
+}
@@ -0,0 +1,78 @@
+package gcs_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/gcs"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+type MySuite struct{}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestWriter(c *C) {
+	var mu sync.Mutex
+	var ranges []string
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Method == "POST" {
+			c.Check(req.URL.Query().Get("name"), Equals, "exports/test.txt")
+			c.Check(req.Header.Get("X-Upload-Content-Type"), Equals, "text/plain")
+			rw.Header().Set("Location", "http://"+req.Host+"/session")
+			return
+		}
+		chunk, _ := ioutil.ReadAll(req.Body)
+		body += string(chunk)
+		ranges = append(ranges, req.Header.Get("Content-Range"))
+		if strings.HasSuffix(ranges[len(ranges)-1], "/*") {
+			rw.WriteHeader(308)
+		}
+	}))
+	defer server.Close()
+	defer func(storageURL string, chunkSize int) {
+		gcs.StorageURL, gcs.ChunkSize = storageURL, chunkSize
+	}(gcs.StorageURL, gcs.ChunkSize)
+	gcs.StorageURL, gcs.ChunkSize = server.URL, 4
+
+	w := gcs.NewWriter(ctx, "bucket", "exports/test.txt", "text/plain")
+	n, err := w.Write([]byte("hello world!"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 12)
+	c.Assert(w.Size(), Equals, int64(12))
+	c.Assert(w.Close(), IsNil)
+	c.Assert(w.Close(), Equals, gcs.ErrClosed)
+	c.Assert(body, Equals, "hello world!")
+	c.Assert(ranges, DeepEquals, []string{"bytes 0-3/*", "bytes 4-7/*", "bytes 8-11/12"})
+}
@@ -0,0 +1,122 @@
+package gcs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ChunkSize is how much a Writer buffers before uploading it. It must be a multiple of 256KiB,
+	// and within the 10MB urlfetch allows a request to send
+	ChunkSize = 8 << 20
+
+	// ErrClosed is returned by a Writer once it's been closed
+	ErrClosed = errors.New("[gcs] Writer is closed")
+)
+
+// Writer uploads an object through a resumable upload, ChunkSize at a time, so objects of any size can be written without
+// holding them in memory. The object is only created once Close succeeds
+type Writer struct {
+	ctx         context.Context
+	bucket      string
+	object      string
+	contentType string
+	session     string // Resumable upload session URL, once started
+	buf         bytes.Buffer
+	offset      int64 // Bytes uploaded so far
+	err         error
+}
+
+// NewWriter returns a Writer for object in bucket, to be served with contentType
+func NewWriter(ctx context.Context, bucket, object, contentType string) *Writer {
+	return &Writer{ctx: ctx, bucket: bucket, object: object, contentType: contentType}
+}
+
+// Write buffers p, uploading ChunkSize at a time. Once an upload fails, the Writer returns that error from then on
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	// Always leave something in the buffer, so Close has a final chunk to send
+	for w.buf.Len() > ChunkSize {
+		if w.err = w.upload(w.buf.Next(ChunkSize), false); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// Close uploads whatever's left in the buffer, and completes the object
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.upload(w.buf.Bytes(), true)
+	if w.err == nil {
+		w.err = ErrClosed
+		return nil
+	}
+	return w.err
+}
+
+// Size returns the number of bytes written so far
+func (w *Writer) Size() int64 {
+	return w.offset + int64(w.buf.Len())
+}
+
+// func upload sends chunk as the next part of the object, starting the upload session first if need be
+func (w *Writer) upload(chunk []byte, final bool) error {
+	if w.session == "" {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest("PUT", w.session, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	total := "*"
+	if final {
+		total = fmt.Sprint(w.offset + int64(len(chunk)))
+	}
+	if len(chunk) == 0 {
+		req.Header.Set("Content-Range", "bytes */"+total)
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%v", w.offset, w.offset+int64(len(chunk))-1, total))
+	}
+	// Cloud Storage responds 308 Resume Incomplete to each chunk but the last
+	resp, err := do(w.ctx, req, 308)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.offset += int64(len(chunk))
+	return nil
+}
+
+// func start begins a resumable upload session for the object
+func (w *Writer) start() error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v/upload/storage/v1/b/%v/o?%v", StorageURL, url.PathEscape(w.bucket),
+		url.Values{"uploadType": {"resumable"}, "name": {w.object}}.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	if w.contentType != "" {
+		req.Header.Set("X-Upload-Content-Type", w.contentType)
+	}
+	resp, err := do(w.ctx, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if w.session = resp.Header.Get("Location"); w.session == "" {
+		return errors.New("[gcs] Cloud Storage didn't return an upload session")
+	}
+	return nil
+}
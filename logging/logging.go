@@ -0,0 +1,130 @@
+// Package logging wraps App Engine's log package, tagging each entry with who the request is for, so logs from
+// every tenant can be told apart and filtered.
+//
+// 	logging.For(ctx).Errorf("[billing/Charge] %v", err.Error())
+//
+// Logs as:
+//
+// 	[account=acme user=42 session=1f2e3d4c request=client-123] [billing/Charge] card declined
+//
+// Tags come from the TagFuncs registered with RegisterTags. The accounts package registers the authenticated
+// account, user and session (identified by a hash, as the key itself is a credential) and the request ID, so
+// they're included once it's imported. Entries below MinLevel are dropped
+package logging
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Levels of App Engine's log package, least severe first
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Error
+	Critical
+)
+
+var (
+	// MinLevel is the least severe level that's logged. Entries below it are dropped
+	MinLevel = Debug
+
+	tagFuncs   []TagFunc
+	tagFuncsMu sync.RWMutex
+)
+
+// Tag is a name and value prefixed to each log entry, as name=value
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// TagFunc returns the tags for entries logged with ctx, if any
+type TagFunc func(ctx context.Context) []Tag
+
+// Logger logs entries for a request, prefixed with its tags
+type Logger struct {
+	ctx  context.Context
+	tags []Tag
+}
+
+// RegisterTags adds fn to the functions asked for tags by For. Like delay.Func, it should be called at init time
+func RegisterTags(fn TagFunc) {
+	tagFuncsMu.Lock()
+	defer tagFuncsMu.Unlock()
+	tagFuncs = append(tagFuncs, fn)
+}
+
+// For returns a Logger for ctx, tagged by each registered TagFunc
+func For(ctx context.Context) *Logger {
+	tagFuncsMu.RLock()
+	defer tagFuncsMu.RUnlock()
+	l := &Logger{ctx: ctx}
+	for _, fn := range tagFuncs {
+		l.tags = append(l.tags, fn(ctx)...)
+	}
+	return l
+}
+
+// With returns a copy of l with another tag, for values that apply to several entries
+//
+// 	logger := logging.For(ctx).With("job", job.Name)
+func (l *Logger) With(name, value string) *Logger {
+	tags := make([]Tag, len(l.tags), len(l.tags)+1)
+	copy(tags, l.tags)
+	return &Logger{ctx: l.ctx, tags: append(tags, Tag{Name: name, Value: value})}
+}
+
+// Prefix returns what l prefixes entries with, ie. "[account=acme request=client-123] ", or "" if it has no tags
+func (l *Logger) Prefix() string {
+	if len(l.tags) == 0 {
+		return ""
+	}
+	parts := make([]string, len(l.tags))
+	for i, tag := range l.tags {
+		parts[i] = tag.Name + "=" + tag.Value
+	}
+	return "[" + strings.Join(parts, " ") + "] "
+}
+
+// Debugf logs at Debug level, like log.Debugf
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if MinLevel <= Debug {
+		log.Debugf(l.ctx, l.Prefix()+format, args...)
+	}
+}
+
+// Infof logs at Info level, like log.Infof
+func (l *Logger) Infof(format string, args ...interface{}) {
+	if MinLevel <= Info {
+		log.Infof(l.ctx, l.Prefix()+format, args...)
+	}
+}
+
+// Warningf logs at Warning level, like log.Warningf
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	if MinLevel <= Warning {
+		log.Warningf(l.ctx, l.Prefix()+format, args...)
+	}
+}
+
+// Errorf logs at Error level, like log.Errorf
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	if MinLevel <= Error {
+		log.Errorf(l.ctx, l.Prefix()+format, args...)
+	}
+}
+
+// Criticalf logs at Critical level, like log.Criticalf
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	if MinLevel <= Critical {
+		log.Criticalf(l.ctx, l.Prefix()+format, args...)
+	}
+}
@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"golang.org/x/net/context"
+)
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type tagKey struct{}
+
+func (s *MySuite) TestPrefix(c *C) {
+	c.Assert(For(context.Background()).Prefix(), Equals, "")
+
+	RegisterTags(func(ctx context.Context) []Tag {
+		if account, ok := ctx.Value(tagKey{}).(string); ok {
+			return []Tag{{Name: "account", Value: account}}
+		}
+		return nil
+	})
+	ctx := context.WithValue(context.Background(), tagKey{}, "acme")
+	logger := For(ctx)
+	c.Assert(logger.Prefix(), Equals, "[account=acme] ")
+	c.Assert(logger.With("job", "backups").Prefix(), Equals, "[account=acme job=backups] ")
+	// With leaves the original logger as it was
+	c.Assert(logger.Prefix(), Equals, "[account=acme] ")
+}
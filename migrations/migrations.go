@@ -0,0 +1,297 @@
+// Package migrations runs ordered schema migrations, tracking which have been applied in the datastore.
+//
+// Migrations are registered at init time, and run in order of their names:
+//
+// 	func init() {
+// 		migrations.Register("0003-add-slug", addSlugs)
+// 		migrations.RegisterTransform("0004-lowercase-emails", &User{}, func(ctx context.Context, obj interface{}) (bool, error) {
+// 			user := obj.(*User)
+// 			user.Email = strings.ToLower(user.Email)
+// 			return true, nil
+// 		})
+// 		http.HandleFunc("/_migrations", migrations.Handler)
+// 	}
+//
+// The handler can then be triggered from cron (or by an admin of the app), and re-queues itself on the task queue
+// to continue any transform that doesn't finish within a single request
+package migrations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrvdot/appengine/accounts"
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	// Kind of the entities recording each migration's progress, keyed by migration name
+	migrationKind = "AEMigration"
+	// Number of changed entities a transform saves with each SaveMulti call
+	transformBatchSize = 100
+)
+
+var (
+	// Queue is the task queue Handler uses to continue migrations that don't finish within a single request
+	Queue = ""
+	// LeaseDuration is how long a runner holds a migration for, so concurrent runs (ie. cron and a continuation task) don't both apply it
+	LeaseDuration = 10 * time.Minute
+
+	// ErrIncomplete is returned by Run when a migration stopped before it was finished, and needs to be run again to continue
+	ErrIncomplete = errors.New("[migrations] Migration not finished, run again to continue")
+	// ErrLeased is returned by Run when another runner is currently applying a migration
+	ErrLeased = errors.New("[migrations] Migration is already being run elsewhere")
+
+	registry   = map[string]*migration{}
+	registryMu sync.RWMutex
+)
+
+// Func is a migration, which should be safe to run again if it fails part way through
+type Func func(ctx context.Context) error
+
+// TransformFunc is called with each entity by a migration registered with RegisterTransform
+// Returning true saves obj, returning an error stops the migration
+type TransformFunc func(ctx context.Context, obj interface{}) (save bool, err error)
+
+type migration struct {
+	name string
+	run  func(ctx context.Context, rec *record) error
+}
+
+// record is stored for each migration that has been started
+type record struct {
+	Name    string
+	Started time.Time
+	Applied time.Time // Zero until the migration has finished
+	Lease   time.Time // Runner currently applying the migration holds it until this time
+	Cursor  string    `datastore:",noindex"` // Where a transform should continue from
+}
+
+// Register adds a migration to be run, in order of name, by Run and Handler
+// Panics if a migration with the same name is already registered
+func Register(name string, fn Func) {
+	register(&migration{
+		name: name,
+		run: func(ctx context.Context, rec *record) error {
+			return fn(ctx)
+		},
+	})
+}
+
+// RegisterTransform adds a migration that calls fn with every entity of the kind of obj (a struct or pointer to struct),
+// saving those it returns true for in batches with aeutils.SaveMulti. Entities are loaded with aeutils.Iterate,
+// so large kinds are processed over as many requests as needed, continuing from where the last one stopped
+func RegisterTransform(name string, obj interface{}, fn TransformFunc) {
+	register(&migration{
+		name: name,
+		run: func(ctx context.Context, rec *record) error {
+			return transform(ctx, rec, obj, fn)
+		},
+	})
+}
+
+func register(m *migration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[m.name]; exists {
+		panic(fmt.Sprintf("[migrations] Migration %v registered twice", m.name))
+	}
+	registry[m.name] = m
+}
+
+// registered returns all registered migrations, ordered by name
+func registered() []*migration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	migrations := make([]*migration, len(names))
+	for i, name := range names {
+		migrations[i] = registry[name]
+	}
+	return migrations
+}
+
+func recordKey(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, migrationKind, name, 0, nil)
+}
+
+// Pending returns the names of all registered migrations that haven't been applied yet, in the order they'll be run
+func Pending(ctx context.Context) ([]string, error) {
+	var pending []string
+	for _, m := range registered() {
+		rec := &record{}
+		err := datastore.Get(ctx, recordKey(ctx, m.name), rec)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		if rec.Applied.IsZero() {
+			pending = append(pending, m.name)
+		}
+	}
+	return pending, nil
+}
+
+// Run applies all pending migrations in order, returning the names of those it finished
+// It stops at the first migration that fails, returning its error, or ErrIncomplete if it needs to be run again to continue
+func Run(ctx context.Context) (applied []string, err error) {
+	for _, m := range registered() {
+		rec, err := lease(ctx, m.name)
+		if err != nil {
+			return applied, err
+		}
+		if rec == nil {
+			// Already applied
+			continue
+		}
+		log.Infof(ctx, "[migrations] Running %v", m.name)
+		runErr := m.run(ctx, rec)
+		if runErr == nil {
+			rec.Applied = time.Now()
+			rec.Cursor = ""
+		}
+		rec.Lease = time.Time{}
+		if _, err = datastore.Put(ctx, recordKey(ctx, m.name), rec); err != nil {
+			return applied, err
+		}
+		if runErr != nil {
+			if runErr != ErrIncomplete {
+				log.Errorf(ctx, "[migrations] %v failed: %v", m.name, runErr.Error())
+			}
+			return applied, runErr
+		}
+		applied = append(applied, m.name)
+	}
+	return applied, nil
+}
+
+// lease claims the migration called name for this runner, returning its record
+// Returns nil if it's already been applied, or ErrLeased if another runner holds it
+func lease(ctx context.Context, name string) (rec *record, err error) {
+	key := recordKey(ctx, name)
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		rec = &record{Name: name}
+		err := datastore.Get(tc, key, rec)
+		if err == datastore.ErrNoSuchEntity {
+			rec.Started = time.Now()
+		} else if err != nil {
+			return err
+		}
+		if !rec.Applied.IsZero() {
+			rec = nil
+			return nil
+		}
+		if time.Now().Before(rec.Lease) {
+			return ErrLeased
+		}
+		rec.Lease = time.Now().Add(LeaseDuration)
+		_, err = datastore.Put(tc, key, rec)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// transform runs fn over every entity of the kind of obj, continuing from rec.Cursor
+// Returns ErrIncomplete (with rec.Cursor updated) if aeutils.Iterate stopped before the end
+func transform(ctx context.Context, rec *record, obj interface{}, fn TransformFunc) error {
+	q := datastore.NewQuery(aeutils.KindOf(obj))
+	if rec.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(rec.Cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(cursor)
+	}
+	var changed []interface{}
+	flush := func() error {
+		if len(changed) == 0 {
+			return nil
+		}
+		_, err := aeutils.SaveMulti(ctx, changed)
+		changed = changed[:0]
+		return err
+	}
+	cursor, err := aeutils.Iterate(ctx, q, obj, func(obj interface{}, key *datastore.Key) error {
+		save, err := fn(ctx, obj)
+		if err != nil {
+			return err
+		}
+		if save {
+			if changed = append(changed, obj); len(changed) == transformBatchSize {
+				return flush()
+			}
+		}
+		return nil
+	})
+	if err != nil && err != aeutils.ErrIterateDeadline {
+		return err
+	}
+	if flushErr := flush(); flushErr != nil {
+		return flushErr
+	}
+	if err == aeutils.ErrIterateDeadline {
+		rec.Cursor = cursor.String()
+		return ErrIncomplete
+	}
+	return nil
+}
+
+// Handler runs all pending migrations (see Run), and if one doesn't finish, adds a task to Queue
+// to call it again and continue. Responds with a utils.ApiResponse listing the migrations applied
+// It only runs for App Engine cron, admins of the app (see accounts.CronOnly), or its own continuation tasks
+func Handler(rw http.ResponseWriter, req *http.Request) {
+	// App Engine strips X-AppEngine-QueueName from requests that didn't come from the task queue
+	if req.Header.Get("X-AppEngine-QueueName") != "" {
+		migrate(rw, req)
+		return
+	}
+	accounts.CronOnly(migrate)(rw, req)
+}
+
+func migrate(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	out := json.NewEncoder(rw)
+	response := &utils.ApiResponse{}
+	applied, err := Run(ctx)
+	switch err {
+	case nil:
+		response.Code = http.StatusOK
+		response.Message = fmt.Sprintf("Applied %v migrations", len(applied))
+	case ErrIncomplete:
+		if _, err = taskqueue.Add(ctx, taskqueue.NewPOSTTask(req.URL.Path, nil), Queue); err != nil {
+			log.Errorf(ctx, "[migrations/Handler] Unable to queue continuation: %v", err.Error())
+			response.Code = http.StatusInternalServerError
+			response.Message = err.Error()
+		} else {
+			response.Code = http.StatusAccepted
+			response.Message = ErrIncomplete.Error()
+		}
+	case ErrLeased:
+		response.Code = http.StatusConflict
+		response.Message = err.Error()
+	default:
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+	}
+	response.Result = applied
+	rw.WriteHeader(response.Code)
+	out.Encode(response)
+}
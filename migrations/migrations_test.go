@@ -0,0 +1,82 @@
+package migrations_test
+
+import (
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/migrations"
+)
+
+type MySuite struct{}
+
+type Widget struct {
+	ID   int64
+	Name string
+}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestRun(c *C) {
+	var order []string
+	migrations.Register("0002-second", func(ctx context.Context) error {
+		order = append(order, "0002-second")
+		return nil
+	})
+	migrations.Register("0001-first", func(ctx context.Context) error {
+		order = append(order, "0001-first")
+		return nil
+	})
+	c.Assert(func() { migrations.Register("0001-first", nil) }, PanicMatches, ".*registered twice")
+
+	widget := &Widget{Name: "widget"}
+	key, err := aeutils.Save(ctx, widget)
+	c.Assert(err, IsNil)
+	datastore.Get(ctx, key, &Widget{})
+	migrations.RegisterTransform("0003-rename-widgets", &Widget{}, func(ctx context.Context, obj interface{}) (bool, error) {
+		obj.(*Widget).Name = "renamed"
+		return true, nil
+	})
+
+	pending, err := migrations.Pending(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(pending, DeepEquals, []string{"0001-first", "0002-second", "0003-rename-widgets"})
+
+	applied, err := migrations.Run(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(applied, DeepEquals, pending)
+	c.Assert(order, DeepEquals, []string{"0001-first", "0002-second"})
+	c.Assert(aeutils.Get(ctx, widget), IsNil)
+	c.Assert(widget.Name, Equals, "renamed")
+
+	// Applied migrations aren't run again
+	applied, err = migrations.Run(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(applied, HasLen, 0)
+	c.Assert(order, HasLen, 2)
+}
@@ -0,0 +1,204 @@
+// Package notify sends notifications to the users of an account, through each of the channels (email, XMPP or the
+// Channel API) they haven't opted out of in their Preferences.
+//
+// 	err := notify.Send(ctx, user, &notify.Notification{
+// 		Kind:    "new-login",
+// 		Subject: "New login to your account",
+// 		Body:    "Someone just logged in to your account from " + req.RemoteAddr,
+// 	})
+//
+// Email notifications use the template registered with the emails package for their Kind, if there is one
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mrvdot/appengine/accounts"
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/emails"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/channel"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/xmpp"
+)
+
+// Names of the channels Notifiers are registered for by default
+const (
+	EmailChannel   = "email"
+	XMPPChannel    = "xmpp"
+	BrowserChannel = "channel" // App Engine's Channel API, for users with the app open in a browser
+)
+
+var (
+	// DefaultChannels are the channels users are notified through unless they've picked their own in their Preferences
+	DefaultChannels = []string{EmailChannel}
+	// ChannelClientID returns the Channel API client ID a user's browser connects with, for the Channel notifier
+	ChannelClientID = func(u *accounts.User) string {
+		return fmt.Sprintf("user-%d", u.ID)
+	}
+
+	notifiers = map[string]Notifier{
+		EmailChannel:   Email{},
+		XMPPChannel:    XMPP{},
+		BrowserChannel: Channel{},
+	}
+	notifiersMu sync.RWMutex
+)
+
+// Notification is a message for a user
+type Notification struct {
+	Kind    string      `json:"kind"` // ie. "invite" or "new-login", which users can opt out of (see Preferences)
+	Subject string      `json:"subject"`
+	Body    string      `json:"body"`
+	Data    interface{} `json:"data,omitempty"` // Extra data, for email templates and browser clients
+}
+
+// Notifier sends notifications through a single channel
+type Notifier interface {
+	Notify(ctx context.Context, u *accounts.User, n *Notification) error
+}
+
+// Register sets the Notifier for channel, replacing the default for EmailChannel, XMPPChannel or BrowserChannel,
+// or adding a new channel (ie. SMS) users can pick in their Preferences
+func Register(channel string, notifier Notifier) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	notifiers[channel] = notifier
+}
+
+// Send notifies u of n through each channel their Preferences allow. Every channel is tried, even if one fails,
+// and the first error is returned
+func Send(ctx context.Context, u *accounts.User, n *Notification) error {
+	prefs, err := GetPreferences(ctx, u)
+	if err != nil {
+		log.Errorf(ctx, "[notify/Send] Error loading preferences: %v", err.Error())
+		return err
+	}
+	var firstErr error
+	for _, channel := range prefs.channels() {
+		if !prefs.Allows(channel, n.Kind) {
+			continue
+		}
+		notifiersMu.RLock()
+		notifier, ok := notifiers[channel]
+		notifiersMu.RUnlock()
+		if !ok {
+			log.Warningf(ctx, "[notify/Send] No notifier is registered for %v", channel)
+			continue
+		}
+		if err = notifier.Notify(ctx, u, n); err != nil {
+			log.Errorf(ctx, "[notify/Send] Error sending %v by %v: %v", n.Kind, channel, err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Preferences are a user's notification settings, stored in the namespace of their account
+type Preferences struct {
+	ID       int64    `json:"-" aekind:"NotificationPreferences"` // ID of the user
+	Channels []string `json:"channels"`                           // Channels to notify the user through, DefaultChannels if empty
+	Muted    []string `json:"muted"`                              // Kinds of notification the user doesn't want at all
+}
+
+// Allows returns whether the preferences allow notifications of kind through channel
+func (p *Preferences) Allows(channel, kind string) bool {
+	for _, muted := range p.Muted {
+		if muted == kind {
+			return false
+		}
+	}
+	for _, c := range p.channels() {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Preferences) channels() []string {
+	if len(p.Channels) == 0 {
+		return DefaultChannels
+	}
+	return p.Channels
+}
+
+// GetPreferences returns u's notification preferences, or the defaults if they haven't saved any
+func GetPreferences(ctx context.Context, u *accounts.User) (*Preferences, error) {
+	ctx, err := accountContext(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	prefs := &Preferences{ID: u.ID}
+	if err = aeutils.Get(ctx, prefs); err == datastore.ErrNoSuchEntity {
+		return &Preferences{ID: u.ID}, nil
+	}
+	return prefs, err
+}
+
+// SavePreferences stores prefs as u's notification preferences
+func SavePreferences(ctx context.Context, u *accounts.User, prefs *Preferences) error {
+	ctx, err := accountContext(ctx, u)
+	if err != nil {
+		return err
+	}
+	prefs.ID = u.ID
+	sort.Strings(prefs.Channels)
+	_, err = aeutils.Save(ctx, prefs)
+	return err
+}
+
+// func accountContext returns ctx in the namespace of u's account
+func accountContext(ctx context.Context, u *accounts.User) (context.Context, error) {
+	if u.ID == 0 {
+		return nil, fmt.Errorf("[notify] User has no ID, it must be saved before it can be notified")
+	}
+	var slug string
+	if u.AccountKey != nil {
+		slug = u.AccountKey.StringID()
+	}
+	return accounts.NamespaceFor(ctx, slug)
+}
+
+// Email notifies users by email, with the template registered with the emails package for the notification's
+// Kind if there is one (which gets the Notification as its .Data), otherwise as plain text
+type Email struct{}
+
+func (Email) Notify(ctx context.Context, u *accounts.User, n *Notification) error {
+	if u.Email == "" {
+		return nil
+	}
+	to := []string{u.Email}
+	if emails.Registered(n.Kind) {
+		return emails.Send(ctx, n.Kind, to, n)
+	}
+	return emails.SendText(ctx, to, n.Subject, n.Body)
+}
+
+// XMPP notifies users with an XMPP (chat) message to their email address
+type XMPP struct{}
+
+func (XMPP) Notify(ctx context.Context, u *accounts.User, n *Notification) error {
+	if u.Email == "" {
+		return nil
+	}
+	msg := &xmpp.Message{
+		To:   []string{u.Email},
+		Body: n.Subject + "\n\n" + n.Body,
+	}
+	return msg.Send(ctx)
+}
+
+// Channel notifies users with the app open in a browser, sending the Notification as JSON over the Channel API
+// to the client ID from ChannelClientID. Users who aren't connected don't get anything
+type Channel struct{}
+
+func (Channel) Notify(ctx context.Context, u *accounts.User, n *Notification) error {
+	return channel.SendJSON(ctx, ChannelClientID(u), n)
+}
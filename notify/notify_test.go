@@ -0,0 +1,77 @@
+package notify_test
+
+import (
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/mrvdot/appengine/accounts"
+	"github.com/mrvdot/appengine/notify"
+)
+
+type MySuite struct{}
+
+// recorder is a Notifier that keeps the notifications it's sent
+type recorder struct {
+	sent []*notify.Notification
+}
+
+func (r *recorder) Notify(ctx context.Context, u *accounts.User, n *notify.Notification) error {
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestPreferences(c *C) {
+	prefs := &notify.Preferences{}
+	c.Assert(prefs.Allows(notify.EmailChannel, "invite"), Equals, true)
+	c.Assert(prefs.Allows(notify.XMPPChannel, "invite"), Equals, false)
+	prefs = &notify.Preferences{Channels: []string{notify.XMPPChannel}, Muted: []string{"new-login"}}
+	c.Assert(prefs.Allows(notify.XMPPChannel, "invite"), Equals, true)
+	c.Assert(prefs.Allows(notify.XMPPChannel, "new-login"), Equals, false)
+	c.Assert(prefs.Allows(notify.EmailChannel, "invite"), Equals, false)
+}
+
+func (s *MySuite) TestSend(c *C) {
+	rec := &recorder{}
+	notify.Register("test", rec)
+	u := &accounts.User{ID: 42}
+	c.Assert(notify.SavePreferences(ctx, u, &notify.Preferences{Channels: []string{"test"}, Muted: []string{"new-login"}}), IsNil)
+	prefs, err := notify.GetPreferences(ctx, u)
+	c.Assert(err, IsNil)
+	c.Assert(prefs.Channels, DeepEquals, []string{"test"})
+
+	c.Assert(notify.Send(ctx, u, &notify.Notification{Kind: "invite", Subject: "You were invited"}), IsNil)
+	c.Assert(notify.Send(ctx, u, &notify.Notification{Kind: "new-login", Subject: "New login"}), IsNil)
+	c.Assert(rec.sent, HasLen, 1)
+	c.Assert(rec.sent[0].Kind, Equals, "invite")
+
+	// Users without saved preferences get the defaults
+	prefs, err = notify.GetPreferences(ctx, &accounts.User{ID: 43})
+	c.Assert(err, IsNil)
+	c.Assert(prefs.Allows(notify.EmailChannel, "invite"), Equals, true)
+}
@@ -0,0 +1,247 @@
+// Package presence tracks which users of an account are online, through App Engine's Channel API.
+//
+// Each browser asks for a channel token for its session, and opens the channel with it. App Engine reports clients
+// connecting and disconnecting to the handlers registered by Handle, which needs channel_presence in the app's
+// inbound_services
+//
+// 	func init() {
+// 		presence.Handle()
+// 		http.Handle("/presence/token", accounts.AuthenticatedFunc(presence.TokenHandler))
+// 	}
+//
+// 	users, err := presence.OnlineUsers(ctx, acct)
+//
+// Connections publish presence.EventConnected and presence.EventDisconnected (see the events package) as they come and go
+package presence
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mrvdot/appengine/accounts"
+	"github.com/mrvdot/appengine/aeutils"
+	"github.com/mrvdot/appengine/events"
+	"github.com/mrvdot/golang-utils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/channel"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Names of the events published as clients connect and disconnect, with the Connection as their Data
+const (
+	EventConnected    = "Presence.connected"
+	EventDisconnected = "Presence.disconnected"
+)
+
+var (
+	// TokenDuration is how long a channel token is valid for (the Channel API's default of two hours)
+	// A connection is no longer counted as online once its token expires, even if no disconnect was reported
+	TokenDuration = 2 * time.Hour
+
+	// ErrInvalidClientID is returned for a client ID that wasn't issued by Token
+	ErrInvalidClientID = errors.New("[presence] Client ID was not issued by Token")
+
+	clientIDPrefix = "presence:"
+)
+
+// Connection is a channel issued for a session, stored in the namespace of its account
+type Connection struct {
+	ClientID  string         `json:"-" aekey:"name"`
+	Created   time.Time      `json:"created" aetime:"created"`
+	User      *datastore.Key `json:"-"` // User the session is for, if any
+	UserID    int64          `json:"userId,omitempty"`
+	Connected bool           `json:"connected"`
+	Expires   time.Time      `json:"expires"` // When the token expires, or the session if that's sooner
+}
+
+// Online returns whether c is connected with a token that hasn't expired
+func (c *Connection) Online() bool {
+	return c.Connected && time.Now().Before(c.Expires)
+}
+
+// Token creates a channel for the session ctx's request was authenticated with, and returns the token the client should
+// open it with, along with the client ID to send messages to it with channel.Send
+// Requesting another token for the same session replaces the last one
+func Token(ctx context.Context) (token, clientID string, err error) {
+	acct, err := accounts.GetAccount(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	session, err := accounts.GetSession(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	conn := &Connection{
+		ClientID: ClientID(acct, session),
+		User:     session.User,
+		Expires:  time.Now().Add(TokenDuration),
+	}
+	if conn.User != nil {
+		conn.UserID = conn.User.IntID()
+	}
+	if expires := session.Expires(); expires.Before(conn.Expires) {
+		conn.Expires = expires
+	}
+	if token, err = channel.Create(ctx, conn.ClientID); err != nil {
+		log.Errorf(ctx, "[presence/Token] %v", err.Error())
+		return "", "", err
+	}
+	nsCtx, err := accounts.NamespaceFor(ctx, acct.Slug)
+	if err == nil {
+		_, err = aeutils.Save(nsCtx, conn)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[presence/Token] %v", err.Error())
+		return "", "", err
+	}
+	return token, conn.ClientID, nil
+}
+
+// ClientID returns the channel client ID for session, of acct. Session keys are hashed so they can't be recovered from it
+func ClientID(acct *accounts.Account, session *accounts.Session) string {
+	return fmt.Sprintf("%v%v:%x", clientIDPrefix, acct.Slug, sha1.Sum([]byte(session.Key)))
+}
+
+// Online returns the connections of acct that are currently online
+func Online(ctx context.Context, acct *accounts.Account) ([]*Connection, error) {
+	ctx, err := accounts.NamespaceFor(ctx, acct.Slug)
+	if err != nil {
+		return nil, err
+	}
+	// Only filtered on Expires, so no composite index is needed
+	var conns []*Connection
+	_, err = aeutils.Query(&Connection{}).Filter("Expires >", time.Now()).GetAll(ctx, &conns)
+	if err != nil {
+		log.Errorf(ctx, "[presence/Online] %v", err.Error())
+		return nil, err
+	}
+	online := conns[:0]
+	for _, conn := range conns {
+		if conn.Online() {
+			online = append(online, conn)
+		}
+	}
+	return online, nil
+}
+
+// OnlineUsers returns the users of acct with at least one connection online, each listed once
+func OnlineUsers(ctx context.Context, acct *accounts.Account) ([]*accounts.User, error) {
+	conns, err := Online(ctx, acct)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*datastore.Key
+	seen := map[string]bool{}
+	for _, conn := range conns {
+		if conn.User == nil || seen[conn.User.Encode()] {
+			continue
+		}
+		seen[conn.User.Encode()] = true
+		keys = append(keys, conn.User)
+	}
+	users := make([]*accounts.User, len(keys))
+	if err = aeutils.GetMulti(ctx, keys, users); err != nil {
+		log.Errorf(ctx, "[presence/OnlineUsers] %v", err.Error())
+		return nil, err
+	}
+	return users, nil
+}
+
+// Handle registers ConnectedHandler and DisconnectedHandler on http.DefaultServeMux, at the paths App Engine
+// reports channel presence to
+func Handle() {
+	http.HandleFunc("/_ah/channel/connected/", ConnectedHandler)
+	http.HandleFunc("/_ah/channel/disconnected/", DisconnectedHandler)
+}
+
+// ConnectedHandler marks the connection App Engine reports has connected as online
+func ConnectedHandler(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	conn, nsCtx, err := loadConnection(ctx, req.FormValue("from"))
+	if err == nil {
+		conn.Connected = true
+		_, err = aeutils.Save(nsCtx, conn)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[presence/ConnectedHandler] %v", err.Error())
+		return
+	}
+	if err = events.Publish(nsCtx, &events.Event{Name: EventConnected, Key: conn.User, Data: conn}); err != nil {
+		log.Warningf(ctx, "[presence/ConnectedHandler] %v", err.Error())
+	}
+}
+
+// DisconnectedHandler removes the connection App Engine reports has disconnected
+func DisconnectedHandler(rw http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	conn, nsCtx, err := loadConnection(ctx, req.FormValue("from"))
+	if err == nil {
+		err = aeutils.HardDelete(nsCtx, conn)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[presence/DisconnectedHandler] %v", err.Error())
+		return
+	}
+	conn.Connected = false
+	if err = events.Publish(nsCtx, &events.Event{Name: EventDisconnected, Key: conn.User, Data: conn}); err != nil {
+		log.Warningf(ctx, "[presence/DisconnectedHandler] %v", err.Error())
+	}
+}
+
+// TokenHandler responds with a channel token for the authenticated session (see Token), as "token" in Data
+// It should be wrapped in accounts.AuthenticatedHandler (or AuthenticatedFunc)
+func TokenHandler(rw http.ResponseWriter, req *http.Request) {
+	ctx, err := accounts.GetContext(req)
+	if err != nil {
+		accounts.RespondTo(rw, req, accounts.ErrorResponse(err))
+		return
+	}
+	token, _, err := Token(ctx)
+	if err != nil {
+		accounts.RespondTo(rw, req, accounts.ErrorResponse(err))
+		return
+	}
+	accounts.RespondTo(rw, req, &utils.ApiResponse{
+		Code: 200,
+		Data: map[string]interface{}{
+			"token": token,
+		},
+	})
+}
+
+// func loadConnection loads the connection for clientID, from the namespace of its account, which is returned as well
+func loadConnection(ctx context.Context, clientID string) (*Connection, context.Context, error) {
+	slug, err := clientSlug(clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err = accounts.NamespaceFor(ctx, slug)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := &Connection{ClientID: clientID}
+	if err = aeutils.Get(ctx, conn); err != nil {
+		return nil, nil, err
+	}
+	return conn, ctx, nil
+}
+
+// func clientSlug returns the slug of the account clientID was issued for
+func clientSlug(clientID string) (string, error) {
+	if !strings.HasPrefix(clientID, clientIDPrefix) {
+		return "", ErrInvalidClientID
+	}
+	slug := strings.TrimPrefix(clientID, clientIDPrefix)
+	colon := strings.LastIndex(slug, ":")
+	if colon <= 0 {
+		return "", ErrInvalidClientID
+	}
+	return slug[:colon], nil
+}
@@ -0,0 +1,69 @@
+package presence
+
+import (
+	"testing"
+	"time"
+	. "gopkg.in/check.v1"
+
+	"github.com/mrvdot/appengine/accounts"
+	"github.com/mrvdot/appengine/aeutils"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+type MySuite struct{}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestClientID(c *C) {
+	acct := &accounts.Account{Slug: "test-presence"}
+	clientID := ClientID(acct, &accounts.Session{Key: "secret"})
+	c.Assert(clientID, Not(Matches), ".*secret.*")
+	c.Assert(clientID, Not(Equals), ClientID(acct, &accounts.Session{Key: "other"}))
+	slug, err := clientSlug(clientID)
+	c.Assert(err, IsNil)
+	c.Assert(slug, Equals, acct.Slug)
+	_, err = clientSlug("user-1")
+	c.Assert(err, Equals, ErrInvalidClientID)
+}
+
+func (s *MySuite) TestOnline(c *C) {
+	acct := &accounts.Account{Slug: "test-online"}
+	nsCtx, err := accounts.NamespaceFor(ctx, acct.Slug)
+	c.Assert(err, IsNil)
+	now := time.Now()
+	for _, conn := range []*Connection{
+		{ClientID: "presence:test-online:1", Connected: true, Expires: now.Add(time.Hour)},
+		{ClientID: "presence:test-online:2", Connected: false, Expires: now.Add(time.Hour)},
+		{ClientID: "presence:test-online:3", Connected: true, Expires: now.Add(-time.Minute)},
+	} {
+		_, err = aeutils.Save(nsCtx, conn)
+		c.Assert(err, IsNil)
+	}
+	conns, err := Online(ctx, acct)
+	c.Assert(err, IsNil)
+	c.Assert(conns, HasLen, 1)
+	c.Assert(conns[0].ClientID, Equals, "presence:test-online:1")
+}
@@ -0,0 +1,154 @@
+// Package tasks adds tasks to the task queue that run in the namespace of the account that added them.
+//
+// Functions to defer are declared at init time, as with the delay package:
+//
+// 	var sendReport = tasks.Func("send-report", func(ctx context.Context, reportID int64) error {
+// 		// ctx is in the namespace of the account that called Defer
+// 		...
+// 	})
+//
+// 	func reportHandler(rw http.ResponseWriter, req *http.Request) {
+// 		ctx, _ := accounts.GetContext(req)
+// 		tasks.Defer(ctx, sendReport, reportID)
+// 	}
+//
+// Tasks for a handler of your own are added with Enqueue, and the handler gets its context with Context
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+
+	"github.com/mrvdot/appengine/accounts"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+var (
+	// Queue is the task queue Defer and Enqueue add tasks to (the default queue if empty)
+	Queue = ""
+	// AccountHeader is the header Enqueue sends the account slug in, for Context to restore its namespace from
+	AccountHeader = "X-Task-Account"
+
+	// ErrNotTask is returned by Context for requests that weren't sent by the task queue
+	ErrNotTask = errors.New("[tasks] Request was not sent by the task queue")
+
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	stringType  = reflect.TypeOf("")
+)
+
+// Function is a func that can be run in a task with Defer, see Func
+type Function struct {
+	fn *delay.Function
+}
+
+// Func declares fn, a func taking a context.Context followed by any gob encodable arguments, as one that can be run in a
+// task with Defer. As with delay.Func, it must be called at init time (ie. in a top level var), with a key unique to fn
+// When the task runs, fn is called with a context in the namespace of the account that deferred it (see NamespaceFor)
+func Func(key string, fn interface{}) *Function {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() == 0 || t.In(0) != contextType {
+		panic("Unsupported func passed to tasks.Func, must take a context.Context first")
+	}
+	// The task is called with the account slug after the context, which is swapped for a context in its namespace
+	in := []reflect.Type{contextType, stringType}
+	for i := 1; i < t.NumIn(); i++ {
+		in = append(in, t.In(i))
+	}
+	out := make([]reflect.Type, t.NumOut())
+	for i := range out {
+		out[i] = t.Out(i)
+	}
+	wrapped := reflect.MakeFunc(reflect.FuncOf(in, out, t.IsVariadic()), func(args []reflect.Value) []reflect.Value {
+		ctx, err := accounts.NamespaceFor(args[0].Interface().(context.Context), args[1].String())
+		if err != nil {
+			return errorResults(t, err)
+		}
+		args = append([]reflect.Value{reflect.ValueOf(ctx)}, args[2:]...)
+		if t.IsVariadic() {
+			return v.CallSlice(args)
+		}
+		return v.Call(args)
+	})
+	return &Function{fn: delay.Func(key, wrapped.Interface())}
+}
+
+// func errorResults returns err as the results of a func of type t, so the task fails and is retried,
+// or panics with it if t doesn't return an error
+func errorResults(t reflect.Type, err error) []reflect.Value {
+	if t.NumOut() == 0 || t.Out(t.NumOut()-1) != errorType {
+		panic(err)
+	}
+	results := make([]reflect.Value, t.NumOut())
+	for i := range results {
+		results[i] = reflect.Zero(t.Out(i))
+	}
+	results[len(results)-1] = reflect.ValueOf(&err).Elem()
+	return results
+}
+
+// Defer adds a task to Queue that calls f with args, in the namespace of the account ctx's request was authenticated
+// as (or the default namespace if it wasn't), returning as soon as the task is added
+func Defer(ctx context.Context, f *Function, args ...interface{}) error {
+	task, err := f.fn.Task(append([]interface{}{accountSlug(ctx)}, args...)...)
+	if err == nil {
+		_, err = taskqueue.Add(ctx, task, Queue)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[tasks/Defer] %v", err.Error())
+	}
+	return err
+}
+
+// Enqueue adds a task to Queue that POSTs payload, encoded as JSON, to path, along with the slug of the account
+// ctx's request was authenticated as. The handler at path should get its context with Context, and can decode
+// the payload with Payload
+func Enqueue(ctx context.Context, path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err == nil {
+		_, err = taskqueue.Add(ctx, &taskqueue.Task{
+			Path:    path,
+			Payload: body,
+			Method:  "POST",
+			Header: http.Header{
+				"Content-Type": []string{"application/json"},
+				AccountHeader:  []string{accountSlug(ctx)},
+			},
+		}, Queue)
+	}
+	if err != nil {
+		log.Errorf(ctx, "[tasks/Enqueue] %v", err.Error())
+	}
+	return err
+}
+
+// Context returns the context for a task added with Enqueue, in the namespace of the account that added it
+// App Engine strips task queue headers from outside requests, so ErrNotTask is returned for any that weren't sent by the queue
+func Context(req *http.Request) (context.Context, error) {
+	if req.Header.Get("X-AppEngine-QueueName") == "" {
+		return nil, ErrNotTask
+	}
+	return accounts.NamespaceFor(appengine.NewContext(req), req.Header.Get(AccountHeader))
+}
+
+// Payload decodes the JSON payload of a task added with Enqueue into v
+func Payload(req *http.Request, v interface{}) error {
+	defer req.Body.Close()
+	return json.NewDecoder(req.Body).Decode(v)
+}
+
+// func accountSlug returns the slug of the account ctx's request was authenticated as, if any
+func accountSlug(ctx context.Context) string {
+	if acct, err := accounts.GetAccount(ctx); err == nil {
+		return acct.Slug
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package tasks_test
+
+import (
+	"net/http"
+	"testing"
+	. "gopkg.in/check.v1"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+
+	"github.com/mrvdot/appengine/tasks"
+)
+
+type MySuite struct{}
+
+var (
+	_    = Suite(&MySuite{})
+	ctx  context.Context
+	done func()
+
+	record = tasks.Func("tasks-test-record", func(ctx context.Context, name string, count int) error {
+		return nil
+	})
+)
+
+// Hook up gocheck testing library to our usual testing tool
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MySuite) SetUpSuite(c *C) {
+	var err error
+	ctx, done, err = aetest.NewContext()
+	if err != nil {
+		c.Fatal("Failed to create appengine context")
+	}
+}
+
+func (s *MySuite) TearDownSuite(c *C) {
+	done()
+}
+
+func (s *MySuite) TestFunc(c *C) {
+	c.Assert(func() { tasks.Func("tasks-test-no-context", func(name string) {}) }, PanicMatches, "Unsupported func.*")
+	c.Assert(func() { tasks.Func("tasks-test-not-func", "not a func") }, PanicMatches, "Unsupported func.*")
+}
+
+func (s *MySuite) TestDefer(c *C) {
+	c.Assert(tasks.Defer(ctx, record, "widgets", 3), IsNil)
+	c.Assert(tasks.Defer(ctx, record, "widgets"), NotNil)
+	c.Assert(tasks.Enqueue(ctx, "/tasks/widgets", map[string]int{"count": 3}), IsNil)
+}
+
+func (s *MySuite) TestContext(c *C) {
+	req, err := http.NewRequest("POST", "/tasks/widgets", nil)
+	c.Assert(err, IsNil)
+	_, err = tasks.Context(req)
+	c.Assert(err, Equals, tasks.ErrNotTask)
+}